@@ -0,0 +1,234 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"filemanager/blob"
+	"filemanager/meta"
+)
+
+// errUnsatisfiable is the error of a range outside the content.
+var errUnsatisfiable = errors.New("range not satisfiable")
+
+// get serves the content of a blob, or only its headers for a
+// HEAD request. The ETag is the content hash, so If-None-Match
+// and If-Range are matched against it; a single byte range is
+// served as a 206, other Range headers are ignored.
+func (s *Server) get(w http.ResponseWriter, r *http.Request) {
+	h, ok := parseHash(w, r)
+	if !ok {
+		return
+	}
+	has, err := s.store.Has(h)
+	if err != nil {
+		s.lg.Error().Err(err).Str("content-hash", h.String()).Msg("check blob error")
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	if !has {
+		writeError(w, http.StatusNotFound, "blob %s not found", h.String())
+		return
+	}
+	b, err := s.store.Open(h)
+	if err != nil {
+		s.lg.Error().Err(err).Str("content-hash", h.String()).Msg("open blob error")
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+	size, err := b.Size()
+	if err != nil {
+		s.lg.Error().Err(err).Str("content-hash", h.String()).Msg("get blob size error")
+		writeError(w, http.StatusInternalServerError, "%v", err)
+		return
+	}
+
+	etag := `"` + h.Hex() + `"`
+	hdr := w.Header()
+	hdr.Set("ETag", etag)
+	hdr.Set("Accept-Ranges", "bytes")
+	// the content of a hash never changes
+	hdr.Set("Cache-Control", "public, max-age=31536000, immutable")
+	ct := ""
+	if bm, ok := s.index.Get(h.String()); ok {
+		ct = contentType(bm)
+		if name, ok := bm.Meta()["filename"].(meta.StringValue); ok {
+			hdr.Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": name.Value()}))
+		}
+	}
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	off, length := int64(0), size
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" && ifRange(r, etag) {
+		o, n, err := parseRange(rng, size)
+		switch {
+		case err == errUnsatisfiable:
+			hdr.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			writeError(w, http.StatusRequestedRangeNotSatisfiable, "range %q is outside the %d bytes of the blob", rng, size)
+			return
+		case err != nil:
+			// not a single byte range, the whole content is served
+		default:
+			off, length, status = o, n, http.StatusPartialContent
+			hdr.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", o, o+n-1, size))
+		}
+	}
+
+	if ct == "" {
+		head, err := readHead(b)
+		if err != nil {
+			s.lg.Error().Err(err).Str("content-hash", h.String()).Msg("blob reader error")
+			writeError(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		ct = http.DetectContentType(head)
+	}
+	var rc io.ReadCloser
+	if r.Method != http.MethodHead {
+		rc, err = blob.OpenRange(b, off, length)
+		if err != nil {
+			s.lg.Error().Err(err).Str("content-hash", h.String()).Msg("blob reader error")
+			writeError(w, http.StatusInternalServerError, "%v", err)
+			return
+		}
+		defer rc.Close()
+	}
+	hdr.Set("Content-Type", ct)
+	hdr.Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	n, err := io.CopyN(w, rc, length)
+	servedBytes.Add(float64(n))
+	if err != nil {
+		s.lg.Warn().Err(err).Str("content-hash", h.String()).Msg("serve blob error")
+	}
+}
+
+// readHead returns the leading bytes of the content the type is
+// detected from.
+func readHead(b blob.Blob) ([]byte, error) {
+	rc, err := blob.OpenRange(b, 0, sniffLen)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+func (s *Server) meta(w http.ResponseWriter, r *http.Request) {
+	h, ok := parseHash(w, r)
+	if !ok {
+		return
+	}
+	bm, ok := s.index.Get(h.String())
+	if !ok {
+		writeError(w, http.StatusNotFound, "no metadata for blob %s", h.String())
+		return
+	}
+	writeJSON(w, http.StatusOK, bm)
+}
+
+// contentType returns the MIME type of the metadata: the one the
+// file command detected, else the one detected from the leading
+// bytes, else the one of the file extension. Unknown types are
+// "".
+func contentType(bm *meta.BlobMeta) string {
+	m := bm.Meta()
+	str := func(k string) string {
+		if v, ok := m[k].(meta.StringValue); ok {
+			return v.Value()
+		}
+		return ""
+	}
+	for _, prefix := range []string{"filetype-mime", "content-mime", "fileext-mime"} {
+		t, st := str(prefix+"-type"), str(prefix+"-subtype")
+		if t == "" || st == "" || (t == "application" && st == "octet-stream") {
+			continue
+		}
+		ct := t + "/" + st
+		if enc := str(prefix + "-encoding"); t == "text" && enc != "" && enc != "binary" {
+			ct += "; charset=" + enc
+		}
+		return ct
+	}
+	return ""
+}
+
+// etagMatch tells if the If-None-Match header matches the etag.
+func etagMatch(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ifRange tells if the Range header applies, which it does unless
+// an If-Range header names another etag.
+func ifRange(r *http.Request, etag string) bool {
+	v := r.Header.Get("If-Range")
+	return v == "" || v == etag
+}
+
+// parseRange returns the offset and length of a single byte range
+// of the Range header, "bytes=<first>-[<last>]" or "bytes=-<n>".
+func parseRange(s string, size int64) (int64, int64, error) {
+	if !strings.HasPrefix(s, "bytes=") {
+		return 0, 0, fmt.Errorf("invalid range %q", s)
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(s, "bytes="))
+	if strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("multiple ranges are not supported")
+	}
+	i := strings.Index(spec, "-")
+	if i == -1 {
+		return 0, 0, fmt.Errorf("invalid range %q", s)
+	}
+	first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+	if first == "" {
+		// the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("invalid range %q", s)
+		}
+		if n > size {
+			n = size
+		}
+		if n == 0 {
+			return 0, 0, errUnsatisfiable
+		}
+		return size - n, n, nil
+	}
+	off, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || off < 0 {
+		return 0, 0, fmt.Errorf("invalid range %q", s)
+	}
+	if off >= size {
+		return 0, 0, errUnsatisfiable
+	}
+	end := size - 1
+	if last != "" {
+		e, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || e < off {
+			return 0, 0, fmt.Errorf("invalid range %q", s)
+		}
+		if e < end {
+			end = e
+		}
+	}
+	return off, end - off + 1, nil
+}
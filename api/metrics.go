@@ -0,0 +1,21 @@
+package api
+
+import (
+	"filemanager/metrics"
+)
+
+var (
+	requestCount = metrics.Default.NewCounterVec(
+		"filemanager_api_requests_total",
+		"Number of api requests, by route and status code.", "route", "code")
+	requestLatency = metrics.Default.NewHistogramVec(
+		"filemanager_api_request_seconds",
+		"Time spent serving an api request, by route.",
+		metrics.DefBuckets, "route")
+	uploadBytes = metrics.Default.NewCounterVec(
+		"filemanager_api_upload_bytes_total",
+		"Total size of uploaded bodies, in bytes.").With()
+	servedBytes = metrics.Default.NewCounterVec(
+		"filemanager_api_served_bytes_total",
+		"Total size of blob content served, in bytes.").With()
+)
@@ -0,0 +1,216 @@
+// Package api implements an http server over a blob store, so that
+// files can be uploaded and fetched without linking the go code.
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"filemanager/blob"
+	"filemanager/job"
+	"filemanager/meta"
+	"filemanager/metrics"
+	"filemanager/util"
+
+	"github.com/rs/zerolog"
+)
+
+// Store is the blob store behind the server, the uploads are
+// stored with Store and read back with Has and Open, and the
+// store processes are run as jobs of its manager.
+type Store interface {
+	blob.Storage
+	Has(h *util.Hash) (bool, error)
+	Open(h *util.Hash) (blob.Blob, error)
+	Jobs() *job.Manager
+}
+
+// Server serves the api:
+//
+//	PUT  /blobs              store the body, returns its hash
+//	GET  /blobs/{hash}       the content, with Range and ETag support
+//	HEAD /blobs/{hash}       whether the blob exists, and its size
+//	GET  /blobs/{hash}/meta  the indexed metadata of the blob
+//	GET  /jobs/{id}          the status of a store process
+//	GET  /metrics            the metrics in the prometheus text format
+type Server struct {
+	store         Store
+	index         *meta.Index
+	tempDir       string
+	maxUploadSize int64
+	lg            *zerolog.Logger
+}
+
+// New creates a server storing the uploads in the store and
+// recording their metadata in the index.
+func New(store Store, index *meta.Index, lg *zerolog.Logger) *Server {
+	return &Server{
+		store:   store,
+		index:   index,
+		tempDir: os.TempDir(),
+		lg:      lg,
+	}
+}
+
+// SetTempDir sets the directory the uploads are written to until
+// they are stored, the system temp dir by default.
+func (s *Server) SetTempDir(dir string) {
+	s.tempDir = dir
+}
+
+// SetMaxUploadSize limits the size of the uploads, larger ones
+// are rejected with 413. Zero means no limit.
+func (s *Server) SetMaxUploadSize(n int64) {
+	s.maxUploadSize = n
+}
+
+// Handler returns the http.Handler of the api.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/blobs", s.route("upload", allow(s.upload, http.MethodPut)))
+	mux.Handle("/blobs/", s.blobs())
+	mux.Handle("/jobs/", s.route("job", allow(s.job, http.MethodGet, http.MethodHead)))
+	mux.Handle("/metrics", metrics.Handler(metrics.Default))
+	return mux
+}
+
+// blobs routes /blobs/{hash} and /blobs/{hash}/meta.
+func (s *Server) blobs() http.Handler {
+	get := s.route("blob", allow(s.get, http.MethodGet, http.MethodHead))
+	meta := s.route("meta", allow(s.meta, http.MethodGet, http.MethodHead))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimPrefix(r.URL.Path, "/blobs/")
+		switch {
+		case p != "" && !strings.Contains(p, "/"):
+			get.ServeHTTP(w, r)
+		case strings.Count(p, "/") == 1 && strings.HasSuffix(p, "/meta"):
+			meta.ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// allow answers 405 to the requests whose method isn't one of the
+// given ones.
+func allow(h http.HandlerFunc, methods ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range methods {
+			if r.Method == m {
+				h(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", strings.Join(methods, ", "))
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	}
+}
+
+// Serve starts an http server listening on the given address
+// (e.g. "127.0.0.1:8080") which serves the api. The returned
+// server can be shut down with its Close or Shutdown method.
+func (s *Server) Serve(addr string) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: s.Handler()}
+	l := s.lg.With().Str("api-addr", ln.Addr().String()).Logger()
+	go func() {
+		l.Info().Msg("serving api")
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			l.Error().Err(err).Msg("api server error")
+		}
+	}()
+	return srv, nil
+}
+
+// statusWriter records the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// route wraps the handler of a route with its metrics.
+func (s *Server) route(name string, h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		h(sw, r)
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		requestCount.With(name, strconv.Itoa(sw.status)).Inc()
+		requestLatency.With(name).ObserveDuration(time.Now().Sub(t))
+	})
+}
+
+// writeJSON writes v as the json body of the response.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)+1))
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
+
+// writeError writes the error as a json {"error": "..."} body.
+func writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{fmt.Sprintf(format, args...)})
+}
+
+// parseHash returns the hash of a /blobs/{hash} path, or writes a
+// 400 response.
+func parseHash(w http.ResponseWriter, r *http.Request) (*util.Hash, bool) {
+	p := strings.TrimPrefix(r.URL.Path, "/blobs/")
+	if i := strings.Index(p, "/"); i != -1 {
+		p = p[:i]
+	}
+	h, err := util.ParseHash(p)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%v", err)
+		return nil, false
+	}
+	return h, true
+}
+
+func (s *Server) job(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	sts, err := s.store.Jobs().Status(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "%v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(sts + "\n"))
+}
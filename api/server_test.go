@@ -0,0 +1,222 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"filemanager/blob"
+	"filemanager/job"
+	"filemanager/memory"
+	"filemanager/meta"
+	"filemanager/util"
+
+	"github.com/rs/zerolog"
+)
+
+var discard = zerolog.New(ioutil.Discard)
+
+// memoryStore serves a memory store.
+type memoryStore struct {
+	st *memory.Store
+}
+
+func (s memoryStore) Store(blobCh chan blob.Blob) blob.StoreStatus {
+	return s.st.Store(blobCh)
+}
+
+func (s memoryStore) Has(h *util.Hash) (bool, error) {
+	return s.st.Has(h)
+}
+
+func (s memoryStore) Jobs() *job.Manager {
+	return s.st.Jobs()
+}
+
+func (s memoryStore) Open(h *util.Hash) (blob.Blob, error) {
+	b, err := s.st.Get(h)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func newServer(t *testing.T) (*Server, *httptest.Server) {
+	st, err := memory.New("test", 2, &discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := New(memoryStore{st}, meta.NewIndex(), &discard)
+	s.SetTempDir(t.TempDir())
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+// do sends the request and returns the response with its body.
+func do(t *testing.T, method, url string, body []byte, hdr ...string) (*http.Response, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(hdr); i += 2 {
+		req.Header.Set(hdr[i], hdr[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, data
+}
+
+func put(t *testing.T, srv *httptest.Server, name string, data []byte) (int, *uploadResult) {
+	t.Helper()
+	resp, body := do(t, http.MethodPut, srv.URL+"/blobs?name="+name, data)
+	res := &uploadResult{}
+	if err := json.Unmarshal(body, res); err != nil {
+		t.Fatalf("upload response %q: %v", body, err)
+	}
+	return resp.StatusCode, res
+}
+
+func hexOf(data []byte) string {
+	sum := sha1.Sum(data)
+	return fmt.Sprintf("%x", sum[:])
+}
+
+func TestUpload(t *testing.T) {
+	_, srv := newServer(t)
+	data := []byte("hello, world\n")
+	status, res := put(t, srv, "hello.txt", data)
+	if status != http.StatusCreated || !res.Stored || res.Hash != "sha1:"+hexOf(data) || res.Size != int64(len(data)) {
+		t.Fatalf("first upload: %d %+v", status, res)
+	}
+	status, dup := put(t, srv, "hello.txt", data)
+	if status != http.StatusOK || dup.Stored || dup.Hash != res.Hash {
+		t.Fatalf("second upload: %d %+v", status, dup)
+	}
+
+	// the status of the store process
+	resp, body := do(t, http.MethodGet, srv.URL+"/jobs/"+res.Job, nil)
+	var job struct {
+		ID    string `json:"id"`
+		Count int64  `json:"count"`
+		Done  bool   `json:"done"`
+	}
+	if err := json.Unmarshal(body, &job); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("job %d %q: %v", resp.StatusCode, body, err)
+	}
+	if job.ID != res.Job || job.Count != 1 || !job.Done {
+		t.Fatalf("job %+v", job)
+	}
+	if resp, _ := do(t, http.MethodGet, srv.URL+"/jobs/none", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown job: %d", resp.StatusCode)
+	}
+
+	// the metadata recorded with the upload
+	resp, body = do(t, http.MethodGet, srv.URL+"/blobs/"+hexOf(data)+"/meta", nil)
+	var bm struct {
+		ID   string                 `json:"id"`
+		Meta map[string]interface{} `json:"meta"`
+	}
+	if err := json.Unmarshal(body, &bm); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("meta %d %q: %v", resp.StatusCode, body, err)
+	}
+	if bm.ID != res.Hash || bm.Meta["filename"] != "hello.txt" || bm.Meta["content-mime-subtype"] != "plain" {
+		t.Fatalf("meta %+v", bm)
+	}
+	if resp, _ := do(t, http.MethodGet, srv.URL+"/blobs/"+hexOf([]byte("x"))+"/meta", nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("meta of a missing blob: %d", resp.StatusCode)
+	}
+}
+
+func TestUploadTooLarge(t *testing.T) {
+	s, srv := newServer(t)
+	s.SetMaxUploadSize(10)
+	if status, res := put(t, srv, "", []byte("0123456789")); status != http.StatusCreated {
+		t.Fatalf("upload of the max size: %d %+v", status, res)
+	}
+	if status, res := put(t, srv, "", []byte("0123456789a")); status != http.StatusRequestEntityTooLarge {
+		t.Fatalf("upload over the max size: %d %+v", status, res)
+	}
+
+	// without a Content-Length, the size is only known once read
+	req, err := http.NewRequest(http.MethodPut, srv.URL+"/blobs", ioutil.NopCloser(strings.NewReader("0123456789ab")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if req.ContentLength != 0 || resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("chunked upload over the max size: %d", resp.StatusCode)
+	}
+}
+
+func TestGet(t *testing.T) {
+	_, srv := newServer(t)
+	data := []byte("0123456789abcdefghij")
+	put(t, srv, "digits.bin", data)
+	u := srv.URL + "/blobs/" + hexOf(data)
+	etag := `"` + hexOf(data) + `"`
+
+	for _, c := range []struct {
+		name   string
+		hdr    []string
+		status int
+		body   string
+		rng    string
+	}{
+		{"whole", nil, http.StatusOK, string(data), ""},
+		{"range", []string{"Range", "bytes=2-5"}, http.StatusPartialContent, "2345", "bytes 2-5/20"},
+		{"open range", []string{"Range", "bytes=18-"}, http.StatusPartialContent, "ij", "bytes 18-19/20"},
+		{"suffix range", []string{"Range", "bytes=-3"}, http.StatusPartialContent, "hij", "bytes 17-19/20"},
+		{"range past the end", []string{"Range", "bytes=15-100"}, http.StatusPartialContent, "fghij", "bytes 15-19/20"},
+		{"unsatisfiable", []string{"Range", "bytes=20-"}, http.StatusRequestedRangeNotSatisfiable, "", "bytes */20"},
+		{"multiple ranges", []string{"Range", "bytes=0-1,4-5"}, http.StatusOK, string(data), ""},
+		{"if-range mismatch", []string{"Range", "bytes=2-5", "If-Range", `"other"`}, http.StatusOK, string(data), ""},
+		{"if-range match", []string{"Range", "bytes=2-5", "If-Range", etag}, http.StatusPartialContent, "2345", "bytes 2-5/20"},
+		{"not modified", []string{"If-None-Match", etag}, http.StatusNotModified, "", ""},
+		{"modified", []string{"If-None-Match", `"other"`}, http.StatusOK, string(data), ""},
+	} {
+		resp, body := do(t, http.MethodGet, u, nil, c.hdr...)
+		if resp.StatusCode != c.status || resp.Header.Get("Content-Range") != c.rng {
+			t.Fatalf("%s: %d with Content-Range %q", c.name, resp.StatusCode, resp.Header.Get("Content-Range"))
+		}
+		if c.status != http.StatusRequestedRangeNotSatisfiable && string(body) != c.body {
+			t.Fatalf("%s: body %q, %q expected", c.name, body, c.body)
+		}
+		if resp.Header.Get("ETag") != etag {
+			t.Fatalf("%s: etag %q", c.name, resp.Header.Get("ETag"))
+		}
+	}
+
+	// HEAD has the headers only
+	resp, body := do(t, http.MethodHead, u, nil)
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != int64(len(data)) || len(body) != 0 {
+		t.Fatalf("head: %d of %d bytes", resp.StatusCode, resp.ContentLength)
+	}
+	if resp, _ := do(t, http.MethodHead, srv.URL+"/blobs/"+hexOf([]byte("x")), nil); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("head of a missing blob: %d", resp.StatusCode)
+	}
+	if resp, _ := do(t, http.MethodGet, srv.URL+"/blobs/nothex", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid hash: %d", resp.StatusCode)
+	}
+	if resp, _ := do(t, http.MethodDelete, u, nil); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("delete: %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,222 @@
+package api
+
+import (
+	"crypto/sha1"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"filemanager/blob"
+	fs "filemanager/filesystem"
+	"filemanager/meta"
+	"filemanager/util"
+)
+
+// sniffLen is the number of leading bytes the content type is
+// detected from.
+const sniffLen = 512
+
+// upload is a request body written to a temp file until stored.
+type upload struct {
+	path string
+	url  *url.URL
+	name string
+	size int64
+	hash *util.Hash
+}
+
+func (u *upload) Hash() *util.Hash {
+	return u.hash
+}
+
+func (u *upload) Type() blob.Type {
+	return blob.TypeUpload
+}
+
+// Url returns upload://<client address>/<name>.
+func (u *upload) Url() *url.URL {
+	return u.url
+}
+
+func (u *upload) Name() string {
+	return u.name
+}
+
+func (u *upload) Size() (int64, error) {
+	return u.size, nil
+}
+
+func (u *upload) ReadCloser() (io.ReadCloser, error) {
+	return os.Open(u.path)
+}
+
+func (u *upload) OpenRange(off, n int64) (io.ReadCloser, error) {
+	return blob.OpenFileRange(u.path, off, n)
+}
+
+// headWriter keeps the first bytes written to it.
+type headWriter struct {
+	head []byte
+}
+
+func (w *headWriter) Write(p []byte) (int, error) {
+	if n := sniffLen - len(w.head); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		w.head = append(w.head, p[:n]...)
+	}
+	return len(p), nil
+}
+
+// uploadResult is the response to an upload.
+type uploadResult struct {
+	Hash   string `json:"hash"`
+	Size   int64  `json:"size"`
+	Name   string `json:"name,omitempty"`
+	Job    string `json:"job"`
+	Stored bool   `json:"stored"`
+	Error  string `json:"error,omitempty"`
+}
+
+// upload hashes the body while writing it to a temp file, then
+// stores it. The response is 201 if the blob was stored, 200 if
+// the store already had it.
+func (s *Server) upload(w http.ResponseWriter, r *http.Request) {
+	if s.maxUploadSize > 0 && r.ContentLength > s.maxUploadSize {
+		writeError(w, http.StatusRequestEntityTooLarge, "upload of %d bytes exceeds %d bytes", r.ContentLength, s.maxUploadSize)
+		return
+	}
+	// a body longer than the max size is read one byte past it
+	var body io.Reader = r.Body
+	if s.maxUploadSize > 0 {
+		body = io.LimitReader(r.Body, s.maxUploadSize+1)
+	}
+	f, err := ioutil.TempFile(s.tempDir, "upload-")
+	if err != nil {
+		s.lg.Error().Err(err).Msg("create upload file error")
+		writeError(w, http.StatusInternalServerError, "create upload file: %v", err)
+		return
+	}
+	defer os.Remove(f.Name())
+	sh := sha1.New()
+	hw := &headWriter{}
+	n, err := io.Copy(io.MultiWriter(f, sh, hw), body)
+	if cerr := f.Close(); err == nil && cerr != nil {
+		s.lg.Error().Err(cerr).Msg("write upload file error")
+		writeError(w, http.StatusInternalServerError, "write upload file: %v", cerr)
+		return
+	}
+	uploadBytes.Add(float64(n))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "read body: %v", err)
+		return
+	}
+	if s.maxUploadSize > 0 && n > s.maxUploadSize {
+		writeError(w, http.StatusRequestEntityTooLarge, "upload exceeds %d bytes", s.maxUploadSize)
+		return
+	}
+
+	h := util.NewSha1Hash(sh.Sum(nil))
+	name := uploadName(r)
+	u := &upload{
+		path: f.Name(),
+		url:  &url.URL{Scheme: "upload", Host: r.RemoteAddr, Path: "/" + name},
+		name: name,
+		size: n,
+		hash: h,
+	}
+	if name == "" {
+		u.name = h.Hex()
+	}
+	ch := make(chan blob.Blob, 1)
+	ch <- u
+	close(ch)
+	sts := s.store.Store(ch)
+	for range sts.Blob() {
+	}
+	<-sts.Done()
+
+	l := s.lg.With().
+		Str("job-id", sts.ID()).
+		Str("source", u.url.String()).
+		Str("content-hash", h.String()).
+		Int64("size", n).
+		Logger()
+	res := &uploadResult{
+		Hash:   h.String(),
+		Size:   n,
+		Name:   name,
+		Job:    sts.ID(),
+		Stored: sts.Count() > 0,
+	}
+	if sts.ErrorCount() > 0 {
+		l.Error().Msg("store upload error")
+		res.Error = "store failed, see the log of job " + sts.ID()
+		writeJSON(w, http.StatusInternalServerError, res)
+		return
+	}
+	if err := s.index.Put(uploadMeta(u, name, hw.head)); err != nil {
+		l.Error().Err(err).Str("index", s.index.Path()).Msg("index upload error")
+	}
+	l.Info().Bool("stored", res.Stored).Msg("uploaded")
+	status := http.StatusOK
+	if res.Stored {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, res)
+}
+
+// uploadName returns the name given by the name query parameter or
+// the filename of the Content-Disposition header, or "".
+func uploadName(r *http.Request) string {
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil {
+			name = params["filename"]
+		}
+	}
+	// the name is untrusted, only its base is kept
+	name = path.Base(strings.Replace(name, "\\", "/", -1))
+	if name == "." || name == "/" || name == ".." {
+		return ""
+	}
+	return name
+}
+
+// uploadMeta returns the metadata of an upload: the file name and
+// the MIME type of its extension, as the meta command records
+// them, the MIME type detected from its leading bytes, and the Exif
+// of a jpeg image.
+func uploadMeta(u *upload, name string, head []byte) *meta.BlobMeta {
+	bm := meta.NewBlobMeta(u.hash.String())
+	if name != "" {
+		mt := fs.MapName2Mime(name)
+		bm.Add("filename", meta.StringValue(name))
+		bm.Add("fileext", meta.StringValue(util.FileExt(name)))
+		bm.Add("fileext-mime-type", meta.StringValue(mt.Type))
+		bm.Add("fileext-mime-subtype", meta.StringValue(mt.Subtype))
+	}
+	t, params, err := mime.ParseMediaType(http.DetectContentType(head))
+	if parts := strings.SplitN(t, "/", 2); err == nil && len(parts) == 2 {
+		bm.Add("content-mime-type", meta.StringValue(parts[0]))
+		bm.Add("content-mime-subtype", meta.StringValue(parts[1]))
+		if cs := params["charset"]; cs != "" {
+			bm.Add("content-mime-encoding", meta.StringValue(cs))
+		}
+	}
+	if t == "image/jpeg" {
+		if em, err := meta.ReadExif(blob.NewReaderAt(u), u.size); err == nil {
+			for k, v := range em {
+				bm.Add(k, v)
+			}
+		}
+	}
+	bm.Add("size", meta.IntValue(u.size))
+	return bm
+}
@@ -0,0 +1,277 @@
+// Package archive implements blob sources over archive files, which
+// load the members of the archives without unpacking them to disk.
+package archive
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"filemanager/blob"
+	"filemanager/job"
+	"filemanager/meta"
+	"filemanager/util"
+
+	"github.com/rs/zerolog"
+	"github.com/satori/go.uuid"
+)
+
+// Member is a member of an archive loaded into memory. Its name is
+// its slash separated path in the archive.
+type Member struct {
+	url     *url.URL
+	name    string
+	blob    []byte
+	size    int64
+	hash    *util.Hash
+	mode    os.FileMode
+	modTime time.Time
+	// parent is the hash of the archive an expanded member is in,
+	// at depth 1 for the members of the expanded archive
+	parent *util.Hash
+	depth  int
+}
+
+// newMember returns the member with the given content, whose url
+// is the url of the archive with the name as fragment.
+func newMember(archive *url.URL, name string, data []byte, mode os.FileMode, modTime time.Time) *Member {
+	u := *archive
+	u.Fragment = name
+	sum := sha1.Sum(data)
+	return &Member{
+		url:     &u,
+		name:    name,
+		blob:    data,
+		size:    int64(len(data)),
+		hash:    util.NewSha1Hash(sum[:]),
+		mode:    mode,
+		modTime: modTime,
+	}
+}
+
+func (m *Member) Hash() *util.Hash {
+	return m.hash
+}
+
+func (m *Member) Type() blob.Type {
+	return blob.TypeArchive
+}
+
+func (m *Member) Url() *url.URL {
+	return m.url
+}
+
+// Name returns the path of the member in the archive.
+func (m *Member) Name() string {
+	return m.name
+}
+
+func (m *Member) Size() (int64, error) {
+	return m.size, nil
+}
+
+// Mode returns the mode recorded in the archive.
+func (m *Member) Mode() os.FileMode {
+	return m.mode
+}
+
+// ModTime returns the mtime recorded in the archive.
+func (m *Member) ModTime() time.Time {
+	return m.modTime
+}
+
+// Parent returns the hash of the archive the member was expanded
+// from, or nil for the members loaded by an archive source.
+func (m *Member) Parent() *util.Hash {
+	return m.parent
+}
+
+// Depth returns the nesting depth of an expanded member, 1 for the
+// members of the expanded archive, or 0.
+func (m *Member) Depth() int {
+	return m.depth
+}
+
+// the metadata keys linking an expanded member to its archive
+const (
+	MetaParent = "archive-parent"
+	MetaMember = "archive-member"
+)
+
+// ParentMeta returns the metadata of an expanded member which
+// records the hash of the archive it is in and its path there, so
+// that the link outlives the load, or nil for other blobs.
+func ParentMeta(b blob.Blob) *meta.BlobMeta {
+	m, ok := b.(*Member)
+	if !ok || m.parent == nil {
+		return nil
+	}
+	bm := meta.NewBlobMeta(m.hash.String())
+	bm.Add(MetaParent, meta.StringValue(m.parent.String()))
+	bm.Add(MetaMember, meta.StringValue(m.name))
+	return bm
+}
+
+// Free clears the loaded content.
+func (m *Member) Free() {
+	m.blob = nil
+}
+
+func (m *Member) ReadCloser() (io.ReadCloser, error) {
+	if m.blob == nil {
+		return nil, fmt.Errorf("underlying blob ([]byte) is nil")
+	}
+	return blob.NewBufferedReadCloser(m.blob), nil
+}
+
+func (m *Member) OpenRange(off, n int64) (io.ReadCloser, error) {
+	if m.blob == nil {
+		return nil, fmt.Errorf("underlying blob ([]byte) is nil")
+	}
+	return blob.OpenBytesRange(m.blob, off, n)
+}
+
+// memberName returns the cleaned path of a member, archives with
+// absolute paths or paths out of the archive are rejected.
+func memberName(name string) (string, error) {
+	name = strings.Replace(name, "\\", "/", -1)
+	if path.IsAbs(name) || strings.HasPrefix(name, "/") {
+		return "", fmt.Errorf("member %q has an absolute path", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("member %q has a path out of the archive", name)
+		}
+	}
+	name = path.Clean(name)
+	if name == "." {
+		return "", fmt.Errorf("member has an empty path")
+	}
+	return name, nil
+}
+
+// source has the settings common to the archive sources.
+type source struct {
+	path             string
+	url              *url.URL
+	skip             skipFunc
+	progressInterval time.Duration
+	jobs             *job.Manager
+	lg               *zerolog.Logger
+}
+
+func newSource(scheme, path string, lg *zerolog.Logger) (*source, error) {
+	l := lg.With().Str("archive", path).Logger()
+	jobs, err := job.NewManager(path, job.DefaultMaxJobs, &l)
+	if err != nil {
+		return nil, err
+	}
+	return &source{
+		path:             path,
+		url:              &url.URL{Scheme: scheme, Path: filepath.ToSlash(path)},
+		skip:             skipDotFile,
+		progressInterval: blob.DefaultProgressInterval,
+		jobs:             jobs,
+		lg:               &l,
+	}, nil
+}
+
+// archivePath returns the absolute path of the archive file.
+func archivePath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !fi.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a file", path)
+	}
+	return path, nil
+}
+
+// Path returns the path of the archive.
+func (s *source) Path() string {
+	return s.path
+}
+
+// Jobs returns the job manager the loads of this source run in.
+func (s *source) Jobs() *job.Manager {
+	return s.jobs
+}
+
+// SetSkip sets the members skipped by Load, hidden ones (with a
+// path part starting with a dot) if dotFiles is true, and the ones
+// whose path or name matches one of the patterns.
+func (s *source) SetSkip(dotFiles bool, patterns []string) error {
+	skip, err := newSkipFunc(dotFiles, patterns)
+	if err != nil {
+		return err
+	}
+	s.skip = skip
+	return nil
+}
+
+// SetProgressInterval sets the interval at which Load emits
+// progress snapshots, a non-positive interval disables them.
+func (s *source) SetProgressInterval(d time.Duration) {
+	s.progressInterval = d
+}
+
+// newLoad returns the status of a new load and its logger.
+func (s *source) newLoad() (*blob.ProcessStatus, *zerolog.Logger) {
+	id := uuid.Must(uuid.NewV4()).String()
+	sts := blob.NewLoadStatus(id)
+	l := s.lg.With().Str("load-id", id).Logger()
+	if s.progressInterval > 0 {
+		sts.ReportProgress(s.progressInterval)
+	}
+	return sts, &l
+}
+
+// skipFunc tells if the member with the given path is skipped.
+type skipFunc func(name string) bool
+
+// skipDotFile skips the members with a path part starting with a
+// dot, like hidden files are skipped in a file system.
+func skipDotFile(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// newSkipFunc skips the hidden members if dotFiles is true, and
+// the ones whose path or name matches one of the patterns.
+func newSkipFunc(dotFiles bool, patterns []string) (skipFunc, error) {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid skip pattern %q: %v", p, err)
+		}
+	}
+	return func(name string) bool {
+		if dotFiles && skipDotFile(name) {
+			return true
+		}
+		base := path.Base(name)
+		for _, p := range patterns {
+			if ok, _ := path.Match(p, base); ok {
+				return true
+			}
+			if ok, _ := path.Match(p, name); ok {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
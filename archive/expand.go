@@ -0,0 +1,279 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"filemanager/blob"
+	"filemanager/util"
+
+	"github.com/rs/zerolog"
+)
+
+// default expansion limits
+const (
+	DefaultExpandDepth   = 3
+	DefaultExpandRatio   = 100
+	DefaultExpandBytes   = 1024 * 1024 * 1024
+	DefaultExpandEntries = 10000
+)
+
+// ErrLimit is wrapped by the errors of the expansions which were
+// stopped by a limit.
+var ErrLimit = errors.New("expansion limit exceeded")
+
+// Limits bound the expansion of an archive, the nested archives
+// included, so that hostile archives (zip bombs) can't exhaust the
+// memory.
+type Limits struct {
+	// MaxDepth is the nesting depth expanded, 1 expands the members
+	// of the archive but not the archives among them.
+	MaxDepth int
+	// MaxRatio is the max ratio of the expanded bytes to the size
+	// of the archive.
+	MaxRatio float64
+	// MaxBytes is the max number of expanded bytes.
+	MaxBytes int64
+	// MaxEntries is the max number of members.
+	MaxEntries int
+}
+
+// NewLimits returns the default expansion limits.
+func NewLimits() *Limits {
+	return &Limits{
+		MaxDepth:   DefaultExpandDepth,
+		MaxRatio:   DefaultExpandRatio,
+		MaxBytes:   DefaultExpandBytes,
+		MaxEntries: DefaultExpandEntries,
+	}
+}
+
+// Validate checks that the limits are positive.
+func (l *Limits) Validate() error {
+	if l.MaxDepth < 1 {
+		return fmt.Errorf("max depth %d is less than 1", l.MaxDepth)
+	}
+	if l.MaxRatio < 1 {
+		return fmt.Errorf("max ratio %g is less than 1", l.MaxRatio)
+	}
+	if l.MaxBytes < 1 || l.MaxEntries < 1 {
+		return fmt.Errorf("max bytes and entries must be positive")
+	}
+	return nil
+}
+
+// archiveKind returns the format of the archive with the given
+// name, from its extension, or "" if it isn't an archive.
+func archiveKind(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar"), strings.HasSuffix(name, ".tgz"),
+		strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tbz2"),
+		strings.HasSuffix(name, ".tar.bz2"):
+		return "tar"
+	case strings.HasSuffix(name, ".gz"):
+		return "gz"
+	}
+	return ""
+}
+
+// IsArchiveName tells if Expand descends into the file with the
+// given name.
+func IsArchiveName(name string) bool {
+	return archiveKind(name) != ""
+}
+
+// expander expands an archive and the archives in it within the
+// limits, which are shared by all of them.
+type expander struct {
+	limits  *Limits
+	budget  int64
+	entries int
+	sts     *blob.ProcessStatus
+	lg      *zerolog.Logger
+}
+
+// Expand sends the members of the archive data named name, and the
+// members of the archives among them down to the max depth, to the
+// blob channel of the load, counted like the other blobs. Members
+// point to the archive they are in as parent, their urls are the
+// url u of the archive, with the scheme of its format if it is a
+// file url, and the member path as fragment, "!/" separated for
+// nested members. It returns an error if the archive
+// can't be read or a limit is exceeded, the members sent before
+// are valid. Nested archives which can't be read are counted as
+// errors.
+func Expand(data []byte, name string, u *url.URL, parent *util.Hash, limits *Limits, sts *blob.ProcessStatus, lg *zerolog.Logger) error {
+	budget := limits.MaxBytes
+	if r := int64(limits.MaxRatio * float64(len(data))); r < budget {
+		budget = r
+	}
+	au := *u
+	if au.Scheme == "file" {
+		au.Scheme = archiveKind(name)
+	}
+	e := &expander{limits: limits, budget: budget, sts: sts, lg: lg}
+	return e.expand(data, name, &au, parent, 1)
+}
+
+func (e *expander) expand(data []byte, name string, u *url.URL, parent *util.Hash, depth int) error {
+	switch archiveKind(name) {
+	case "zip":
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil && err != zip.ErrInsecurePath {
+			return err
+		}
+		return e.expandZip(zr, u, parent, depth)
+	case "tar":
+		r, err := decompress(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		return e.expandTar(tar.NewReader(r), u, parent, depth)
+	case "gz":
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		member := strings.TrimSuffix(path.Base(name), path.Ext(name))
+		if zr.Name != "" {
+			member = path.Base(zr.Name)
+		}
+		return e.member(zr, -1, member, zr.ModTime, 0644, u, parent, depth)
+	}
+	return fmt.Errorf("%s is not an archive", name)
+}
+
+func (e *expander) expandZip(zr *zip.Reader, u *url.URL, parent *util.Hash, depth int) error {
+	for _, f := range zr.File {
+		fi := f.FileInfo()
+		if fi.IsDir() {
+			continue
+		}
+		name, err := memberName(zipName(f))
+		if err != nil {
+			e.sts.AddErrorCount(1)
+			e.lg.Error().Err(err).Msg("invalid member")
+			continue
+		}
+		if f.Flags&0x1 != 0 || !fi.Mode().IsRegular() {
+			e.skip(name, int64(f.UncompressedSize64))
+			continue
+		}
+		rc, err := f.Open()
+		if errors.Is(err, zip.ErrAlgorithm) {
+			e.skip(name, int64(f.UncompressedSize64))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = e.member(rc, int64(f.UncompressedSize64), name, f.Modified, f.Mode(), u, parent, depth)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *expander) expandTar(tr *tar.Reader, u *url.URL, parent *util.Hash, depth int) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fi := hdr.FileInfo()
+		if fi.IsDir() {
+			continue
+		}
+		name, err := memberName(hdr.Name)
+		if err != nil {
+			e.sts.AddErrorCount(1)
+			e.lg.Error().Err(err).Msg("invalid member")
+			continue
+		}
+		if !fi.Mode().IsRegular() {
+			e.skip(name, 0)
+			continue
+		}
+		if err := e.member(tr, hdr.Size, name, hdr.ModTime, fi.Mode(), u, parent, depth); err != nil {
+			return err
+		}
+	}
+}
+
+func (e *expander) skip(name string, size int64) {
+	e.sts.AddSkipCount(1)
+	e.sts.AddSkipSize(size)
+	e.lg.Info().Str("member", name).Msg("skip member")
+}
+
+// member reads the member from r within the limits, size is its
+// declared size or -1, sends it and expands it if it is an archive
+// and the max depth isn't reached.
+func (e *expander) member(r io.Reader, size int64, name string, modTime time.Time, mode os.FileMode, u *url.URL, parent *util.Hash, depth int) error {
+	if e.entries >= e.limits.MaxEntries {
+		return fmt.Errorf("%w: more than %d members", ErrLimit, e.limits.MaxEntries)
+	}
+	e.entries++
+	if size > e.budget {
+		return fmt.Errorf("%w: member %s of %d bytes exceeds the remaining %d bytes", ErrLimit, name, size, e.budget)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r, e.budget+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > e.budget {
+		return fmt.Errorf("%w: member %s exceeds the remaining %d bytes", ErrLimit, name, e.budget)
+	}
+	e.budget -= int64(len(data))
+
+	m := newMember(u, name, data, mode, modTime)
+	if u.Fragment != "" {
+		m.url.Fragment = u.Fragment + "!/" + name
+	}
+	m.parent = parent
+	m.depth = depth
+	e.sts.AddCount(1)
+	e.sts.AddSize(m.size)
+	e.lg.Info().
+		Str("member", m.url.Fragment).
+		Str("content-hash", m.hash.String()).
+		Int64("size", m.size).
+		Msg("expanded")
+	select {
+	case e.sts.Blob() <- m:
+	case <-e.sts.Canceled():
+		return nil
+	}
+
+	if depth >= e.limits.MaxDepth || !IsArchiveName(name) {
+		return nil
+	}
+	err = e.expand(data, name, m.url, m.hash, depth+1)
+	if errors.Is(err, ErrLimit) {
+		return err
+	}
+	if err != nil {
+		e.sts.AddErrorCount(1)
+		e.lg.Error().Err(err).Str("member", m.url.Fragment).Msg("expand nested archive error")
+	}
+	return nil
+}
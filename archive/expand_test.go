@@ -0,0 +1,151 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"testing"
+
+	"filemanager/blob"
+	"filemanager/meta"
+	"filemanager/util"
+
+	"github.com/rs/zerolog"
+)
+
+var discard = zerolog.New(ioutil.Discard)
+
+// zipFile is a zip member, compressed with deflate.
+type zipFile struct {
+	name string
+	data []byte
+}
+
+func zipOf(t *testing.T, files ...zipFile) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, err := zw.Create(f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func hashOf(data []byte) *util.Hash {
+	sum := sha1.Sum(data)
+	return util.NewSha1Hash(sum[:])
+}
+
+// expand expands the zip named name and returns the members sent,
+// with the error of the expansion.
+func expand(data []byte, name string, limits *Limits) (*blob.ProcessStatus, []*Member, error) {
+	sts := blob.NewLoadStatus("test")
+	members := make([]*Member, 0)
+	done := make(chan struct{})
+	go func() {
+		for b := range sts.Blob() {
+			members = append(members, b.(*Member))
+		}
+		close(done)
+	}()
+	u := &url.URL{Scheme: "file", Path: "/src/" + name}
+	err := Expand(data, name, u, hashOf(data), limits, sts, &discard)
+	close(sts.Blob())
+	<-done
+	return sts, members, err
+}
+
+func TestExpandNested(t *testing.T) {
+	inner := zipOf(t, zipFile{"deep.txt", []byte("deep content")})
+	outer := zipOf(t,
+		zipFile{"a.txt", []byte("hello")},
+		zipFile{"dir/inner.zip", inner},
+	)
+	sts, members, err := expand(outer, "outer.zip", NewLimits())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 3 || sts.Count() != 3 || sts.ErrorCount() != 0 {
+		t.Fatalf("expanded %d members, counted %d, %d errors", len(members), sts.Count(), sts.ErrorCount())
+	}
+	for i, want := range []struct {
+		url    string
+		parent *util.Hash
+		depth  int
+	}{
+		{"zip:///src/outer.zip#a.txt", hashOf(outer), 1},
+		{"zip:///src/outer.zip#dir/inner.zip", hashOf(outer), 1},
+		{"zip:///src/outer.zip#dir/inner.zip!/deep.txt", hashOf(inner), 2},
+	} {
+		m := members[i]
+		if m.Url().String() != want.url || m.Parent().String() != want.parent.String() || m.Depth() != want.depth {
+			t.Fatalf("member %d: %s in %s at depth %d, expected %+v", i, m.Url(), m.Parent(), m.Depth(), want)
+		}
+	}
+
+	// the parent link is kept as metadata
+	deep := members[2]
+	bm := ParentMeta(deep)
+	if bm == nil || bm.ID() != hashOf([]byte("deep content")).String() {
+		t.Fatalf("parent meta %v", bm)
+	}
+	if bm.Meta()[MetaParent] != meta.StringValue(hashOf(inner).String()) || bm.Meta()[MetaMember] != meta.StringValue("deep.txt") {
+		t.Fatalf("parent meta %v", bm.Meta())
+	}
+	if ParentMeta(newMember(deep.Url(), "x", nil, 0644, deep.ModTime())) != nil {
+		t.Fatal("parent meta of a member which wasn't expanded")
+	}
+}
+
+// nest returns a zip holding the data named name, nested n times.
+func nest(t *testing.T, name string, data []byte, n int) []byte {
+	for i := 0; i < n; i++ {
+		data = zipOf(t, zipFile{name, data})
+		name = fmt.Sprintf("level%d.zip", i)
+	}
+	return data
+}
+
+func TestExpandLimits(t *testing.T) {
+	zeros := make([]byte, 1<<20)
+	many := make([]zipFile, 20)
+	for i := range many {
+		many[i] = zipFile{fmt.Sprintf("f%d", i), []byte{byte(i)}}
+	}
+	for _, c := range []struct {
+		name    string
+		data    []byte
+		limits  Limits
+		members int
+		limit   bool
+	}{
+		// the archives below max depth are members, not expanded
+		{"max-depth", nest(t, "zeros", zeros, 5), Limits{MaxDepth: 2, MaxRatio: 1e6, MaxBytes: 1 << 30, MaxEntries: 100}, 2, false},
+		{"max-entries", zipOf(t, many...), Limits{MaxDepth: 3, MaxRatio: 100, MaxBytes: 1 << 30, MaxEntries: 10}, 10, true},
+		{"max-bytes", zipOf(t, zipFile{"a", zeros[:1000]}, zipFile{"b", zeros}), Limits{MaxDepth: 3, MaxRatio: 1e6, MaxBytes: 1 << 19, MaxEntries: 100}, 1, true},
+		{"max-ratio", zipOf(t, zipFile{"zeros", zeros}), Limits{MaxDepth: 3, MaxRatio: 100, MaxBytes: 1 << 30, MaxEntries: 100}, 0, true},
+		// the nested zips are small, the limits hold over them all
+		{"nested max-ratio", nest(t, "zeros", zeros, 3), Limits{MaxDepth: 5, MaxRatio: 100, MaxBytes: 1 << 30, MaxEntries: 100}, 2, true},
+	} {
+		limits := c.limits
+		_, members, err := expand(c.data, "bomb.zip", &limits)
+		if c.limit != errors.Is(err, ErrLimit) {
+			t.Fatalf("%s: error %v", c.name, err)
+		}
+		if len(members) != c.members {
+			t.Fatalf("%s: expanded %d members, %d expected", c.name, len(members), c.members)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package archive
+
+import (
+	"filemanager/metrics"
+)
+
+var (
+	memberCount = metrics.Default.NewCounterVec(
+		"filemanager_archive_members_total",
+		"Number of archive members loaded, skipped or failed.", "format", "state")
+	memberBytes = metrics.Default.NewCounterVec(
+		"filemanager_archive_member_bytes_total",
+		"Total size of loaded archive members, in bytes.", "format")
+)
@@ -0,0 +1,172 @@
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"filemanager/blob"
+
+	"github.com/rs/zerolog"
+)
+
+// TarSource loads the regular members of a tar archive, plain or
+// compressed with gzip or bzip2, which is detected from its content.
+// The members are named by their path in the archive and their urls
+// are tar://<archive path>#<member path>.
+type TarSource struct {
+	source
+	// r is the stream of a source which isn't a file, it can be
+	// loaded once
+	r      io.Reader
+	loaded int32
+}
+
+// NewTarSource creates the source of the tar archive at path.
+func NewTarSource(path string, lg *zerolog.Logger) (*TarSource, error) {
+	path, err := archivePath(path)
+	if err != nil {
+		return nil, err
+	}
+	src, err := newSource("tar", path, lg)
+	if err != nil {
+		return nil, err
+	}
+	return &TarSource{source: *src}, nil
+}
+
+// NewTarStream creates the source of the tar archive read from r,
+// e.g. stdin or a pipe, name is used in the urls of its members.
+// It can be loaded once.
+func NewTarStream(r io.Reader, name string, lg *zerolog.Logger) (*TarSource, error) {
+	src, err := newSource("tar", name, lg)
+	if err != nil {
+		return nil, err
+	}
+	return &TarSource{source: *src, r: r}, nil
+}
+
+func (s *TarSource) Load() blob.LoadStatus {
+	sts, l := s.newLoad()
+	s.jobs.Run(sts, func() {
+		defer sts.Finish()
+		r, err := s.open()
+		if err != nil {
+			sts.AddErrorCount(1)
+			l.Error().Err(err).Msg("open archive error")
+			return
+		}
+		defer r.Close()
+		loadTar(r, s.url, s.skip, sts, l)
+	})
+	return sts
+}
+
+func (s *TarSource) open() (io.ReadCloser, error) {
+	if s.r == nil {
+		return os.Open(s.path)
+	}
+	if !atomic.CompareAndSwapInt32(&s.loaded, 0, 1) {
+		return nil, fmt.Errorf("the stream of %s has been loaded already", s.path)
+	}
+	return ioutil.NopCloser(s.r), nil
+}
+
+// decompress returns the content of r, decompressed if it starts
+// with the gzip or bzip2 magic.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(3)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(br)
+	case bytes.Equal(magic, []byte("BZh")):
+		return bzip2.NewReader(br), nil
+	}
+	return br, nil
+}
+
+// loadTar sends the regular members of the tar stream r which are
+// not skipped. Links and special files are counted as skipped.
+func loadTar(r io.Reader, base *url.URL, skip skipFunc, sts *blob.ProcessStatus, lg *zerolog.Logger) {
+	dr, err := decompress(r)
+	if err != nil {
+		sts.AddErrorCount(1)
+		lg.Error().Err(err).Msg("open archive error")
+		return
+	}
+	tr := tar.NewReader(dr)
+	worker := "tar"
+	defer sts.RemoveWorker(worker)
+	for {
+		if !sts.WaitIfPaused() {
+			lg.Info().Msg("canceled")
+			return
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			// the rest of the stream can't be found
+			sts.AddErrorCount(1)
+			memberCount.With("tar", "error").Inc()
+			lg.Error().Err(err).Msg("read archive error")
+			return
+		}
+		fi := hdr.FileInfo()
+		if fi.IsDir() {
+			continue
+		}
+		name, err := memberName(hdr.Name)
+		if err != nil {
+			sts.AddErrorCount(1)
+			memberCount.With("tar", "error").Inc()
+			lg.Error().Err(err).Msg("invalid member")
+			continue
+		}
+		ml := lg.With().Str("member", name).Logger()
+		if !fi.Mode().IsRegular() || skip(name) {
+			sts.AddSkipCount(1)
+			memberCount.With("tar", "skipped").Inc()
+			if fi.Mode().IsRegular() {
+				sts.AddSkipSize(hdr.Size)
+			}
+			ml.Info().Str("mode", fi.Mode().String()).Msg("skip member")
+			continue
+		}
+		sts.SetWorkerState(worker, name)
+		t := time.Now()
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			sts.AddErrorCount(1)
+			memberCount.With("tar", "error").Inc()
+			ml.Error().Err(err).Msg("read member error")
+			return
+		}
+		m := newMember(base, name, data, fi.Mode(), hdr.ModTime)
+		sts.AddCount(1)
+		sts.AddSize(m.size)
+		memberCount.With("tar", "loaded").Inc()
+		memberBytes.With("tar").Add(float64(m.size))
+		ml.Info().
+			Str("content-hash", m.hash.String()).
+			Int64("size", m.size).
+			Int64("duration", time.Now().Sub(t).Nanoseconds()).
+			Msg("loaded")
+		select {
+		case sts.Blob() <- m:
+		case <-sts.Canceled():
+			return
+		}
+	}
+}
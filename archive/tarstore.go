@@ -0,0 +1,360 @@
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"filemanager/blob"
+	"filemanager/job"
+	"filemanager/util"
+
+	"github.com/rs/zerolog"
+	"github.com/satori/go.uuid"
+)
+
+// the manifest written as the last entry of the exported tars
+const (
+	ManifestName    = "manifest.json"
+	manifestKind    = "filemanager-tar-export"
+	manifestVersion = 1
+)
+
+// Namer returns the name of the tar entry of a blob, a relative
+// slash separated path.
+type Namer func(b blob.Blob) string
+
+// OriginalName names the entries by the path of the blob at its
+// source, without the leading slash, archive members by the path
+// of the archive and their path in it, "!/" separated so that
+// they don't clash with the archive when extracted, downloads by
+// the host and path of their url.
+func OriginalName(b blob.Blob) string {
+	u := b.Url()
+	name := u.Host + u.Path
+	if name == "" {
+		name = u.Opaque
+	}
+	if u.Fragment != "" {
+		name += "!/" + u.Fragment
+	}
+	return strings.TrimLeft(name, "/")
+}
+
+// Manifest lists the entries of an exported tar. Partial is set
+// when the store was canceled, the tar then lacks some of the blobs
+// sent to it.
+type Manifest struct {
+	Kind    string           `json:"kind"`
+	Version int              `json:"version"`
+	Time    time.Time        `json:"time"`
+	Partial bool             `json:"partial,omitempty"`
+	Files   int64            `json:"files"`
+	Size    int64            `json:"size"`
+	Entries []*ManifestEntry `json:"entries"`
+}
+
+// ManifestEntry is a blob written to an exported tar, Url is the
+// url of the blob at its source.
+type ManifestEntry struct {
+	Name string `json:"name"`
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+	Url  string `json:"url"`
+}
+
+// ErrWriteOnly is returned by the reads of a TarEntry.
+var ErrWriteOnly = errors.New("tar entries are write-only")
+
+// TarEntry is a blob written to a tar stream, as sent by the
+// stores of a TarStorage. The stream is write-only, so an entry
+// has no content: ReadCloser and OpenRange return ErrWriteOnly.
+type TarEntry struct {
+	url     *url.URL
+	name    string
+	size    int64
+	hash    *util.Hash
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (e *TarEntry) Hash() *util.Hash {
+	return e.hash
+}
+
+func (e *TarEntry) Type() blob.Type {
+	return blob.TypeArchive
+}
+
+func (e *TarEntry) Url() *url.URL {
+	return e.url
+}
+
+// Name returns the name of the entry in the tar.
+func (e *TarEntry) Name() string {
+	return e.name
+}
+
+func (e *TarEntry) Size() (int64, error) {
+	return e.size, nil
+}
+
+// Mode returns the mode the entry was written with.
+func (e *TarEntry) Mode() os.FileMode {
+	return e.mode
+}
+
+// ModTime returns the mtime the entry was written with.
+func (e *TarEntry) ModTime() time.Time {
+	return e.modTime
+}
+
+func (e *TarEntry) ReadCloser() (io.ReadCloser, error) {
+	return nil, ErrWriteOnly
+}
+
+func (e *TarEntry) OpenRange(off, n int64) (io.ReadCloser, error) {
+	return nil, ErrWriteOnly
+}
+
+// TarStorage writes the blobs it stores as the entries of a tar
+// stream, gzip compressed or not, followed by a manifest entry.
+// Entries are written one at a time in the order the blobs come,
+// a blob whose entry name was already written is skipped, the
+// written ones are sent as TarEntry. It can be stored to once, the
+// stream is complete when the store is done, with a manifest marked
+// partial if the store was canceled.
+type TarStorage struct {
+	w      io.Writer
+	closer io.Closer
+	url    *url.URL
+	gzip   bool
+	namer  Namer
+	stored int32
+	jobs   *job.Manager
+	lg     *zerolog.Logger
+}
+
+// NewTarStorage creates the storage writing to w, e.g. stdout or
+// a pipe, name is used in the urls of the written entries. The
+// entries are named by namer.
+func NewTarStorage(w io.Writer, name string, gz bool, namer Namer, lg *zerolog.Logger) (*TarStorage, error) {
+	l := lg.With().Str("archive", name).Logger()
+	jobs, err := job.NewManager(name, job.DefaultMaxJobs, &l)
+	if err != nil {
+		return nil, err
+	}
+	return &TarStorage{
+		w:     w,
+		url:   &url.URL{Scheme: "tar", Path: name},
+		gzip:  gz,
+		namer: namer,
+		jobs:  jobs,
+		lg:    &l,
+	}, nil
+}
+
+// CreateTarStorage creates the storage writing to the file at
+// path, which is created or truncated, a tape or a disk image as
+// well as a regular file. The file is closed when the store is
+// done.
+func CreateTarStorage(path string, gz bool, namer Namer, lg *zerolog.Logger) (*TarStorage, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewTarStorage(f, path, gz, namer, lg)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.closer = f
+	return s, nil
+}
+
+// Jobs returns the job manager the stores of this storage run in.
+func (s *TarStorage) Jobs() *job.Manager {
+	return s.jobs
+}
+
+func (s *TarStorage) Store(blobCh chan blob.Blob) blob.StoreStatus {
+	id := uuid.Must(uuid.NewV4()).String()
+	sts := blob.NewStoreStatus(id)
+	l := s.lg.With().Str("process-id", id).Logger()
+	s.jobs.Run(sts, func() {
+		defer sts.Finish()
+		if !atomic.CompareAndSwapInt32(&s.stored, 0, 1) {
+			drain(fmt.Errorf("%s has been written already", s.url.Path), blobCh, sts, &l)
+			return
+		}
+		if s.closer != nil {
+			defer s.closer.Close()
+		}
+		if err := s.store(blobCh, sts, &l); err != nil {
+			drain(err, blobCh, sts, &l)
+		}
+	})
+	return sts
+}
+
+// store writes the blobs and the manifest, an error leaves the
+// stream unusable.
+func (s *TarStorage) store(blobCh chan blob.Blob, sts *blob.ProcessStatus, lg *zerolog.Logger) error {
+	w := s.w
+	var zw *gzip.Writer
+	if s.gzip {
+		zw = gzip.NewWriter(w)
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+	t := time.Now()
+	man := &Manifest{Kind: manifestKind, Version: manifestVersion, Time: t.UTC(), Entries: make([]*ManifestEntry, 0)}
+	written := make(map[string]bool)
+	worker := "tar"
+	defer sts.RemoveWorker(worker)
+	for b := range blobCh {
+		if !sts.WaitIfPaused() {
+			// keep draining so that the sender doesn't block
+			continue
+		}
+		name := s.namer(b)
+		bl := lg.With().Str("source", b.Url().String()).Str("entry", name).Logger()
+		if written[name] {
+			size, _ := b.Size()
+			sts.AddSkipCount(1)
+			sts.AddSkipSize(size)
+			bl.Info().Msg("skip written")
+			continue
+		}
+		sts.SetWorkerState(worker, name)
+		e, err := writeEntry(tw, name, b, t)
+		if err != nil {
+			sts.AddErrorCount(1)
+			memberCount.With("tar", "error").Inc()
+			if e == nil {
+				// nothing was written, the stream is fine
+				bl.Error().Err(err).Msg("read blob error")
+				continue
+			}
+			return err
+		}
+		written[name] = true
+		man.Entries = append(man.Entries, e)
+		man.Files++
+		man.Size += e.Size
+		sts.AddCount(1)
+		sts.AddSize(e.Size)
+		memberCount.With("tar", "written").Inc()
+		bl.Info().Int64("size", e.Size).Msg("written")
+
+		u := *s.url
+		u.Fragment = name
+		te := &TarEntry{url: &u, name: name, size: e.Size, hash: b.Hash(), mode: entryMode(b), modTime: entryTime(b, t)}
+		select {
+		case sts.Blob() <- te:
+		case <-sts.Canceled():
+		}
+	}
+	sts.SetWorkerState(worker, "")
+
+	// the blobs sent once canceled were drained, not written
+	man.Partial = sts.IsCanceled()
+	data, err := json.MarshalIndent(man, "", "  ")
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: ManifestName, Mode: 0644, Size: int64(len(data)), ModTime: t, Typeflag: tar.TypeReg}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+	lg.Info().
+		Int64("files", man.Files).
+		Int64("size", man.Size).
+		Bool("partial", man.Partial).
+		Int64("duration", time.Now().Sub(t).Nanoseconds()).
+		Msg("tar written")
+	return nil
+}
+
+// writeEntry writes the blob as a tar entry, it returns a nil
+// entry if the error left the stream untouched.
+func writeEntry(tw *tar.Writer, name string, b blob.Blob, t time.Time) (*ManifestEntry, error) {
+	size, err := b.Size()
+	if err != nil {
+		return nil, err
+	}
+	rc, err := b.ReadCloser()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	hdr := &tar.Header{
+		Name:     name,
+		Mode:     int64(entryMode(b).Perm()),
+		Size:     size,
+		ModTime:  entryTime(b, t),
+		Typeflag: tar.TypeReg,
+	}
+	e := &ManifestEntry{Name: name, Hash: b.Hash().String(), Size: size, Url: b.Url().String()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return e, err
+	}
+	n, err := io.Copy(tw, rc)
+	if err == nil && n != size {
+		err = fmt.Errorf("blob has %d bytes, %d expected", n, size)
+	}
+	return e, err
+}
+
+// entryMode returns the mode of the blob if its source records
+// one, archive members do.
+func entryMode(b blob.Blob) os.FileMode {
+	if m, ok := b.(interface{ Mode() os.FileMode }); ok && m.Mode() != 0 {
+		return m.Mode()
+	}
+	return 0644
+}
+
+// entryTime returns the mtime of the blob if its source records
+// one, or t.
+func entryTime(b blob.Blob, t time.Time) time.Time {
+	if m, ok := b.(interface{ ModTime() time.Time }); ok && !m.ModTime().IsZero() {
+		return m.ModTime()
+	}
+	return t
+}
+
+// drain counts the blobs which can't be written as errors.
+func drain(err error, ch chan blob.Blob, sts *blob.ProcessStatus, lg *zerolog.Logger) {
+	lg.Error().Err(err).Msg("store error")
+	for range ch {
+		sts.AddErrorCount(1)
+	}
+}
+
+// LayoutNamer names the entries by the hash of the blobs with the
+// given function, e.g. the path of a store layout.
+func LayoutNamer(path func(h *util.Hash) string) Namer {
+	return func(b blob.Blob) string {
+		return path(b.Hash())
+	}
+}
@@ -0,0 +1,110 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"testing"
+	"time"
+
+	"filemanager/blob"
+)
+
+// readManifest returns the manifest of the tar, with the names of
+// the entries before it.
+func readManifest(t *testing.T, data []byte) (*Manifest, []string) {
+	tr := tar.NewReader(bytes.NewReader(data))
+	names := make([]string, 0)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			t.Fatalf("no manifest after %v", names)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name != ManifestName {
+			names = append(names, hdr.Name)
+			continue
+		}
+		man := &Manifest{}
+		if err := json.NewDecoder(tr).Decode(man); err != nil {
+			t.Fatal(err)
+		}
+		return man, names
+	}
+}
+
+func newTarStorage(t *testing.T, w io.Writer) *TarStorage {
+	s, err := NewTarStorage(w, "test.tar", false, OriginalName, &discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestTarStorage(t *testing.T) {
+	var buf bytes.Buffer
+	s := newTarStorage(t, &buf)
+	ch := make(chan blob.Blob, 3)
+	u := &url.URL{Scheme: "zip", Path: "/src/a.zip"}
+	ch <- newMember(u, "a.txt", []byte("aaa"), 0600, time.Time{})
+	ch <- newMember(u, "b.txt", []byte("b"), 0644, time.Time{})
+	ch <- newMember(u, "a.txt", []byte("aaa"), 0600, time.Time{})
+	close(ch)
+	sts := s.Store(ch)
+	entries := make([]blob.Blob, 0)
+	for b := range sts.Blob() {
+		entries = append(entries, b)
+	}
+	<-sts.Done()
+	if sts.Count() != 2 || sts.SkipCount() != 1 || len(entries) != 2 {
+		t.Fatalf("written %d, skipped %d, %d sent", sts.Count(), sts.SkipCount(), len(entries))
+	}
+	e := entries[0].(*TarEntry)
+	if e.Url().String() != "tar://test.tar#src/a.zip!/a.txt" || e.Mode() != 0600 {
+		t.Fatalf("entry %s with mode %v", e.Url(), e.Mode())
+	}
+	if _, err := e.ReadCloser(); err != ErrWriteOnly {
+		t.Fatalf("read entry: %v", err)
+	}
+	if _, err := blob.OpenRange(e, 0, 1); err != ErrWriteOnly {
+		t.Fatalf("read entry range: %v", err)
+	}
+
+	man, names := readManifest(t, buf.Bytes())
+	if man.Partial || man.Files != 2 || man.Size != 4 || fmt.Sprint(names) != "[src/a.zip!/a.txt src/a.zip!/b.txt]" {
+		t.Fatalf("manifest %+v of %v", man, names)
+	}
+}
+
+func TestTarStorageCancel(t *testing.T) {
+	var buf bytes.Buffer
+	s := newTarStorage(t, &buf)
+	ch := make(chan blob.Blob)
+	sts := s.Store(ch)
+	sent := make(chan struct{})
+	go func() {
+		u := &url.URL{Scheme: "zip", Path: "/src/a.zip"}
+		for i := 0; i < 10; i++ {
+			ch <- newMember(u, fmt.Sprintf("f%d", i), []byte{byte(i)}, 0644, time.Time{})
+		}
+		close(ch)
+		close(sent)
+	}()
+	<-sts.Blob()
+	sts.Cancel()
+	for range sts.Blob() {
+	}
+	<-sts.Done()
+	// the sender isn't blocked
+	<-sent
+
+	man, names := readManifest(t, buf.Bytes())
+	if !man.Partial || int(man.Files) != len(names) || man.Files == 10 {
+		t.Fatalf("manifest %+v of %v", man, names)
+	}
+}
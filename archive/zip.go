@@ -0,0 +1,304 @@
+package archive
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"filemanager/blob"
+
+	"github.com/rs/zerolog"
+)
+
+// ZipSource loads the regular members of a zip archive, ZIP64
+// included, maxLoader of them in parallel. Encrypted members and
+// the ones with an unsupported compression method are skipped. The
+// urls of the members are zip://<archive path>#<member path>.
+type ZipSource struct {
+	source
+	maxLoader int
+}
+
+// NewZipSource creates the source of the zip archive at path.
+func NewZipSource(path string, maxLoader int, lg *zerolog.Logger) (*ZipSource, error) {
+	if maxLoader < 1 || maxLoader > 20 {
+		return nil, fmt.Errorf("maxLoader %d is out of allowed range [1, 20]", maxLoader)
+	}
+	path, err := archivePath(path)
+	if err != nil {
+		return nil, err
+	}
+	src, err := newSource("zip", path, lg)
+	if err != nil {
+		return nil, err
+	}
+	return &ZipSource{source: *src, maxLoader: maxLoader}, nil
+}
+
+func (s *ZipSource) Load() blob.LoadStatus {
+	sts, l := s.newLoad()
+	s.jobs.Run(sts, func() {
+		defer sts.Finish()
+		zr, err := zip.OpenReader(s.path)
+		if err == zip.ErrInsecurePath {
+			// the member paths are checked when loading
+			err = nil
+		}
+		if err != nil {
+			sts.AddErrorCount(1)
+			l.Error().Err(err).Msg("open archive error")
+			return
+		}
+		defer zr.Close()
+		loadZip(&zr.Reader, s.url, s.skip, s.maxLoader, sts, l)
+	})
+	return sts
+}
+
+// IsZip tells if the file at path is a zip archive, by its
+// extension or its signature.
+func IsZip(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".zip", ".jar":
+		return true
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	sig := make([]byte, 4)
+	if _, err := io.ReadFull(f, sig); err != nil {
+		return false
+	}
+	return string(sig) == "PK\x03\x04" || string(sig) == "PK\x05\x06"
+}
+
+// OpenZip reads the directory of the zip archive in the blob, e.g.
+// one of a store. Only the directory is read then, and a member
+// when it is opened, with ranges of the blob.
+func OpenZip(b blob.Blob) (*zip.Reader, error) {
+	size, err := b.Size()
+	if err != nil {
+		return nil, err
+	}
+	zr, err := zip.NewReader(blob.NewReaderAt(b), size)
+	if err == zip.ErrInsecurePath {
+		// the member paths are checked when opened
+		err = nil
+	}
+	return zr, err
+}
+
+// OpenZipMember opens the regular member of the zip archive with
+// the given path, as a ZipSource names it.
+func OpenZipMember(zr *zip.Reader, name string) (io.ReadCloser, error) {
+	for _, f := range zr.File {
+		if !f.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		n, err := memberName(zipName(f))
+		if err != nil || n != name {
+			continue
+		}
+		if f.Flags&0x1 != 0 {
+			return nil, fmt.Errorf("member %s is encrypted", name)
+		}
+		return f.Open()
+	}
+	return nil, fmt.Errorf("member %s not found", name)
+}
+
+// zipMember is a member of a zip archive selected to be loaded.
+type zipMember struct {
+	f    *zip.File
+	name string
+}
+
+// loadZip sends the regular members of the zip archive which are
+// not skipped, loaded by loaderCnt workers. Members with a path out
+// of the archive are errors.
+func loadZip(zr *zip.Reader, base *url.URL, skip skipFunc, loaderCnt int, sts *blob.ProcessStatus, lg *zerolog.Logger) {
+	members := make([]*zipMember, 0, len(zr.File))
+	size := int64(0)
+	for _, f := range zr.File {
+		fi := f.FileInfo()
+		if fi.IsDir() {
+			continue
+		}
+		name, err := memberName(zipName(f))
+		if err != nil {
+			sts.AddErrorCount(1)
+			memberCount.With("zip", "error").Inc()
+			lg.Error().Err(err).Msg("invalid member")
+			continue
+		}
+		reason := ""
+		switch {
+		case f.Flags&0x1 != 0:
+			reason = "encrypted"
+		case !fi.Mode().IsRegular():
+			reason = "not a regular file"
+		case skip(name):
+			reason = "skipped"
+		}
+		if reason != "" {
+			skipMember(name, int64(f.UncompressedSize64), reason, sts, lg)
+			continue
+		}
+		members = append(members, &zipMember{f: f, name: name})
+		size += int64(f.UncompressedSize64)
+	}
+	sts.AddEstimate(len(members), size)
+	sts.FinishEstimate()
+
+	ch := make(chan *zipMember)
+	wg := &sync.WaitGroup{}
+	wg.Add(loaderCnt)
+	for i := 0; i < loaderCnt; i++ {
+		go loadZipMembers(i, ch, base, wg, sts, lg)
+	}
+	for _, m := range members {
+		select {
+		case ch <- m:
+		case <-sts.Canceled():
+		}
+	}
+	close(ch)
+	wg.Wait()
+}
+
+func loadZipMembers(id int, ch chan *zipMember, base *url.URL, wg *sync.WaitGroup, sts *blob.ProcessStatus, lg *zerolog.Logger) {
+	defer wg.Done()
+	worker := fmt.Sprintf("zip-%d", id)
+	defer sts.RemoveWorker(worker)
+	for zm := range ch {
+		if !sts.WaitIfPaused() {
+			continue
+		}
+		sts.SetWorkerState(worker, zm.name)
+		ml := lg.With().Str("member", zm.name).Logger()
+		t := time.Now()
+		rc, err := zm.f.Open()
+		if errors.Is(err, zip.ErrAlgorithm) {
+			reason := fmt.Sprintf("unsupported compression method %d", zm.f.Method)
+			skipMember(zm.name, int64(zm.f.UncompressedSize64), reason, sts, lg)
+			continue
+		}
+		if err != nil {
+			sts.AddErrorCount(1)
+			memberCount.With("zip", "error").Inc()
+			ml.Error().Err(err).Msg("open member error")
+			continue
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			sts.AddErrorCount(1)
+			memberCount.With("zip", "error").Inc()
+			ml.Error().Err(err).Msg("read member error")
+			continue
+		}
+		m := newMember(base, zm.name, data, zm.f.Mode(), zm.f.Modified)
+		sts.AddCount(1)
+		sts.AddSize(m.size)
+		memberCount.With("zip", "loaded").Inc()
+		memberBytes.With("zip").Add(float64(m.size))
+		ml.Info().
+			Str("content-hash", m.hash.String()).
+			Int64("size", m.size).
+			Int64("duration", time.Now().Sub(t).Nanoseconds()).
+			Msg("loaded")
+		select {
+		case sts.Blob() <- m:
+		case <-sts.Canceled():
+		}
+	}
+	sts.SetWorkerState(worker, "")
+}
+
+// skipMember counts the member as skipped and logs why.
+func skipMember(name string, size int64, reason string, sts *blob.ProcessStatus, lg *zerolog.Logger) {
+	sts.AddSkipCount(1)
+	sts.AddSkipSize(size)
+	memberCount.With("zip", "skipped").Inc()
+	lg.Warn().Str("member", name).Str("reason", reason).Msg("skip member")
+}
+
+// unicodePathTag is the id of the Info-ZIP Unicode Path extra
+// field, which holds the UTF-8 name of members whose name is in a
+// legacy encoding.
+const unicodePathTag = 0x7075
+
+// zipName returns the name of the member in UTF-8. Names are UTF-8
+// if the UTF-8 flag is set, else the Info-ZIP Unicode Path field is
+// used if it matches the name. Other names are taken as UTF-8 if
+// they are valid, as many tools write UTF-8 without the flag, and
+// as CP437, the legacy zip encoding, if not.
+func zipName(f *zip.File) string {
+	if f.Flags&0x800 != 0 {
+		return f.Name
+	}
+	if name, ok := unicodePath(f.Extra, f.Name); ok {
+		return name
+	}
+	if utf8.ValidString(f.Name) {
+		return f.Name
+	}
+	return decodeCP437(f.Name)
+}
+
+func unicodePath(extra []byte, raw string) (string, bool) {
+	for len(extra) >= 4 {
+		tag := binary.LittleEndian.Uint16(extra)
+		size := int(binary.LittleEndian.Uint16(extra[2:]))
+		extra = extra[4:]
+		if size > len(extra) {
+			break
+		}
+		data := extra[:size]
+		extra = extra[size:]
+		if tag != unicodePathTag || len(data) < 5 || data[0] != 1 {
+			continue
+		}
+		if binary.LittleEndian.Uint32(data[1:]) != crc32.ChecksumIEEE([]byte(raw)) {
+			// the name was changed by a tool unaware of the field
+			continue
+		}
+		if name := string(data[5:]); utf8.ValidString(name) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// cp437 are the characters of the bytes 0x80 to 0xff in CP437, the
+// lower half is ASCII.
+const cp437 = "ÇüéâäàåçêëèïîìÄÅÉæÆôöòûùÿÖÜ¢£¥₧ƒáíóúñÑªº¿⌐¬½¼¡«»░▒▓│┤╡╢╖╕╣║╗╝╜╛┐" +
+	"└┴┬├─┼╞╟╚╔╩╦╠═╬╧╨╤╥╙╘╒╓╫╪┘┌█▄▌▐▀αßΓπΣσµτΦΘΩδ∞φε∩≡±≥≤⌠⌡÷≈°∙·√ⁿ²■\u00a0"
+
+var cp437High = []rune(cp437)
+
+func decodeCP437(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x80 {
+			b.WriteByte(c)
+		} else {
+			b.WriteRune(cp437High[c-0x80])
+		}
+	}
+	return b.String()
+}
@@ -14,6 +14,16 @@ type Type string
 // supported blob types
 const (
 	TypeFile Type = "file"
+	// a member of an archive file
+	TypeArchive Type = "archive"
+	// a resource downloaded over http(s)
+	TypeHTTP Type = "http"
+	// an object of an S3-compatible store
+	TypeObject Type = "object"
+	// a file uploaded to the api server
+	TypeUpload Type = "upload"
+	// a blob held in memory, e.g. by a memory.Store
+	TypeMemory Type = "memory"
 )
 
 // Blob represents a []byte object with
@@ -42,14 +52,24 @@ type Blob interface {
 	ReadCloser() (io.ReadCloser, error)
 }
 
+// BufferedReadCloser reads a []byte, it is also an io.Seeker and
+// an io.ReaderAt.
 type BufferedReadCloser struct {
-	b *bytes.Buffer
+	b *bytes.Reader
 }
 
 func (b *BufferedReadCloser) Read(p []byte) (n int, err error) {
 	return b.b.Read(p)
 }
 
+func (b *BufferedReadCloser) Seek(offset int64, whence int) (int64, error) {
+	return b.b.Seek(offset, whence)
+}
+
+func (b *BufferedReadCloser) ReadAt(p []byte, off int64) (int, error) {
+	return b.b.ReadAt(p, off)
+}
+
 // Close clears the cached []byte. A BufferedReadCloser
 // MUST NOT be used after Close() is called.
 func (b *BufferedReadCloser) Close() error {
@@ -58,5 +78,5 @@ func (b *BufferedReadCloser) Close() error {
 }
 
 func NewBufferedReadCloser(b []byte) *BufferedReadCloser {
-	return &BufferedReadCloser{bytes.NewBuffer(b)}
+	return &BufferedReadCloser{bytes.NewReader(b)}
 }
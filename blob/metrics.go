@@ -0,0 +1,29 @@
+package blob
+
+import (
+	"filemanager/metrics"
+)
+
+var (
+	blobsMetric = metrics.Default.NewCounterVec(
+		"filemanager_process_blobs_total",
+		"Number of blobs processed.", "type")
+	bytesMetric = metrics.Default.NewCounterVec(
+		"filemanager_process_bytes_total",
+		"Total size of blobs processed, in bytes.", "type")
+	skipBlobsMetric = metrics.Default.NewCounterVec(
+		"filemanager_process_skipped_blobs_total",
+		"Number of blobs skipped.", "type")
+	skipBytesMetric = metrics.Default.NewCounterVec(
+		"filemanager_process_skipped_bytes_total",
+		"Total size of blobs skipped, in bytes.", "type")
+	errorsMetric = metrics.Default.NewCounterVec(
+		"filemanager_process_errors_total",
+		"Number of process errors.", "type")
+	activeMetric = metrics.Default.NewGaugeVec(
+		"filemanager_processes_active",
+		"Number of processes which haven't finished yet.", "type")
+	workersMetric = metrics.Default.NewGaugeVec(
+		"filemanager_workers_in_flight",
+		"Number of workers currently working on a blob.", "type")
+)
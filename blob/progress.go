@@ -0,0 +1,155 @@
+package blob
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultProgressInterval is the interval at which progress
+// snapshots are emitted when none is given.
+const DefaultProgressInterval = time.Second * 5
+
+// progressSmoothing is the weight given to the latest sample
+// when calculating the moving average rates.
+const progressSmoothing = 0.3
+
+// Progress is a point-in-time snapshot of a process.
+type Progress struct {
+	ID             string            `json:"id"`
+	Type           string            `json:"type"`
+	Time           time.Time         `json:"time"`
+	Elapsed        time.Duration     `json:"elapsed"`
+	Count          int64             `json:"count"`
+	Size           int64             `json:"size"`
+	SkipCount      int64             `json:"skip-count"`
+	SkipSize       int64             `json:"skip-size"`
+	ErrorCount     int64             `json:"error-count"`
+	FilesPerSec    float64           `json:"files-per-sec"`
+	BytesPerSec    float64           `json:"bytes-per-sec"`
+	AvgFilesPerSec float64           `json:"avg-files-per-sec"`
+	AvgBytesPerSec float64           `json:"avg-bytes-per-sec"`
+	EstimatedCount int64             `json:"estimated-count"`
+	EstimatedSize  int64             `json:"estimated-size"`
+	EstimateDone   bool              `json:"estimate-done"`
+	Percent        float64           `json:"percent"`
+	ETA            time.Duration     `json:"eta"`
+	Workers        map[string]string `json:"workers,omitempty"`
+	Paused         bool              `json:"paused"`
+	Done           bool              `json:"done"`
+}
+
+// progressTracker keeps the state needed to calculate rates
+// between two snapshots, and the per-worker state.
+type progressTracker struct {
+	sync.Mutex
+	lastTime  time.Time
+	lastCount int64
+	lastSize  int64
+	avgFiles  float64
+	avgBytes  float64
+	sampled   bool
+	workers   map[string]string
+}
+
+func newProgressTracker(start time.Time) *progressTracker {
+	return &progressTracker{
+		lastTime: start,
+		workers:  make(map[string]string),
+	}
+}
+
+// setWorker sets the worker state and returns the previous one.
+func (t *progressTracker) setWorker(name, state string) string {
+	t.Lock()
+	defer t.Unlock()
+	prev := t.workers[name]
+	t.workers[name] = state
+	return prev
+}
+
+// removeWorker removes the worker and returns its last state.
+func (t *progressTracker) removeWorker(name string) string {
+	t.Lock()
+	defer t.Unlock()
+	prev := t.workers[name]
+	delete(t.workers, name)
+	return prev
+}
+
+func (t *progressTracker) copyWorkers() map[string]string {
+	if len(t.workers) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(t.workers))
+	for name := range t.workers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	m := make(map[string]string, len(names))
+	for _, name := range names {
+		m[name] = t.workers[name]
+	}
+	return m
+}
+
+// sample fills the rate and estimate fields of p. The moving
+// averages are only updated when advance is true so that ad hoc
+// snapshots don't skew them.
+func (t *progressTracker) sample(p *Progress, advance bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	elapsed := p.Time.Sub(t.lastTime).Seconds()
+	if elapsed > 0 {
+		p.FilesPerSec = float64(p.Count-t.lastCount) / elapsed
+		p.BytesPerSec = float64(p.Size-t.lastSize) / elapsed
+	}
+	avgFiles, avgBytes := t.avgFiles, t.avgBytes
+	if advance && elapsed > 0 {
+		if t.sampled {
+			avgFiles = progressSmoothing*p.FilesPerSec + (1-progressSmoothing)*avgFiles
+			avgBytes = progressSmoothing*p.BytesPerSec + (1-progressSmoothing)*avgBytes
+		} else {
+			avgFiles, avgBytes = p.FilesPerSec, p.BytesPerSec
+		}
+		t.avgFiles, t.avgBytes = avgFiles, avgBytes
+		t.sampled = true
+		t.lastTime = p.Time
+		t.lastCount = p.Count
+		t.lastSize = p.Size
+	}
+	if !t.sampled {
+		// no interval sampled yet, fall back to the overall rate
+		if secs := p.Elapsed.Seconds(); secs > 0 {
+			avgFiles = float64(p.Count) / secs
+			avgBytes = float64(p.Size) / secs
+		}
+	}
+	p.AvgFilesPerSec = avgFiles
+	p.AvgBytesPerSec = avgBytes
+	p.Workers = t.copyWorkers()
+
+	// percent and eta, based on size when it is known
+	// and on count otherwise
+	done := p.Size + p.SkipSize
+	total := p.EstimatedSize
+	rate := avgBytes
+	if total <= 0 {
+		done = p.Count + p.SkipCount + p.ErrorCount
+		total = p.EstimatedCount
+		rate = avgFiles
+	}
+	switch {
+	case p.Done:
+		p.Percent = 100
+	case total > 0:
+		p.Percent = float64(done) * 100 / float64(total)
+		if p.Percent > 100 {
+			p.Percent = 100
+		}
+		if rate > 0 && total > done {
+			p.ETA = time.Duration(float64(total-done) / rate * float64(time.Second))
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package blob
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// RangeReader is implemented by the blobs whose content can be read
+// from an offset without reading what precedes it.
+type RangeReader interface {
+	// OpenRange returns a reader of the n bytes of the content from
+	// off, or up to the end if n is negative. The range is cut at
+	// the end of the content, an offset past it is an error.
+	OpenRange(off, n int64) (io.ReadCloser, error)
+}
+
+// OpenRange opens a range of the content of the blob, with its
+// OpenRange if it is a RangeReader, else by discarding the first
+// off bytes of its ReadCloser.
+func OpenRange(b Blob, off, n int64) (io.ReadCloser, error) {
+	if off < 0 {
+		return nil, fmt.Errorf("negative offset %d", off)
+	}
+	if rr, ok := b.(RangeReader); ok {
+		return rr.OpenRange(off, n)
+	}
+	rc, err := b.ReadCloser()
+	if err != nil {
+		return nil, err
+	}
+	return SkipRange(rc, off, n)
+}
+
+// SkipRange returns a reader of n bytes of rc from off, or up to
+// the end if n is negative, the first off bytes of rc are read and
+// discarded. rc is closed on error.
+func SkipRange(rc io.ReadCloser, off, n int64) (io.ReadCloser, error) {
+	if off > 0 {
+		if _, err := io.CopyN(ioutil.Discard, rc, off); err != nil {
+			rc.Close()
+			if err == io.EOF {
+				return nil, fmt.Errorf("offset %d is past the end of the content", off)
+			}
+			return nil, err
+		}
+	}
+	return LimitReadCloser(rc, n), nil
+}
+
+// limitReadCloser reads up to n bytes and closes the underlying
+// reader.
+type limitReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// LimitReadCloser returns a reader of the first n bytes of rc, or
+// rc itself if n is negative.
+func LimitReadCloser(rc io.ReadCloser, n int64) io.ReadCloser {
+	if n < 0 {
+		return rc
+	}
+	return &limitReadCloser{io.LimitReader(rc, n), rc}
+}
+
+// OpenFileRange opens a range of the file at path, which is read
+// from off.
+func OpenFileRange(path string, off, n int64) (io.ReadCloser, error) {
+	if off < 0 {
+		return nil, fmt.Errorf("negative offset %d", off)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err == nil && off > fi.Size() {
+		err = fmt.Errorf("offset %d is past the end of %s", off, path)
+	}
+	if err == nil {
+		_, err = f.Seek(off, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return LimitReadCloser(f, n), nil
+}
+
+// OpenBytesRange returns a BufferedReadCloser of a range of data.
+func OpenBytesRange(data []byte, off, n int64) (io.ReadCloser, error) {
+	if off < 0 || off > int64(len(data)) {
+		return nil, fmt.Errorf("offset %d is out of the %d bytes of the content", off, len(data))
+	}
+	end := int64(len(data))
+	if n >= 0 && off+n < end {
+		end = off + n
+	}
+	return NewBufferedReadCloser(data[off:end]), nil
+}
+
+// readAhead is the size of the block a readerAt reads at once for
+// smaller reads.
+const readAhead = 64 * 1024
+
+// readerAt reads the content of a blob at any offset, a read
+// smaller than readAhead opens a range of readAhead bytes which is
+// kept for the next reads, along with whether it ends the content.
+type readerAt struct {
+	sync.Mutex
+	b     Blob
+	off   int64
+	block []byte
+	last  bool
+}
+
+// NewReaderAt returns an io.ReaderAt of the content of the blob,
+// which opens ranges of it, e.g. to read a zip archive of a store
+// without reading it all. io.NewSectionReader of it is an
+// io.Seeker.
+func NewReaderAt(b Blob) io.ReaderAt {
+	return &readerAt{b: b}
+}
+
+func (r *readerAt) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) >= readAhead {
+		return r.read(p, off)
+	}
+	r.Lock()
+	defer r.Unlock()
+	end := r.off + int64(len(r.block))
+	if off < r.off || off > end || (off+int64(len(p)) > end && !r.last) {
+		block := make([]byte, readAhead)
+		n, err := r.read(block, off)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		r.off, r.block, r.last = off, block[:n], err == io.EOF
+	}
+	n := copy(p, r.block[off-r.off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *readerAt) read(p []byte, off int64) (int, error) {
+	rc, err := OpenRange(r.b, off, int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	n, err := io.ReadFull(rc, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,167 @@
+package blob
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"filemanager/util"
+)
+
+// testBlob holds its content in memory, it counts the ranges
+// opened.
+type testBlob struct {
+	data   []byte
+	ranges int
+}
+
+func (b *testBlob) Hash() *util.Hash {
+	return nil
+}
+
+func (b *testBlob) Type() Type {
+	return TypeMemory
+}
+
+func (b *testBlob) Url() *url.URL {
+	return &url.URL{Scheme: "memory", Path: "/test"}
+}
+
+func (b *testBlob) Name() string {
+	return "test"
+}
+
+func (b *testBlob) Size() (int64, error) {
+	return int64(len(b.data)), nil
+}
+
+func (b *testBlob) ReadCloser() (io.ReadCloser, error) {
+	return NewBufferedReadCloser(b.data), nil
+}
+
+func (b *testBlob) OpenRange(off, n int64) (io.ReadCloser, error) {
+	b.ranges++
+	return OpenBytesRange(b.data, off, n)
+}
+
+// sequentialBlob has only the methods of a Blob, its ranges are
+// skipped to.
+type sequentialBlob struct {
+	Blob
+}
+
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7 / 3)
+	}
+	return data
+}
+
+func TestOpenRange(t *testing.T) {
+	data := testData(1000)
+	path := filepath.Join(t.TempDir(), "data")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	opens := map[string]func(off, n int64) (io.ReadCloser, error){
+		"range reader": func(off, n int64) (io.ReadCloser, error) {
+			return OpenRange(&testBlob{data: data}, off, n)
+		},
+		"sequential": func(off, n int64) (io.ReadCloser, error) {
+			return OpenRange(sequentialBlob{&testBlob{data: data}}, off, n)
+		},
+		"file": func(off, n int64) (io.ReadCloser, error) {
+			return OpenFileRange(path, off, n)
+		},
+		"bytes": func(off, n int64) (io.ReadCloser, error) {
+			return OpenBytesRange(data, off, n)
+		},
+	}
+	for name, open := range opens {
+		for _, c := range []struct {
+			off, n int64
+			want   []byte
+			err    bool
+		}{
+			{0, -1, data, false},
+			{0, 0, []byte{}, false},
+			{0, 10, data[:10], false},
+			{999, -1, data[999:], false},
+			{999, 10, data[999:], false},
+			{500, 500, data[500:], false},
+			{500, 501, data[500:], false},
+			{1000, -1, []byte{}, false},
+			{1000, 10, []byte{}, false},
+			{1001, -1, nil, true},
+			{-1, 10, nil, true},
+		} {
+			rc, err := open(c.off, c.n)
+			if c.err {
+				if err == nil {
+					rc.Close()
+					t.Fatalf("%s: range %d+%d opened", name, c.off, c.n)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: range %d+%d: %v", name, c.off, c.n, err)
+			}
+			got, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil || !bytes.Equal(got, c.want) {
+				t.Fatalf("%s: range %d+%d read %d bytes, %d expected: %v", name, c.off, c.n, len(got), len(c.want), err)
+			}
+		}
+	}
+}
+
+func TestReaderAt(t *testing.T) {
+	data := testData(3*readAhead + 100)
+	b := &testBlob{data: data}
+	r := NewReaderAt(b)
+	for _, c := range []struct {
+		off    int64
+		n      int
+		ranges int
+		eof    bool
+	}{
+		// a small read opens a block which the next ones in it use
+		{0, 10, 1, false},
+		{10, 100, 1, false},
+		{readAhead - 10, 10, 1, false},
+		// past the block, or before it, a new block is opened
+		{readAhead - 5, 10, 2, false},
+		{readAhead, 10, 2, false},
+		{5, 10, 3, false},
+		// a large read is read as is, the block is kept
+		{100, readAhead, 4, false},
+		{20, 10, 4, false},
+		// at the end the block is short, and ends the content
+		{int64(len(data)) - 50, 10, 5, false},
+		{int64(len(data)) - 10, 20, 5, true},
+		{int64(len(data)), 10, 5, true},
+	} {
+		p := make([]byte, c.n)
+		n, err := r.ReadAt(p, c.off)
+		if c.eof != (err == io.EOF) || (err != nil && err != io.EOF) {
+			t.Fatalf("read %d at %d: %v", c.n, c.off, err)
+		}
+		end := c.off + int64(c.n)
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		if !bytes.Equal(p[:n], data[c.off:end]) {
+			t.Fatalf("read %d at %d: %d bytes differ", c.n, c.off, n)
+		}
+		if b.ranges != c.ranges {
+			t.Fatalf("read %d at %d: %d ranges opened, %d expected", c.n, c.off, b.ranges, c.ranges)
+		}
+	}
+	if _, err := r.ReadAt(make([]byte, 10), int64(len(data))+1); err == nil || err == io.EOF {
+		t.Fatalf("read past the end: %v", err)
+	}
+}
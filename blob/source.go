@@ -20,4 +20,9 @@ type LoadStatus interface {
 	ErrorCount() int
 	Blob() chan Blob
 	Done() chan struct{}
+	Progress() chan *Progress
+	Cancel()
+	Pause()
+	Resume()
+	JSONStr() string
 }
@@ -2,6 +2,7 @@ package blob
 
 import (
 	"encoding/json"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -26,6 +27,18 @@ type ProcessStatus struct {
 	blobChan   chan Blob
 	doneChan   chan struct{}
 	done       *int32
+	cancelChan chan struct{}
+	canceled   *int32
+	pauseLock  sync.Mutex
+	resumeChan chan struct{}
+
+	// progress reporting
+	estCount     *int64
+	estSize      *int64
+	estDone      *int32
+	tracker      *progressTracker
+	progressChan chan *Progress
+	reporting    *int32
 }
 
 type processType string
@@ -36,10 +49,12 @@ const (
 )
 
 func NewProcessStatus(id string, typ processType) *ProcessStatus {
+	startTime := time.Now().UTC()
+	activeMetric.With(string(typ)).Inc()
 	return &ProcessStatus{
 		id:         id,
 		typ:        typ,
-		startTime:  time.Now().UTC(),
+		startTime:  startTime,
 		finishTime: time.Now().UTC().Add(-time.Second * 60),
 		duration:   -1,
 		count:      new(int64),
@@ -50,6 +65,15 @@ func NewProcessStatus(id string, typ processType) *ProcessStatus {
 		blobChan:   make(chan Blob),
 		doneChan:   make(chan struct{}),
 		done:       new(int32),
+		cancelChan: make(chan struct{}),
+		canceled:   new(int32),
+
+		estCount:     new(int64),
+		estSize:      new(int64),
+		estDone:      new(int32),
+		tracker:      newProgressTracker(startTime),
+		progressChan: make(chan *Progress, 1),
+		reporting:    new(int32),
 	}
 }
 
@@ -79,9 +103,6 @@ func (r *ProcessStatus) StartTime() time.Time {
 // Duration returns the duration from its start time.
 func (r *ProcessStatus) Duration() time.Duration {
 	if atomic.LoadInt32(r.done) == int32(1) {
-		if r.duration < 0 {
-			r.duration = r.finishTime.Sub(r.startTime)
-		}
 		return r.duration
 	}
 	return time.Now().UTC().Sub(r.startTime)
@@ -125,35 +146,220 @@ func (r *ProcessStatus) Done() chan struct{} {
 // AddCount increases the blob count by the given number.
 func (r *ProcessStatus) AddCount(n int) {
 	atomic.AddInt64(r.count, int64(n))
+	blobsMetric.With(string(r.typ)).Add(float64(n))
 }
 
 // AddSize increases the blob size by the given number.
 func (r *ProcessStatus) AddSize(n int64) {
 	atomic.AddInt64(r.size, n)
+	bytesMetric.With(string(r.typ)).Add(float64(n))
 }
 
 // AddSkipCount increases the blob skip count by the given number.
 func (r *ProcessStatus) AddSkipCount(n int) {
 	atomic.AddInt64(r.skipCount, int64(n))
+	skipBlobsMetric.With(string(r.typ)).Add(float64(n))
 }
 
 // AddSkipSize increases the blob skip size by the given number.
 func (r *ProcessStatus) AddSkipSize(n int64) {
 	atomic.AddInt64(r.skipSize, n)
+	skipBytesMetric.With(string(r.typ)).Add(float64(n))
 }
 
 // AddErrorCount increases the error count by the given number.
 func (r *ProcessStatus) AddErrorCount(n int) {
 	atomic.AddInt64(r.errorCount, int64(n))
+	errorsMetric.With(string(r.typ)).Add(float64(n))
+}
+
+// Cancel asks the process to stop, it is up to the process to
+// stop its workers and call Finish.
+func (r *ProcessStatus) Cancel() {
+	if atomic.CompareAndSwapInt32(r.canceled, 0, 1) {
+		close(r.cancelChan)
+	}
+}
+
+// Canceled returns a channel which is closed when the process
+// is asked to stop.
+func (r *ProcessStatus) Canceled() chan struct{} {
+	return r.cancelChan
+}
+
+// IsCanceled returns true if the process is asked to stop.
+func (r *ProcessStatus) IsCanceled() bool {
+	return atomic.LoadInt32(r.canceled) == int32(1)
+}
+
+// Pause asks the workers of the process to stop picking up new
+// blobs until Resume is called. Blobs already being processed
+// are finished.
+func (r *ProcessStatus) Pause() {
+	r.pauseLock.Lock()
+	if r.resumeChan == nil {
+		r.resumeChan = make(chan struct{})
+	}
+	r.pauseLock.Unlock()
+}
+
+// Resume lets the workers of a paused process continue.
+func (r *ProcessStatus) Resume() {
+	r.pauseLock.Lock()
+	if r.resumeChan != nil {
+		close(r.resumeChan)
+		r.resumeChan = nil
+	}
+	r.pauseLock.Unlock()
+}
+
+// IsPaused returns true if the process is paused.
+func (r *ProcessStatus) IsPaused() bool {
+	r.pauseLock.Lock()
+	defer r.pauseLock.Unlock()
+	return r.resumeChan != nil
+}
+
+// WaitIfPaused blocks while the process is paused. It returns
+// false if the process is canceled, true otherwise.
+func (r *ProcessStatus) WaitIfPaused() bool {
+	r.pauseLock.Lock()
+	ch := r.resumeChan
+	r.pauseLock.Unlock()
+	if ch != nil {
+		select {
+		case <-ch:
+		case <-r.cancelChan:
+		}
+	}
+	return !r.IsCanceled()
+}
+
+// AddEstimate increases the estimated total blob count and
+// size by the given numbers.
+func (r *ProcessStatus) AddEstimate(n int, size int64) {
+	atomic.AddInt64(r.estCount, int64(n))
+	atomic.AddInt64(r.estSize, size)
+}
+
+// FinishEstimate marks the estimated totals as complete.
+func (r *ProcessStatus) FinishEstimate() {
+	atomic.StoreInt32(r.estDone, int32(1))
+}
+
+// SetWorkerState records what the named worker is currently
+// working on, an empty state means the worker is idle.
+func (r *ProcessStatus) SetWorkerState(worker, state string) {
+	prev := r.tracker.setWorker(worker, state)
+	if prev == "" && state != "" {
+		workersMetric.With(string(r.typ)).Inc()
+	} else if prev != "" && state == "" {
+		workersMetric.With(string(r.typ)).Dec()
+	}
+}
+
+// RemoveWorker drops the named worker from the worker states.
+func (r *ProcessStatus) RemoveWorker(worker string) {
+	if r.tracker.removeWorker(worker) != "" {
+		workersMetric.With(string(r.typ)).Dec()
+	}
+}
+
+// Progress returns a channel from which progress snapshots
+// can be read once ReportProgress is called. The channel is
+// closed after the final snapshot when the process finishes.
+// Snapshots are dropped if the channel is not drained in time.
+func (r *ProcessStatus) Progress() chan *Progress {
+	return r.progressChan
+}
+
+// ReportProgress starts emitting progress snapshots at the
+// given interval until the process finishes. It does nothing
+// if the reporting has already been started.
+func (r *ProcessStatus) ReportProgress(interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultProgressInterval
+	}
+	if !atomic.CompareAndSwapInt32(r.reporting, 0, 1) {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.sendProgress(r.snapshot(true))
+			case <-r.doneChan:
+				r.sendProgress(r.snapshot(true))
+				close(r.progressChan)
+				return
+			}
+		}
+	}()
+}
+
+// sendProgress replaces any unread snapshot with p so that a
+// slow reader always gets the latest one.
+func (r *ProcessStatus) sendProgress(p *Progress) {
+	for {
+		select {
+		case r.progressChan <- p:
+			return
+		default:
+		}
+		select {
+		case <-r.progressChan:
+		default:
+		}
+	}
+}
+
+// Snapshot returns the current progress of the process.
+func (r *ProcessStatus) Snapshot() *Progress {
+	return r.snapshot(false)
+}
+
+func (r *ProcessStatus) snapshot(advance bool) *Progress {
+	done := atomic.LoadInt32(r.done) == int32(1)
+	now := time.Now().UTC()
+	if done {
+		now = r.finishTime
+	}
+	p := &Progress{
+		ID:             r.id,
+		Type:           r.Type(),
+		Time:           now,
+		Elapsed:        r.Duration(),
+		Count:          atomic.LoadInt64(r.count),
+		Size:           atomic.LoadInt64(r.size),
+		SkipCount:      atomic.LoadInt64(r.skipCount),
+		SkipSize:       atomic.LoadInt64(r.skipSize),
+		ErrorCount:     atomic.LoadInt64(r.errorCount),
+		EstimatedCount: atomic.LoadInt64(r.estCount),
+		EstimatedSize:  atomic.LoadInt64(r.estSize),
+		EstimateDone:   atomic.LoadInt32(r.estDone) == int32(1),
+		Paused:         r.IsPaused(),
+		Done:           done,
+	}
+	r.tracker.sample(p, advance)
+	return p
 }
 
 // Finish sets the finish time, closes the blob channel, the
 // error channel and the done channel.
 func (r *ProcessStatus) Finish() {
 	r.finishTime = time.Now().UTC()
+	r.duration = r.finishTime.Sub(r.startTime)
 	atomic.StoreInt32(r.done, int32(1))
+	activeMetric.With(string(r.typ)).Dec()
 	close(r.blobChan)
 	close(r.doneChan)
+	if atomic.CompareAndSwapInt32(r.reporting, 0, 2) {
+		// nobody reports progress, close the channel
+		// so readers don't block forever
+		close(r.progressChan)
+	}
 }
 
 // JSONStr returns json encoded string of the stats data
@@ -177,6 +383,9 @@ func (r *ProcessStatus) JSONStr() string {
 		SkipSize   int64         `json:"skip-size"`
 		ErrorCount int64         `json:"error-count"`
 		Done       bool          `json:"done"`
+		Canceled   bool          `json:"canceled"`
+		Paused     bool          `json:"paused"`
+		Progress   *Progress     `json:"progress"`
 	}{
 		ID:         r.id,
 		Type:       r.Type(),
@@ -189,6 +398,9 @@ func (r *ProcessStatus) JSONStr() string {
 		SkipSize:   atomic.LoadInt64(r.skipSize),
 		ErrorCount: atomic.LoadInt64(r.errorCount),
 		Done:       done,
+		Canceled:   r.IsCanceled(),
+		Paused:     r.IsPaused(),
+		Progress:   r.Snapshot(),
 	}
 	data, err := json.Marshal(stats)
 	if err != nil {
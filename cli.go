@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"filemanager/archive"
+	"filemanager/blob"
+	"filemanager/config"
+	fs "filemanager/filesystem"
+	"filemanager/logging"
+	"filemanager/metrics"
+	"filemanager/s3"
+	"filemanager/web"
+
+	"github.com/rs/zerolog"
+)
+
+// options are the flags shared by all commands.
+type options struct {
+	maxLoader  int
+	maxSaver   int
+	logLevel   string
+	format     string
+	store      string
+	progress   time.Duration
+	configPath string
+	keyFile    string
+	addressing string
+	expand     bool
+	// metricsAddr is where the long-running commands serve their
+	// metrics, set by the commands which register the flag
+	metricsAddr string
+	// urlState keeps the validators of downloaded urls for the
+	// next runs, set by the commands which store what they load
+	urlState bool
+
+	// the loaded config and the names of the flags given on the
+	// command line, which take precedence over the config
+	cfg *config.Config
+	set map[string]bool
+}
+
+// closeLogging closes the log file of the running command, if
+// any, main calls it once the command is done.
+var closeLogging = func() error { return nil }
+
+// newFlagSet creates the flag set of the given command with the
+// common flags registered, the store flag is only registered
+// for the commands working on a store.
+func newFlagSet(name string, opts *options, withStore bool) *flag.FlagSet {
+	cmd := commands[name]
+	f := flag.NewFlagSet(name, flag.ContinueOnError)
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: filemanager %s\n\n%s\n\nflags:\n", cmd.usage, cmd.desc)
+		f.PrintDefaults()
+	}
+	f.StringVar(&opts.configPath, "config", os.Getenv(config.EnvConfig), "config file (default $"+config.EnvConfig+")")
+	f.IntVar(&opts.maxLoader, "max-loader", config.DefaultWorkers, "number of concurrent loaders [1, 20]")
+	f.IntVar(&opts.maxSaver, "max-saver", config.DefaultWorkers, "number of concurrent savers [1, 20]")
+	f.StringVar(&opts.logLevel, "log-level", "warn", "log level (debug, info, warn, error), overrides the config")
+	f.StringVar(&opts.format, "format", "text", "output format (text, json)")
+	f.DurationVar(&opts.progress, "progress", 0, "print progress to stderr at this interval, 0 disables it")
+	f.StringVar(&opts.keyFile, "key-file", "", "master key file of an encrypted store, overrides the config")
+	if withStore {
+		f.StringVar(&opts.store, "store", ".", "store root directory, or the name of a store in the config")
+	}
+	return f
+}
+
+// parse parses the args and sets up logging, it returns the
+// positional args, or false and the exit code if the command
+// should not run. A negative nargs accepts any number of args.
+func (o *options) parse(f *flag.FlagSet, args []string, nargs int) ([]string, bool, int) {
+	if err := f.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil, false, exitOK
+		}
+		return nil, false, exitUsage
+	}
+	o.set = make(map[string]bool)
+	f.Visit(func(fl *flag.Flag) {
+		o.set[fl.Name] = true
+	})
+	if nargs >= 0 && f.NArg() != nargs {
+		fmt.Fprintf(os.Stderr, "expected %d argument(s), got %d\n", nargs, f.NArg())
+		f.Usage()
+		return nil, false, exitUsage
+	}
+	if o.format != "text" && o.format != "json" {
+		fmt.Fprintf(os.Stderr, "invalid format %q, expected text or json\n", o.format)
+		return nil, false, exitUsage
+	}
+	if err := o.loadConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return nil, false, exitUsage
+	}
+	closeLog, err := o.cfg.SetupLogging()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return nil, false, exitFailure
+	}
+	closeLogging = closeLog
+	if o.metricsAddr != "" {
+		if _, err := metrics.Serve(o.metricsAddr, o.logger()); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return nil, false, exitFailure
+		}
+	}
+	return f.Args(), true, exitOK
+}
+
+// loadConfig loads the config file if one is given, otherwise
+// the defaults with the environment overrides. The log level
+// flag overrides the config, and is the default without one.
+func (o *options) loadConfig() error {
+	var err error
+	if o.configPath != "" {
+		o.cfg, err = config.LoadConfig(o.configPath)
+		if err != nil {
+			return err
+		}
+	} else {
+		o.cfg = config.Default()
+		o.cfg.Logging.Level = o.logLevel
+		if err := o.cfg.ApplyEnv(os.Environ()); err != nil {
+			return err
+		}
+	}
+	if o.set["log-level"] {
+		o.cfg.Logging.Level = o.logLevel
+	}
+	return o.cfg.Validate()
+}
+
+func (o *options) logger() *zerolog.Logger {
+	return logging.GetLogger()
+}
+
+// openSource opens the source with the given config name, or
+// at the given path, which must exist.
+func (o *options) openSource(arg string) (*fs.FileSystem, error) {
+	path := arg
+	maxLoader := o.maxLoader
+	src, ok := o.cfg.Source(arg)
+	if ok {
+		path = src.Path
+		if src.MaxLoader != 0 && !o.set["max-loader"] {
+			maxLoader = src.MaxLoader
+		}
+	}
+	if err := checkDir(path); err != nil {
+		return nil, err
+	}
+	source, err := fs.New(path, o.maxSaver, maxLoader, o.logger())
+	if err != nil {
+		return nil, err
+	}
+	skip := o.cfg.SkipFor(src)
+	if err := source.SetSkip(skip.DotFiles == nil || *skip.DotFiles, skip.Patterns); err != nil {
+		return nil, err
+	}
+	var limits *archive.Limits
+	if ok && src.Expand != nil {
+		limits = src.Expand.Limits()
+	}
+	if o.set["expand"] {
+		if !o.expand {
+			limits = nil
+		} else if limits == nil {
+			limits = archive.NewLimits()
+		}
+	}
+	if err := source.SetExpansion(limits); err != nil {
+		return nil, err
+	}
+	return o.apply(source)
+}
+
+// openBlobSource opens the source like openSource, or the archive
+// if arg is a file, whose members are loaded then. An http(s) url
+// is downloaded, as are the urls listed in the file of an @<file>
+// arg, whose validators are kept in <file>.state for the next runs
+// if urlState is set.
+func (o *options) openBlobSource(arg string) (blob.BlobSource, error) {
+	if strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://") {
+		return o.cfg.OpenURLs([]string{arg}, o.maxLoader, "", o.logger())
+	}
+	if strings.HasPrefix(arg, "@") {
+		urls, err := web.ReadURLList(arg[1:])
+		if err != nil {
+			return nil, err
+		}
+		state := ""
+		if o.urlState {
+			state = arg[1:] + ".state"
+		}
+		return o.cfg.OpenURLs(urls, o.maxLoader, state, o.logger())
+	}
+	if _, ok := o.cfg.Source(arg); !ok {
+		if fi, err := os.Stat(arg); err == nil && fi.Mode().IsRegular() {
+			return o.cfg.OpenArchive(arg, o.maxLoader, o.logger())
+		}
+	}
+	return o.openSource(arg)
+}
+
+// storedBlobs returns the blobs ss sends once stored, through the
+// url source, if src is one, so that it records the validators of
+// the stored downloads.
+func storedBlobs(src blob.BlobSource, ss blob.StoreStatus) chan blob.Blob {
+	if us, ok := src.(*web.URLSource); ok {
+		return us.Stored(ss.Blob())
+	}
+	return ss.Blob()
+}
+
+// openS3Store opens the store with the given config name if it is
+// on S3-compatible object storage, or returns nil.
+func (o *options) openS3Store(arg string) (*s3.Store, error) {
+	st, ok := o.cfg.Store(arg)
+	if !ok || !st.IsS3() {
+		return nil, nil
+	}
+	maxSaver := o.maxSaver
+	if st.MaxSaver != 0 && !o.set["max-saver"] {
+		maxSaver = st.MaxSaver
+	}
+	return o.cfg.OpenS3Store(arg, maxSaver, o.logger())
+}
+
+// openStore opens the store with the given config name, or at
+// the given path, which must exist unless create is true.
+func (o *options) openStore(arg string, create bool) (*fs.FileSystem, error) {
+	path := arg
+	maxSaver := o.maxSaver
+	st, ok := o.cfg.Store(arg)
+	if ok && st.IsS3() {
+		return nil, fmt.Errorf("store %q is an s3 store, which only import, get, ls and rm support", arg)
+	}
+	if ok {
+		path = st.Path
+		if st.MaxSaver != 0 && !o.set["max-saver"] {
+			maxSaver = st.MaxSaver
+		}
+	}
+	if !create {
+		if err := checkDir(path); err != nil {
+			return nil, err
+		}
+	}
+	store, err := fs.New(path, maxSaver, o.maxLoader, o.logger())
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if err := o.cfg.ApplyStore(st, store); err != nil {
+			return nil, err
+		}
+	}
+	if o.keyFile != "" {
+		key, err := fs.LoadMasterKey(o.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		if err := store.SetEncryption(key, fs.Addressing(o.addressing)); err != nil {
+			return nil, err
+		}
+	}
+	return o.apply(store)
+}
+
+func (o *options) apply(f *fs.FileSystem) (*fs.FileSystem, error) {
+	f, err := o.cfg.Apply(f)
+	if err != nil {
+		return nil, err
+	}
+	if o.set["progress"] {
+		f.SetProgressInterval(o.progress)
+	}
+	return f, nil
+}
+
+func checkDir(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	return nil
+}
+
+// printer writes command output either as text lines or as
+// json objects, one per line.
+type printer struct {
+	w    io.Writer
+	json bool
+}
+
+func (o *options) printer() *printer {
+	return &printer{w: os.Stdout, json: o.format == "json"}
+}
+
+// print writes v as json, or the text line otherwise.
+func (p *printer) print(v interface{}, format string, args ...interface{}) {
+	if p.json {
+		data, err := json.Marshal(v)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "json encode error: %v\n", err)
+			return
+		}
+		p.w.Write(append(data, '\n'))
+		return
+	}
+	if !strings.HasSuffix(format, "\n") {
+		format += "\n"
+	}
+	fmt.Fprintf(p.w, format, args...)
+}
+
+// printStatus writes the final status of a load/store process.
+func (p *printer) printStatus(sts blob.LoadStatus) {
+	if p.json {
+		fmt.Fprintln(p.w, sts.JSONStr())
+		return
+	}
+	fmt.Fprintf(p.w, "%s: %d blobs, %s", statusType(sts), sts.Count(), formatSize(sts.Size()))
+	if ss, ok := sts.(blob.StoreStatus); ok && ss.SkipCount() > 0 {
+		fmt.Fprintf(p.w, ", %d skipped (%s)", ss.SkipCount(), formatSize(ss.SkipSize()))
+	}
+	fmt.Fprintf(p.w, ", %d errors in %s\n", sts.ErrorCount(), sts.Duration().Round(time.Millisecond))
+}
+
+func statusType(sts blob.LoadStatus) string {
+	if t, ok := sts.(interface{ Type() string }); ok {
+		return t.Type()
+	}
+	return "process"
+}
+
+// printProgress writes the progress snapshots of the process
+// to stderr until the process finishes.
+func printProgress(sts blob.LoadStatus) {
+	for p := range sts.Progress() {
+		done := ""
+		if p.EstimatedCount > 0 {
+			done = fmt.Sprintf(", %.1f%%", p.Percent)
+		}
+		if p.ETA > 0 {
+			done += fmt.Sprintf(", eta %s", p.ETA.Round(time.Second))
+		}
+		fmt.Fprintf(os.Stderr, "[%s] %d blobs, %s, %.1f files/s, %s/s%s\n",
+			p.Type, p.Count, formatSize(p.Size), p.AvgFilesPerSec,
+			formatSize(int64(p.AvgBytesPerSec)), done)
+	}
+}
+
+// formatSize formats the size in bytes with a binary unit.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// fatal prints the error and returns exitFailure.
+func fatal(err error) int {
+	fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	return exitFailure
+}
+
+// exitCode returns exitErrors if any of the processes had errors.
+func exitCode(errorCounts ...int) int {
+	for _, n := range errorCounts {
+		if n > 0 {
+			return exitErrors
+		}
+	}
+	return exitOK
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"filemanager/archive"
+	fs "filemanager/filesystem"
+)
+
+func runExport(args []string) int {
+	opts := &options{urlState: true}
+	f := newFlagSet("export", opts, false)
+	gz := f.Bool("gzip", false, "gzip compress the tar (default true if target ends with .tgz or .tar.gz)")
+	names := f.String("names", "layout", "name the entries by the store layout of their hash (layout) or by their source path (original)")
+	layout := f.String("layout", fs.DefaultLayout.String(), "store layout of the entries named by hash, e.g. 2x3 or flat")
+	f.BoolVar(&opts.expand, "expand", false, "descend into the zip, tar and gzip files of a directory src, with the default limits unless the config sets them")
+	f.StringVar(&opts.metricsAddr, "metrics-addr", "", "serve the metrics at /metrics on this address while the command runs, e.g. 127.0.0.1:9100")
+	args, ok, code := opts.parse(f, args, 2)
+	if !ok {
+		return code
+	}
+	var namer archive.Namer
+	switch *names {
+	case "layout":
+		l, err := fs.ParseLayout(*layout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return exitUsage
+		}
+		namer = archive.LayoutNamer(l.Name)
+	case "original":
+		namer = archive.OriginalName
+	default:
+		fmt.Fprintf(os.Stderr, "invalid names %q, expected layout or original\n", *names)
+		return exitUsage
+	}
+	target := args[1]
+	if !opts.set["gzip"] {
+		*gz = strings.HasSuffix(target, ".tgz") || strings.HasSuffix(target, ".tar.gz")
+	}
+
+	src, err := opts.openBlobSource(args[0])
+	if err != nil {
+		return fatal(err)
+	}
+	p := opts.printer()
+	var dst *archive.TarStorage
+	if target == "-" {
+		// the tar goes to stdout, the status to stderr
+		dst, err = archive.NewTarStorage(os.Stdout, "stdout", *gz, namer, opts.logger())
+		p.w = os.Stderr
+	} else {
+		dst, err = archive.CreateTarStorage(target, *gz, namer, opts.logger())
+	}
+	if err != nil {
+		return fatal(err)
+	}
+
+	ls := src.Load()
+	ss := dst.Store(ls.Blob())
+	if opts.progress > 0 {
+		go printProgress(ls)
+		go printProgress(ss)
+	}
+	for range storedBlobs(src, ss) {
+	}
+	<-ls.Done()
+
+	p.printStatus(ls)
+	p.printStatus(ss)
+	return exitCode(ls.ErrorCount(), ss.ErrorCount())
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+
+	"filemanager/archive"
+	"filemanager/blob"
+	"filemanager/config"
+	fs "filemanager/filesystem"
+	"filemanager/job"
+	"filemanager/meta"
+	"filemanager/s3"
+)
+
+func runImport(args []string) int {
+	opts := &options{urlState: true}
+	f := newFlagSet("import", opts, false)
+	id := f.String("id", "", "job id, an interrupted import run again with the same id resumes where it stopped")
+	ckDir := f.String("checkpoint-dir", "", "directory of the job checkpoints (default jobs.checkpoint-dir or <store>/.checkpoints)")
+	compress := f.String("compress", "", "compress the stored blobs with this codec (gzip, flate, none), overrides the config")
+	chunking := f.Bool("chunking", false, "split large blobs into content-defined chunks with the default sizes, overrides the config")
+	pack := f.Bool("pack", false, "append small blobs to pack files with the default sizes, overrides the config")
+	snapshot := f.Bool("snapshot", false, "record a snapshot of the src tree in the store and print its hash")
+	f.BoolVar(&opts.expand, "expand", false, "descend into the zip, tar and gzip files of a directory src, with the default limits unless the config sets them")
+	f.StringVar(&opts.addressing, "addressing", "", "how a new store encrypted with -key-file names its blobs (plain, hmac)")
+	f.StringVar(&opts.metricsAddr, "metrics-addr", "", "serve the metrics at /metrics on this address while the command runs, e.g. 127.0.0.1:9100")
+	args, ok, code := opts.parse(f, args, 2)
+	if !ok {
+		return code
+	}
+	if *snapshot && *id != "" {
+		// a resumed load skips the stored files, which would be
+		// missing from the snapshot
+		fmt.Fprintf(os.Stderr, "-snapshot can't be used with -id\n")
+		return exitUsage
+	}
+
+	src, err := opts.openBlobSource(args[0])
+	if err != nil {
+		return fatal(err)
+	}
+	srcDir, isDir := src.(*fs.FileSystem)
+	if !isDir && (*id != "" || *snapshot) {
+		fmt.Fprintf(os.Stderr, "-id and -snapshot need a directory source\n")
+		return exitUsage
+	}
+	s3dst, err := opts.openS3Store(args[1])
+	if err != nil {
+		return fatal(err)
+	}
+	if s3dst != nil {
+		if *id != "" || *snapshot || *compress != "" || *chunking || *pack {
+			fmt.Fprintf(os.Stderr, "-id, -snapshot, -compress, -chunking and -pack are not supported by s3 stores\n")
+			return exitUsage
+		}
+		return importS3(opts, src, s3dst)
+	}
+	dst, err := opts.openStore(args[1], true)
+	if err != nil {
+		return fatal(err)
+	}
+	if *compress != "" {
+		comp, err := (&config.CompressionConfig{Codec: *compress}).Compression()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return exitUsage
+		}
+		dst.SetCompression(comp)
+	}
+	if *chunking {
+		dst.SetChunking(fs.NewChunking())
+	}
+	if *pack {
+		dst.SetPacking(fs.NewPacking())
+	}
+
+	var ls blob.LoadStatus
+	var ss blob.StoreStatus
+	var sl *fs.SnapshotLoad
+	var cp *job.Checkpoint
+	if *id != "" {
+		dir := *ckDir
+		if dir == "" {
+			dir = opts.cfg.Jobs.CheckpointDir
+		}
+		if dir == "" {
+			dir = filepath.Join(dst.Root(), ".checkpoints")
+		}
+		cp, err = job.OpenCheckpoint(dir, *id)
+		if err != nil {
+			return fatal(err)
+		}
+		defer cp.Close()
+		if n := cp.Count(); n > 0 {
+			fmt.Fprintf(os.Stderr, "resuming job %s, %d blobs already stored\n", *id, n)
+		}
+		ls = srcDir.LoadCheckpoint(cp)
+	} else if *snapshot {
+		sl = srcDir.LoadSnapshot()
+		ls = sl.LoadStatus
+	} else {
+		ls = src.Load()
+	}
+	// the members of the expanded archives are linked to their
+	// archive in the metadata index of the store
+	parents := &parentRecorder{path: filepath.Join(dst.Root(), indexName)}
+	blobCh := parents.record(ls.Blob())
+	if cp != nil {
+		ss = dst.StoreCheckpoint(cp, blobCh)
+	} else {
+		ss = dst.Store(blobCh)
+	}
+	if opts.progress > 0 {
+		go printProgress(ls)
+		go printProgress(ss)
+	}
+
+	// stop cleanly on interrupt so that the checkpoint is synced
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+	interrupted := new(int32)
+	go func() {
+		if _, ok := <-sigCh; ok {
+			atomic.StoreInt32(interrupted, 1)
+			fmt.Fprintf(os.Stderr, "interrupted, stopping ...\n")
+			ls.Cancel()
+			ss.Cancel()
+		}
+	}()
+
+	for range storedBlobs(src, ss) {
+	}
+	<-ls.Done()
+
+	p := opts.printer()
+	p.printStatus(ls)
+	p.printStatus(ss)
+
+	if atomic.LoadInt32(interrupted) == 1 {
+		return exitErrors
+	}
+	code = exitCode(ls.ErrorCount(), ss.ErrorCount(), parents.errors)
+	if sl != nil {
+		if code := recordSnapshot(sl, dst, ss.ErrorCount(), p); code != exitOK {
+			return code
+		}
+	}
+	if cp != nil && code == exitOK {
+		if err := cp.Remove(); err != nil {
+			fmt.Fprintf(os.Stderr, "remove checkpoint error: %v\n", err)
+		}
+	}
+	return code
+}
+
+// parentRecorder records the parent archive of the expanded
+// members in the metadata index at path, which is only opened once
+// a member shows up.
+type parentRecorder struct {
+	path   string
+	idx    *meta.Index
+	errors int
+}
+
+// record relays the blobs of in to the returned channel, recording
+// the parents of the members on the way.
+func (r *parentRecorder) record(in chan blob.Blob) chan blob.Blob {
+	out := make(chan blob.Blob)
+	go func() {
+		defer close(out)
+		for b := range in {
+			if bm := archive.ParentMeta(b); bm != nil {
+				r.put(bm)
+			}
+			out <- b
+		}
+	}()
+	return out
+}
+
+func (r *parentRecorder) put(bm *meta.BlobMeta) {
+	var err error
+	if r.idx == nil {
+		r.idx, err = meta.OpenIndex(r.path)
+	}
+	if err == nil {
+		err = r.idx.Put(bm)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "index %s: %v\n", bm.ID(), err)
+		r.errors++
+	}
+}
+
+// importS3 stores the blobs of src in the s3 store.
+func importS3(opts *options, src blob.BlobSource, dst *s3.Store) int {
+	ls := src.Load()
+	ss := dst.Store(ls.Blob())
+	if opts.progress > 0 {
+		go printProgress(ls)
+		go printProgress(ss)
+	}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+	interrupted := new(int32)
+	go func() {
+		if _, ok := <-sigCh; ok {
+			atomic.StoreInt32(interrupted, 1)
+			fmt.Fprintf(os.Stderr, "interrupted, stopping ...\n")
+			ls.Cancel()
+			ss.Cancel()
+		}
+	}()
+	for range storedBlobs(src, ss) {
+	}
+	<-ls.Done()
+
+	p := opts.printer()
+	p.printStatus(ls)
+	p.printStatus(ss)
+	if atomic.LoadInt32(interrupted) == 1 {
+		return exitErrors
+	}
+	return exitCode(ls.ErrorCount(), ss.ErrorCount())
+}
+
+// recordSnapshot adds the snapshot of the load to the log of the
+// store and prints its hash. A snapshot with load errors is still
+// recorded, its manifest counts them, but not if blobs failed to
+// be stored.
+func recordSnapshot(sl *fs.SnapshotLoad, dst *fs.FileSystem, storeErrors int, p *printer) int {
+	snap, h := sl.Snapshot()
+	if snap == nil {
+		return fatal(fmt.Errorf("no snapshot was recorded"))
+	}
+	if storeErrors > 0 {
+		return fatal(fmt.Errorf("snapshot %s not recorded, %d blobs failed to be stored", h.String(), storeErrors))
+	}
+	if err := dst.AddSnapshot(h, snap); err != nil {
+		return fatal(err)
+	}
+	p.print(struct {
+		Snapshot string `json:"snapshot"`
+		Files    int64  `json:"files"`
+		Size     int64  `json:"size"`
+		Errors   int64  `json:"errors"`
+	}{h.String(), snap.Files, snap.Size, snap.Errors},
+		"snapshot %s: %d files (%s), %d errors", h.String(), snap.Files, formatSize(snap.Size), snap.Errors)
+	return exitOK
+}
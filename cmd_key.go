@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	fs "filemanager/filesystem"
+)
+
+func runKey(args []string) int {
+	opts := &options{}
+	f := newFlagSet("key", opts, true)
+	args, ok, code := opts.parse(f, args, -1)
+	if !ok {
+		return code
+	}
+	if len(args) == 0 {
+		f.Usage()
+		return exitUsage
+	}
+	switch {
+	case args[0] == "gen" && len(args) == 2:
+		if err := fs.GenerateMasterKey(args[1]); err != nil {
+			return fatal(err)
+		}
+		fmt.Fprintf(os.Stderr, "master key written to %s, keep a copy, the store can't be read without it\n", args[1])
+		return exitOK
+	case args[0] == "info" && len(args) == 1:
+		return keyInfo(opts)
+	case args[0] == "rotate" && len(args) == 2:
+		return keyRotate(opts, args[1])
+	}
+	f.Usage()
+	return exitUsage
+}
+
+func keyInfo(opts *options) int {
+	store, err := opts.openStore(opts.store, false)
+	if err != nil {
+		return fatal(err)
+	}
+	kr, err := store.Keyring()
+	if err != nil {
+		return fatal(err)
+	}
+	if kr == nil {
+		return fatal(fmt.Errorf("the store is not encrypted"))
+	}
+	opts.printer().print(struct {
+		Addressing fs.Addressing `json:"addressing"`
+		ChunkSize  int           `json:"chunk-size"`
+		Master     string        `json:"master"`
+	}{kr.Addressing, kr.ChunkSize, kr.Master},
+		"addressing: %s\nchunk size: %s\nmaster key: %s",
+		kr.Addressing, formatSize(int64(kr.ChunkSize)), kr.Master)
+	return exitOK
+}
+
+// keyRotate rewraps the store key with the new master key, the
+// current one is given with -key-file or by the config.
+func keyRotate(opts *options, newKeyFile string) int {
+	newKey, err := fs.LoadMasterKey(newKeyFile)
+	if err != nil {
+		return fatal(err)
+	}
+	keyFile := opts.keyFile
+	if st, ok := opts.cfg.Store(opts.store); ok && keyFile == "" && st.Encryption != nil {
+		keyFile = st.Encryption.KeyFile
+	}
+	if keyFile == "" {
+		fmt.Fprintf(os.Stderr, "the current master key is required, use -key-file\n")
+		return exitUsage
+	}
+	oldKey, err := fs.LoadMasterKey(keyFile)
+	if err != nil {
+		return fatal(err)
+	}
+	store, err := opts.openStore(opts.store, false)
+	if err != nil {
+		return fatal(err)
+	}
+	if err := store.RotateMasterKey(oldKey, newKey); err != nil {
+		return fatal(err)
+	}
+	kr, err := store.Keyring()
+	if err != nil {
+		return fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "the store is now encrypted with master key %s, update the key file in the config\n", kr.Master)
+	return exitOK
+}
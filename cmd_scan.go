@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"filemanager/blob"
+	fs "filemanager/filesystem"
+	"filemanager/meta"
+	"filemanager/util"
+)
+
+// startLoad opens src and starts loading it.
+func startLoad(opts *options, src string) (blob.LoadStatus, error) {
+	source, err := opts.openBlobSource(src)
+	if err != nil {
+		return nil, err
+	}
+	ls := source.Load()
+	if opts.progress > 0 {
+		go printProgress(ls)
+	}
+	return ls, nil
+}
+
+// blobPath returns the path of the blob for display, with the
+// member path for archive members, or the url of a download.
+func blobPath(b blob.Blob) string {
+	u := b.Url()
+	if u.Scheme == "http" || u.Scheme == "https" {
+		return u.String()
+	}
+	if u.Fragment != "" {
+		return u.Path + "#" + u.Fragment
+	}
+	return u.Path
+}
+
+// blobParent returns the hash of the archive an expanded member
+// is in, or "".
+func blobParent(b blob.Blob) string {
+	if m, ok := b.(interface{ Parent() *util.Hash }); ok && m.Parent() != nil {
+		return m.Parent().String()
+	}
+	return ""
+}
+
+// freeBlob drops the loaded content of the blob, which isn't
+// needed once its hash is known.
+func freeBlob(b blob.Blob) {
+	if fb, ok := b.(interface{ Free() }); ok {
+		fb.Free()
+	}
+}
+
+func runScan(args []string) int {
+	opts := &options{}
+	f := newFlagSet("scan", opts, false)
+	f.BoolVar(&opts.expand, "expand", false, "descend into the zip, tar and gzip files of a directory src, with the default limits unless the config sets them")
+	args, ok, code := opts.parse(f, args, 1)
+	if !ok {
+		return code
+	}
+	ls, err := startLoad(opts, args[0])
+	if err != nil {
+		return fatal(err)
+	}
+	p := opts.printer()
+	for b := range ls.Blob() {
+		size, _ := b.Size()
+		p.print(struct {
+			Hash   string `json:"hash"`
+			Size   int64  `json:"size"`
+			Url    string `json:"url"`
+			Parent string `json:"parent,omitempty"`
+		}{b.Hash().String(), size, b.Url().String(), blobParent(b)},
+			"%s %12d %s", b.Hash().String(), size, blobPath(b))
+		freeBlob(b)
+	}
+	if !p.json {
+		p.printStatus(ls)
+	}
+	return exitCode(ls.ErrorCount())
+}
+
+func runMeta(args []string) int {
+	opts := &options{}
+	f := newFlagSet("meta", opts, false)
+	batch := f.Int("batch", 100, "number of files per file command run (default detect.batch)")
+	workDir := f.String("work-dir", os.TempDir(), "directory for the file command list files (default detect.work-dir)")
+	index := f.String("index", "", "also add the metadata to this index file, e.g. the "+indexName+" of a store served by serve")
+	args, ok, code := opts.parse(f, args, 1)
+	if !ok {
+		return code
+	}
+	if !opts.set["batch"] {
+		*batch = opts.cfg.Detect.Batch
+	}
+	if !opts.set["work-dir"] {
+		*workDir = opts.cfg.Detect.WorkDir
+	}
+	if *batch < 1 {
+		fmt.Fprintf(os.Stderr, "batch must be positive\n")
+		return exitUsage
+	}
+	var idx *meta.Index
+	if *index != "" {
+		var err error
+		if idx, err = meta.OpenIndex(*index); err != nil {
+			return fatal(err)
+		}
+	}
+	// the file command detects files, so the source is a directory
+	src, err := opts.openSource(args[0])
+	if err != nil {
+		return fatal(err)
+	}
+	ls := src.Load()
+	if opts.progress > 0 {
+		go printProgress(ls)
+	}
+
+	// the members of expanded archives aren't files, they are
+	// counted as skipped
+	fileCh := make(chan *fs.FileBlob)
+	skipped := 0
+	go func() {
+		for b := range ls.Blob() {
+			fb, ok := b.(*fs.FileBlob)
+			if !ok {
+				skipped++
+				freeBlob(b)
+				continue
+			}
+			fb.Free()
+			fileCh <- fb
+		}
+		close(fileCh)
+	}()
+
+	p := opts.printer()
+	indexErrors := 0
+	for bm := range fs.DetectMimeType(*workDir, *batch, fileCh, opts.logger()) {
+		if idx != nil {
+			if err := idx.Put(bm); err != nil {
+				fmt.Fprintf(os.Stderr, "index %s: %v\n", bm.ID(), err)
+				indexErrors++
+			}
+		}
+		m := bm.Meta()
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if p.json {
+			p.print(struct {
+				ID   string      `json:"id"`
+				Meta interface{} `json:"meta"`
+			}{bm.ID(), m}, "")
+			continue
+		}
+		fmt.Fprintf(p.w, "%s\n", bm.ID())
+		for _, k := range keys {
+			fmt.Fprintf(p.w, "  %s: %v\n", k, m[k])
+		}
+	}
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, "%d archive members skipped, only files are detected\n", skipped)
+	}
+	return exitCode(ls.ErrorCount(), indexErrors)
+}
+
+func runDedupe(args []string) int {
+	opts := &options{}
+	f := newFlagSet("dedupe", opts, false)
+	args, ok, code := opts.parse(f, args, 1)
+	if !ok {
+		return code
+	}
+	ls, err := startLoad(opts, args[0])
+	if err != nil {
+		return fatal(err)
+	}
+
+	type group struct {
+		Hash   string   `json:"hash"`
+		Size   int64    `json:"size"`
+		Wasted int64    `json:"wasted"`
+		Paths  []string `json:"paths"`
+	}
+	groups := make(map[string]*group)
+	for b := range ls.Blob() {
+		h := b.Hash().String()
+		g, ok := groups[h]
+		if !ok {
+			size, _ := b.Size()
+			g = &group{Hash: h, Size: size}
+			groups[h] = g
+		}
+		g.Paths = append(g.Paths, blobPath(b))
+		freeBlob(b)
+	}
+
+	dups := make([]*group, 0)
+	wasted := int64(0)
+	for _, g := range groups {
+		if len(g.Paths) > 1 {
+			sort.Strings(g.Paths)
+			g.Wasted = g.Size * int64(len(g.Paths)-1)
+			wasted += g.Wasted
+			dups = append(dups, g)
+		}
+	}
+	sort.Slice(dups, func(i, j int) bool {
+		if dups[i].Wasted != dups[j].Wasted {
+			return dups[i].Wasted > dups[j].Wasted
+		}
+		return dups[i].Hash < dups[j].Hash
+	})
+
+	p := opts.printer()
+	for _, g := range dups {
+		if p.json {
+			p.print(g, "")
+			continue
+		}
+		fmt.Fprintf(p.w, "%s %d copies of %s, %s wasted\n",
+			g.Hash, len(g.Paths), formatSize(g.Size), formatSize(g.Wasted))
+		for _, path := range g.Paths {
+			fmt.Fprintf(p.w, "  %s\n", path)
+		}
+	}
+	if !p.json {
+		fmt.Fprintf(p.w, "%d files, %d duplicate groups, %s wasted\n", ls.Count(), len(dups), formatSize(wasted))
+	}
+	return exitCode(ls.ErrorCount())
+}
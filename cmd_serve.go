@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"filemanager/api"
+	"filemanager/blob"
+	fs "filemanager/filesystem"
+	"filemanager/job"
+	"filemanager/meta"
+	"filemanager/s3"
+	"filemanager/util"
+)
+
+// indexName is the metadata index of a store on a file system,
+// at its root.
+const indexName = "meta.jsonl"
+
+// fsBackend serves a store on a file system.
+type fsBackend struct {
+	*fs.FileSystem
+}
+
+func (b fsBackend) Open(h *util.Hash) (blob.Blob, error) {
+	fb, err := b.Get(h)
+	if err != nil {
+		return nil, err
+	}
+	return fb, nil
+}
+
+// s3Backend serves a store on S3-compatible object storage.
+type s3Backend struct {
+	st *s3.Store
+}
+
+func (b s3Backend) Store(blobCh chan blob.Blob) blob.StoreStatus {
+	return b.st.Store(blobCh)
+}
+
+func (b s3Backend) Has(h *util.Hash) (bool, error) {
+	return b.st.Has(h)
+}
+
+func (b s3Backend) Jobs() *job.Manager {
+	return b.st.Jobs()
+}
+
+func (b s3Backend) Open(h *util.Hash) (blob.Blob, error) {
+	o, err := b.st.Get(h)
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func runServe(args []string) int {
+	opts := &options{}
+	f := newFlagSet("serve", opts, true)
+	addr := f.String("addr", "127.0.0.1:8080", "address to listen on")
+	index := f.String("index", "", "metadata index file (default "+indexName+" at the store root, in memory for an s3 store)")
+	tempDir := f.String("temp-dir", os.TempDir(), "directory the uploads are written to until stored")
+	maxUpload := f.Int64("max-upload", 0, "max upload size in bytes, 0 means no limit")
+	_, ok, code := opts.parse(f, args, 0)
+	if !ok {
+		return code
+	}
+	if *maxUpload < 0 {
+		fmt.Fprintf(os.Stderr, "max-upload must not be negative\n")
+		return exitUsage
+	}
+	if err := checkDir(*tempDir); err != nil {
+		return fatal(err)
+	}
+
+	var store api.Store
+	indexPath := *index
+	s3st, err := opts.openS3Store(opts.store)
+	if err != nil {
+		return fatal(err)
+	}
+	if s3st != nil {
+		store = s3Backend{s3st}
+	} else {
+		fst, err := opts.openStore(opts.store, false)
+		if err != nil {
+			return fatal(err)
+		}
+		store = fsBackend{fst}
+		if indexPath == "" {
+			indexPath = filepath.Join(fst.Root(), indexName)
+		}
+	}
+	idx := meta.NewIndex()
+	if indexPath != "" {
+		if idx, err = meta.OpenIndex(indexPath); err != nil {
+			return fatal(err)
+		}
+	}
+
+	srv := api.New(store, idx, opts.logger())
+	srv.SetTempDir(*tempDir)
+	srv.SetMaxUploadSize(*maxUpload)
+	hs, err := srv.Serve(*addr)
+	if err != nil {
+		return fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "serving the api on %s, %d blobs indexed\n", *addr, idx.Len())
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+	<-sigCh
+	fmt.Fprintf(os.Stderr, "interrupted, stopping ...\n")
+	// let the uploads in progress finish
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := hs.Shutdown(ctx); err != nil {
+		return fatal(err)
+	}
+	return exitOK
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	fs "filemanager/filesystem"
+	"filemanager/util"
+)
+
+func runSnapshot(args []string) int {
+	opts := &options{}
+	f := newFlagSet("snapshot", opts, true)
+	prefix := f.String("prefix", "", "restore only the subtree at this relative path")
+	patterns := f.String("pattern", "", "restore only the files whose relative path or name matches one of these comma separated patterns")
+	overwrite := f.Bool("overwrite", false, "restore over existing files with other content")
+	args, ok, code := opts.parse(f, args, -1)
+	if !ok {
+		return code
+	}
+	if len(args) == 0 {
+		f.Usage()
+		return exitUsage
+	}
+	switch {
+	case args[0] == "ls" && len(args) == 1:
+		return snapshotLs(opts)
+	case args[0] == "show" && len(args) == 2:
+		return snapshotShow(opts, args[1])
+	case args[0] == "restore" && len(args) == 3:
+		ro := &fs.RestoreOptions{
+			Workers:   opts.maxSaver,
+			Prefix:    *prefix,
+			Overwrite: *overwrite,
+		}
+		if *patterns != "" {
+			ro.Patterns = strings.Split(*patterns, ",")
+		}
+		return snapshotRestore(opts, args[1], args[2], ro)
+	case args[0] == "diff" && len(args) == 3:
+		return snapshotDiff(opts, args[1], args[2])
+	}
+	f.Usage()
+	return exitUsage
+}
+
+func snapshotLs(opts *options) int {
+	store, err := opts.openStore(opts.store, false)
+	if err != nil {
+		return fatal(err)
+	}
+	refs, err := store.Snapshots()
+	if err != nil {
+		return fatal(err)
+	}
+	p := opts.printer()
+	for _, ref := range refs {
+		p.print(ref, "%s %s %8d %10s %s",
+			ref.Hash, ref.Time.Local().Format(time.RFC3339), ref.Files, formatSize(ref.Size), ref.Source)
+	}
+	return exitOK
+}
+
+func snapshotShow(opts *options, arg string) int {
+	h, err := util.ParseHash(arg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return exitUsage
+	}
+	store, err := opts.openStore(opts.store, false)
+	if err != nil {
+		return fatal(err)
+	}
+	snap, err := store.ReadSnapshot(h)
+	if err != nil {
+		return fatal(err)
+	}
+	p := opts.printer()
+	if p.json {
+		p.print(snap, "")
+		return exitOK
+	}
+	fmt.Fprintf(p.w, "source: %s\ntime: %s\nfiles: %d (%s), %d errors\n",
+		snap.Source, snap.Time.Local().Format(time.RFC3339), snap.Files, formatSize(snap.Size), snap.Errors)
+	for _, e := range snap.Entries {
+		hash := e.Hash
+		if e.Dir {
+			hash = "-"
+		}
+		fmt.Fprintf(p.w, "%s %12d %s %s %s\n",
+			e.Mode, e.Size, e.ModTime.Local().Format(time.RFC3339), hash, e.Path)
+	}
+	return exitOK
+}
+
+func snapshotRestore(opts *options, arg, target string, ro *fs.RestoreOptions) int {
+	h, err := util.ParseHash(arg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return exitUsage
+	}
+	store, err := opts.openStore(opts.store, false)
+	if err != nil {
+		return fatal(err)
+	}
+	report, err := store.Restore(h, target, ro)
+	if err != nil {
+		return fatal(err)
+	}
+	p := opts.printer()
+	if p.json {
+		p.print(report, "")
+		return exitCode(len(report.Problems))
+	}
+	for _, pr := range report.Problems {
+		fmt.Fprintf(p.w, "error %s: %s\n", pr.Path, pr.Error)
+	}
+	fmt.Fprintf(p.w, "%d dirs, %d files (%s) restored, %d existing in %s, %d problems\n",
+		report.Dirs, report.Files, formatSize(report.Size), report.Existing,
+		report.Duration.Round(time.Millisecond), len(report.Problems))
+	if report.AttrsSkipped > 0 {
+		fmt.Fprintf(p.w, "%d owners or xattrs not restored for lack of permission or support\n", report.AttrsSkipped)
+	}
+	return exitCode(len(report.Problems))
+}
+
+func snapshotDiff(opts *options, fromArg, toArg string) int {
+	from, err := util.ParseHash(fromArg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return exitUsage
+	}
+	to, err := util.ParseHash(toArg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return exitUsage
+	}
+	store, err := opts.openStore(opts.store, false)
+	if err != nil {
+		return fatal(err)
+	}
+	d, err := store.DiffSnapshots(from, to)
+	if err != nil {
+		return fatal(err)
+	}
+	p := opts.printer()
+	if p.json {
+		p.print(d, "")
+		return exitOK
+	}
+	for _, c := range d.Changes {
+		switch c.Kind {
+		case fs.ChangeAdded:
+			fmt.Fprintf(p.w, "A %s (%s)\n", c.Path, formatSize(c.Size))
+		case fs.ChangeDeleted:
+			fmt.Fprintf(p.w, "D %s (%s)\n", c.Path, formatSize(c.Size))
+		case fs.ChangeModified:
+			fmt.Fprintf(p.w, "M %s (%s)\n", c.Path, formatDelta(c.Size-c.OldSize))
+		case fs.ChangeMoved:
+			fmt.Fprintf(p.w, "R %s -> %s\n", c.OldPath, c.Path)
+		}
+	}
+	if len(d.Dirs) > 0 {
+		fmt.Fprintf(p.w, "\n%-24s %7s %7s %7s %7s %10s\n", "dir", "added", "deleted", "changed", "moved", "bytes")
+	}
+	for _, dd := range d.Dirs {
+		fmt.Fprintf(p.w, "%-24s %7d %7d %7d %7d %10s\n",
+			dd.Dir, dd.Added, dd.Deleted, dd.Modified, dd.Moved, formatDelta(dd.Bytes))
+	}
+	fmt.Fprintf(p.w, "%d added, %d deleted, %d modified, %d moved, %s\n",
+		d.Added, d.Deleted, d.Modified, d.Moved, formatDelta(d.Bytes))
+	return exitOK
+}
+
+// formatDelta formats a size change with its sign.
+func formatDelta(n int64) string {
+	if n < 0 {
+		return "-" + formatSize(-n)
+	}
+	return "+" + formatSize(n)
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"filemanager/archive"
+	"filemanager/blob"
+	fs "filemanager/filesystem"
+	"filemanager/util"
+)
+
+func runGet(args []string) int {
+	opts := &options{}
+	f := newFlagSet("get", opts, true)
+	out := f.String("o", "", "write the blob to this file instead of stdout")
+	member := f.String("member", "", "write this member of the blob, a zip archive, reading only its directory and the member")
+	args, ok, code := opts.parse(f, args, 1)
+	if !ok {
+		return code
+	}
+	h, err := util.ParseHash(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return exitUsage
+	}
+	b, err := getBlob(opts, h)
+	if err != nil {
+		return fatal(err)
+	}
+	var rc io.ReadCloser
+	if *member != "" {
+		zr, zerr := archive.OpenZip(b)
+		if zerr != nil {
+			return fatal(zerr)
+		}
+		rc, err = archive.OpenZipMember(zr, *member)
+	} else {
+		rc, err = b.ReadCloser()
+	}
+	if err != nil {
+		return fatal(err)
+	}
+	defer rc.Close()
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		dst, err := os.Create(*out)
+		if err != nil {
+			return fatal(err)
+		}
+		defer dst.Close()
+		w = dst
+	}
+	if _, err := io.Copy(w, rc); err != nil {
+		return fatal(err)
+	}
+	return exitOK
+}
+
+// getBlob returns the blob from the store, on a file system or s3.
+func getBlob(opts *options, h *util.Hash) (blob.Blob, error) {
+	s3st, err := opts.openS3Store(opts.store)
+	if err != nil {
+		return nil, err
+	}
+	if s3st != nil {
+		o, err := s3st.Get(h)
+		if err != nil {
+			return nil, err
+		}
+		return o, nil
+	}
+	store, err := opts.openStore(opts.store, false)
+	if err != nil {
+		return nil, err
+	}
+	b, err := store.Get(h)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// blobIndex is what ls and rm need of a store, on a file system
+// or s3.
+type blobIndex interface {
+	List(fn func(h *util.Hash, size int64) error) error
+	Delete(h *util.Hash) error
+}
+
+func openIndex(opts *options) (blobIndex, error) {
+	s3st, err := opts.openS3Store(opts.store)
+	if err != nil {
+		return nil, err
+	}
+	if s3st != nil {
+		return s3st, nil
+	}
+	store, err := opts.openStore(opts.store, false)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func runLs(args []string) int {
+	opts := &options{}
+	f := newFlagSet("ls", opts, true)
+	args, ok, code := opts.parse(f, args, 0)
+	if !ok {
+		return code
+	}
+	store, err := openIndex(opts)
+	if err != nil {
+		return fatal(err)
+	}
+	p := opts.printer()
+	err = store.List(func(h *util.Hash, size int64) error {
+		p.print(struct {
+			Hash string `json:"hash"`
+			Size int64  `json:"size"`
+		}{h.String(), size}, "%s %12d", h.String(), size)
+		return nil
+	})
+	if err != nil {
+		return fatal(err)
+	}
+	return exitOK
+}
+
+func runVerify(args []string) int {
+	opts := &options{}
+	f := newFlagSet("verify", opts, true)
+	repair := f.Bool("repair", false, "quarantine bad blobs, move misplaced ones and remove stray temp files")
+	quarantine := f.String("quarantine", "", "quarantine directory (default <store>/.quarantine)")
+	refetch := f.String("refetch", "", "source to re-fetch quarantined blobs from, implies -repair")
+	tempAge := f.Duration("temp-age", fs.DefaultTempMaxAge, "age after which temp files are stray")
+	args, ok, code := opts.parse(f, args, 0)
+	if !ok {
+		return code
+	}
+	store, err := opts.openStore(opts.store, false)
+	if err != nil {
+		return fatal(err)
+	}
+	fo := &fs.FsckOptions{
+		Workers:    opts.maxLoader,
+		Repair:     *repair || *refetch != "",
+		Quarantine: *quarantine,
+		TempMaxAge: *tempAge,
+	}
+	if *refetch != "" {
+		src, err := opts.openSource(*refetch)
+		if err != nil {
+			return fatal(err)
+		}
+		fo.Source = src
+	}
+	report, err := store.Fsck(fo)
+	if err != nil {
+		return fatal(err)
+	}
+
+	p := opts.printer()
+	if p.json {
+		p.print(report, "")
+		return exitCode(len(report.Problems))
+	}
+	for _, pr := range report.Problems {
+		line := fmt.Sprintf("%-11s %s", pr.Kind, pr.Path)
+		if pr.Actual != "" {
+			line += ", content hash is " + pr.Actual
+		}
+		if pr.Action != "" {
+			line += " (" + pr.Action + ")"
+		}
+		if pr.Error != "" {
+			line += ": " + pr.Error
+		}
+		fmt.Fprintln(p.w, line)
+	}
+	for _, h := range report.Refetched {
+		fmt.Fprintf(p.w, "refetched   %s\n", h)
+	}
+	for _, h := range report.Missing {
+		fmt.Fprintf(p.w, "missing     %s\n", h)
+	}
+	fmt.Fprintf(p.w, "%d blobs (%s) verified in %s, %d problems\n",
+		report.Checked, formatSize(report.Size), report.Duration.Round(time.Millisecond), len(report.Problems))
+	return exitCode(len(report.Problems))
+}
+
+func runStat(args []string) int {
+	opts := &options{}
+	f := newFlagSet("stat", opts, true)
+	args, ok, code := opts.parse(f, args, 0)
+	if !ok {
+		return code
+	}
+	store, err := opts.openStore(opts.store, false)
+	if err != nil {
+		return fatal(err)
+	}
+	st := struct {
+		Root    string `json:"root"`
+		Layout  string `json:"layout"`
+		Count   int64  `json:"count"`
+		Size    int64  `json:"size"`
+		Empty   int64  `json:"empty"`
+		Largest int64  `json:"largest"`
+		Average int64  `json:"average"`
+	}{Root: store.Root(), Layout: store.Layout().String()}
+	err = store.List(func(h *util.Hash, size int64) error {
+		st.Count++
+		st.Size += size
+		if size == 0 {
+			st.Empty++
+		}
+		if size > st.Largest {
+			st.Largest = size
+		}
+		return nil
+	})
+	if err != nil {
+		return fatal(err)
+	}
+	if st.Count > 0 {
+		st.Average = st.Size / st.Count
+	}
+	opts.printer().print(st,
+		"root:    %s\nlayout:  %s\nblobs:   %d\nsize:    %s\nempty:   %d\nlargest: %s\naverage: %s",
+		st.Root, st.Layout, st.Count, formatSize(st.Size), st.Empty, formatSize(st.Largest), formatSize(st.Average))
+	return exitOK
+}
+
+func runMigrate(args []string) int {
+	opts := &options{}
+	f := newFlagSet("migrate", opts, true)
+	args, ok, code := opts.parse(f, args, 1)
+	if !ok {
+		return code
+	}
+	to, err := fs.ParseLayout(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return exitUsage
+	}
+	store, err := opts.openStore(opts.store, false)
+	if err != nil {
+		return fatal(err)
+	}
+	report, err := store.Migrate(to)
+	if report == nil {
+		return fatal(err)
+	}
+	opts.printer().print(report, "%s -> %s: %d blobs moved, %d duplicates removed, %d errors in %s",
+		report.From, report.To, report.Moved, report.Removed, report.Errors, report.Duration.Round(time.Millisecond))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+	return exitCode(int(report.Errors))
+}
+
+func runRepack(args []string) int {
+	opts := &options{}
+	f := newFlagSet("repack", opts, true)
+	loose := f.Bool("loose", false, "also move the small loose blobs into the packs")
+	orphanAge := f.Duration("orphan-age", fs.DefaultTempMaxAge, "age after which a pack without an index is repacked")
+	args, ok, code := opts.parse(f, args, 0)
+	if !ok {
+		return code
+	}
+	store, err := opts.openStore(opts.store, false)
+	if err != nil {
+		return fatal(err)
+	}
+	report, err := store.Repack(&fs.RepackOptions{Loose: *loose, OrphanAge: *orphanAge})
+	if err != nil {
+		return fatal(err)
+	}
+	opts.printer().print(report, "%d packs (%d orphaned) -> %d: %d blobs kept, %d dropped, %d loose packed, %s reclaimed in %s",
+		report.Packs, report.Orphans, report.Written, report.Entries, report.Dropped, report.Loose,
+		formatSize(report.Reclaimed), report.Duration.Round(time.Millisecond))
+	return exitOK
+}
+
+func runRm(args []string) int {
+	opts := &options{}
+	f := newFlagSet("rm", opts, true)
+	args, ok, code := opts.parse(f, args, -1)
+	if !ok {
+		return code
+	}
+	hashes := make([]*util.Hash, 0, len(args))
+	for _, arg := range args {
+		h, err := util.ParseHash(arg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return exitUsage
+		}
+		hashes = append(hashes, h)
+	}
+	store, err := openIndex(opts)
+	if err != nil {
+		return fatal(err)
+	}
+	errors := 0
+	for _, h := range hashes {
+		if err := store.Delete(h); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			errors++
+		}
+	}
+	return exitCode(errors)
+}
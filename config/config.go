@@ -0,0 +1,314 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// EnvPrefix is the prefix of the environment variables which
+// override config values, see ApplyEnv.
+const EnvPrefix = "FILEMANAGER"
+
+// EnvConfig is the environment variable holding the path to
+// the default config file.
+const EnvConfig = EnvPrefix + "_CONFIG"
+
+// Config describes the sources, stores and processing options
+// of the file manager.
+type Config struct {
+	Hash    string         `json:"hash"`
+	Sources []SourceConfig `json:"sources"`
+	Stores  []StoreConfig  `json:"stores"`
+	Skip    SkipConfig     `json:"skip"`
+	Detect  DetectConfig   `json:"detect"`
+	Jobs    JobsConfig     `json:"jobs"`
+	Logging LoggingConfig  `json:"logging"`
+
+	// unknownEnv are the FILEMANAGER_* variables ApplyEnv ignored,
+	// SetupLogging warns about them
+	unknownEnv []string
+}
+
+// SourceConfig describes a directory tree to load files from.
+type SourceConfig struct {
+	Name      string        `json:"name"`
+	Path      string        `json:"path"`
+	MaxLoader int           `json:"max-loader"`
+	Skip      *SkipConfig   `json:"skip"`
+	Expand    *ExpandConfig `json:"expand"`
+}
+
+// ExpandConfig describes how a source descends into the archives
+// it loads. Expansion is off unless enabled, zero limits mean the
+// defaults.
+type ExpandConfig struct {
+	Enabled    *bool   `json:"enabled"`
+	MaxDepth   int     `json:"max-depth"`
+	MaxRatio   float64 `json:"max-ratio"`
+	MaxBytes   int64   `json:"max-bytes"`
+	MaxEntries int     `json:"max-entries"`
+}
+
+// StoreConfig describes a blob store.
+type StoreConfig struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	MaxSaver int    `json:"max-saver"`
+	// Layout is the fan-out of a new store, "<depth>x<width>"
+	// or "flat", an existing store keeps its own.
+	Layout      string             `json:"layout"`
+	Compression *CompressionConfig `json:"compression"`
+	Encryption  *EncryptionConfig  `json:"encryption"`
+	Chunking    *ChunkingConfig    `json:"chunking"`
+	Packing     *PackingConfig     `json:"packing"`
+	// S3 puts the store in a bucket of S3-compatible object
+	// storage instead of under Path.
+	S3 *S3Config `json:"s3"`
+}
+
+// S3Config describes the bucket of a store on S3-compatible object
+// storage, e.g. MinIO. The store is on a file system unless the
+// bucket is set, a zero part size means the default.
+type S3Config struct {
+	Endpoint  string `json:"endpoint"`
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	Prefix    string `json:"prefix"`
+	AccessKey string `json:"access-key"`
+	SecretKey string `json:"secret-key"`
+	PathStyle *bool  `json:"path-style"`
+	PartSize  int64  `json:"part-size"`
+}
+
+// IsS3 tells if the store is on S3-compatible object storage.
+func (st *StoreConfig) IsS3() bool {
+	return st.S3 != nil && st.S3.Bucket != ""
+}
+
+// PackingConfig describes how a store packs small blobs. Packing
+// is off unless enabled, zero sizes mean the defaults.
+type PackingConfig struct {
+	Enabled     *bool `json:"enabled"`
+	MaxBlobSize int64 `json:"max-blob-size"`
+	MaxPackSize int64 `json:"max-pack-size"`
+}
+
+// ChunkingConfig describes how a store splits large blobs into
+// content-defined chunks. Chunking is off unless enabled, zero
+// sizes mean the defaults.
+type ChunkingConfig struct {
+	Enabled     *bool `json:"enabled"`
+	MinBlobSize int64 `json:"min-blob-size"`
+	MinSize     int   `json:"min-size"`
+	AvgSize     int   `json:"avg-size"`
+	MaxSize     int   `json:"max-size"`
+}
+
+// EncryptionConfig describes the master key of an encrypted
+// store, and how a new one names its blobs, plain or hmac.
+type EncryptionConfig struct {
+	KeyFile    string `json:"key-file"`
+	Addressing string `json:"addressing"`
+}
+
+// CompressionConfig describes which blobs a store compresses.
+// Zero values mean the defaults, an empty codec or "none"
+// disables compression.
+type CompressionConfig struct {
+	Codec     string   `json:"codec"`
+	Level     int      `json:"level"`
+	MinSize   int64    `json:"min-size"`
+	MaxRatio  float64  `json:"max-ratio"`
+	SkipTypes []string `json:"skip-types"`
+}
+
+// SkipConfig describes which files are skipped when loading.
+type SkipConfig struct {
+	DotFiles *bool    `json:"dot-files"`
+	Patterns []string `json:"patterns"`
+}
+
+// DetectConfig describes the file type detection.
+type DetectConfig struct {
+	FileCmd string `json:"file-cmd"`
+	Batch   int    `json:"batch"`
+	WorkDir string `json:"work-dir"`
+}
+
+// JobsConfig describes how load/store jobs are run.
+type JobsConfig struct {
+	MaxJobs          int      `json:"max-jobs"`
+	History          string   `json:"history"`
+	CheckpointDir    string   `json:"checkpoint-dir"`
+	ProgressInterval Duration `json:"progress-interval"`
+}
+
+// LoggingConfig describes the log level and output.
+type LoggingConfig struct {
+	Level  string `json:"level"`
+	Output string `json:"output"`
+}
+
+// Duration is a time.Duration which is written as a string
+// such as "5s" or "1m30s" in the config file.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"5s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Default returns the config used when no config file is given.
+func Default() *Config {
+	dotFiles := true
+	return &Config{
+		Hash: "sha1",
+		Skip: SkipConfig{
+			DotFiles: &dotFiles,
+		},
+		Detect: DetectConfig{
+			Batch:   100,
+			WorkDir: os.TempDir(),
+		},
+		Jobs: JobsConfig{
+			MaxJobs:          2,
+			ProgressInterval: Duration(time.Second * 5),
+		},
+		Logging: LoggingConfig{
+			Level:  "info",
+			Output: "stderr",
+		},
+	}
+}
+
+// LoadConfig reads the config file at the given path on top of
+// the defaults, applies the environment variable overrides and
+// validates the result.
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := cfg.ApplyEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// Parse decodes the json config on top of the defaults, it
+// does not validate the result. Unknown fields are errors.
+func Parse(data []byte) (*Config, error) {
+	return ParseInto(Default(), data)
+}
+
+// ParseInto decodes the json config on top of the given one.
+func ParseInto(cfg *Config, data []byte) (*Config, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, decodeError(data, err)
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after the config object")
+	}
+	return cfg, nil
+}
+
+// decodeError adds the line and column to json errors which
+// carry an offset.
+func decodeError(data []byte, err error) error {
+	var offset int64
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		offset = e.Offset
+	case *json.UnmarshalTypeError:
+		offset = e.Offset
+		if e.Field != "" {
+			return fmt.Errorf("%s: %s: expected %s, got %s",
+				position(data, offset), e.Field, e.Type.String(), e.Value)
+		}
+	default:
+		msg := err.Error()
+		if strings.HasPrefix(msg, "json: unknown field ") {
+			return fmt.Errorf("unknown field %s", strings.TrimPrefix(msg, "json: unknown field "))
+		}
+		return err
+	}
+	return fmt.Errorf("%s: %v", position(data, offset), err)
+}
+
+// position returns "line L, column C" of the given offset.
+func position(data []byte, offset int64) string {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	line, col := 1, 1
+	for _, b := range data[:offset] {
+		if b == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return fmt.Sprintf("line %d, column %d", line, col)
+}
+
+// Source returns the source with the given name.
+func (c *Config) Source(name string) (*SourceConfig, bool) {
+	for i := range c.Sources {
+		if c.Sources[i].Name == name {
+			return &c.Sources[i], true
+		}
+	}
+	return nil, false
+}
+
+// Store returns the store with the given name.
+func (c *Config) Store(name string) (*StoreConfig, bool) {
+	for i := range c.Stores {
+		if c.Stores[i].Name == name {
+			return &c.Stores[i], true
+		}
+	}
+	return nil, false
+}
+
+// SkipFor returns the skip rules of the given source, which are
+// its own rules when it has them and the global ones otherwise.
+func (c *Config) SkipFor(src *SourceConfig) SkipConfig {
+	skip := c.Skip
+	if src != nil && src.Skip != nil {
+		if src.Skip.DotFiles != nil {
+			skip.DotFiles = src.Skip.DotFiles
+		}
+		if src.Skip.Patterns != nil {
+			skip.Patterns = src.Skip.Patterns
+		}
+	}
+	return skip
+}
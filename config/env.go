@@ -0,0 +1,181 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// envName converts a json field name or an item name into the
+// form used in environment variable names, e.g. "max-loader"
+// becomes "MAX_LOADER".
+func envName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// envSetter sets a config value from its string form.
+type envSetter func(string) error
+
+// collectEnv walks the config value and registers a setter for
+// every leaf field under its environment variable name. Slice
+// items are addressed by their "name" field. The setters reach
+// their field through get, which allocates the nil optional
+// sections on the way, so that only the sections with a variable
+// set are allocated.
+func collectEnv(prefix string, v reflect.Value, get func() reflect.Value, setters map[string]envSetter) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if tag == "" || tag == "-" || tag == "name" {
+			continue
+		}
+		name := prefix + "_" + envName(tag)
+		i, fv := i, v.Field(i)
+		field := func() reflect.Value {
+			return get().Field(i)
+		}
+		switch {
+		case fv.Kind() == reflect.Struct:
+			collectEnv(name, fv, field, setters)
+		case fv.Kind() == reflect.Ptr && fv.Type().Elem().Kind() == reflect.Struct:
+			// a nil section is walked as an empty one, its fields
+			// are set in a section allocated by the first setter
+			elem := func() reflect.Value {
+				f := field()
+				if f.IsNil() {
+					f.Set(reflect.New(f.Type().Elem()))
+				}
+				return f.Elem()
+			}
+			if fv.IsNil() {
+				collectEnv(name, reflect.New(fv.Type().Elem()).Elem(), elem, setters)
+			} else {
+				collectEnv(name, fv.Elem(), elem, setters)
+			}
+		case fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.Struct:
+			for j := 0; j < fv.Len(); j++ {
+				j, item := j, fv.Index(j)
+				itemName := item.FieldByName("Name").String()
+				if itemName == "" {
+					continue
+				}
+				collectEnv(name+"_"+envName(itemName), item, func() reflect.Value {
+					return field().Index(j)
+				}, setters)
+			}
+		default:
+			setters[name] = leafSetter(field)
+		}
+	}
+}
+
+func leafSetter(field func() reflect.Value) envSetter {
+	return func(s string) error {
+		fv := field()
+		if fv.Type() == durationType {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return err
+			}
+			fv.SetInt(int64(d))
+			return nil
+		}
+		switch fv.Kind() {
+		case reflect.String:
+			fv.SetString(s)
+		case reflect.Int, reflect.Int64:
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return fmt.Errorf("expected an integer, got %q", s)
+			}
+			fv.SetInt(n)
+		case reflect.Float64:
+			f, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				return fmt.Errorf("expected a number, got %q", s)
+			}
+			fv.SetFloat(f)
+		case reflect.Ptr:
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return fmt.Errorf("expected a boolean, got %q", s)
+			}
+			fv.Set(reflect.ValueOf(&b))
+		case reflect.Slice:
+			items := make([]string, 0)
+			for _, item := range strings.Split(s, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			fv.Set(reflect.ValueOf(items))
+		default:
+			return fmt.Errorf("unsupported field type %s", fv.Type())
+		}
+		return nil
+	}
+}
+
+// EnvNames returns the names of all environment variables which
+// can override a value of this config, sorted.
+func (c *Config) EnvNames() []string {
+	setters := make(map[string]envSetter)
+	root := reflect.ValueOf(c).Elem()
+	collectEnv(EnvPrefix, root, func() reflect.Value { return root }, setters)
+	names := make([]string, 0, len(setters))
+	for name := range setters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ApplyEnv overrides config values with the FILEMANAGER_*
+// variables in env, given as "KEY=value" strings. The variable
+// name is the upper-cased path of the field, with sources and
+// stores addressed by name, e.g. FILEMANAGER_LOGGING_LEVEL or
+// FILEMANAGER_SOURCES_PHOTOS_MAX_LOADER. List values are comma
+// separated and durations are written as "5s". Unknown variables
+// are ignored, SetupLogging logs a warning for each of them.
+func (c *Config) ApplyEnv(env []string) error {
+	setters := make(map[string]envSetter)
+	root := reflect.ValueOf(c).Elem()
+	collectEnv(EnvPrefix, root, func() reflect.Value { return root }, setters)
+	e := &ValidationError{}
+	for _, kv := range env {
+		idx := strings.Index(kv, "=")
+		if idx == -1 || !strings.HasPrefix(kv, EnvPrefix+"_") {
+			continue
+		}
+		key, value := kv[0:idx], kv[idx+1:]
+		if key == EnvConfig {
+			continue
+		}
+		set, ok := setters[key]
+		if !ok {
+			c.unknownEnv = append(c.unknownEnv, key)
+			continue
+		}
+		if err := set(value); err != nil {
+			e.add(key, "%v", err)
+		}
+	}
+	if len(e.Problems) > 0 {
+		return e
+	}
+	return nil
+}
@@ -0,0 +1,340 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"filemanager/archive"
+	"filemanager/blob"
+	"filemanager/filesystem"
+	"filemanager/job"
+	"filemanager/logging"
+	"filemanager/s3"
+	"filemanager/web"
+
+	"github.com/rs/zerolog"
+)
+
+// DefaultWorkers is the number of loaders/savers used when a
+// source or store doesn't set it.
+const DefaultWorkers = 4
+
+// SetupLogging applies the logging level and output, and warns
+// about the environment variables ApplyEnv ignored. The returned
+// function closes the log file, if any.
+func (c *Config) SetupLogging() (func() error, error) {
+	if err := logging.SetLevel(c.Logging.Level); err != nil {
+		return nil, err
+	}
+	closeLog := func() error { return nil }
+	switch c.Logging.Output {
+	case "stdout":
+		logging.SetOutput(os.Stdout)
+	case "stderr":
+		logging.SetOutput(os.Stderr)
+	default:
+		f, err := os.OpenFile(c.Logging.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		logging.SetOutput(f)
+		closeLog = f.Close
+	}
+	for _, name := range c.unknownEnv {
+		logging.GetLogger().Warn().Str("variable", name).Msg("unknown config variable ignored")
+	}
+	return closeLog, nil
+}
+
+// Apply applies the detect and jobs options to the file system.
+func (c *Config) Apply(fs *filesystem.FileSystem) (*filesystem.FileSystem, error) {
+	if c.Detect.FileCmd != "" {
+		if err := filesystem.SetFileCmd(c.Detect.FileCmd); err != nil {
+			return nil, fmt.Errorf("detect.file-cmd: %v", err)
+		}
+	}
+	if err := fs.Jobs().SetMaxJobs(c.Jobs.MaxJobs); err != nil {
+		return nil, err
+	}
+	fs.Jobs().SetHistoryFile(c.Jobs.History)
+	fs.SetProgressInterval(time.Duration(c.Jobs.ProgressInterval))
+	return fs, nil
+}
+
+// OpenSource creates the file system of the named source with
+// its skip rules applied.
+func (c *Config) OpenSource(name string, lg *zerolog.Logger) (*filesystem.FileSystem, error) {
+	src, ok := c.Source(name)
+	if !ok {
+		return nil, fmt.Errorf("source %q not found in config", name)
+	}
+	maxLoader := src.MaxLoader
+	if maxLoader == 0 {
+		maxLoader = DefaultWorkers
+	}
+	fs, err := filesystem.New(src.Path, DefaultWorkers, maxLoader, lg)
+	if err != nil {
+		return nil, fmt.Errorf("source %q: %v", name, err)
+	}
+	skip := c.SkipFor(src)
+	if err := fs.SetSkip(skip.DotFiles == nil || *skip.DotFiles, skip.Patterns); err != nil {
+		return nil, fmt.Errorf("source %q: %v", name, err)
+	}
+	if src.Expand != nil {
+		if err := fs.SetExpansion(src.Expand.Limits()); err != nil {
+			return nil, fmt.Errorf("source %q: %v", name, err)
+		}
+	}
+	return c.Apply(fs)
+}
+
+// OpenArchive creates the source of the zip or tar archive file at
+// path, with the global skip rules and the jobs options applied.
+func (c *Config) OpenArchive(path string, maxLoader int, lg *zerolog.Logger) (blob.BlobSource, error) {
+	var src archiveSource
+	var err error
+	if archive.IsZip(path) {
+		src, err = archive.NewZipSource(path, maxLoader, lg)
+	} else {
+		src, err = archive.NewTarSource(path, lg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	skip := c.SkipFor(nil)
+	if err := src.SetSkip(skip.DotFiles == nil || *skip.DotFiles, skip.Patterns); err != nil {
+		return nil, err
+	}
+	if err := src.Jobs().SetMaxJobs(c.Jobs.MaxJobs); err != nil {
+		return nil, err
+	}
+	src.Jobs().SetHistoryFile(c.Jobs.History)
+	src.SetProgressInterval(time.Duration(c.Jobs.ProgressInterval))
+	return src, nil
+}
+
+// OpenURLs creates the source downloading the given http(s) urls,
+// with the jobs options applied. The validators of the responses
+// are kept in the state file, if any, for the next loads.
+func (c *Config) OpenURLs(urls []string, maxLoader int, statePath string, lg *zerolog.Logger) (blob.BlobSource, error) {
+	src, err := web.NewURLSource(urls, maxLoader, lg)
+	if err != nil {
+		return nil, err
+	}
+	src.SetStateFile(statePath)
+	if err := src.Jobs().SetMaxJobs(c.Jobs.MaxJobs); err != nil {
+		return nil, err
+	}
+	src.Jobs().SetHistoryFile(c.Jobs.History)
+	src.SetProgressInterval(time.Duration(c.Jobs.ProgressInterval))
+	return src, nil
+}
+
+// archiveSource is what the archive sources have in common.
+type archiveSource interface {
+	blob.BlobSource
+	SetSkip(dotFiles bool, patterns []string) error
+	SetProgressInterval(d time.Duration)
+	Jobs() *job.Manager
+}
+
+// OpenStore creates the file system of the named store.
+func (c *Config) OpenStore(name string, lg *zerolog.Logger) (*filesystem.FileSystem, error) {
+	st, ok := c.Store(name)
+	if !ok {
+		return nil, fmt.Errorf("store %q not found in config", name)
+	}
+	maxSaver := st.MaxSaver
+	if maxSaver == 0 {
+		maxSaver = DefaultWorkers
+	}
+	fs, err := filesystem.New(st.Path, maxSaver, DefaultWorkers, lg)
+	if err != nil {
+		return nil, fmt.Errorf("store %q: %v", name, err)
+	}
+	if err := c.ApplyStore(st, fs); err != nil {
+		return nil, err
+	}
+	return c.Apply(fs)
+}
+
+// OpenS3Store creates the store of the named config store, which
+// must be on S3-compatible object storage, with maxSaver uploaders
+// and the jobs options applied.
+func (c *Config) OpenS3Store(name string, maxSaver int, lg *zerolog.Logger) (*s3.Store, error) {
+	st, ok := c.Store(name)
+	if !ok || !st.IsS3() {
+		return nil, fmt.Errorf("store %q is not an s3 store", name)
+	}
+	opts, err := st.S3.Options(st.Layout)
+	if err != nil {
+		return nil, fmt.Errorf("store %q: %v", name, err)
+	}
+	store, err := s3.New(opts, maxSaver, lg)
+	if err != nil {
+		return nil, fmt.Errorf("store %q: %v", name, err)
+	}
+	if err := store.Jobs().SetMaxJobs(c.Jobs.MaxJobs); err != nil {
+		return nil, err
+	}
+	store.Jobs().SetHistoryFile(c.Jobs.History)
+	return store, nil
+}
+
+// Options returns the options of the bucket with the zero values
+// replaced by the defaults, and the given layout if not empty.
+func (c *S3Config) Options(layout string) (*s3.Options, error) {
+	o := s3.NewOptions(c.Endpoint, c.Bucket)
+	if c.Region != "" {
+		o.Region = c.Region
+	}
+	o.Prefix = c.Prefix
+	o.AccessKey = c.AccessKey
+	o.SecretKey = c.SecretKey
+	o.PathStyle = c.PathStyle != nil && *c.PathStyle
+	if c.PartSize > 0 {
+		o.PartSize = c.PartSize
+	}
+	if layout != "" {
+		l, err := filesystem.ParseLayout(layout)
+		if err != nil {
+			return nil, err
+		}
+		o.Layout = l
+	}
+	return o, o.Validate()
+}
+
+// ApplyStore sets the layout of the store, its compression,
+// chunking, packing and encryption if the store config has them. Setting the layout
+// fails if an existing store has another one.
+func (c *Config) ApplyStore(st *StoreConfig, fs *filesystem.FileSystem) error {
+	if st.Layout != "" {
+		l, err := filesystem.ParseLayout(st.Layout)
+		if err != nil {
+			return fmt.Errorf("store %q: %v", st.Name, err)
+		}
+		if err := fs.SetLayout(l); err != nil {
+			return fmt.Errorf("store %q: %v", st.Name, err)
+		}
+	}
+	if st.Compression != nil {
+		comp, err := st.Compression.Compression()
+		if err != nil {
+			return fmt.Errorf("store %q: %v", st.Name, err)
+		}
+		fs.SetCompression(comp)
+	}
+	if st.Chunking != nil {
+		if err := fs.SetChunking(st.Chunking.Chunking()); err != nil {
+			return fmt.Errorf("store %q: %v", st.Name, err)
+		}
+	}
+	if st.Packing != nil {
+		if err := fs.SetPacking(st.Packing.Packing()); err != nil {
+			return fmt.Errorf("store %q: %v", st.Name, err)
+		}
+	}
+	if st.Encryption != nil && st.Encryption.KeyFile != "" {
+		key, err := filesystem.LoadMasterKey(st.Encryption.KeyFile)
+		if err != nil {
+			return fmt.Errorf("store %q: %v", st.Name, err)
+		}
+		if err := fs.SetEncryption(key, filesystem.Addressing(st.Encryption.Addressing)); err != nil {
+			return fmt.Errorf("store %q: %v", st.Name, err)
+		}
+	}
+	return nil
+}
+
+// Compression returns the compression settings with the zero
+// values replaced by the defaults, or nil if it is disabled.
+func (c *CompressionConfig) Compression() (*filesystem.Compression, error) {
+	var codec filesystem.Codec
+	switch c.Codec {
+	case "", "none":
+		return nil, nil
+	case "gzip":
+		codec = filesystem.GzipCodec{Level: c.Level}
+	case "flate":
+		codec = filesystem.FlateCodec{Level: c.Level}
+	default:
+		var ok bool
+		codec, ok = filesystem.LookupCodec(c.Codec)
+		if !ok {
+			return nil, fmt.Errorf("unknown codec %q", c.Codec)
+		}
+	}
+	comp := filesystem.NewCompression(codec)
+	if c.MinSize > 0 {
+		comp.MinSize = c.MinSize
+	}
+	if c.MaxRatio > 0 {
+		comp.MaxRatio = c.MaxRatio
+	}
+	if c.SkipTypes != nil {
+		comp.SkipTypes = c.SkipTypes
+	}
+	return comp, nil
+}
+
+// Chunking returns the chunking settings with the zero values
+// replaced by the defaults, or nil if it is disabled.
+func (c *ChunkingConfig) Chunking() *filesystem.Chunking {
+	if c.Enabled == nil || !*c.Enabled {
+		return nil
+	}
+	ch := filesystem.NewChunking()
+	if c.MinBlobSize > 0 {
+		ch.MinBlobSize = c.MinBlobSize
+	}
+	if c.MinSize > 0 {
+		ch.MinSize = c.MinSize
+	}
+	if c.AvgSize > 0 {
+		ch.AvgSize = c.AvgSize
+	}
+	if c.MaxSize > 0 {
+		ch.MaxSize = c.MaxSize
+	}
+	return ch
+}
+
+// Limits returns the expansion limits with the zero values
+// replaced by the defaults, or nil if it is disabled.
+func (c *ExpandConfig) Limits() *archive.Limits {
+	if c.Enabled == nil || !*c.Enabled {
+		return nil
+	}
+	l := archive.NewLimits()
+	if c.MaxDepth > 0 {
+		l.MaxDepth = c.MaxDepth
+	}
+	if c.MaxRatio > 0 {
+		l.MaxRatio = c.MaxRatio
+	}
+	if c.MaxBytes > 0 {
+		l.MaxBytes = c.MaxBytes
+	}
+	if c.MaxEntries > 0 {
+		l.MaxEntries = c.MaxEntries
+	}
+	return l
+}
+
+// Packing returns the packing settings with the zero values
+// replaced by the defaults, or nil if it is disabled.
+func (c *PackingConfig) Packing() *filesystem.Packing {
+	if c.Enabled == nil || !*c.Enabled {
+		return nil
+	}
+	p := filesystem.NewPacking()
+	if c.MaxBlobSize > 0 {
+		p.MaxBlobSize = c.MaxBlobSize
+	}
+	if c.MaxPackSize > 0 {
+		p.MaxPackSize = c.MaxPackSize
+	}
+	return p
+}
@@ -0,0 +1,237 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"filemanager/filesystem"
+
+	"github.com/rs/zerolog"
+)
+
+// the allowed range of jobs.max-jobs
+const (
+	minJobs = 1
+	maxJobs = 20
+)
+
+// ValidationError lists every problem found in a config, each
+// prefixed with the path of the offending field.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Problems) == 1 {
+		return "invalid config: " + e.Problems[0]
+	}
+	return fmt.Sprintf("invalid config, %d problems:\n  %s",
+		len(e.Problems), strings.Join(e.Problems, "\n  "))
+}
+
+func (e *ValidationError) add(field string, format string, args ...interface{}) {
+	e.Problems = append(e.Problems, field+": "+fmt.Sprintf(format, args...))
+}
+
+// Validate checks the config and returns a *ValidationError
+// describing all problems found, or nil.
+func (c *Config) Validate() error {
+	e := &ValidationError{}
+
+	if c.Hash != "sha1" {
+		e.add("hash", "unsupported algorithm %q, supported: sha1", c.Hash)
+	}
+
+	names := make(map[string]string)
+	checkName := func(field, name string) {
+		if name == "" {
+			e.add(field+".name", "must not be empty")
+			return
+		}
+		if strings.ContainsAny(name, "/\\ ") {
+			e.add(field+".name", "%q must not contain slashes or spaces", name)
+		}
+		if prev, ok := names[name]; ok {
+			e.add(field+".name", "%q is already used by %s", name, prev)
+			return
+		}
+		names[name] = field
+	}
+
+	for i, src := range c.Sources {
+		field := fmt.Sprintf("sources[%d]", i)
+		checkName(field, src.Name)
+		if src.Path == "" {
+			e.add(field+".path", "must not be empty")
+		}
+		if src.MaxLoader != 0 && (src.MaxLoader < filesystem.MinWorkers || src.MaxLoader > filesystem.MaxWorkers) {
+			e.add(field+".max-loader", "%d is out of allowed range [%d, %d]", src.MaxLoader, filesystem.MinWorkers, filesystem.MaxWorkers)
+		}
+		if src.Skip != nil {
+			validatePatterns(e, field+".skip.patterns", src.Skip.Patterns)
+		}
+		if src.Expand != nil {
+			validateExpand(e, field+".expand", src.Expand)
+		}
+	}
+	for i, st := range c.Stores {
+		field := fmt.Sprintf("stores[%d]", i)
+		checkName(field, st.Name)
+		if st.Path == "" && !st.IsS3() {
+			e.add(field+".path", "must not be empty")
+		}
+		if st.IsS3() {
+			validateS3(e, field, &st)
+		}
+		if st.MaxSaver != 0 && (st.MaxSaver < filesystem.MinWorkers || st.MaxSaver > filesystem.MaxWorkers) {
+			e.add(field+".max-saver", "%d is out of allowed range [%d, %d]", st.MaxSaver, filesystem.MinWorkers, filesystem.MaxWorkers)
+		}
+		if st.Layout != "" {
+			if _, err := filesystem.ParseLayout(st.Layout); err != nil {
+				e.add(field+".layout", "%v", err)
+			}
+		}
+		if st.Compression != nil {
+			validateCompression(e, field+".compression", st.Compression)
+		}
+		if st.Chunking != nil {
+			validateChunking(e, field+".chunking", st.Chunking)
+		}
+		if st.Packing != nil {
+			validatePacking(e, field+".packing", st.Packing)
+		}
+		if st.Encryption != nil {
+			switch filesystem.Addressing(st.Encryption.Addressing) {
+			case "", filesystem.AddressPlain, filesystem.AddressHMAC:
+			default:
+				e.add(field+".encryption.addressing", "unknown addressing %q, expected plain or hmac", st.Encryption.Addressing)
+			}
+			if st.Encryption.KeyFile == "" && st.Encryption.Addressing != "" {
+				e.add(field+".encryption.key-file", "must not be empty")
+			}
+		}
+	}
+
+	validatePatterns(e, "skip.patterns", c.Skip.Patterns)
+
+	if c.Detect.Batch < 1 {
+		e.add("detect.batch", "must be positive, got %d", c.Detect.Batch)
+	}
+	if c.Detect.WorkDir == "" {
+		e.add("detect.work-dir", "must not be empty")
+	}
+
+	if c.Jobs.MaxJobs < minJobs || c.Jobs.MaxJobs > maxJobs {
+		e.add("jobs.max-jobs", "%d is out of allowed range [%d, %d]", c.Jobs.MaxJobs, minJobs, maxJobs)
+	}
+	if c.Jobs.ProgressInterval < 0 {
+		e.add("jobs.progress-interval", "must not be negative")
+	}
+
+	if _, err := zerolog.ParseLevel(c.Logging.Level); err != nil || c.Logging.Level == "" {
+		e.add("logging.level", "unknown level %q, expected debug, info, warn or error", c.Logging.Level)
+	}
+	if c.Logging.Output == "" {
+		e.add("logging.output", "must be stdout, stderr or a file path")
+	}
+
+	if len(e.Problems) > 0 {
+		return e
+	}
+	return nil
+}
+
+func validatePatterns(e *ValidationError, field string, patterns []string) {
+	for i, p := range patterns {
+		if p == "" {
+			e.add(fmt.Sprintf("%s[%d]", field, i), "must not be empty")
+			continue
+		}
+		if _, err := filepath.Match(p, ""); err != nil {
+			e.add(fmt.Sprintf("%s[%d]", field, i), "invalid glob %q: %v", p, err)
+		}
+	}
+}
+
+func validateCompression(e *ValidationError, field string, c *CompressionConfig) {
+	if c.Codec != "" && c.Codec != "none" {
+		if _, ok := filesystem.LookupCodec(c.Codec); !ok {
+			e.add(field+".codec", "unknown codec %q, expected gzip, flate or none", c.Codec)
+		}
+	}
+	if c.Level < -2 || c.Level > 9 {
+		e.add(field+".level", "%d is out of allowed range [-2, 9]", c.Level)
+	}
+	if c.MinSize < 0 {
+		e.add(field+".min-size", "must not be negative")
+	}
+	if c.MaxRatio < 0 || c.MaxRatio > 1 {
+		e.add(field+".max-ratio", "%g is out of allowed range [0, 1]", c.MaxRatio)
+	}
+	for i, t := range c.SkipTypes {
+		if _, err := path.Match(t, ""); err != nil || !strings.Contains(t, "/") {
+			e.add(fmt.Sprintf("%s.skip-types[%d]", field, i), "invalid MIME type pattern %q", t)
+		}
+	}
+}
+
+func validateChunking(e *ValidationError, field string, c *ChunkingConfig) {
+	if c.MinBlobSize < 0 {
+		e.add(field+".min-blob-size", "must not be negative")
+	}
+	if c.MinSize < 0 || c.AvgSize < 0 || c.MaxSize < 0 {
+		e.add(field, "chunk sizes must not be negative")
+		return
+	}
+	if ch := c.Chunking(); ch != nil {
+		if err := ch.Validate(); err != nil {
+			e.add(field, "%v", err)
+		}
+	}
+}
+
+// validateS3 checks the bucket of an s3 store, which stores the
+// blobs whole and plain.
+func validateS3(e *ValidationError, field string, st *StoreConfig) {
+	if _, err := st.S3.Options(""); err != nil {
+		e.add(field+".s3", "%v", err)
+	}
+	if st.Compression != nil && st.Compression.Codec != "" && st.Compression.Codec != "none" {
+		e.add(field+".compression", "not supported by s3 stores")
+	}
+	if st.Encryption != nil && st.Encryption.KeyFile != "" {
+		e.add(field+".encryption", "not supported by s3 stores")
+	}
+	if st.Chunking != nil && st.Chunking.Chunking() != nil {
+		e.add(field+".chunking", "not supported by s3 stores")
+	}
+	if st.Packing != nil && st.Packing.Packing() != nil {
+		e.add(field+".packing", "not supported by s3 stores")
+	}
+}
+
+func validateExpand(e *ValidationError, field string, c *ExpandConfig) {
+	if c.MaxDepth < 0 || c.MaxRatio < 0 || c.MaxBytes < 0 || c.MaxEntries < 0 {
+		e.add(field, "limits must not be negative")
+		return
+	}
+	if l := c.Limits(); l != nil {
+		if err := l.Validate(); err != nil {
+			e.add(field, "%v", err)
+		}
+	}
+}
+
+func validatePacking(e *ValidationError, field string, c *PackingConfig) {
+	if c.MaxBlobSize < 0 || c.MaxPackSize < 0 {
+		e.add(field, "sizes must not be negative")
+		return
+	}
+	if p := c.Packing(); p != nil {
+		if err := p.Validate(); err != nil {
+			e.add(field, "%v", err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package filesystem
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// FileAttrs are the attributes of a file beyond its mode and mtime,
+// which are recorded in snapshots where the platform has them.
+type FileAttrs struct {
+	Uid   int       `json:"uid"`
+	Gid   int       `json:"gid"`
+	Atime time.Time `json:"atime"`
+	// Xattrs are the extended attributes by name, e.g. user.* tags
+	// or security.selinux labels.
+	Xattrs map[string][]byte `json:"xattrs,omitempty"`
+}
+
+// specialMode are the mode bits restored besides the permissions.
+const specialMode = os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// setAttrs restores the owner, mode, xattrs and times of the entry
+// at path, in that order since a chown clears the setuid bits. It
+// returns the number of attributes which were not restored for
+// lack of permission or support, which isn't an error.
+func setAttrs(path string, e *SnapshotEntry) (int, error) {
+	skipped := 0
+	if e.Attrs != nil {
+		n, err := writeOwner(path, e.Attrs)
+		if err != nil {
+			return 0, err
+		}
+		skipped += n
+	}
+	if err := os.Chmod(path, e.Mode&(os.ModePerm|specialMode)); err != nil {
+		return 0, err
+	}
+	atime := e.ModTime
+	if e.Attrs != nil {
+		n, err := writeXattrs(path, e.Attrs)
+		if err != nil {
+			return 0, err
+		}
+		skipped += n
+		if !e.Attrs.Atime.IsZero() {
+			atime = e.Attrs.Atime
+		}
+	}
+	if err := os.Chtimes(path, atime, e.ModTime); err != nil {
+		return 0, err
+	}
+	return skipped, nil
+}
+
+// notPermitted tells if err is for an attribute the user or the
+// file system can't set.
+func notPermitted(err error) bool {
+	return errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) ||
+		errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EOPNOTSUPP)
+}
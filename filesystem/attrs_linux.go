@@ -0,0 +1,102 @@
+package filesystem
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"time"
+)
+
+// readAttrs returns the owner, atime and xattrs of the file at
+// path, fi is its stat. Xattrs which can't be read are left out.
+func readAttrs(path string, fi os.FileInfo) *FileAttrs {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	a := &FileAttrs{
+		Uid:   int(st.Uid),
+		Gid:   int(st.Gid),
+		Atime: time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec)),
+	}
+	for _, name := range listXattrs(path) {
+		if v, ok := getXattr(path, name); ok {
+			if a.Xattrs == nil {
+				a.Xattrs = make(map[string][]byte)
+			}
+			a.Xattrs[name] = v
+		}
+	}
+	return a
+}
+
+func listXattrs(path string) []string {
+	n, err := syscall.Listxattr(path, nil)
+	if err != nil || n == 0 {
+		return nil
+	}
+	buf := make([]byte, n)
+	n, err = syscall.Listxattr(path, buf)
+	if err != nil {
+		return nil
+	}
+	names := make([]string, 0)
+	for _, name := range bytes.Split(buf[:n], []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+	return names
+}
+
+func getXattr(path, name string) ([]byte, bool) {
+	n, err := syscall.Getxattr(path, name, nil)
+	if err != nil {
+		return nil, false
+	}
+	buf := make([]byte, n)
+	if n == 0 {
+		return buf, true
+	}
+	n, err = syscall.Getxattr(path, name, buf)
+	if err != nil {
+		return nil, false
+	}
+	return buf[:n], true
+}
+
+// writeOwner sets the owner of the file at path if it differs.
+func writeOwner(path string, a *FileAttrs) (int, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) == a.Uid && int(st.Gid) == a.Gid {
+		return 0, nil
+	}
+	if err := os.Chown(path, a.Uid, a.Gid); err != nil {
+		if notPermitted(err) {
+			return 1, nil
+		}
+		return 0, err
+	}
+	return 0, nil
+}
+
+// writeXattrs sets the xattrs of the file at path.
+func writeXattrs(path string, a *FileAttrs) (int, error) {
+	skipped := 0
+	for name, v := range a.Xattrs {
+		if cur, ok := getXattr(path, name); ok && bytes.Equal(cur, v) {
+			continue
+		}
+		if err := syscall.Setxattr(path, name, v, 0); err != nil {
+			if notPermitted(err) {
+				skipped++
+				continue
+			}
+			return 0, &os.PathError{Op: "setxattr " + name, Path: path, Err: err}
+		}
+	}
+	return skipped, nil
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package filesystem
+
+import (
+	"os"
+)
+
+// readAttrs returns nil, only the mode and mtime are recorded on
+// this platform.
+func readAttrs(path string, fi os.FileInfo) *FileAttrs {
+	return nil
+}
+
+func writeOwner(path string, a *FileAttrs) (int, error) {
+	return 0, nil
+}
+
+func writeXattrs(path string, a *FileAttrs) (int, error) {
+	return 0, nil
+}
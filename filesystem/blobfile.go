@@ -0,0 +1,261 @@
+package filesystem
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"filemanager/util"
+)
+
+// blobFiles reads and writes the blob files of a store, which
+// are compressed, encrypted, chunked or packed depending on the settings
+// of the store when the Store started, or the blob was read.
+type blobFiles struct {
+	layout   *storeLayout
+	comp     *Compression
+	enc      *Encryption
+	chunking *Chunking
+	packs    *packSet
+	// packer is set if small blobs are packed
+	packer *packer
+}
+
+func (fs *FileSystem) files() *blobFiles {
+	b := &blobFiles{
+		layout:   fs.layout,
+		comp:     fs.compression,
+		enc:      fs.enc,
+		chunking: fs.chunking,
+		packs:    fs.packs,
+	}
+	if fs.packing != nil {
+		b.packer = newPacker(fs.packs, fs.packing)
+	}
+	return b
+}
+
+// locate returns the path and info of the existing blob file
+// with the given content hash, or "" if there is none.
+func (b *blobFiles) locate(h *util.Hash) (string, os.FileInfo, error) {
+	return b.layout.locate(b.layout.root, b.enc.address(h))
+}
+
+// settle moves the blob file just written at path under base to
+// the path of the current layout, in case another process started
+// or finished a migration while it was written, so that it isn't
+// left at a layout which is no longer searched. It returns the path
+// of the file.
+func (b *blobFiles) settle(base, path string, h *util.Hash) (string, error) {
+	if _, err := b.layout.reload(); err != nil {
+		return path, err
+	}
+	target := b.layout.path(base, b.enc.address(h)) + blobExt(path)
+	if target == path {
+		return path, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return path, err
+	}
+	if err := os.Rename(path, target); err != nil {
+		return path, err
+	}
+	return target, nil
+}
+
+// locateChunk is like locate for the chunks of chunked blobs.
+func (b *blobFiles) locateChunk(h *util.Hash) (string, os.FileInfo, error) {
+	return b.layout.locate(b.layout.chunkRoot(), b.enc.address(h))
+}
+
+// size returns the size of the content of the blob file, which
+// is the original size for compressed, encrypted and chunked
+// files.
+func (b *blobFiles) size(path string, fi os.FileInfo) (int64, error) {
+	_, size, err := b.stat(path, fi)
+	return size, err
+}
+
+// stat returns the content hash and size of the blob file. The
+// hash is nil when the header doesn't have it, in which case it
+// is the name of the file.
+func (b *blobFiles) stat(path string, fi os.FileInfo) (*util.Hash, int64, error) {
+	switch blobExt(path) {
+	case compressedExt:
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		defer f.Close()
+		_, size, err := readCompressedHeader(f)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: %v", path, err)
+		}
+		return nil, size, nil
+	case encryptedExt:
+		hdr, err := readEncHeader(path, b.enc)
+		if err != nil {
+			return nil, 0, err
+		}
+		return hdr.hash, hdr.size, nil
+	case recipeExt:
+		rc, err := b.readRecipe(path)
+		if err != nil {
+			return nil, 0, err
+		}
+		h, err := util.ParseHash(rc.Hash)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: %v", path, err)
+		}
+		return h, rc.Size, nil
+	}
+	return nil, fi.Size(), nil
+}
+
+// exists returns true if the blob file at the given path exists
+// and its content has the given size. A file whose size can't be
+// read (e.g. a corrupted header) is an error.
+func (b *blobFiles) exists(path string, size int64) (bool, error) {
+	fi, err := os.Stat(path)
+	if err == nil {
+		n, err := b.size(path, fi)
+		if err != nil {
+			return false, err
+		}
+		return n == size, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// blobFileReadCloser reads the original content of a compressed
+// or encrypted blob file.
+type blobFileReadCloser struct {
+	io.Reader
+	dec io.ReadCloser
+	f   *os.File
+}
+
+func (r *blobFileReadCloser) Close() error {
+	if r.dec != nil {
+		r.dec.Close()
+	}
+	return r.f.Close()
+}
+
+// open opens the blob file at the given path, which reads the
+// original content of compressed, encrypted and chunked files.
+func (b *blobFiles) open(path string) (io.ReadCloser, error) {
+	ext := blobExt(path)
+	if ext == recipeExt {
+		rc, err := b.readRecipe(path)
+		if err != nil {
+			return nil, err
+		}
+		return &chunkReader{files: b, chunks: rc.Chunks}, nil
+	}
+	f, err := os.Open(path)
+	if err != nil || ext == "" {
+		return f, err
+	}
+	r, dec, err := b.decode(bufio.NewReader(f), ext)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &blobFileReadCloser{Reader: r, dec: dec, f: f}, nil
+}
+
+// decode returns the reader of the original content of the blob
+// file with the given extension read from r, and the decompressor
+// to close along with the file if there is one.
+func (b *blobFiles) decode(r *bufio.Reader, ext string) (io.Reader, io.ReadCloser, error) {
+	if ext == "" {
+		return r, nil, nil
+	}
+	var src io.Reader = r
+	compressed := ext == compressedExt
+	if !compressed {
+		hdr, err := b.enc.readHeader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		src = newDecryptReader(r, hdr)
+		compressed = hdr.flags&flagCompressed != 0
+	}
+	if !compressed {
+		return src, nil, nil
+	}
+	dec, err := decompress(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	return dec, dec, nil
+}
+
+// prepare decides how the blob is encoded, it returns the
+// extension of its blob file, the codec if it is compressed and
+// a reader of the whole blob.
+func (b *blobFiles) prepare(name string, size int64, src io.Reader) (string, Codec, io.Reader, error) {
+	var codec Codec
+	if b.comp != nil {
+		compressed, r, err := b.comp.decide(name, size, src)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		src = r
+		if compressed {
+			codec = b.comp.Codec
+		}
+	}
+	switch {
+	case b.enc != nil:
+		return encryptedExt, codec, src, nil
+	case codec != nil:
+		return compressedExt, codec, src, nil
+	}
+	return "", nil, src, nil
+}
+
+// encode writes the content of src to w as the blob file with
+// the given extension.
+func (b *blobFiles) encode(w io.Writer, ext string, codec Codec, h *util.Hash, size int64, src io.Reader) error {
+	switch ext {
+	case encryptedExt:
+		return writeEncrypted(w, b.enc, codec, h, size, src)
+	case compressedExt:
+		return writeCompressed(w, codec, size, src)
+	}
+	_, err := io.Copy(w, src)
+	return err
+}
+
+// write writes the content of src to the blob file at the given
+// path, plus the extension of the compressed or encrypted file
+// if it is one. It returns the path written to, the number of
+// bytes written and whether the content was compressed.
+func (b *blobFiles) write(path, name string, h *util.Hash, size int64, src io.Reader) (string, int64, bool, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", 0, false, err
+	}
+	ext, codec, src, err := b.prepare(name, size, src)
+	if err != nil {
+		return "", 0, false, err
+	}
+	path += ext
+	var n int64
+	switch ext {
+	case encryptedExt:
+		n, err = saveEncryptedFile(path, b.enc, codec, h, size, src)
+	case compressedExt:
+		n, err = saveCompressedFile(path, codec, size, src)
+	default:
+		n, err = saveFile(path, ioutil.NopCloser(src))
+	}
+	return path, n, codec != nil, err
+}
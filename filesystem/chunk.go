@@ -0,0 +1,381 @@
+package filesystem
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"path/filepath"
+
+	"filemanager/util"
+)
+
+// chunkDir is the dir under the store root the chunks of chunked
+// blobs are stored in.
+const chunkDir = "chunks"
+
+// recipeExt is the extension of the files which record the
+// chunks of chunked blobs.
+const recipeExt = ".r"
+
+// default chunking settings
+const (
+	DefaultChunkMinBlob = 4 * 1024 * 1024
+	DefaultChunkMin     = 256 * 1024
+	DefaultChunkAvg     = 1024 * 1024
+	DefaultChunkMax     = 4 * 1024 * 1024
+)
+
+// Chunking splits large blobs into content-defined chunks, which
+// are stored once, so that blobs which differ in a few places
+// share most of their chunks.
+type Chunking struct {
+	// MinBlobSize is the size below which blobs are stored whole.
+	MinBlobSize int64
+	// MinSize, AvgSize and MaxSize bound the chunk sizes, the
+	// chunks are AvgSize long on average.
+	MinSize int
+	AvgSize int
+	MaxSize int
+}
+
+// NewChunking returns the chunking with the default settings.
+func NewChunking() *Chunking {
+	return &Chunking{
+		MinBlobSize: DefaultChunkMinBlob,
+		MinSize:     DefaultChunkMin,
+		AvgSize:     DefaultChunkAvg,
+		MaxSize:     DefaultChunkMax,
+	}
+}
+
+// Validate checks that the chunk sizes are consistent.
+func (c *Chunking) Validate() error {
+	if c.MinSize < 64 {
+		return fmt.Errorf("min chunk size %d is less than 64", c.MinSize)
+	}
+	if c.AvgSize <= c.MinSize || c.MaxSize <= c.AvgSize {
+		return fmt.Errorf("chunk sizes must be min < avg < max, got %d, %d, %d", c.MinSize, c.AvgSize, c.MaxSize)
+	}
+	if c.MinBlobSize < 0 {
+		return fmt.Errorf("min blob size must not be negative")
+	}
+	return nil
+}
+
+// SetChunking sets the chunking of the blobs stored by Store, nil
+// stores them whole. Chunked blobs are read like whole ones.
+func (fs *FileSystem) SetChunking(c *Chunking) error {
+	if c != nil {
+		if err := c.Validate(); err != nil {
+			return err
+		}
+	}
+	fs.chunking = c
+	return nil
+}
+
+// gear is the table of the rolling hash. It must never change,
+// or the chunks of new blobs would no longer match the stored
+// ones.
+var gear [256]uint64
+
+func init() {
+	// splitmix64 with a fixed seed
+	x := uint64(0x66696c656d616e61)
+	for i := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// chunker splits a stream into content-defined chunks with the
+// FastCDC algorithm: a cut point is where the gear hash of the
+// last bytes has its top bits zero, with more bits required
+// before the average size than after, which narrows the spread
+// of the chunk sizes.
+type chunker struct {
+	r            io.Reader
+	buf          []byte
+	start, end   int
+	eof          bool
+	min, avg     int
+	max          int
+	maskS, maskL uint64
+}
+
+func newChunker(r io.Reader, c *Chunking) *chunker {
+	b := bits.Len(uint(c.AvgSize)) - 1
+	return &chunker{
+		r:     r,
+		buf:   make([]byte, 2*c.MaxSize),
+		min:   c.MinSize,
+		avg:   c.AvgSize,
+		max:   c.MaxSize,
+		maskS: topBits(b + 2),
+		maskL: topBits(b - 2),
+	}
+}
+
+func topBits(n int) uint64 {
+	if n < 1 {
+		n = 1
+	}
+	return ^uint64(0) << uint(64-n)
+}
+
+// next returns the next chunk, which is only valid until the
+// next call, or io.EOF after the last one.
+func (c *chunker) next() ([]byte, error) {
+	if c.end-c.start < c.max && !c.eof {
+		copy(c.buf, c.buf[c.start:c.end])
+		c.end -= c.start
+		c.start = 0
+		n, err := io.ReadFull(c.r, c.buf[c.end:])
+		c.end += n
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			c.eof = true
+		default:
+			return nil, err
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// cut returns the length of the chunk at the start of data.
+func (c *chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+	if n > c.max {
+		n = c.max
+	}
+	normal := c.avg
+	if normal > n {
+		normal = n
+	}
+	var fp uint64
+	i := c.min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// the version of the recipe format
+const recipeVersion = 1
+
+// recipe records the chunks a chunked blob is made of, in order.
+type recipe struct {
+	Version int           `json:"version"`
+	Hash    string        `json:"hash"`
+	Size    int64         `json:"size"`
+	Chunks  []recipeChunk `json:"chunks"`
+}
+
+type recipeChunk struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// chunkStats counts the chunks written for a chunked blob.
+type chunkStats struct {
+	chunks   int
+	existing int
+	written  int64
+}
+
+// writeChunked splits src into chunks, writes the chunks which
+// aren't stored yet and the recipe of the blob at the given path
+// plus the recipe extension. It returns the path of the recipe.
+func (b *blobFiles) writeChunked(path, name string, h *util.Hash, size int64, src io.Reader) (string, *chunkStats, error) {
+	st := &chunkStats{}
+	rc := &recipe{Version: recipeVersion, Hash: h.String(), Size: size}
+	ch := newChunker(src, b.chunking)
+	var total int64
+	for {
+		data, err := ch.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		sum := sha1.Sum(data)
+		chash := util.NewSha1Hash(sum[:])
+		csize := int64(len(data))
+		rc.Chunks = append(rc.Chunks, recipeChunk{Hash: chash.Hex(), Size: csize})
+		total += csize
+		st.chunks++
+
+		existing, fi, err := b.locateChunk(chash)
+		if err != nil {
+			return "", nil, err
+		}
+		if existing != "" {
+			if n, err := b.size(existing, fi); err == nil && n == csize {
+				st.existing++
+				chunkCount.With("existing").Inc()
+				chunkBytes.With("existing").Add(float64(csize))
+				continue
+			}
+		}
+		cpath := b.layout.path(b.layout.chunkRoot(), b.enc.address(chash))
+		cpath, n, _, err := b.write(cpath, name, chash, csize, bytes.NewReader(data))
+		if err == nil {
+			_, err = b.settle(b.layout.chunkRoot(), cpath, chash)
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("write chunk %s: %v", chash.String(), err)
+		}
+		st.written += n
+		chunkCount.With("new").Inc()
+		chunkBytes.With("new").Add(float64(csize))
+	}
+	if total != size {
+		return "", nil, fmt.Errorf("blob size changed from %d to %d while storing", size, total)
+	}
+
+	data, err := json.Marshal(rc)
+	if err != nil {
+		return "", nil, err
+	}
+	path += recipeExt
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", nil, err
+	}
+	var n int64
+	if b.enc != nil {
+		// the recipe reveals the chunk hashes, encrypt it too
+		n, err = saveEncryptedFile(path, b.enc, nil, h, size, bytes.NewReader(data))
+	} else {
+		n, err = saveFile(path, ioutil.NopCloser(bytes.NewReader(data)))
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	st.written += n
+	return path, st, nil
+}
+
+// readRecipe reads the recipe file at the given path, which is
+// encrypted in encrypted stores.
+func (b *blobFiles) readRecipe(path string) (*recipe, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, _ := br.Peek(len(encryptedMagic)); string(magic) == encryptedMagic {
+		hdr, err := b.enc.readHeader(br)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		r = newDecryptReader(br, hdr)
+	}
+	rc := &recipe{}
+	if err := json.NewDecoder(r).Decode(rc); err != nil {
+		return nil, fmt.Errorf("%s: invalid recipe: %v", path, err)
+	}
+	if rc.Version != recipeVersion {
+		return nil, fmt.Errorf("%s: unsupported recipe version %d", path, rc.Version)
+	}
+	return rc, nil
+}
+
+// chunkReader reads the content of a chunked blob from its
+// chunks, opening one at a time.
+type chunkReader struct {
+	files  *blobFiles
+	chunks []recipeChunk
+	idx    int
+	cur    io.ReadCloser
+	// skip is the offset the first chunk is read from
+	skip int64
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if r.idx == len(r.chunks) {
+				return 0, io.EOF
+			}
+			if err := r.openChunk(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.cur.Close()
+			r.cur = nil
+			r.idx++
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *chunkReader) openChunk() error {
+	c := r.chunks[r.idx]
+	h, err := util.NewSha1HashFromHex(c.Hash)
+	if err != nil {
+		return fmt.Errorf("chunk %d: %v", r.idx, err)
+	}
+	path, _, err := r.files.locateChunk(h)
+	if err != nil {
+		return fmt.Errorf("chunk %s: %v", h.String(), err)
+	}
+	if path == "" {
+		return fmt.Errorf("chunk %s not found", h.String())
+	}
+	if r.skip > 0 {
+		r.cur, err = r.files.openRange(path, r.skip, -1)
+		r.skip = 0
+	} else {
+		r.cur, err = r.files.open(path)
+	}
+	if err != nil {
+		return fmt.Errorf("chunk %s: %v", h.String(), err)
+	}
+	return nil
+}
+
+func (r *chunkReader) Close() error {
+	if r.cur != nil {
+		r.cur.Close()
+		r.cur = nil
+	}
+	r.idx = len(r.chunks)
+	return nil
+}
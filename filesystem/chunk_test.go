@@ -0,0 +1,75 @@
+package filesystem
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testChunking cuts chunks of 4KB on average.
+func testChunking() *Chunking {
+	return &Chunking{MinBlobSize: 16 * 1024, MinSize: 1024, AvgSize: 4 * 1024, MaxSize: 16 * 1024}
+}
+
+// countFiles returns the number of files under dir.
+func countFiles(t *testing.T, dir string) int {
+	n := 0
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestChunkDedup(t *testing.T) {
+	v1 := testContent(256*1024, 1)
+	// the next version has a few bytes changed and a few inserted
+	v2 := append([]byte(nil), v1[:100000]...)
+	v2 = append(v2, []byte("inserted")...)
+	v2 = append(v2, v1[100000:]...)
+	copy(v2[200000:], "changed")
+	for _, encrypted := range []bool{false, true} {
+		root := t.TempDir()
+		fs := newFS(t, root)
+		if err := fs.SetChunking(testChunking()); err != nil {
+			t.Fatal(err)
+		}
+		if encrypted {
+			if err := fs.SetEncryption(newMasterKey(t), AddressHMAC); err != nil {
+				t.Fatal(err)
+			}
+		}
+		chunks := fs.layout.chunkRoot()
+		hashes := storeAll(t, fs, v1)
+		if path := fs.BlobPath(hashes[0]); !strings.HasSuffix(path, recipeExt) {
+			t.Fatalf("blob stored at %s", path)
+		}
+		n1 := countFiles(t, chunks)
+		if n1 < 32 {
+			t.Fatalf("blob of %d bytes cut in %d chunks", len(v1), n1)
+		}
+
+		// the chunks around the changes are new, the others shared
+		hashes = append(hashes, storeAll(t, fs, v2)...)
+		n2 := countFiles(t, chunks)
+		if n2 == n1 || n2-n1 > 8 {
+			t.Fatalf("encrypted %v: %d chunks for the first version, %d new for the second", encrypted, n1, n2-n1)
+		}
+		checkBlobs(t, fs, hashes, v1, v2)
+
+		// the chunks outlive the deleted version
+		if err := fs.Delete(hashes[0]); err != nil {
+			t.Fatal(err)
+		}
+		if n := countFiles(t, chunks); n != n2 {
+			t.Fatalf("%d chunks left of %d", n, n2)
+		}
+		checkBlobs(t, fs, hashes[1:], v2)
+	}
+}
@@ -0,0 +1,281 @@
+package filesystem
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Codec compresses the blob files of a store.
+type Codec interface {
+	// Name is recorded in the header of the compressed blob
+	// files, so that they can be read with the same codec.
+	Name() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// GzipCodec compresses with gzip at the given level, zero is
+// the default level.
+type GzipCodec struct {
+	Level int
+}
+
+func (c GzipCodec) Name() string {
+	return "gzip"
+}
+
+func (c GzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, level(c.Level, gzip.DefaultCompression))
+}
+
+func (c GzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// FlateCodec compresses with raw deflate at the given level,
+// zero is the default level.
+type FlateCodec struct {
+	Level int
+}
+
+func (c FlateCodec) Name() string {
+	return "flate"
+}
+
+func (c FlateCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, level(c.Level, flate.DefaultCompression))
+}
+
+func (c FlateCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+func level(l, def int) int {
+	if l == 0 {
+		return def
+	}
+	return l
+}
+
+var (
+	codecsLock sync.RWMutex
+	codecs     = map[string]Codec{
+		"gzip":  GzipCodec{},
+		"flate": FlateCodec{},
+	}
+)
+
+// RegisterCodec makes the codec available by its name, to read
+// the blobs it compressed and to be chosen in the config.
+func RegisterCodec(c Codec) {
+	codecsLock.Lock()
+	codecs[c.Name()] = c
+	codecsLock.Unlock()
+}
+
+// LookupCodec returns the registered codec with the given name.
+func LookupCodec(name string) (Codec, bool) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// default compression settings
+const (
+	DefaultCompressMinSize  = 512
+	DefaultCompressMaxRatio = 0.9
+	DefaultCompressTrial    = 64 * 1024
+)
+
+// DefaultSkipTypes are the MIME types which are already
+// compressed and are stored as is.
+var DefaultSkipTypes = []string{
+	"image/jpeg", "image/png", "image/gif", "image/webp", "image/heic",
+	"video/*", "audio/*",
+	"application/zip", "application/gzip", "application/x-gzip",
+	"application/x-bzip2", "application/x-xz", "application/x-7z-compressed",
+	"application/x-rar-compressed", "application/zstd", "application/pdf",
+	"application/java-archive", "application/vnd.openxmlformats-officedocument.*",
+}
+
+// Compression decides which blobs are compressed when they are
+// stored, and with which codec.
+type Compression struct {
+	Codec Codec
+	// MinSize is the size below which blobs are stored as is.
+	MinSize int64
+	// MaxRatio is the highest compressed to original size ratio
+	// of the trial compression for which the blob is compressed.
+	MaxRatio float64
+	// TrialSize is the number of leading bytes compressed to
+	// measure the ratio.
+	TrialSize int
+	// SkipTypes are the MIME types, or glob patterns of them such
+	// as "video/*", which are never compressed.
+	SkipTypes []string
+}
+
+// NewCompression returns the compression with the given codec
+// and the default settings.
+func NewCompression(c Codec) *Compression {
+	return &Compression{
+		Codec:     c,
+		MinSize:   DefaultCompressMinSize,
+		MaxRatio:  DefaultCompressMaxRatio,
+		TrialSize: DefaultCompressTrial,
+		SkipTypes: DefaultSkipTypes,
+	}
+}
+
+// SetCompression sets the compression of the blobs stored by
+// Store, nil stores them as is. Blobs are read the same way
+// whether or not they are compressed.
+func (fs *FileSystem) SetCompression(c *Compression) {
+	fs.compression = c
+}
+
+// mimeType returns the MIME type of the blob, from its name or
+// else from its leading bytes.
+func mimeType(name string, head []byte) string {
+	mt := MapName2Mime(name)
+	if mt != defaultMimeType {
+		return mt.Type + "/" + mt.Subtype
+	}
+	t := http.DetectContentType(head)
+	if idx := strings.Index(t, ";"); idx != -1 {
+		t = t[0:idx]
+	}
+	return t
+}
+
+// skipType returns true if the MIME type matches any of the
+// skip types.
+func (c *Compression) skipType(mime string) bool {
+	for _, p := range c.SkipTypes {
+		if ok, _ := path.Match(p, mime); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// decide reads the head of src and returns true if the blob
+// should be compressed, along with a reader of the whole blob.
+func (c *Compression) decide(name string, size int64, src io.Reader) (bool, io.Reader, error) {
+	if size < c.MinSize {
+		return false, src, nil
+	}
+	head := make([]byte, c.TrialSize)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return false, nil, err
+	}
+	head = head[0:n]
+	src = io.MultiReader(bytes.NewReader(head), src)
+	if c.skipType(mimeType(name, head)) {
+		return false, src, nil
+	}
+	buf := &bytes.Buffer{}
+	w, err := c.Codec.NewWriter(buf)
+	if err != nil {
+		return false, nil, err
+	}
+	w.Write(head)
+	if err := w.Close(); err != nil {
+		return false, nil, err
+	}
+	return float64(buf.Len()) <= float64(n)*c.MaxRatio, src, nil
+}
+
+// compressedExt is the extension of compressed blob files.
+const compressedExt = ".z"
+
+// compressedMagic starts the header of compressed blob files.
+const compressedMagic = "FMZ1"
+
+// the header of a compressed blob file is the magic, the length
+// of the codec name as a byte, the codec name and the size of
+// the original content as a big endian uint64
+func writeCompressedHeader(w io.Writer, codec string, size int64) error {
+	hdr := make([]byte, 0, len(compressedMagic)+1+len(codec)+8)
+	hdr = append(hdr, compressedMagic...)
+	hdr = append(hdr, byte(len(codec)))
+	hdr = append(hdr, codec...)
+	var sz [8]byte
+	binary.BigEndian.PutUint64(sz[:], uint64(size))
+	hdr = append(hdr, sz[:]...)
+	_, err := w.Write(hdr)
+	return err
+}
+
+var errBadHeader = errors.New("invalid compressed blob header")
+
+func readCompressedHeader(r io.Reader) (string, int64, error) {
+	var hdr [len(compressedMagic) + 1]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", 0, errBadHeader
+	}
+	if string(hdr[0:len(compressedMagic)]) != compressedMagic {
+		return "", 0, errBadHeader
+	}
+	rest := make([]byte, int(hdr[len(compressedMagic)])+8)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return "", 0, errBadHeader
+	}
+	n := len(rest) - 8
+	return string(rest[0:n]), int64(binary.BigEndian.Uint64(rest[n:])), nil
+}
+
+// decompress reads the compressed header and returns the reader
+// of the original content.
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	name, _, err := readCompressedHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	codec, ok := LookupCodec(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+	return codec.NewReader(r)
+}
+
+// writeCompressed writes the compressed header and the content
+// of src compressed with the codec.
+func writeCompressed(w io.Writer, codec Codec, size int64, src io.Reader) error {
+	if err := writeCompressedHeader(w, codec.Name(), size); err != nil {
+		return err
+	}
+	cw, err := codec.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(cw, src)
+	if cerr := cw.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// saveCompressedFile is like saveFile but compresses the content
+// with the given codec.
+func saveCompressedFile(path string, codec Codec, size int64, src io.Reader) (int64, error) {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	defer func() { <-done }()
+	go func() {
+		defer close(done)
+		pw.CloseWithError(writeCompressed(pw, codec, size, src))
+	}()
+	return saveFile(path, pr)
+}
@@ -0,0 +1,646 @@
+package filesystem
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filemanager/util"
+)
+
+// Addressing is how the blobs of an encrypted store are named.
+type Addressing string
+
+const (
+	// blobs are named by the hash of their content
+	AddressPlain Addressing = "plain"
+	// blobs are named by a keyed HMAC of the hash of their content,
+	// so that the names don't reveal which content is stored
+	AddressHMAC Addressing = "hmac"
+)
+
+// MasterKeySize is the size of the master key, in bytes.
+const MasterKeySize = 32
+
+// DefaultChunkSize is the size of the chunks blobs are encrypted
+// in, so that large blobs are streamed rather than held in memory.
+const DefaultChunkSize = 64 * 1024
+
+// GenerateMasterKey writes a new random master key to the given
+// file, hex encoded, which must not exist.
+func GenerateMasterKey(path string) error {
+	key := make([]byte, MasterKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, hex.EncodeToString(key))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// LoadMasterKey reads a master key file, hex encoded or raw.
+func LoadMasterKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == MasterKeySize {
+		return data, nil
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != MasterKeySize {
+		return nil, fmt.Errorf("%s: expected a %d bytes key, hex encoded or raw", path, MasterKeySize)
+	}
+	return key, nil
+}
+
+// fingerprint identifies a master key without revealing it.
+func fingerprint(key []byte) string {
+	h := sha256.Sum256(key)
+	return hex.EncodeToString(h[0:8])
+}
+
+// keyringName is the name of the keyring file in the store root.
+const keyringName = "keys.json"
+
+// the version of the keyring format
+const keyringVersion = 1
+
+// Keyring is the keyring file of an encrypted store. The store
+// key, which wraps the keys of the blobs, is itself wrapped by
+// the master key, so that rotating the master key only rewraps
+// the store key.
+type Keyring struct {
+	Version    int        `json:"version"`
+	Addressing Addressing `json:"addressing"`
+	ChunkSize  int        `json:"chunk-size"`
+	Master     string     `json:"master"`
+	StoreKey   string     `json:"store-key"`
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// wrap encrypts the key with a random nonce, which is prepended.
+func wrap(kek cipher.AEAD, key []byte) ([]byte, error) {
+	nonce := make([]byte, kek.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return kek.Seal(nonce, nonce, key, nil), nil
+}
+
+func unwrap(kek cipher.AEAD, wrapped []byte) ([]byte, error) {
+	n := kek.NonceSize()
+	if len(wrapped) < n {
+		return nil, errors.New("wrapped key is too short")
+	}
+	return kek.Open(nil, wrapped[0:n], wrapped[n:], nil)
+}
+
+// Encryption encrypts the blobs of a store with AES-GCM, each
+// with its own key, which is wrapped by the store key and kept
+// in the header of the blob file.
+type Encryption struct {
+	addressing Addressing
+	chunkSize  int
+	storeKey   cipher.AEAD
+	hmacKey    []byte
+}
+
+func newEncryption(kr *Keyring, master []byte) (*Encryption, error) {
+	if kr.Master != fingerprint(master) {
+		return nil, fmt.Errorf("the store is encrypted with master key %s, not %s", kr.Master, fingerprint(master))
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(kr.StoreKey)
+	if err != nil {
+		return nil, err
+	}
+	kek, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	key, err := unwrap(kek, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap store key: %v", err)
+	}
+	storeKey, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("filemanager blob address"))
+	return &Encryption{
+		addressing: kr.Addressing,
+		chunkSize:  kr.ChunkSize,
+		storeKey:   storeKey,
+		hmacKey:    mac.Sum(nil),
+	}, nil
+}
+
+// Addressing returns how the blobs are named.
+func (e *Encryption) Addressing() Addressing {
+	return e.addressing
+}
+
+// address returns the hash the blob with the given content hash
+// is named by, which is the hash itself unless the store uses
+// HMAC addressing.
+func (e *Encryption) address(h *util.Hash) *util.Hash {
+	if e == nil || e.addressing != AddressHMAC {
+		return h
+	}
+	mac := hmac.New(sha1.New, e.hmacKey)
+	mac.Write(h.Bytes())
+	return util.NewSha1Hash(mac.Sum(nil))
+}
+
+func readKeyring(root string) (*Keyring, error) {
+	path := filepath.Join(root, keyringName)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	kr := &Keyring{}
+	if err := json.Unmarshal(data, kr); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if kr.Version != keyringVersion {
+		return nil, fmt.Errorf("%s: unsupported version %d", path, kr.Version)
+	}
+	if kr.Addressing != AddressPlain && kr.Addressing != AddressHMAC {
+		return nil, fmt.Errorf("%s: unknown addressing %q", path, kr.Addressing)
+	}
+	if kr.ChunkSize < 1 {
+		return nil, fmt.Errorf("%s: invalid chunk size %d", path, kr.ChunkSize)
+	}
+	return kr, nil
+}
+
+func writeKeyring(root string, kr *Keyring) error {
+	data, err := json.MarshalIndent(kr, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(root, keyringName)
+	if _, err := saveFile(path, ioutil.NopCloser(bytes.NewReader(append(data, '\n')))); err != nil {
+		return err
+	}
+	return os.Chmod(path, 0600)
+}
+
+// Encrypted returns true if the store has a keyring, in which
+// case it can only be written with its master key.
+func (fs *FileSystem) Encrypted() bool {
+	kr, err := readKeyring(fs.root)
+	return err != nil || kr != nil
+}
+
+// Keyring returns the keyring of the store, or nil if it isn't
+// encrypted. The store key in it is wrapped by the master key.
+func (fs *FileSystem) Keyring() (*Keyring, error) {
+	return readKeyring(fs.root)
+}
+
+// Encryption returns the encryption of the store, or nil.
+func (fs *FileSystem) Encryption() *Encryption {
+	return fs.enc
+}
+
+// SetEncryption unlocks the keyring of an encrypted store with
+// the master key, so that its blobs can be read and written. A
+// store without a keyring gets a new one with the given
+// addressing, empty means plain. The blobs stored after that
+// are encrypted, existing ones remain readable, unless the store
+// switches to HMAC addressing which needs an empty store.
+func (fs *FileSystem) SetEncryption(master []byte, addressing Addressing) error {
+	if len(master) != MasterKeySize {
+		return fmt.Errorf("master key must be %d bytes, got %d", MasterKeySize, len(master))
+	}
+	kr, err := readKeyring(fs.root)
+	if err != nil {
+		return err
+	}
+	if kr != nil {
+		if addressing != "" && addressing != kr.Addressing {
+			return fmt.Errorf("the store uses %s addressing, not %s", kr.Addressing, addressing)
+		}
+	} else {
+		if addressing == "" {
+			addressing = AddressPlain
+		}
+		if addressing != AddressPlain && addressing != AddressHMAC {
+			return fmt.Errorf("unknown addressing %q, expected plain or hmac", addressing)
+		}
+		if addressing == AddressHMAC {
+			found, err := fs.layout.hasBlobs()
+			if err != nil {
+				return err
+			}
+			if found {
+				return fmt.Errorf("hmac addressing needs an empty store")
+			}
+		}
+		kr, err = newKeyring(master, addressing)
+		if err != nil {
+			return err
+		}
+		if err := writeKeyring(fs.root, kr); err != nil {
+			return err
+		}
+		fs.lg.Info().Str("addressing", string(addressing)).Msg("store keyring created")
+	}
+	enc, err := newEncryption(kr, master)
+	if err != nil {
+		return err
+	}
+	fs.enc = enc
+	return nil
+}
+
+func newKeyring(master []byte, addressing Addressing) (*Keyring, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	kek, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := wrap(kek, key)
+	if err != nil {
+		return nil, err
+	}
+	return &Keyring{
+		Version:    keyringVersion,
+		Addressing: addressing,
+		ChunkSize:  DefaultChunkSize,
+		Master:     fingerprint(master),
+		StoreKey:   base64.StdEncoding.EncodeToString(wrapped),
+	}, nil
+}
+
+// RotateMasterKey rewraps the store key with a new master key.
+// The blobs are not touched, their keys are wrapped by the store
+// key which doesn't change.
+func (fs *FileSystem) RotateMasterKey(old, new []byte) error {
+	kr, err := readKeyring(fs.root)
+	if err != nil {
+		return err
+	}
+	if kr == nil {
+		return fmt.Errorf("the store is not encrypted")
+	}
+	if len(new) != MasterKeySize {
+		return fmt.Errorf("master key must be %d bytes, got %d", MasterKeySize, len(new))
+	}
+	if kr.Master != fingerprint(old) {
+		return fmt.Errorf("the store is encrypted with master key %s, not %s", kr.Master, fingerprint(old))
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(kr.StoreKey)
+	if err != nil {
+		return err
+	}
+	oldKek, err := newGCM(old)
+	if err != nil {
+		return err
+	}
+	key, err := unwrap(oldKek, wrapped)
+	if err != nil {
+		return fmt.Errorf("unwrap store key: %v", err)
+	}
+	newKek, err := newGCM(new)
+	if err != nil {
+		return err
+	}
+	if wrapped, err = wrap(newKek, key); err != nil {
+		return err
+	}
+	kr.Master = fingerprint(new)
+	kr.StoreKey = base64.StdEncoding.EncodeToString(wrapped)
+	if err := writeKeyring(fs.root, kr); err != nil {
+		return err
+	}
+	fs.lg.Info().Str("master", kr.Master).Msg("master key rotated")
+	if fs.enc != nil {
+		if fs.enc, err = newEncryption(kr, new); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encryptedExt is the extension of encrypted blob files.
+const encryptedExt = ".e"
+
+// encryptedMagic starts the header of encrypted blob files.
+const encryptedMagic = "FME1"
+
+// header flags
+const flagCompressed = 1
+
+// the header of an encrypted blob file is
+//
+//	magic, flags byte, chunk size uint32
+//	the blob key wrapped by the store key
+//	the content hash and size sealed by the blob key, with the
+//	above as additional data
+//
+// followed by the chunks, each sealed by the blob key with the
+// chunk index as nonce, and a flag in the nonce of the last one
+// so that a truncated file doesn't pass as a shorter blob.
+const (
+	prefixSize     = len(encryptedMagic) + 1 + 4
+	blobKeySize    = 32
+	wrappedKeySize = 12 + blobKeySize + 16
+	sealedMetaSize = sha1.Size + 8 + 16
+)
+
+// metaNonce is the nonce of the sealed meta, chunk nonces
+// start with 0 or 1 so they never equal it.
+var metaNonce = bytes.Repeat([]byte{0xff}, 12)
+
+func chunkNonce(nonce []byte, idx uint64, last bool) {
+	for i := range nonce[0:4] {
+		nonce[i] = 0
+	}
+	if last {
+		nonce[0] = 1
+	}
+	binary.BigEndian.PutUint64(nonce[4:], idx)
+}
+
+// encHeader is the decoded header of an encrypted blob file.
+type encHeader struct {
+	flags     byte
+	chunkSize int
+	blobKey   cipher.AEAD
+	hash      *util.Hash
+	size      int64
+}
+
+func (e *Encryption) writeHeader(w io.Writer, h *util.Hash, size int64, flags byte) (cipher.AEAD, error) {
+	key := make([]byte, blobKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	blobKey, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := wrap(e.storeKey, key)
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, 0, prefixSize+wrappedKeySize+sealedMetaSize)
+	hdr = append(hdr, encryptedMagic...)
+	hdr = append(hdr, flags)
+	var cs [4]byte
+	binary.BigEndian.PutUint32(cs[:], uint32(e.chunkSize))
+	hdr = append(hdr, cs[:]...)
+	hdr = append(hdr, wrapped...)
+	meta := make([]byte, 0, sha1.Size+8)
+	meta = append(meta, h.Bytes()...)
+	var sz [8]byte
+	binary.BigEndian.PutUint64(sz[:], uint64(size))
+	meta = append(meta, sz[:]...)
+	hdr = blobKey.Seal(hdr, metaNonce, meta, hdr[0:prefixSize])
+	_, err = w.Write(hdr)
+	return blobKey, err
+}
+
+var errEncHeader = errors.New("invalid encrypted blob header")
+
+func (e *Encryption) readHeader(r io.Reader) (*encHeader, error) {
+	hdr := make([]byte, prefixSize+wrappedKeySize+sealedMetaSize)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, errEncHeader
+	}
+	if string(hdr[0:len(encryptedMagic)]) != encryptedMagic {
+		return nil, errEncHeader
+	}
+	if e == nil {
+		return nil, errors.New("the blob is encrypted, a master key is required")
+	}
+	key, err := unwrap(e.storeKey, hdr[prefixSize:prefixSize+wrappedKeySize])
+	if err != nil {
+		return nil, fmt.Errorf("unwrap blob key: %v", err)
+	}
+	blobKey, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := blobKey.Open(nil, metaNonce, hdr[prefixSize+wrappedKeySize:], hdr[0:prefixSize])
+	if err != nil {
+		return nil, fmt.Errorf("open blob meta: %v", err)
+	}
+	chunkSize := int(binary.BigEndian.Uint32(hdr[len(encryptedMagic)+1 : prefixSize]))
+	if chunkSize < 1 {
+		return nil, errEncHeader
+	}
+	return &encHeader{
+		flags:     hdr[len(encryptedMagic)],
+		chunkSize: chunkSize,
+		blobKey:   blobKey,
+		hash:      util.NewSha1Hash(meta[0:sha1.Size]),
+		size:      int64(binary.BigEndian.Uint64(meta[sha1.Size:])),
+	}, nil
+}
+
+// readEncHeader reads the header of the encrypted blob file.
+func readEncHeader(path string, enc *Encryption) (*encHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hdr, err := enc.readHeader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return hdr, nil
+}
+
+// encryptWriter seals what is written to it in chunks.
+type encryptWriter struct {
+	w     io.Writer
+	key   cipher.AEAD
+	buf   []byte
+	out   []byte
+	nonce []byte
+	idx   uint64
+}
+
+func (e *Encryption) newWriter(w io.Writer, h *util.Hash, size int64, flags byte) (io.WriteCloser, error) {
+	key, err := e.writeHeader(w, h, size, flags)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		w:     w,
+		key:   key,
+		buf:   make([]byte, 0, e.chunkSize),
+		out:   make([]byte, 0, e.chunkSize+key.Overhead()),
+		nonce: make([]byte, key.NonceSize()),
+	}, nil
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed once more data follows, as
+		// the last chunk is sealed differently
+		if len(w.buf) == cap(w.buf) {
+			if err := w.seal(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[0 : len(w.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (w *encryptWriter) seal(last bool) error {
+	chunkNonce(w.nonce, w.idx, last)
+	w.out = w.key.Seal(w.out[0:0], w.nonce, w.buf, nil)
+	w.idx++
+	w.buf = w.buf[0:0]
+	_, err := w.w.Write(w.out)
+	return err
+}
+
+// Close seals the last chunk, which may be empty.
+func (w *encryptWriter) Close() error {
+	return w.seal(true)
+}
+
+// decryptReader opens the chunks read from r.
+type decryptReader struct {
+	r     *bufio.Reader
+	key   cipher.AEAD
+	in    []byte
+	buf   []byte
+	nonce []byte
+	idx   uint64
+	done  bool
+}
+
+func newDecryptReader(r *bufio.Reader, hdr *encHeader) *decryptReader {
+	return &decryptReader{
+		r:     r,
+		key:   hdr.blobKey,
+		in:    make([]byte, hdr.chunkSize+hdr.blobKey.Overhead()),
+		nonce: make([]byte, hdr.blobKey.NonceSize()),
+	}
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.r, d.in)
+	last := false
+	switch err {
+	case nil:
+		if _, err := d.r.Peek(1); err == io.EOF {
+			last = true
+		}
+	case io.ErrUnexpectedEOF:
+		last = true
+	case io.EOF:
+		return io.ErrUnexpectedEOF
+	default:
+		return err
+	}
+	chunkNonce(d.nonce, d.idx, last)
+	d.buf, err = d.key.Open(d.in[0:0], d.nonce, d.in[0:n], nil)
+	if err != nil {
+		return fmt.Errorf("open chunk %d: %v", d.idx, err)
+	}
+	d.idx++
+	d.done = last
+	return nil
+}
+
+// saveEncryptedFile is like saveFile but encrypts the content,
+// compressing it first with the given codec, if any.
+func saveEncryptedFile(path string, enc *Encryption, codec Codec, h *util.Hash, size int64, src io.Reader) (int64, error) {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	defer func() { <-done }()
+	go func() {
+		defer close(done)
+		pw.CloseWithError(writeEncrypted(pw, enc, codec, h, size, src))
+	}()
+	return saveFile(path, pr)
+}
+
+// writeEncrypted writes the encrypted header and the content of
+// src sealed with a new blob key, compressed first with the codec
+// if there is one.
+func writeEncrypted(w io.Writer, enc *Encryption, codec Codec, h *util.Hash, size int64, src io.Reader) error {
+	var flags byte
+	if codec != nil {
+		flags |= flagCompressed
+	}
+	ew, err := enc.newWriter(w, h, size, flags)
+	if err != nil {
+		return err
+	}
+	if codec != nil {
+		err = writeCompressed(ew, codec, size, src)
+	} else {
+		_, err = io.Copy(ew, src)
+	}
+	if cerr := ew.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
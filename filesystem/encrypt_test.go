@@ -0,0 +1,106 @@
+package filesystem
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func newMasterKey(t *testing.T) []byte {
+	key := make([]byte, MasterKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	// the large blob spans a few encryption chunks, and compresses
+	contents := [][]byte{[]byte("a"), testContent(3000, 1), bytes.Repeat(testContent(1000, 2), 3*DefaultChunkSize/1000+1)}
+	for _, c := range []struct {
+		name       string
+		addressing Addressing
+		compress   bool
+	}{
+		{"plain", AddressPlain, false},
+		{"plain compressed", AddressPlain, true},
+		{"hmac", AddressHMAC, false},
+		{"hmac compressed", AddressHMAC, true},
+	} {
+		root := t.TempDir()
+		master := newMasterKey(t)
+		fs := newFS(t, root)
+		if err := fs.SetEncryption(master, c.addressing); err != nil {
+			t.Fatal(err)
+		}
+		if c.compress {
+			fs.SetCompression(NewCompression(GzipCodec{}))
+		}
+		hashes := storeAll(t, fs, contents...)
+		checkBlobs(t, fs, hashes, contents...)
+		for i, h := range hashes {
+			path := fs.BlobPath(h)
+			if !strings.HasSuffix(path, encryptedExt) {
+				t.Fatalf("%s: blob %d stored at %s", c.name, i, path)
+			}
+			if named := strings.Contains(path, h.Hex()); named != (c.addressing == AddressPlain) {
+				t.Fatalf("%s: blob %d stored at %s", c.name, i, path)
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(contents[i]) > 1 && bytes.Contains(data, contents[i][:64]) {
+				t.Fatalf("%s: blob %d stored in clear", c.name, i)
+			}
+			if i == 2 && c.compress != (len(data) < len(contents[i])) {
+				t.Fatalf("%s: blob %d of %d bytes stored in %d bytes", c.name, i, len(contents[i]), len(data))
+			}
+		}
+
+		// another file system reads them back with the master key,
+		// not without it
+		other := newFS(t, root)
+		if _, err := readBlob(other, hashes[1]); err == nil {
+			t.Fatalf("%s: blob read without the master key", c.name)
+		}
+		if err := other.SetEncryption(newMasterKey(t), ""); err == nil {
+			t.Fatalf("%s: keyring unlocked by another key", c.name)
+		}
+		if err := other.SetEncryption(master, ""); err != nil {
+			t.Fatal(err)
+		}
+		checkBlobs(t, other, hashes, contents...)
+	}
+}
+
+func TestRotateMasterKey(t *testing.T) {
+	root := t.TempDir()
+	old, next := newMasterKey(t), newMasterKey(t)
+	fs := newFS(t, root)
+	if err := fs.SetEncryption(old, AddressHMAC); err != nil {
+		t.Fatal(err)
+	}
+	contents := [][]byte{[]byte("before"), testContent(DefaultChunkSize+1, 1)}
+	hashes := storeAll(t, fs, contents...)
+	if err := fs.RotateMasterKey(next, newMasterKey(t)); err == nil {
+		t.Fatal("rotated with another key than the master key")
+	}
+	if err := fs.RotateMasterKey(old, next); err != nil {
+		t.Fatal(err)
+	}
+
+	// the blobs stored before and after the rotation read back
+	more := storeAll(t, fs, []byte("after"))
+	checkBlobs(t, fs, append(hashes, more...), append(contents, []byte("after"))...)
+	other := newFS(t, root)
+	if err := other.SetEncryption(old, ""); err == nil {
+		t.Fatal("keyring unlocked by the old master key")
+	}
+	if err := other.SetEncryption(next, ""); err != nil {
+		t.Fatal(err)
+	}
+	checkBlobs(t, other, append(hashes, more...), append(contents, []byte("after"))...)
+}
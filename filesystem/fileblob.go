@@ -21,6 +21,11 @@ type FileBlob struct {
 	blob []byte
 	size int64
 	hash *util.Hash
+	// files is set for the blob files of a store, which may be
+	// compressed, encrypted or chunked
+	files *blobFiles
+	// entry is set for packed blobs, path is the pack then
+	entry *packEntry
 }
 
 // Path returns the full path to the file
@@ -58,7 +63,7 @@ func (f *FileBlob) Load() error {
 		f.hash = util.NewSha1Hash(h[:])
 		return nil
 	}
-	ff, err := os.Open(f.path)
+	ff, err := f.open()
 	if err != nil {
 		return err
 	}
@@ -84,14 +89,30 @@ func (f *FileBlob) Bytes() []byte {
 	return f.blob
 }
 
-// Reader returns a bytes.Buffer wrapping its blob
+// Reader returns a bytes.Buffer wrapping its blob, or the
+// opened file if the blob hasn't been loaded into memory. The
+// content of compressed, encrypted, chunked and packed blobs is
+// decoded.
 func (f *FileBlob) ReadCloser() (io.ReadCloser, error) {
 	if f.blob == nil {
-		return nil, fmt.Errorf("underlying blob ([]byte) is nil")
+		if f.path == "" {
+			return nil, fmt.Errorf("underlying blob ([]byte) is nil")
+		}
+		return f.open()
 	}
 	return blob.NewBufferedReadCloser(f.blob), nil
 }
 
+func (f *FileBlob) open() (io.ReadCloser, error) {
+	if f.entry != nil {
+		return f.files.openEntry(f.entry)
+	}
+	if f.files != nil {
+		return f.files.open(f.path)
+	}
+	return os.Open(f.path)
+}
+
 // Hash returns a *util.Hash object represents the hash
 // of the file content.
 func (f *FileBlob) Hash() *util.Hash {
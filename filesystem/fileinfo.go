@@ -7,8 +7,9 @@ import (
 	"os/exec"
 	"strings"
 	"sync"
+	"time"
 
-	//"filemanager/blob"
+	"filemanager/blob"
 	"filemanager/meta"
 	"filemanager/util"
 
@@ -21,15 +22,26 @@ func init() {
 	fileCmdPath = lookupFileCmd()
 }
 
-// look up 'file' command, panic if not found
+// look up 'file' command, return empty string if not found
 func lookupFileCmd() string {
 	path, err := exec.LookPath("file")
 	if err != nil {
-		panic(err.Error())
+		return ""
 	}
 	return path
 }
 
+// SetFileCmd sets the path to the 'file' command used by
+// DetectMimeType, instead of the one found in PATH.
+func SetFileCmd(path string) error {
+	p, err := exec.LookPath(path)
+	if err != nil {
+		return err
+	}
+	fileCmdPath = p
+	return nil
+}
+
 // example:
 //   text/plain; charset=us-ascii
 func parseMimeString(s string) *MimeType {
@@ -84,6 +96,11 @@ func detectWithFileCmd(
 	inputFilePath string,
 	outCh chan *meta.MetaExtractResult) {
 
+	if fileCmdPath == "" {
+		outCh <- meta.NewMetaExtractErr(fmt.Errorf("'file' command not found"))
+		return
+	}
+
 	// detect mime info
 	outBytes, err := exec.Command(fileCmdPath, "-p", "--mime", "-f", inputFilePath).Output()
 	if err != nil {
@@ -168,6 +185,17 @@ func detect(
 		bm.Add("fileext", meta.StringValue(util.FileExt(fname)))
 		bm.Add("fileext-mime-type", meta.StringValue(mt.Type))
 		bm.Add("fileext-mime-subtype", meta.StringValue(mt.Subtype))
+		if mt.Type == "image" && mt.Subtype == "jpeg" {
+			// only the leading segments are read
+			size, _ := f.Size()
+			em, err := meta.ReadExif(blob.NewReaderAt(f), size)
+			if err != nil {
+				outCh <- meta.NewMetaExtractErr(fmt.Errorf("%s: %v", path, err))
+			}
+			for k, v := range em {
+				bm.Add(k, v)
+			}
+		}
 		path2meta[path] = bm
 	}
 
@@ -187,7 +215,10 @@ func detect(
 		} else {
 			// successfully created the list file, call "file" command to
 			// detect file mime info
+			t := time.Now()
 			detectWithFileCmd(path2meta, tmpfilepath, outCh)
+			detectBatchLatency.ObserveDuration(time.Now().Sub(t))
+			detectBatchSize.Observe(float64(cnt))
 		}
 	}
 
@@ -3,12 +3,15 @@ package filesystem
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sync"
 	"time"
 
+	"filemanager/archive"
 	"filemanager/blob"
+	"filemanager/job"
 	"filemanager/util"
 
 	"github.com/rs/zerolog"
@@ -28,6 +31,29 @@ var skipDotFile = func(path string) bool {
 	return false
 }
 
+// skipPatterns returns a skipFunc which skips the paths whose
+// base name, or path relative to root, matches any of the
+// given glob patterns.
+func skipPatterns(root string, patterns []string) skipFunc {
+	return func(path string) bool {
+		name := filepath.Base(path)
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			rel = path
+		}
+		rel = filepath.ToSlash(rel)
+		for _, p := range patterns {
+			if ok, _ := filepath.Match(p, name); ok {
+				return true
+			}
+			if ok, _ := filepath.Match(p, rel); ok {
+				return true
+			}
+		}
+		return false
+	}
+}
+
 func composeSkipFunc(funcs ...skipFunc) skipFunc {
 	return func(path string) bool {
 		for _, f := range funcs {
@@ -40,13 +66,28 @@ func composeSkipFunc(funcs ...skipFunc) skipFunc {
 }
 
 type FileSystem struct {
-	root      string
-	maxLoader int
-	maxSaver  int
-	skip      skipFunc
-	lg        *zerolog.Logger
+	root             string
+	maxLoader        int
+	maxSaver         int
+	skip             skipFunc
+	progressInterval time.Duration
+	layout           *storeLayout
+	compression      *Compression
+	enc              *Encryption
+	chunking         *Chunking
+	packing          *Packing
+	packs            *packSet
+	expand           *archive.Limits
+	jobs             *job.Manager
+	lg               *zerolog.Logger
 }
 
+// the allowed range of maxLoader and maxSaver
+const (
+	MinWorkers = 1
+	MaxWorkers = 20
+)
+
 // New creates a file system storage
 func New(
 	root string,
@@ -58,25 +99,92 @@ func New(
 	if err != nil {
 		return nil, err
 	}
-	if maxSaver < 1 || maxSaver > 20 {
-		return nil, fmt.Errorf("maxSaver %d is out of allowed range [1, 20]", maxSaver)
+	if maxSaver < MinWorkers || maxSaver > MaxWorkers {
+		return nil, fmt.Errorf("maxSaver %d is out of allowed range [%d, %d]", maxSaver, MinWorkers, MaxWorkers)
 	}
-	if maxLoader < 1 || maxLoader > 20 {
-		return nil, fmt.Errorf("maxLoader %d is out of allowed range [1, 20]", maxLoader)
+	if maxLoader < MinWorkers || maxLoader > MaxWorkers {
+		return nil, fmt.Errorf("maxLoader %d is out of allowed range [%d, %d]", maxLoader, MinWorkers, MaxWorkers)
+	}
+	layout, err := newStoreLayout(root)
+	if err != nil {
+		return nil, err
 	}
 	l := lg.With().Str("root", root).Logger()
+	jobs, err := job.NewManager(root, job.DefaultMaxJobs, &l)
+	if err != nil {
+		return nil, err
+	}
 	return &FileSystem{
-		root:      root,
-		skip:      skipDotFile,
-		maxLoader: maxLoader,
-		maxSaver:  maxSaver,
-		lg:        &l,
+		root:             root,
+		skip:             skipDotFile,
+		maxLoader:        maxLoader,
+		maxSaver:         maxSaver,
+		progressInterval: blob.DefaultProgressInterval,
+		layout:           layout,
+		packs:            newPackSet(root),
+		jobs:             jobs,
+		lg:               &l,
 	}, nil
 }
 
+// Root returns the absolute path to the root directory.
+func (fs *FileSystem) Root() string {
+	return fs.root
+}
+
+// Jobs returns the manager of the Load and Store jobs of this
+// file system, which limits how many of each run at once. Loads
+// and stores have separate slots, so a Load piped into a Store of
+// the same file system runs with a single slot.
+func (fs *FileSystem) Jobs() *job.Manager {
+	return fs.jobs
+}
+
+// SetSkip replaces the skip rules used by Load. Dot files are
+// skipped if dotFiles is true, and so are the files and dirs
+// whose name or path relative to the root matches any of the
+// given glob patterns.
+func (fs *FileSystem) SetSkip(dotFiles bool, patterns []string) error {
+	for _, p := range patterns {
+		if _, err := filepath.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid skip pattern %q: %v", p, err)
+		}
+	}
+	funcs := make([]skipFunc, 0, 2)
+	if dotFiles {
+		funcs = append(funcs, skipDotFile)
+	}
+	if len(patterns) > 0 {
+		funcs = append(funcs, skipPatterns(fs.root, patterns))
+	}
+	fs.skip = composeSkipFunc(funcs...)
+	return nil
+}
+
+// SetExpansion makes Load descend into the zip, tar and gzip files
+// it loads, within the limits, see archive.Expand. The archives are
+// loaded as-is as well. Nil disables the expansion.
+func (fs *FileSystem) SetExpansion(l *archive.Limits) error {
+	if l != nil {
+		if err := l.Validate(); err != nil {
+			return err
+		}
+	}
+	fs.expand = l
+	return nil
+}
+
+// SetProgressInterval sets the interval at which Load and Store
+// emit progress snapshots, a non-positive interval disables them.
+func (fs *FileSystem) SetProgressInterval(d time.Duration) {
+	fs.progressInterval = d
+}
+
 func loadFile(
 	id int,
 	fileCh chan string,
+	rec *snapshotRecorder,
+	expand *archive.Limits,
 	wg *sync.WaitGroup,
 	pr *blob.ProcessStatus,
 	lg *zerolog.Logger) {
@@ -87,14 +195,36 @@ func loadFile(
 
 	l.Debug().Msg("started")
 
+	worker := fmt.Sprintf("loader-%d", id)
+	defer pr.RemoveWorker(worker)
+
 	blobCh := pr.Blob()
-	for fpath := range fileCh {
+	for {
+		pr.SetWorkerState(worker, "")
+		fpath, ok := <-fileCh
+		if !ok {
+			break
+		}
+		if !pr.WaitIfPaused() {
+			continue
+		}
+		pr.SetWorkerState(worker, fpath)
 		blob := NewFileBlob(fpath)
 		url := blob.Url()
 		bl := l.With().Str("url", url.String()).Logger()
 
 		bl.Debug().Msg("start loading file")
 		t := time.Now()
+		var fi os.FileInfo
+		if rec != nil {
+			// before reading it, which changes its atime
+			var err error
+			if fi, err = os.Stat(fpath); err != nil {
+				pr.AddErrorCount(1)
+				bl.Error().Err(err).Msg("stat")
+				continue
+			}
+		}
 		err := blob.Load()
 		if err != nil {
 			pr.AddErrorCount(1)
@@ -103,14 +233,34 @@ func loadFile(
 		}
 		h := blob.Hash()
 		size, _ := blob.Size()
+		if rec != nil {
+			rec.add(fpath, fi, size, h)
+		}
+		d := time.Now().Sub(t)
 		pr.AddCount(1)
 		pr.AddSize(size)
+		loadLatency.ObserveDuration(d)
+		loadSize.Observe(float64(size))
 		bl.Info().
 			Str("content-hash", h.String()).
 			Int64("size", size).
-			Int64("duration", time.Now().Sub(t).Nanoseconds()).
+			Int64("duration", d.Nanoseconds()).
 			Msg("loaded")
-		blobCh <- blob
+		// the content is kept for the expansion, the storage may
+		// free the blob once sent
+		data := blob.Bytes()
+		select {
+		case blobCh <- blob:
+		case <-pr.Canceled():
+			continue
+		}
+		if expand != nil && archive.IsArchiveName(fpath) {
+			err := archive.Expand(data, filepath.Base(fpath), url, h, expand, pr, &bl)
+			if err != nil {
+				pr.AddErrorCount(1)
+				bl.Error().Err(err).Msg("expand")
+			}
+		}
 	}
 
 	l.Debug().Msg("finished")
@@ -120,6 +270,7 @@ func walkDir(
 	dirPath string,
 	skip skipFunc,
 	fileCh chan string,
+	rec *snapshotRecorder,
 	sts *blob.ProcessStatus,
 	lg *zerolog.Logger) {
 
@@ -147,6 +298,10 @@ func walkDir(
 	}
 	if fileInfoArray != nil {
 		for _, fi := range fileInfoArray {
+			if !sts.WaitIfPaused() {
+				lg.Info().Str("path", dirPath).Msg("canceled")
+				return
+			}
 			fpath := filepath.Join(dirPath, fi.Name())
 			if skip(fpath) {
 				sts.AddSkipCount(1)
@@ -164,9 +319,13 @@ func walkDir(
 				}
 			} else {
 				if fi.IsDir() {
-					walkDir(fpath, skip, fileCh, sts, lg)
+					rec.add(fpath, fi, 0, nil)
+					walkDir(fpath, skip, fileCh, rec, sts, lg)
 				} else {
-					fileCh <- fpath
+					select {
+					case fileCh <- fpath:
+					case <-sts.Canceled():
+					}
 				}
 			}
 		}
@@ -175,53 +334,132 @@ func walkDir(
 	lg.Debug().Str("path", dirPath).Msg("done scanning dir")
 }
 
+// countDir is a fast pass over the dir tree which adds the
+// number and size of the files walkDir will meet to the
+// estimated totals of the given status. It stops early once
+// the process is done.
+func countDir(
+	dirPath string,
+	skip skipFunc,
+	sts *blob.ProcessStatus) bool {
+
+	select {
+	case <-sts.Done():
+		return false
+	case <-sts.Canceled():
+		return false
+	default:
+	}
+
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return true
+	}
+	fileInfoArray, _ := dir.Readdir(-1)
+	dir.Close()
+	cnt := 0
+	size := int64(0)
+	for _, fi := range fileInfoArray {
+		fpath := filepath.Join(dirPath, fi.Name())
+		if fi.IsDir() && !skip(fpath) {
+			if !countDir(fpath, skip, sts) {
+				return false
+			}
+			continue
+		}
+		cnt++
+		if !fi.IsDir() {
+			size += fi.Size()
+		}
+	}
+	sts.AddEstimate(cnt, size)
+	return true
+}
+
+func estimate(
+	dirPath string,
+	skip skipFunc,
+	sts *blob.ProcessStatus,
+	lg *zerolog.Logger) {
+
+	t := time.Now()
+	if countDir(dirPath, skip, sts) {
+		sts.FinishEstimate()
+		p := sts.Snapshot()
+		lg.Debug().
+			Int64("estimated-count", p.EstimatedCount).
+			Int64("estimated-size", p.EstimatedSize).
+			Int64("duration", time.Now().Sub(t).Nanoseconds()).
+			Msg("done estimating")
+	}
+}
+
 func load(
 	dirPath string,
 	skip skipFunc,
 	loaderCnt int,
+	rec *snapshotRecorder,
+	expand *archive.Limits,
+	done func(*blob.ProcessStatus),
 	sts *blob.ProcessStatus,
 	lg *zerolog.Logger) {
 
 	lg.Debug().Msg("start scanning")
 
+	go estimate(dirPath, skip, sts, lg)
+
 	fileCh := make(chan string)
 	wg := &sync.WaitGroup{}
 	wg.Add(loaderCnt)
 	for i := 0; i < loaderCnt; i++ {
-		go loadFile(i, fileCh, wg, sts, lg)
+		go loadFile(i, fileCh, rec, expand, wg, sts, lg)
 	}
-	walkDir(dirPath, skip, fileCh, sts, lg)
+	walkDir(dirPath, skip, fileCh, rec, sts, lg)
 	close(fileCh)
 	wg.Wait()
+	if done != nil && !sts.IsCanceled() {
+		done(sts)
+	}
 	sts.Finish()
 
 	lg.Debug().Msg("done scanning")
 }
 
-func blobExists(path string, size int64) (bool, error) {
-	fi, err := os.Stat(path)
+// tempMarker is part of the name of the temp files blobs are
+// written to before they are renamed to their final path.
+const tempMarker = ".tmp-"
+
+// saveFile writes src to a temp file next to path and renames
+// it to path once complete, so that an interrupted write never
+// leaves a truncated blob behind.
+func saveFile(path string, src io.ReadCloser) (int64, error) {
+	defer src.Close()
+	dst, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+tempMarker)
+	if err != nil {
+		return 0, err
+	}
+	tmpPath := dst.Name()
+	n, err := io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
 	if err == nil {
-		return fi.Size() == size, nil
+		err = os.Chmod(tmpPath, 0644)
 	}
-	if os.IsNotExist(err) {
-		return false, nil
+	if err == nil {
+		err = os.Rename(tmpPath, path)
 	}
-	return false, err
-}
-
-func saveFile(path string, src io.ReadCloser) (int64, error) {
-	dst, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
+		os.Remove(tmpPath)
 		return 0, err
 	}
-	defer dst.Close()
-	defer src.Close()
-	return io.Copy(dst, src)
+	return n, nil
 }
 
 func save(
 	id int,
-	root string,
+	files *blobFiles,
+	cp *job.Checkpoint,
 	inCh chan blob.Blob,
 	wg *sync.WaitGroup,
 	sts *blob.ProcessStatus,
@@ -233,10 +471,28 @@ func save(
 
 	l.Debug().Msg("started")
 
+	worker := fmt.Sprintf("saver-%d", id)
+	defer sts.RemoveWorker(worker)
+
 	outCh := sts.Blob()
-	for blob := range inCh {
+	for {
+		sts.SetWorkerState(worker, "")
+		blob, ok := <-inCh
+		if !ok {
+			break
+		}
+		if cp != nil && sts.IsPaused() {
+			if err := cp.Sync(); err != nil {
+				l.Error().Err(err).Msg("sync checkpoint error")
+			}
+		}
+		if !sts.WaitIfPaused() {
+			// keep draining so that the sender doesn't block
+			continue
+		}
 		url := blob.Url()
 		bl := l.With().Str("source", url.String()).Logger()
+		sts.SetWorkerState(worker, url.String())
 
 		// blob size
 		blobSize, err := blob.Size()
@@ -246,28 +502,39 @@ func save(
 			continue
 		}
 
-		// blob hash & path
+		// blob hash
 		blobHash := blob.Hash()
-		alg := blobHash.Algorithm()
-		hex := blobHash.Hex()
-		blobPath := filepath.Join(root, alg, hex[0:2], hex[2:4], hex[4:6], hex[6:8], hex)
 		blobHashStr := blobHash.String()
 		bl = bl.With().
 			Str("content-hash", blobHashStr).
-			Str("blob-path", blobPath).
 			Logger()
 
-		// skip if target already exists
-		exists, err := blobExists(blobPath, blobSize)
+		// skip if target already exists, in either layout while
+		// the store is migrated
+		existing, fi, err := files.locate(blobHash)
 		if err != nil {
 			sts.AddErrorCount(1)
 			bl.Error().Err(err).Msg("check target blob error")
 			continue
 		}
+		// the path, named by its address, in the layout of the
+		// descriptor locate may just have reread
+		blobPath := files.layout.path(files.layout.root, files.enc.address(blobHash))
+		bl = bl.With().
+			Str("blob-path", blobPath).
+			Logger()
+		exists := false
+		if existing != "" {
+			size, err := files.size(existing, fi)
+			exists = err == nil && size == blobSize
+		} else if e, err := files.lookupPacked(blobHash); err == nil && e != nil {
+			exists = e.size == blobSize
+		}
 		if exists {
 			sts.AddSkipCount(1)
 			sts.AddSkipSize(blobSize)
 			bl.Info().Msg("skip existing")
+			markDone(cp, url.String(), blobHashStr, blobSize, &bl)
 			continue
 		}
 
@@ -275,83 +542,204 @@ func save(
 
 		t := time.Now()
 
-		// create dir
-		err = os.MkdirAll(filepath.Dir(blobPath), 0755)
-		if err != nil {
-			sts.AddErrorCount(1)
-			bl.Error().Err(err).Msg("mkdir error")
-			continue
-		}
-
-		// save blob file
+		// save blob file, whole or in chunks
 		blobReadCloser, err := blob.ReadCloser()
 		if err != nil {
 			sts.AddErrorCount(1)
 			bl.Error().Err(err).Msg("blob reader error")
 			continue
 		}
-		_, err = saveFile(blobPath, blobReadCloser)
+		var written int64
+		var compressed bool
+		var chunks *chunkStats
+		var entry *packEntry
+		switch {
+		case files.packer != nil && blobSize <= files.packer.packing.MaxBlobSize:
+			entry, written, compressed, err = files.pack(blob.Name(), blobHash, blobSize, blobReadCloser)
+			if entry != nil {
+				blobPath = entry.path
+			}
+		case files.chunking != nil && blobSize >= files.chunking.MinBlobSize:
+			blobPath, chunks, err = files.writeChunked(blobPath, blob.Name(), blobHash, blobSize, blobReadCloser)
+			if chunks != nil {
+				written = chunks.written
+			}
+		default:
+			blobPath, written, compressed, err = files.write(blobPath, blob.Name(), blobHash, blobSize, blobReadCloser)
+		}
+		blobReadCloser.Close()
+		if err == nil && entry == nil {
+			blobPath, err = files.settle(files.layout.root, blobPath, blobHash)
+		}
 		if err != nil {
 			sts.AddErrorCount(1)
 			bl.Error().Err(err).Msg("save blob error")
 			continue
 		}
+		if chunks != nil {
+			bl.Info().
+				Int("chunks", chunks.chunks).
+				Int("existing-chunks", chunks.existing).
+				Msg("blob chunked")
+		}
 		bl.Info().
 			Int64("blob-size", blobSize).
+			Int64("written", written).
+			Bool("compressed", compressed).
+			Bool("encrypted", files.enc != nil).
 			Msg("blob written")
 
 		// log result
+		d := time.Now().Sub(t)
 		sts.AddCount(1)
 		sts.AddSize(blobSize)
+		saveLatency.ObserveDuration(d)
+		saveSize.Observe(float64(blobSize))
 		bl.Info().
-			Int64("duration", time.Now().Sub(t).Nanoseconds()).
+			Int64("duration", d.Nanoseconds()).
 			Msg("done saving")
+		markDone(cp, url.String(), blobHashStr, blobSize, &bl)
 
-		outCh <- &FileBlob{
+		select {
+		case outCh <- &FileBlob{
 			path: blobPath,
 			url:  util.PathToUrl(blobPath),
 			name: blob.Name(),
 			blob: nil,
 			size: blobSize,
 			hash: blobHash,
+
+			files: files,
+			entry: entry,
+		}:
+		case <-sts.Canceled():
 		}
 	}
 
 	l.Debug().Msg("finished")
 }
 
+// markDone records the stored blob in the checkpoint, if any.
+func markDone(
+	cp *job.Checkpoint,
+	url string,
+	hash string,
+	size int64,
+	lg *zerolog.Logger) {
+
+	if cp == nil {
+		return
+	}
+	if err := cp.MarkDone(url, hash, size); err != nil {
+		lg.Error().Err(err).Msg("checkpoint error")
+	}
+}
+
 func store(
-	dirPath string,
+	files *blobFiles,
 	saverCnt int,
+	cp *job.Checkpoint,
 	ch chan blob.Blob,
 	sts *blob.ProcessStatus,
 	lg *zerolog.Logger) {
 
 	lg.Debug().Msg("start storing")
 
+	if err := files.layout.ensure(); err != nil {
+		lg.Error().Err(err).Msg("write store descriptor error")
+	}
+
 	wg := &sync.WaitGroup{}
 	wg.Add(saverCnt)
 	for i := 0; i < saverCnt; i++ {
-		go save(i, dirPath, ch, wg, sts, lg)
+		go save(i, files, cp, ch, wg, sts, lg)
 	}
 	wg.Wait()
+	if err := files.packer.close(); err != nil {
+		sts.AddErrorCount(1)
+		lg.Error().Err(err).Msg("write pack index error")
+	}
+	if cp != nil {
+		if err := cp.Sync(); err != nil {
+			lg.Error().Err(err).Msg("sync checkpoint error")
+		}
+	}
 	sts.Finish()
 
 	lg.Debug().Msg("done storing")
 }
 
+// reject counts every blob sent to a store which can't store
+// them as an error.
+func reject(
+	err error,
+	ch chan blob.Blob,
+	sts *blob.ProcessStatus,
+	lg *zerolog.Logger) {
+
+	lg.Error().Err(err).Msg("store error")
+	for range ch {
+		sts.AddErrorCount(1)
+	}
+	sts.Finish()
+}
+
 func (fs *FileSystem) Load() blob.LoadStatus {
 	id := uuid.Must(uuid.NewV4()).String()
+	return fs.load(id, fs.skip, nil, nil)
+}
+
+// LoadCheckpoint is like Load but skips the files which the
+// given checkpoint has recorded as stored, so that a restarted
+// job resumes where it stopped. The load id is the checkpoint
+// id followed by "/load".
+func (fs *FileSystem) LoadCheckpoint(cp *job.Checkpoint) blob.LoadStatus {
+	skip := composeSkipFunc(fs.skip, func(path string) bool {
+		return cp.IsDone(util.PathToUrl(path).String())
+	})
+	return fs.load(cp.ID()+"/load", skip, nil, nil)
+}
+
+// load runs a load, with rec set it records the loaded tree and
+// done runs once all the files are loaded, unless canceled.
+func (fs *FileSystem) load(id string, skip skipFunc, rec *snapshotRecorder, done func(*blob.ProcessStatus)) blob.LoadStatus {
 	sts := blob.NewLoadStatus(id)
 	l := fs.lg.With().Str("load-id", id).Logger()
-	go load(fs.root, fs.skip, fs.maxLoader, sts, &l)
+	if fs.progressInterval > 0 {
+		sts.ReportProgress(fs.progressInterval)
+	}
+	fs.jobs.Run(sts, func() {
+		load(fs.root, skip, fs.maxLoader, rec, fs.expand, done, sts, &l)
+	})
 	return sts
 }
 
 func (fs *FileSystem) Store(blobCh chan blob.Blob) blob.StoreStatus {
 	id := uuid.Must(uuid.NewV4()).String()
+	return fs.store(id, nil, blobCh)
+}
+
+// StoreCheckpoint is like Store but records every stored blob
+// (or existing one) in the given checkpoint. The store id is the
+// checkpoint id followed by "/store", so that the load and the
+// store of a checkpoint are separate jobs.
+func (fs *FileSystem) StoreCheckpoint(cp *job.Checkpoint, blobCh chan blob.Blob) blob.StoreStatus {
+	return fs.store(cp.ID()+"/store", cp, blobCh)
+}
+
+func (fs *FileSystem) store(id string, cp *job.Checkpoint, blobCh chan blob.Blob) blob.StoreStatus {
 	sts := blob.NewStoreStatus(id)
 	l := fs.lg.With().Str("process-id", id).Logger()
-	go store(fs.root, fs.maxSaver, blobCh, sts, &l)
+	if fs.progressInterval > 0 {
+		sts.ReportProgress(fs.progressInterval)
+	}
+	locked := fs.enc == nil && fs.Encrypted()
+	fs.jobs.Run(sts, func() {
+		if locked {
+			reject(fmt.Errorf("the store is encrypted, a master key is required"), blobCh, sts, &l)
+			return
+		}
+		store(fs.files(), fs.maxSaver, cp, blobCh, sts, &l)
+	})
 	return sts
 }
@@ -0,0 +1,94 @@
+package filesystem
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"filemanager/blob"
+	"filemanager/memory"
+	"filemanager/util"
+
+	"github.com/rs/zerolog"
+)
+
+var discard = zerolog.New(ioutil.Discard)
+
+func newFS(t *testing.T, root string) *FileSystem {
+	fs, err := New(root, 2, 2, &discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.SetProgressInterval(0)
+	return fs
+}
+
+// storeAll stores the contents and returns their hashes, the store
+// must not have errors.
+func storeAll(t *testing.T, fs *FileSystem, contents ...[]byte) []*util.Hash {
+	ch := make(chan blob.Blob, len(contents))
+	hashes := make([]*util.Hash, 0, len(contents))
+	for i, c := range contents {
+		b := memory.NewBlob(fmt.Sprintf("f%d", i), c)
+		hashes = append(hashes, b.Hash())
+		ch <- b
+	}
+	close(ch)
+	sts := fs.Store(ch)
+	for range sts.Blob() {
+	}
+	<-sts.Done()
+	if sts.ErrorCount() != 0 {
+		t.Fatalf("%d store errors", sts.ErrorCount())
+	}
+	return hashes
+}
+
+func hashOf(data []byte) *util.Hash {
+	sum := sha1.Sum(data)
+	return util.NewSha1Hash(sum[:])
+}
+
+// readBlob returns the content of the stored blob.
+func readBlob(fs *FileSystem, h *util.Hash) ([]byte, error) {
+	b, err := fs.Get(h)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := b.ReadCloser()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// checkBlobs checks that the blobs read back with their contents.
+func checkBlobs(t *testing.T, fs *FileSystem, hashes []*util.Hash, contents ...[]byte) {
+	t.Helper()
+	for i, h := range hashes {
+		data, err := readBlob(fs, h)
+		if err != nil {
+			t.Fatalf("blob %d: %v", i, err)
+		}
+		if !bytes.Equal(data, contents[i]) {
+			t.Fatalf("blob %d: read %d bytes, content differs", i, len(data))
+		}
+	}
+}
+
+// testContent returns n bytes of content varying with seed, which
+// doesn't compress.
+func testContent(n int, seed int) []byte {
+	data := make([]byte, n)
+	x := uint32(seed*2654435761 + 1)
+	for i := range data {
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		data[i] = byte(x % 64)
+	}
+	return data
+}
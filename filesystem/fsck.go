@@ -0,0 +1,608 @@
+package filesystem
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"filemanager/blob"
+	"filemanager/util"
+)
+
+// ProblemKind is the kind of a problem found by Fsck.
+type ProblemKind string
+
+// problems found by Fsck
+const (
+	// the content hash of the blob doesn't match its name
+	ProblemCorrupt ProblemKind = "corrupt"
+	// the blob is empty but its name isn't the empty hash
+	ProblemZeroLength ProblemKind = "zero-length"
+	// the blob is named by a hash but isn't at its layout path
+	ProblemMisplaced ProblemKind = "misplaced"
+	// a temp file left behind by an interrupted save
+	ProblemTemp ProblemKind = "temp"
+	// a file which doesn't belong to the store layout
+	ProblemUnknown ProblemKind = "unknown"
+	// the blob could not be read
+	ProblemUnreadable ProblemKind = "unreadable"
+	// a pack without an index, left behind by an interrupted store
+	ProblemUnindexed ProblemKind = "unindexed"
+)
+
+// DefaultTempMaxAge is the age after which temp files are
+// considered stray rather than being written.
+const DefaultTempMaxAge = time.Hour
+
+// quarantineDir is the default quarantine dir under the root.
+const quarantineDir = ".quarantine"
+
+// FsckOptions controls what Fsck checks and repairs.
+type FsckOptions struct {
+	// Workers is the number of blobs hashed in parallel,
+	// defaults to the maxLoader of the file system.
+	Workers int
+	// Repair moves bad blobs to the quarantine dir, moves
+	// misplaced but good blobs to their layout path and removes
+	// stray temp files.
+	Repair bool
+	// Quarantine is the dir bad blobs are moved to, it defaults
+	// to .quarantine under the store root.
+	Quarantine string
+	// TempMaxAge is the age after which a temp file is reported
+	// as stray, it defaults to DefaultTempMaxAge.
+	TempMaxAge time.Duration
+	// Source, if set, is loaded after the repair to re-fetch good
+	// copies of the quarantined blobs.
+	Source blob.BlobSource
+}
+
+// FsckProblem describes a problem found by Fsck and what was
+// done about it.
+type FsckProblem struct {
+	Kind   ProblemKind `json:"kind"`
+	Path   string      `json:"path"`
+	Hash   string      `json:"hash,omitempty"`
+	Actual string      `json:"actual,omitempty"`
+	Action string      `json:"action,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// FsckReport is the result of Fsck.
+type FsckReport struct {
+	Checked   int64          `json:"checked"`
+	Size      int64          `json:"size"`
+	Problems  []*FsckProblem `json:"problems"`
+	Refetched []string       `json:"refetched,omitempty"`
+	Missing   []string       `json:"missing,omitempty"`
+	Duration  time.Duration  `json:"duration"`
+}
+
+// Count returns the number of problems of the given kind.
+func (r *FsckReport) Count(kind ProblemKind) int {
+	n := 0
+	for _, p := range r.Problems {
+		if p.Kind == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// fsck holds the state of one Fsck run.
+type fsck struct {
+	sync.Mutex
+	fs     *FileSystem
+	files  *blobFiles
+	opts   *FsckOptions
+	report *FsckReport
+	lost   map[string]bool
+}
+
+// Fsck walks the store and rehashes every blob in parallel, it
+// reports corrupt, zero-length, misplaced, unreadable blobs and
+// stray temp files. With opts.Repair it also fixes them, and
+// with opts.Source it re-fetches the blobs it quarantined.
+func (fs *FileSystem) Fsck(opts *FsckOptions) (*FsckReport, error) {
+	o := *opts
+	if o.Workers < 1 {
+		o.Workers = fs.maxLoader
+	}
+	if o.Quarantine == "" {
+		o.Quarantine = filepath.Join(fs.root, quarantineDir)
+	}
+	if o.TempMaxAge <= 0 {
+		o.TempMaxAge = DefaultTempMaxAge
+	}
+	c := &fsck{
+		fs:     fs,
+		files:  fs.files(),
+		opts:   &o,
+		report: &FsckReport{Problems: make([]*FsckProblem, 0)},
+		lost:   make(map[string]bool),
+	}
+	t := time.Now()
+
+	pathCh := make(chan string)
+	wg := &sync.WaitGroup{}
+	wg.Add(o.Workers)
+	for i := 0; i < o.Workers; i++ {
+		go func() {
+			defer wg.Done()
+			for path := range pathCh {
+				c.check(path)
+			}
+		}()
+	}
+	err := c.walk(pathCh)
+	close(pathCh)
+	wg.Wait()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkPacks(); err != nil {
+		return nil, err
+	}
+
+	if o.Source != nil && len(c.lost) > 0 {
+		c.refetch()
+	}
+
+	sort.Slice(c.report.Problems, func(i, j int) bool {
+		return c.report.Problems[i].Path < c.report.Problems[j].Path
+	})
+	c.report.Duration = time.Now().Sub(t)
+	fs.lg.Info().
+		Int64("checked", c.report.Checked).
+		Int("problems", len(c.report.Problems)).
+		Int("refetched", len(c.report.Refetched)).
+		Int64("duration", c.report.Duration.Nanoseconds()).
+		Msg("fsck done")
+	return c.report, nil
+}
+
+// walk sends every file under the hash algorithm dirs of the
+// blobs and of the chunks.
+func (c *fsck) walk(pathCh chan string) error {
+	for _, base := range c.fs.layout.bases() {
+		if err := c.walkBase(base, pathCh); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *fsck) walkBase(base string, pathCh chan string) error {
+	algDir := filepath.Join(base, "sha1")
+	exists, err := util.IsPathExists(algDir)
+	if err != nil || !exists {
+		return err
+	}
+	return filepath.Walk(algDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			c.add(&FsckProblem{Kind: ProblemUnreadable, Path: path, Error: err.Error()})
+			if fi != nil && fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.Mode().IsRegular() {
+			pathCh <- path
+		} else if !fi.IsDir() {
+			c.add(&FsckProblem{Kind: ProblemUnknown, Path: path})
+		}
+		return nil
+	})
+}
+
+func (c *fsck) add(p *FsckProblem) {
+	c.Lock()
+	c.report.Problems = append(c.report.Problems, p)
+	c.Unlock()
+	c.fs.lg.Warn().
+		Str("kind", string(p.Kind)).
+		Str("path", p.Path).
+		Str("action", p.Action).
+		Str("error", p.Error).
+		Msg("fsck problem")
+}
+
+// base returns the base of the blob file at the given path,
+// which is the chunk dir for chunks and the store root else.
+func (c *fsck) base(path string) string {
+	if root := c.fs.layout.chunkRoot(); strings.HasPrefix(path, root+string(filepath.Separator)) {
+		return root
+	}
+	return c.fs.root
+}
+
+// check classifies the file at the given path and repairs it
+// if asked to.
+func (c *fsck) check(path string) {
+	name := filepath.Base(path)
+	base := c.base(path)
+	fi, err := os.Stat(path)
+	if err != nil {
+		c.add(&FsckProblem{Kind: ProblemUnreadable, Path: path, Error: err.Error()})
+		return
+	}
+
+	if c.checkTemp(path, fi) {
+		return
+	}
+
+	ext := blobExt(name)
+	data, err := hex.DecodeString(strings.TrimSuffix(name, ext))
+	if err != nil || len(data) != sha1.Size {
+		p := &FsckProblem{Kind: ProblemUnknown, Path: path}
+		if c.opts.Repair {
+			c.do(p, "quarantined", c.quarantine(path))
+		}
+		c.add(p)
+		return
+	}
+	h := util.NewSha1Hash(data)
+
+	// the recipes of chunked blobs are encrypted too
+	if c.fs.enc == nil && (ext == encryptedExt || ext == recipeExt && c.fs.Encrypted()) {
+		c.add(&FsckProblem{Kind: ProblemUnreadable, Path: path, Hash: h.String(), Error: "the blob is encrypted, a master key is required"})
+		return
+	}
+	actual, size, err := hashPath(c.files, path)
+	if _, ok := err.(*os.PathError); ok {
+		c.add(&FsckProblem{Kind: ProblemUnreadable, Path: path, Hash: h.String(), Error: err.Error()})
+		return
+	}
+	c.Lock()
+	c.report.Checked++
+	c.report.Size += size
+	c.Unlock()
+
+	// a content which can't be decompressed or decrypted is
+	// corrupt, like one which doesn't match its hash
+	good := false
+	if err == nil {
+		ah, _ := util.NewSha1HashFromHex(actual)
+		// the blobs of a store with HMAC addressing are named
+		// by the address of their content hash
+		good = c.fs.enc.address(ah).Hex() == h.Hex()
+	}
+	target := c.fs.layout.path(base, h) + ext
+	switch {
+	case good && c.fs.layout.parse(base, path) != nil:
+		// at its path in the current layout, or in the previous
+		// one while the store is migrated
+		return
+	case good:
+		p := &FsckProblem{Kind: ProblemMisplaced, Path: path, Hash: h.String()}
+		if c.opts.Repair {
+			c.do(p, "moved", c.move(path, target, size))
+		}
+		c.add(p)
+	default:
+		kind := ProblemCorrupt
+		if size == 0 && err == nil {
+			kind = ProblemZeroLength
+		}
+		p := &FsckProblem{Kind: kind, Path: path, Hash: h.String()}
+		if err != nil {
+			p.Error = err.Error()
+		} else {
+			p.Actual = "sha1:" + actual
+		}
+		if c.opts.Repair {
+			err := c.quarantine(path)
+			c.do(p, "quarantined", err)
+			// only whole blobs can be re-fetched, a chunk is
+			// stored again with the next blob which has it
+			if err == nil && base == c.fs.root && c.fs.layout.parse(base, path) != nil {
+				c.Lock()
+				c.lost[h.String()] = true
+				c.Unlock()
+			}
+		}
+		c.add(p)
+	}
+}
+
+// checkTemp returns true if the file is a temp file, which it
+// reports if it is old enough to be stray.
+func (c *fsck) checkTemp(path string, fi os.FileInfo) bool {
+	if !strings.Contains(filepath.Base(path), tempMarker) {
+		return false
+	}
+	if time.Now().Sub(fi.ModTime()) < c.opts.TempMaxAge {
+		// probably being written right now
+		return true
+	}
+	p := &FsckProblem{Kind: ProblemTemp, Path: path}
+	if c.opts.Repair {
+		c.do(p, "removed", os.Remove(path))
+	}
+	c.add(p)
+	return true
+}
+
+// checkPacks checks the files in the pack dir, indexes the packs
+// left without one and rehashes the packed blobs.
+func (c *fsck) checkPacks() error {
+	dir := c.fs.packs.dir
+	fis, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	exists := make(map[string]bool, len(fis))
+	for _, fi := range fis {
+		exists[fi.Name()] = true
+	}
+	repaired := false
+	for _, fi := range fis {
+		name := fi.Name()
+		path := filepath.Join(dir, name)
+		if !fi.Mode().IsRegular() {
+			c.add(&FsckProblem{Kind: ProblemUnknown, Path: path})
+			continue
+		}
+		if c.checkTemp(path, fi) {
+			continue
+		}
+		ext := filepath.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		switch {
+		case (ext == packIdxExt || ext == packDelExt) && exists[base+packExt]:
+			// checked with the pack
+		case ext == packExt:
+			p, err := readIndex(path)
+			if err != nil && !os.IsNotExist(err) {
+				pr := &FsckProblem{Kind: ProblemCorrupt, Path: strings.TrimSuffix(path, packExt) + packIdxExt, Error: err.Error()}
+				p = c.reindex(pr, path, "reindexed")
+				repaired = repaired || p != nil
+				c.add(pr)
+			} else if err != nil {
+				if time.Now().Sub(fi.ModTime()) < c.opts.TempMaxAge {
+					// probably being written right now
+					continue
+				}
+				pr := &FsckProblem{Kind: ProblemUnindexed, Path: path}
+				p = c.reindex(pr, path, "indexed")
+				repaired = repaired || p != nil
+				c.add(pr)
+			}
+			if p != nil && c.checkEntries(p) {
+				repaired = true
+			}
+		default:
+			p := &FsckProblem{Kind: ProblemUnknown, Path: path}
+			if c.opts.Repair {
+				c.do(p, "quarantined", c.quarantine(path))
+			}
+			c.add(p)
+		}
+	}
+	if repaired {
+		// the packs may have new indexes and deleted entries
+		c.fs.packs.invalidate()
+	}
+	return nil
+}
+
+// reindex rebuilds the index of the pack from its entries if
+// repairing, it returns the index or nil if not repairing.
+func (c *fsck) reindex(pr *FsckProblem, path, action string) *packIndex {
+	if !c.opts.Repair {
+		return nil
+	}
+	p, err := scanPack(path)
+	if err == nil {
+		err = writeIndex(p)
+	}
+	c.do(pr, action, err)
+	if err != nil {
+		return nil
+	}
+	return p
+}
+
+// checkEntries rehashes the packed blobs which aren't deleted, and
+// marks the bad ones deleted if repairing. It returns true if it
+// did.
+func (c *fsck) checkEntries(p *packIndex) bool {
+	entries := make([]*packEntry, 0, len(p.entries))
+	for i := range p.entries {
+		if !p.deleted[p.entries[i].addr] {
+			entries = append(entries, &p.entries[i])
+		}
+	}
+	entryCh := make(chan *packEntry)
+	wg := &sync.WaitGroup{}
+	wg.Add(c.opts.Workers)
+	deleted := int32(0)
+	for i := 0; i < c.opts.Workers; i++ {
+		go func() {
+			defer wg.Done()
+			for e := range entryCh {
+				if c.checkEntry(p, e) {
+					atomic.AddInt32(&deleted, 1)
+				}
+			}
+		}()
+	}
+	for _, e := range entries {
+		entryCh <- e
+	}
+	close(entryCh)
+	wg.Wait()
+	return deleted > 0
+}
+
+func (c *fsck) checkEntry(p *packIndex, e *packEntry) bool {
+	h := e.hash()
+	if packKinds[e.kind] == encryptedExt && c.fs.enc == nil {
+		c.add(&FsckProblem{Kind: ProblemUnreadable, Path: e.String(), Hash: h.String(), Error: "the blob is encrypted, a master key is required"})
+		return false
+	}
+	actual, size, err := hashReader(c.files.openEntry(e))
+	if _, ok := err.(*os.PathError); ok {
+		c.add(&FsckProblem{Kind: ProblemUnreadable, Path: e.String(), Hash: h.String(), Error: err.Error()})
+		return false
+	}
+	c.Lock()
+	c.report.Checked++
+	c.report.Size += size
+	c.Unlock()
+	if err == nil {
+		ah, _ := util.NewSha1HashFromHex(actual)
+		if c.fs.enc.address(ah).Hex() == h.Hex() {
+			return false
+		}
+	}
+	pr := &FsckProblem{Kind: ProblemCorrupt, Path: e.String(), Hash: h.String()}
+	if err != nil {
+		pr.Error = err.Error()
+	} else {
+		pr.Actual = "sha1:" + actual
+	}
+	deleted := false
+	if c.opts.Repair {
+		c.Lock()
+		err := p.markDeleted(e.addr)
+		if err == nil {
+			c.lost[h.String()] = true
+			deleted = true
+		}
+		c.Unlock()
+		c.do(pr, "deleted", err)
+	}
+	c.add(pr)
+	return deleted
+}
+
+// do records the outcome of a repair action.
+func (c *fsck) do(p *FsckProblem, action string, err error) {
+	if err != nil {
+		p.Error = err.Error()
+		return
+	}
+	p.Action = action
+}
+
+// move moves a good but misplaced blob to its layout path, or
+// removes it if the layout path already has a good copy.
+func (c *fsck) move(path, target string, size int64) error {
+	// a target which can't be read is replaced
+	if exists, _ := c.files.exists(target, size); exists {
+		if actual, _, err := hashPath(c.files, target); err == nil {
+			ah, _ := util.NewSha1HashFromHex(actual)
+			if ah != nil && c.fs.enc.address(ah).Hex() == strings.TrimSuffix(filepath.Base(target), blobExt(target)) {
+				return os.Remove(path)
+			}
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	return os.Rename(path, target)
+}
+
+// quarantine moves the file to the quarantine dir, keeping its
+// path relative to the store root.
+func (c *fsck) quarantine(path string) error {
+	rel, err := filepath.Rel(c.fs.root, path)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(c.opts.Quarantine, rel)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if exists, _ := util.IsPathExists(dst); exists {
+		dst = fmt.Sprintf("%s.%d", dst, time.Now().UnixNano())
+	}
+	return os.Rename(path, dst)
+}
+
+// refetch loads the source and stores the blobs which were
+// quarantined from their layout path.
+func (c *fsck) refetch() {
+	wanted := make([]string, 0, len(c.lost))
+	for h := range c.lost {
+		wanted = append(wanted, h)
+	}
+
+	ls := c.opts.Source.Load()
+	ch := make(chan blob.Blob)
+	ss := c.fs.Store(ch)
+
+	go func() {
+		for b := range ls.Blob() {
+			h := c.fs.enc.address(b.Hash()).String()
+			c.Lock()
+			want := c.lost[h]
+			delete(c.lost, h)
+			left := len(c.lost)
+			c.Unlock()
+			if want {
+				ch <- b
+			} else if fb, ok := b.(*FileBlob); ok {
+				fb.Free()
+			}
+			if left == 0 {
+				// found them all, no need to load the rest
+				ls.Cancel()
+			}
+		}
+		close(ch)
+	}()
+
+	for b := range ss.Blob() {
+		c.report.Refetched = append(c.report.Refetched, c.fs.enc.address(b.Hash()).String())
+	}
+	<-ls.Done()
+
+	// the blobs the source didn't have, or failed to store
+	refetched := make(map[string]bool, len(c.report.Refetched))
+	for _, h := range c.report.Refetched {
+		refetched[h] = true
+	}
+	for _, h := range wanted {
+		if !refetched[h] {
+			c.report.Missing = append(c.report.Missing, h)
+		}
+	}
+	sort.Strings(c.report.Refetched)
+	sort.Strings(c.report.Missing)
+}
+
+// hashPath returns the hex sha1 hash and size of the content
+// of the blob file, which for chunked blobs is read from all
+// their chunks.
+func hashPath(files *blobFiles, path string) (string, int64, error) {
+	return hashReader(files.open(path))
+}
+
+// hashReader returns the hex sha1 hash and size of the content
+// read from f, which it closes.
+func hashReader(f io.ReadCloser, err error) (string, int64, error) {
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha1.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
@@ -0,0 +1,119 @@
+package filesystem
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filemanager/memory"
+	"filemanager/util"
+)
+
+// problems returns the problems of the report by path.
+func problems(r *FsckReport) map[string]*FsckProblem {
+	m := make(map[string]*FsckProblem, len(r.Problems))
+	for _, p := range r.Problems {
+		m[p.Path] = p
+	}
+	return m
+}
+
+func TestFsck(t *testing.T) {
+	root := t.TempDir()
+	fs := newFS(t, root)
+	contents := [][]byte{testContent(1000, 1), testContent(2000, 2), testContent(3000, 3)}
+	hashes := storeAll(t, fs, contents...)
+
+	// a flipped byte, a truncated file, and temp files, a stray one
+	// and one being written
+	flipped, truncated := fs.BlobPath(hashes[0]), fs.BlobPath(hashes[1])
+	data, err := ioutil.ReadFile(flipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[500] ^= 1
+	if err := ioutil.WriteFile(flipped, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(truncated, 1000); err != nil {
+		t.Fatal(err)
+	}
+	stray := filepath.Join(filepath.Dir(fs.BlobPath(hashes[2])), tempMarker+"stray")
+	writing := filepath.Join(filepath.Dir(fs.BlobPath(hashes[2])), tempMarker+"writing")
+	for _, path := range []string{stray, writing} {
+		if err := ioutil.WriteFile(path, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * DefaultTempMaxAge)
+	if err := os.Chtimes(stray, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := fs.Fsck(&FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := problems(r)
+	if len(ps) != 3 || r.Checked != 3 || r.Count(ProblemCorrupt) != 2 || r.Count(ProblemTemp) != 1 {
+		t.Fatalf("checked %d, problems %+v", r.Checked, r.Problems)
+	}
+	if p := ps[flipped]; p == nil || p.Kind != ProblemCorrupt || p.Hash != hashes[0].String() || p.Action != "" {
+		t.Fatalf("flipped byte: %+v", p)
+	}
+	if p := ps[truncated]; p == nil || p.Kind != ProblemCorrupt || p.Actual == "" {
+		t.Fatalf("truncated file: %+v", p)
+	}
+	if p := ps[stray]; p == nil || p.Kind != ProblemTemp {
+		t.Fatalf("stray temp file: %+v", p)
+	}
+
+	// the repair quarantines the bad blobs, removes the stray temp
+	// file and re-fetches the good copies from the source
+	src, err := memory.NewSource(2, &discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.SetProgressInterval(0)
+	src.Add("a", contents[0])
+	src.Add("c", contents[2])
+	r, err = fs.Fsck(&FsckOptions{Repair: true, Source: src})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range r.Problems {
+		if p.Action == "" || p.Error != "" {
+			t.Fatalf("not repaired: %+v", p)
+		}
+	}
+	if len(r.Refetched) != 1 || r.Refetched[0] != hashes[0].String() || len(r.Missing) != 1 || r.Missing[0] != hashes[1].String() {
+		t.Fatalf("refetched %v, missing %v", r.Refetched, r.Missing)
+	}
+	for _, path := range []string{flipped, truncated} {
+		rel, _ := filepath.Rel(root, path)
+		if _, err := os.Stat(filepath.Join(root, quarantineDir, rel)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(stray); !os.IsNotExist(err) {
+		t.Fatalf("stray temp file left: %v", err)
+	}
+	if _, err := os.Stat(writing); err != nil {
+		t.Fatalf("temp file being written removed: %v", err)
+	}
+	checkBlobs(t, fs, []*util.Hash{hashes[0], hashes[2]}, contents[0], contents[2])
+	if ok, _ := fs.Has(hashes[1]); ok {
+		t.Fatal("quarantined blob found")
+	}
+
+	os.Remove(writing)
+	r, err = fs.Fsck(&FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Problems) != 0 || r.Checked != 2 {
+		t.Fatalf("after repair: checked %d, problems %+v", r.Checked, r.Problems)
+	}
+}
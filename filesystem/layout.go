@@ -0,0 +1,427 @@
+package filesystem
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"filemanager/util"
+)
+
+// Layout describes how the blob files of a store are fanned out
+// into dirs under root/<algorithm>: Depth levels of dirs, each
+// named by the next Width hex chars of the hash. A zero Depth is
+// the flat layout, with all blobs in a single dir.
+type Layout struct {
+	Depth int `json:"depth"`
+	Width int `json:"width"`
+}
+
+// the layout of the stores which have no descriptor
+var DefaultLayout = Layout{Depth: 4, Width: 2}
+
+// the allowed range of the layout depth and width
+const (
+	maxLayoutDepth = 8
+	maxLayoutWidth = 4
+)
+
+// ParseLayout parses a layout written as "<depth>x<width>",
+// e.g. "4x2" or "2x3", or "flat".
+func ParseLayout(s string) (Layout, error) {
+	if s == "flat" {
+		return Layout{}, nil
+	}
+	parts := strings.Split(s, "x")
+	if len(parts) != 2 {
+		return Layout{}, fmt.Errorf("invalid layout %q, expected <depth>x<width> or flat", s)
+	}
+	depth, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return Layout{}, fmt.Errorf("invalid layout %q, expected <depth>x<width> or flat", s)
+	}
+	width, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return Layout{}, fmt.Errorf("invalid layout %q, expected <depth>x<width> or flat", s)
+	}
+	l := Layout{Depth: depth, Width: width}
+	if err := l.Validate(); err != nil {
+		return Layout{}, err
+	}
+	return l, nil
+}
+
+// Validate checks that the depth and width are in range.
+func (l Layout) Validate() error {
+	if l.Depth < 0 || l.Depth > maxLayoutDepth {
+		return fmt.Errorf("layout depth %d is out of allowed range [0, %d]", l.Depth, maxLayoutDepth)
+	}
+	if l.Depth == 0 {
+		if l.Width != 0 {
+			return fmt.Errorf("flat layout must have zero width, got %d", l.Width)
+		}
+		return nil
+	}
+	if l.Width < 1 || l.Width > maxLayoutWidth {
+		return fmt.Errorf("layout width %d is out of allowed range [1, %d]", l.Width, maxLayoutWidth)
+	}
+	return nil
+}
+
+func (l Layout) String() string {
+	if l.Depth == 0 {
+		return "flat"
+	}
+	return fmt.Sprintf("%dx%d", l.Depth, l.Width)
+}
+
+// path returns the path of the blob with the given hash under
+// the given store root.
+func (l Layout) path(root string, h *util.Hash) string {
+	hex := h.Hex()
+	elems := make([]string, 0, l.Depth+3)
+	elems = append(elems, root, h.Algorithm())
+	for i := 0; i < l.Depth; i++ {
+		elems = append(elems, hex[i*l.Width:(i+1)*l.Width])
+	}
+	elems = append(elems, hex)
+	return filepath.Join(elems...)
+}
+
+// Name returns the slash separated path of the blob with the
+// given hash relative to a store root, e.g. to name it in an
+// export.
+func (l Layout) Name(h *util.Hash) string {
+	return filepath.ToSlash(l.path("", h))
+}
+
+// parse returns the hash of the blob at the given path, or nil
+// if the path doesn't follow this layout.
+func (l Layout) parse(root, path string) *util.Hash {
+	path = strings.TrimSuffix(path, blobExt(path))
+	data, err := hex.DecodeString(filepath.Base(path))
+	if err != nil || len(data) != 20 {
+		return nil
+	}
+	h := util.NewSha1Hash(data)
+	if l.path(root, h) != path {
+		return nil
+	}
+	return h
+}
+
+// blobExts are the extensions of blob files, of plain,
+// compressed, encrypted and chunked ones
+var blobExts = []string{"", compressedExt, encryptedExt, recipeExt}
+
+// blobExt returns the extension of compressed, encrypted or
+// chunked blob files if the path has one, or "".
+func blobExt(path string) string {
+	for _, ext := range blobExts[1:] {
+		if strings.HasSuffix(path, ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+// descriptorName is the name of the store descriptor file in
+// the store root.
+const descriptorName = "store.json"
+
+// the version of the store descriptor format
+const descriptorVersion = 1
+
+// Descriptor records the settings of a store. While the store is
+// migrated to a new layout, Previous is the layout which blobs
+// may still be at.
+type Descriptor struct {
+	Version  int     `json:"version"`
+	Hash     string  `json:"hash"`
+	Layout   Layout  `json:"layout"`
+	Previous *Layout `json:"previous,omitempty"`
+}
+
+// storeLayout is the layout state of a store. It is shared by
+// the savers and readers of the store, and changes while the
+// store is migrated, by this or another process.
+type storeLayout struct {
+	sync.RWMutex
+	root    string
+	desc    Descriptor
+	written bool      // the descriptor exists on disk
+	modTime time.Time // of the descriptor file when it was read
+}
+
+func newStoreLayout(root string) (*storeLayout, error) {
+	s := &storeLayout{
+		root: root,
+		desc: Descriptor{Version: descriptorVersion, Hash: "sha1", Layout: DefaultLayout},
+	}
+	if _, err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *storeLayout) descriptorPath() string {
+	return filepath.Join(s.root, descriptorName)
+}
+
+// reload reads the descriptor if it changed since it was last
+// read, it returns true if it did.
+func (s *storeLayout) reload() (bool, error) {
+	path := s.descriptorPath()
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	s.RLock()
+	same := s.written && fi.ModTime().Equal(s.modTime)
+	s.RUnlock()
+	if same {
+		return false, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	var desc Descriptor
+	if err := json.Unmarshal(data, &desc); err != nil {
+		return false, fmt.Errorf("%s: %v", path, err)
+	}
+	if desc.Version != descriptorVersion {
+		return false, fmt.Errorf("%s: unsupported version %d", path, desc.Version)
+	}
+	if desc.Hash != "sha1" {
+		return false, fmt.Errorf("%s: unsupported hash %q", path, desc.Hash)
+	}
+	if err := desc.Layout.Validate(); err != nil {
+		return false, fmt.Errorf("%s: %v", path, err)
+	}
+	if desc.Previous != nil {
+		if err := desc.Previous.Validate(); err != nil {
+			return false, fmt.Errorf("%s: previous %v", path, err)
+		}
+	}
+	s.Lock()
+	s.desc = desc
+	s.written = true
+	s.modTime = fi.ModTime()
+	s.Unlock()
+	return true, nil
+}
+
+// write replaces the descriptor on disk with the given one.
+func (s *storeLayout) write(desc Descriptor) error {
+	data, err := json.MarshalIndent(&desc, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.root, 0755); err != nil {
+		return err
+	}
+	path := s.descriptorPath()
+	tmp, err := ioutil.TempFile(s.root, descriptorName+tempMarker)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(append(data, '\n'))
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	s.desc = desc
+	s.written = true
+	s.modTime = fi.ModTime()
+	s.Unlock()
+	return nil
+}
+
+// ensure writes the descriptor if the store doesn't have one.
+func (s *storeLayout) ensure() error {
+	s.RLock()
+	written, desc := s.written, s.desc
+	s.RUnlock()
+	if written {
+		return nil
+	}
+	return s.write(desc)
+}
+
+// descriptor returns a copy of the current descriptor.
+func (s *storeLayout) descriptor() Descriptor {
+	s.RLock()
+	defer s.RUnlock()
+	return s.desc
+}
+
+// path returns the path new blobs are written to, under the
+// given base, which is the store root or its chunk dir.
+func (s *storeLayout) path(base string, h *util.Hash) string {
+	s.RLock()
+	defer s.RUnlock()
+	return s.desc.Layout.path(base, h)
+}
+
+// paths returns the paths the blob may be at, in the current
+// layout first.
+func (s *storeLayout) paths(base string, h *util.Hash) []string {
+	s.RLock()
+	defer s.RUnlock()
+	paths := []string{s.desc.Layout.path(base, h)}
+	if s.desc.Previous != nil {
+		paths = append(paths, s.desc.Previous.path(base, h))
+	}
+	return paths
+}
+
+// locate returns the path and info of the existing blob file
+// with the given hash under the given base, plain, compressed,
+// encrypted or chunked, or "" if there is none. During a
+// migration the current layout is checked again after the
+// previous one, as the blob may have been moved in between. When
+// the blob isn't found it rereads a changed descriptor, in case
+// another process has started or finished a migration.
+func (s *storeLayout) locate(base string, h *util.Hash) (string, os.FileInfo, error) {
+	for retry := 0; retry < 2; retry++ {
+		paths := s.paths(base, h)
+		if len(paths) > 1 {
+			paths = append(paths, paths[0])
+		}
+		for _, path := range paths {
+			for _, ext := range blobExts {
+				p := path + ext
+				fi, err := os.Stat(p)
+				if err == nil {
+					return p, fi, nil
+				}
+				if !os.IsNotExist(err) {
+					return "", nil, err
+				}
+			}
+		}
+		changed, err := s.reload()
+		if err != nil || !changed {
+			return "", nil, err
+		}
+	}
+	return "", nil, nil
+}
+
+// parse returns the hash of the blob at the given path under
+// the given base, or nil if the path follows neither the current
+// nor the previous layout.
+func (s *storeLayout) parse(base, path string) *util.Hash {
+	s.RLock()
+	defer s.RUnlock()
+	if h := s.desc.Layout.parse(base, path); h != nil {
+		return h
+	}
+	if s.desc.Previous != nil {
+		return s.desc.Previous.parse(base, path)
+	}
+	return nil
+}
+
+// chunkRoot returns the dir the chunks of chunked blobs are
+// stored in, with the same layout as the blobs.
+func (s *storeLayout) chunkRoot() string {
+	return filepath.Join(s.root, chunkDir)
+}
+
+// bases returns the store root and its chunk dir.
+func (s *storeLayout) bases() []string {
+	return []string{s.root, s.chunkRoot()}
+}
+
+// errFound stops a walk once it found what it looked for.
+var errFound = errors.New("found")
+
+// hasBlobs returns true if there is any file under the hash
+// algorithm dir.
+func (s *storeLayout) hasBlobs() (bool, error) {
+	err := filepath.Walk(filepath.Join(s.root, "sha1"), func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fi.IsDir() {
+			return errFound
+		}
+		return nil
+	})
+	if err == errFound {
+		return true, nil
+	}
+	return false, err
+}
+
+// Layout returns the layout blobs are written to.
+func (fs *FileSystem) Layout() Layout {
+	return fs.layout.descriptor().Layout
+}
+
+// Descriptor returns the settings of this store.
+func (fs *FileSystem) Descriptor() Descriptor {
+	return fs.layout.descriptor()
+}
+
+// SetLayout sets the layout of a new store and records it in the
+// store descriptor. An existing store keeps its layout, use
+// Migrate to change it.
+func (fs *FileSystem) SetLayout(l Layout) error {
+	if err := l.Validate(); err != nil {
+		return err
+	}
+	desc := fs.layout.descriptor()
+	if desc.Layout == l && desc.Previous == nil {
+		return nil
+	}
+	if desc.Previous != nil {
+		return fmt.Errorf("store is being migrated from layout %s to %s, run the migration to completion first",
+			desc.Previous, desc.Layout)
+	}
+	fs.layout.RLock()
+	written := fs.layout.written
+	fs.layout.RUnlock()
+	if written {
+		return fmt.Errorf("store has layout %s, migrate it to change the layout to %s", desc.Layout, l)
+	}
+	found, err := fs.layout.hasBlobs()
+	if err != nil {
+		return err
+	}
+	if found {
+		return fmt.Errorf("store has blobs in layout %s, migrate it to change the layout to %s", desc.Layout, l)
+	}
+	desc.Layout = l
+	return fs.layout.write(desc)
+}
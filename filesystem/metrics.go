@@ -0,0 +1,38 @@
+package filesystem
+
+import (
+	"filemanager/metrics"
+)
+
+var (
+	loadLatency = metrics.Default.NewHistogramVec(
+		"filemanager_file_load_seconds",
+		"Time spent loading and hashing a single file.",
+		metrics.DefBuckets).With()
+	loadSize = metrics.Default.NewHistogramVec(
+		"filemanager_file_load_bytes",
+		"Size of loaded files, in bytes.",
+		metrics.SizeBuckets).With()
+	saveLatency = metrics.Default.NewHistogramVec(
+		"filemanager_blob_save_seconds",
+		"Time spent saving a single blob to the store.",
+		metrics.DefBuckets).With()
+	saveSize = metrics.Default.NewHistogramVec(
+		"filemanager_blob_save_bytes",
+		"Size of saved blobs, in bytes.",
+		metrics.SizeBuckets).With()
+	detectBatchLatency = metrics.Default.NewHistogramVec(
+		"filemanager_detect_batch_seconds",
+		"Time spent running the file command on a batch of files.",
+		metrics.DefBuckets).With()
+	detectBatchSize = metrics.Default.NewHistogramVec(
+		"filemanager_detect_batch_files",
+		"Number of files in a file command batch.",
+		[]float64{1, 10, 50, 100, 500, 1000}).With()
+	chunkCount = metrics.Default.NewCounterVec(
+		"filemanager_chunks_total",
+		"Number of chunks of chunked blobs, new or already stored.", "state")
+	chunkBytes = metrics.Default.NewCounterVec(
+		"filemanager_chunk_bytes_total",
+		"Total size of chunks of chunked blobs, in bytes.", "state")
+)
@@ -0,0 +1,150 @@
+package filesystem
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// MigrateReport is the result of Migrate.
+type MigrateReport struct {
+	From     string        `json:"from"`
+	To       string        `json:"to"`
+	Moved    int64         `json:"moved"`
+	Removed  int64         `json:"removed"`
+	Errors   int64         `json:"errors"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Migrate moves the blobs of the store to the given layout. The
+// descriptor records both layouts while the blobs are moved, so
+// that Load, Store, Get and Has keep working during the move, in
+// this and other processes, with new blobs written to the new
+// layout. An interrupted migration is resumed by running it
+// again with the same layout. Blobs which already exist in the
+// new layout are removed from the previous one.
+func (fs *FileSystem) Migrate(to Layout) (*MigrateReport, error) {
+	if err := to.Validate(); err != nil {
+		return nil, err
+	}
+	if _, err := fs.layout.reload(); err != nil {
+		return nil, err
+	}
+	desc := fs.layout.descriptor()
+	var from Layout
+	switch {
+	case desc.Previous != nil && desc.Layout != to:
+		return nil, fmt.Errorf("store is being migrated from layout %s to %s, run that migration to completion first",
+			desc.Previous, desc.Layout)
+	case desc.Previous != nil:
+		from = *desc.Previous
+	default:
+		from = desc.Layout
+	}
+	r := &MigrateReport{From: from.String(), To: to.String()}
+	t := time.Now()
+	l := fs.lg.With().Str("from", r.From).Str("to", r.To).Logger()
+
+	if from == to {
+		if err := fs.layout.ensure(); err != nil {
+			return nil, err
+		}
+		r.Duration = time.Now().Sub(t)
+		return r, nil
+	}
+
+	l.Info().Msg("start migrating")
+	desc.Layout = to
+	desc.Previous = &from
+	if err := fs.layout.write(desc); err != nil {
+		return nil, err
+	}
+
+	files := fs.files()
+	dirs := make([]string, 0)
+	for _, base := range fs.layout.bases() {
+		// the chunks of chunked blobs have the layout of the blobs
+		algDir := filepath.Join(base, "sha1")
+		err := filepath.Walk(algDir, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if fi.IsDir() {
+				if path != algDir {
+					dirs = append(dirs, path)
+				}
+				return nil
+			}
+			h := from.parse(base, path)
+			if h == nil {
+				// a blob of the new layout or a stray file
+				return nil
+			}
+			removed := false
+			size, err := files.size(path, fi)
+			if err == nil {
+				removed, err = migrateBlob(files, path, to.path(base, h)+blobExt(path), size)
+			}
+			switch {
+			case err != nil:
+				r.Errors++
+				l.Error().Err(err).Str("blob-path", path).Msg("migrate blob error")
+			case removed:
+				r.Removed++
+			default:
+				r.Moved++
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// remove the dirs of the previous layout which are empty now,
+	// the deepest first
+	sort.Slice(dirs, func(i, j int) bool {
+		return len(dirs[i]) > len(dirs[j])
+	})
+	for _, dir := range dirs {
+		os.Remove(dir)
+	}
+
+	r.Duration = time.Now().Sub(t)
+	if r.Errors > 0 {
+		// keep both layouts until a rerun moves the rest
+		return r, fmt.Errorf("%d blobs could not be moved, run the migration again", r.Errors)
+	}
+	desc.Previous = nil
+	if err := fs.layout.write(desc); err != nil {
+		return nil, err
+	}
+	l.Info().
+		Int64("moved", r.Moved).
+		Int64("removed", r.Removed).
+		Int64("duration", r.Duration.Nanoseconds()).
+		Msg("done migrating")
+	return r, nil
+}
+
+// migrateBlob moves the blob at path to target, or removes it if
+// target already exists with the same size. It returns true if
+// the blob was removed.
+func migrateBlob(files *blobFiles, path, target string, size int64) (bool, error) {
+	exists, err := files.exists(target, size)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return true, os.Remove(path)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return false, err
+	}
+	return false, os.Rename(path, target)
+}
@@ -0,0 +1,98 @@
+package filesystem
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	root := t.TempDir()
+	fs := newFS(t, root)
+	contents := [][]byte{[]byte("a"), []byte("bb"), testContent(5000, 1)}
+	hashes := storeAll(t, fs, contents...)
+	from := fs.Layout()
+	to, err := ParseLayout("2x3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an interrupted migration: the blobs are read from both layouts
+	// and new ones written to the new layout
+	desc := fs.Descriptor()
+	desc.Layout, desc.Previous = to, &from
+	if err := fs.layout.write(desc); err != nil {
+		t.Fatal(err)
+	}
+	checkBlobs(t, fs, hashes, contents...)
+	more := [][]byte{[]byte("new"), contents[0]}
+	moreHashes := storeAll(t, fs, more...)
+	if path := fs.BlobPath(moreHashes[0]); path != to.path(root, moreHashes[0]) {
+		t.Fatalf("new blob written at %s", path)
+	}
+	if path := fs.BlobPath(hashes[0]); path != from.path(root, hashes[0]) {
+		t.Fatalf("existing blob stored again at %s", path)
+	}
+
+	r, err := fs.Migrate(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Moved != 3 || r.Errors != 0 || fs.Descriptor().Previous != nil {
+		t.Fatalf("moved %d with %d errors, previous %v", r.Moved, r.Errors, fs.Descriptor().Previous)
+	}
+	checkBlobs(t, fs, append(hashes, moreHashes[0]), append(contents, more[0])...)
+	for _, h := range hashes {
+		if _, err := os.Stat(from.path(root, h)); !os.IsNotExist(err) {
+			t.Fatalf("blob %s left in the previous layout: %v", h, err)
+		}
+	}
+
+	// another file system on the root reads the new layout back
+	checkBlobs(t, newFS(t, root), hashes, contents...)
+}
+
+func TestMigrateByOtherProcess(t *testing.T) {
+	root := t.TempDir()
+	a := newFS(t, root)
+	hashes := storeAll(t, a, []byte("a"))
+	b := newFS(t, root)
+	to, _ := ParseLayout("flat")
+	if _, err := b.Migrate(to); err != nil {
+		t.Fatal(err)
+	}
+
+	// a still has the previous layout, it rereads the descriptor
+	// when it misses a blob
+	checkBlobs(t, a, hashes, []byte("a"))
+	more := storeAll(t, a, []byte("b"))
+	if path := b.BlobPath(more[0]); path != to.path(root, more[0]) {
+		t.Fatalf("blob written at %s", path)
+	}
+	checkBlobs(t, b, more, []byte("b"))
+
+	// a blob written at a stale layout is moved to the current one
+	c := newFS(t, root)
+	from := c.Layout()
+	back, _ := ParseLayout("4x2")
+	if _, err := b.Migrate(back); err != nil {
+		t.Fatal(err)
+	}
+	h := hashes[0]
+	files := c.files()
+	path, _, _, err := files.write(from.path(root, h), "x", h, 1, strings.NewReader("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != from.path(root, h) {
+		t.Fatalf("written at %s", path)
+	}
+	path, err = files.settle(root, path, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != back.path(root, h) {
+		t.Fatalf("settled at %s, %s expected", path, back.path(root, h))
+	}
+	checkBlobs(t, b, hashes, []byte("a"))
+}
@@ -0,0 +1,753 @@
+package filesystem
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"filemanager/util"
+)
+
+// packDir is the dir under the store root the pack files are in.
+const packDir = "packs"
+
+// the files of a pack, the pack itself, its index and the list
+// of its deleted entries
+const (
+	packExt    = ".pack"
+	packIdxExt = ".idx"
+	packDelExt = ".del"
+)
+
+// the magic which starts pack and index files
+const (
+	packMagic    = "FMP1"
+	packIdxMagic = "FMI1"
+)
+
+// default packing settings
+const (
+	DefaultPackMaxBlob = 64 * 1024
+	DefaultPackMaxSize = 64 * 1024 * 1024
+)
+
+// Packing appends small blobs to pack files rather than storing
+// each in its own file, which saves inodes and speeds up copying
+// the store.
+type Packing struct {
+	// MaxBlobSize is the size up to which blobs are packed.
+	MaxBlobSize int64
+	// MaxPackSize is the size at which a pack is closed and the
+	// next blobs go to a new one.
+	MaxPackSize int64
+}
+
+// NewPacking returns the packing with the default settings.
+func NewPacking() *Packing {
+	return &Packing{
+		MaxBlobSize: DefaultPackMaxBlob,
+		MaxPackSize: DefaultPackMaxSize,
+	}
+}
+
+// Validate checks that the sizes are consistent.
+func (p *Packing) Validate() error {
+	if p.MaxBlobSize < 1 {
+		return fmt.Errorf("max packed blob size must be positive")
+	}
+	if p.MaxPackSize < p.MaxBlobSize {
+		return fmt.Errorf("max pack size %d is less than the max packed blob size %d", p.MaxPackSize, p.MaxBlobSize)
+	}
+	return nil
+}
+
+// SetPacking sets the packing of the blobs stored by Store, nil
+// stores every blob in its own file. Packed blobs are read like
+// the others.
+func (fs *FileSystem) SetPacking(p *Packing) error {
+	if p != nil {
+		if err := p.Validate(); err != nil {
+			return err
+		}
+	}
+	fs.packing = p
+	return nil
+}
+
+// the kinds of packed entries are the extensions their blob file
+// would have
+var packKinds = []string{"", compressedExt, encryptedExt}
+
+func packKind(ext string) (byte, bool) {
+	for i, k := range packKinds {
+		if k == ext {
+			return byte(i), true
+		}
+	}
+	return 0, false
+}
+
+// an entry in a pack is a header, the address, the kind, the size
+// of the original content and the length of the data, followed
+// by the data, which is the content of the blob file it would be
+const packEntryHeaderSize = sha1.Size + 1 + 8 + 8
+
+// a record in an index is the address, the kind, the size, the
+// offset of the data in the pack and its length
+const packIdxRecordSize = sha1.Size + 1 + 8 + 8 + 8
+
+// packEntry is a blob in a pack.
+type packEntry struct {
+	addr   [sha1.Size]byte
+	kind   byte
+	size   int64
+	offset int64
+	length int64
+	// the pack file
+	path string
+}
+
+func (e *packEntry) hash() *util.Hash {
+	return util.NewSha1Hash(e.addr[:])
+}
+
+func (e *packEntry) String() string {
+	return fmt.Sprintf("%s@%d", e.path, e.offset)
+}
+
+// packIndex is the index of a pack, the entries are sorted by
+// address once the pack is complete, while it is written they
+// are in pack order and found by byAddr. The size and mtime of
+// the list of deleted entries tell when another process appended
+// to it.
+type packIndex struct {
+	name       string
+	path       string
+	entries    []packEntry
+	deleted    map[[sha1.Size]byte]bool
+	byAddr     map[[sha1.Size]byte]int
+	delSize    int64
+	delModTime time.Time
+}
+
+// find returns the entry with the given address, unless it is
+// deleted.
+func (p *packIndex) find(addr [sha1.Size]byte) *packEntry {
+	if p.deleted[addr] {
+		return nil
+	}
+	if p.byAddr != nil {
+		if i, ok := p.byAddr[addr]; ok {
+			e := p.entries[i]
+			return &e
+		}
+		return nil
+	}
+	i := sort.Search(len(p.entries), func(i int) bool {
+		return bytes.Compare(p.entries[i].addr[:], addr[:]) >= 0
+	})
+	if i < len(p.entries) && p.entries[i].addr == addr {
+		e := p.entries[i]
+		return &e
+	}
+	return nil
+}
+
+func (p *packIndex) sort() {
+	sort.Slice(p.entries, func(i, j int) bool {
+		return bytes.Compare(p.entries[i].addr[:], p.entries[j].addr[:]) < 0
+	})
+}
+
+func (p *packIndex) idxPath() string {
+	return strings.TrimSuffix(p.path, packExt) + packIdxExt
+}
+
+func (p *packIndex) delPath() string {
+	return strings.TrimSuffix(p.path, packExt) + packDelExt
+}
+
+// writeIndex writes the sorted index of a complete pack.
+func writeIndex(p *packIndex) error {
+	buf := &bytes.Buffer{}
+	buf.WriteString(packIdxMagic)
+	var n [8]byte
+	binary.BigEndian.PutUint32(n[:4], uint32(len(p.entries)))
+	buf.Write(n[:4])
+	for _, e := range p.entries {
+		buf.Write(e.addr[:])
+		buf.WriteByte(e.kind)
+		for _, v := range []int64{e.size, e.offset, e.length} {
+			binary.BigEndian.PutUint64(n[:], uint64(v))
+			buf.Write(n[:])
+		}
+	}
+	sum := sha1.Sum(buf.Bytes())
+	buf.Write(sum[:])
+	_, err := saveFile(p.idxPath(), ioutil.NopCloser(buf))
+	return err
+}
+
+var errBadIndex = errors.New("invalid pack index")
+
+// readIndex reads the index of the pack at the given path, and
+// the list of its deleted entries.
+func readIndex(path string) (*packIndex, error) {
+	p := &packIndex{
+		name:    strings.TrimSuffix(filepath.Base(path), packExt),
+		path:    path,
+		deleted: make(map[[sha1.Size]byte]bool),
+	}
+	data, err := ioutil.ReadFile(p.idxPath())
+	if err != nil {
+		return nil, err
+	}
+	hdr := len(packIdxMagic) + 4
+	if len(data) < hdr+sha1.Size || string(data[:len(packIdxMagic)]) != packIdxMagic {
+		return nil, fmt.Errorf("%s: %v", p.idxPath(), errBadIndex)
+	}
+	body := data[:len(data)-sha1.Size]
+	if sum := sha1.Sum(body); !bytes.Equal(sum[:], data[len(body):]) {
+		return nil, fmt.Errorf("%s: %v, checksum mismatch", p.idxPath(), errBadIndex)
+	}
+	count := int(binary.BigEndian.Uint32(body[len(packIdxMagic):hdr]))
+	if len(body) != hdr+count*packIdxRecordSize {
+		return nil, fmt.Errorf("%s: %v", p.idxPath(), errBadIndex)
+	}
+	p.entries = make([]packEntry, count)
+	for i := range p.entries {
+		r := body[hdr+i*packIdxRecordSize:]
+		e := &p.entries[i]
+		copy(e.addr[:], r)
+		r = r[sha1.Size:]
+		e.kind = r[0]
+		e.size = int64(binary.BigEndian.Uint64(r[1:]))
+		e.offset = int64(binary.BigEndian.Uint64(r[9:]))
+		e.length = int64(binary.BigEndian.Uint64(r[17:]))
+		e.path = path
+	}
+	if err := p.readDeleted(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// readDeleted reads the addresses of the deleted entries, one hex
+// address per line, unless the list is unchanged since the last
+// time.
+func (p *packIndex) readDeleted() error {
+	fi, err := os.Stat(p.delPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Size() == p.delSize && fi.ModTime().Equal(p.delModTime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(p.delPath())
+	if err != nil {
+		return err
+	}
+	p.delSize, p.delModTime = int64(len(data)), fi.ModTime()
+	for _, line := range strings.Split(string(data), "\n") {
+		b, err := hex.DecodeString(strings.TrimSpace(line))
+		if err != nil || len(b) != sha1.Size {
+			continue
+		}
+		var addr [sha1.Size]byte
+		copy(addr[:], b)
+		p.deleted[addr] = true
+	}
+	return nil
+}
+
+// scanPack rebuilds the index of a pack from the headers of its
+// entries, for packs whose index was never written. It stops at
+// the first incomplete entry.
+func scanPack(path string) (*packIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(packMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != packMagic {
+		return nil, fmt.Errorf("%s: invalid pack", path)
+	}
+	p := &packIndex{
+		name:    strings.TrimSuffix(filepath.Base(path), packExt),
+		path:    path,
+		deleted: make(map[[sha1.Size]byte]bool),
+	}
+	offset := int64(len(packMagic))
+	var hdr [packEntryHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			break
+		}
+		e := packEntry{path: path}
+		copy(e.addr[:], hdr[:])
+		e.kind = hdr[sha1.Size]
+		e.size = int64(binary.BigEndian.Uint64(hdr[sha1.Size+1:]))
+		e.length = int64(binary.BigEndian.Uint64(hdr[sha1.Size+9:]))
+		e.offset = offset + packEntryHeaderSize
+		if int(e.kind) >= len(packKinds) || e.length < 0 || e.offset+e.length > fi.Size() {
+			break
+		}
+		if _, err := r.Discard(int(e.length)); err != nil {
+			break
+		}
+		p.entries = append(p.entries, e)
+		offset = e.offset + e.length
+	}
+	p.sort()
+	return p, nil
+}
+
+// packSet holds the indexes of the packs of a store, the complete
+// ones read from their index files and the ones being written.
+type packSet struct {
+	sync.RWMutex
+	dir     string
+	modTime time.Time
+	packs   map[string]*packIndex
+	open    map[string]*packIndex
+}
+
+func newPackSet(root string) *packSet {
+	return &packSet{
+		dir:   filepath.Join(root, packDir),
+		packs: make(map[string]*packIndex),
+		open:  make(map[string]*packIndex),
+	}
+}
+
+// reload reads the indexes of the packs which were added since
+// the last time, and forgets the removed ones. The deleted entries
+// of the known packs are reread when their list changed, appending
+// to it leaves the pack dir alone. It returns true if the pack dir
+// changed.
+func (s *packSet) reload() (bool, error) {
+	fi, err := os.Stat(s.dir)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if fi.ModTime().Equal(s.modTime) {
+		for _, p := range s.packs {
+			if err := p.readDeleted(); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	}
+	names, err := filepath.Glob(filepath.Join(s.dir, "*"+packIdxExt))
+	if err != nil {
+		return false, err
+	}
+	found := make(map[string]bool, len(names))
+	for _, idx := range names {
+		path := strings.TrimSuffix(idx, packIdxExt) + packExt
+		name := strings.TrimSuffix(filepath.Base(idx), packIdxExt)
+		found[name] = true
+		if p, ok := s.packs[name]; ok {
+			// another process may have deleted entries
+			if err := p.readDeleted(); err != nil {
+				return false, err
+			}
+			continue
+		}
+		p, err := readIndex(path)
+		if err != nil {
+			// a bad index hides its pack, Fsck reports it
+			continue
+		}
+		s.packs[name] = p
+	}
+	for name := range s.packs {
+		if !found[name] {
+			delete(s.packs, name)
+		}
+	}
+	s.modTime = fi.ModTime()
+	return true, nil
+}
+
+// invalidate forgets the complete packs, so that the next
+// lookup rereads their indexes.
+func (s *packSet) invalidate() {
+	s.Lock()
+	s.packs = make(map[string]*packIndex)
+	s.modTime = time.Time{}
+	s.Unlock()
+}
+
+// lookup returns the packed entry with the given address, or nil
+// if there is none. When the entry is found in a complete pack it
+// checks that the pack is still there and rereads its deleted
+// entries, when it isn't found it rereads the pack dir, in case
+// another process has added packs.
+func (s *packSet) lookup(addr *util.Hash) (*packEntry, error) {
+	var a [sha1.Size]byte
+	copy(a[:], addr.Bytes())
+	for retry := 0; retry < 2; retry++ {
+		e, err := s.find(a)
+		if e != nil || err != nil {
+			return e, err
+		}
+		changed, err := s.reload()
+		if err != nil || !changed {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+func (s *packSet) find(addr [sha1.Size]byte) (*packEntry, error) {
+	s.Lock()
+	defer s.Unlock()
+	for name, p := range s.packs {
+		if p.find(addr) == nil {
+			continue
+		}
+		// another process may have deleted the entry, or removed
+		// the pack when repacking
+		if _, err := os.Stat(p.idxPath()); os.IsNotExist(err) {
+			delete(s.packs, name)
+			continue
+		}
+		if err := p.readDeleted(); err != nil {
+			return nil, err
+		}
+		if e := p.find(addr); e != nil {
+			return e, nil
+		}
+	}
+	for _, p := range s.open {
+		if e := p.find(addr); e != nil {
+			return e, nil
+		}
+	}
+	return nil, nil
+}
+
+// complete returns the indexes of the complete packs, sorted by
+// name.
+func (s *packSet) complete() []*packIndex {
+	s.RLock()
+	defer s.RUnlock()
+	packs := make([]*packIndex, 0, len(s.packs))
+	for _, p := range s.packs {
+		packs = append(packs, p)
+	}
+	sort.Slice(packs, func(i, j int) bool {
+		return packs[i].name < packs[j].name
+	})
+	return packs
+}
+
+// each calls fn with every entry of the complete packs which isn't
+// deleted, once per address.
+func (s *packSet) each(fn func(e *packEntry) error) error {
+	seen := make(map[[sha1.Size]byte]bool)
+	for _, p := range s.complete() {
+		for i := range p.entries {
+			e := p.entries[i]
+			if seen[e.addr] || p.deleted[e.addr] {
+				continue
+			}
+			seen[e.addr] = true
+			if err := fn(&e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// remove marks the entries with the given address as deleted in
+// every pack, complete or being written, it returns true if there
+// was any.
+func (s *packSet) remove(addr *util.Hash) (bool, error) {
+	if _, err := s.reload(); err != nil {
+		return false, err
+	}
+	var a [sha1.Size]byte
+	copy(a[:], addr.Bytes())
+	s.Lock()
+	defer s.Unlock()
+	found := false
+	for _, packs := range []map[string]*packIndex{s.packs, s.open} {
+		for _, p := range packs {
+			if p.find(a) == nil {
+				continue
+			}
+			if err := p.markDeleted(a); err != nil {
+				return found, err
+			}
+			found = true
+		}
+	}
+	return found, nil
+}
+
+// markDeleted appends the address to the deleted entries of the
+// pack.
+func (p *packIndex) markDeleted(addr [sha1.Size]byte) error {
+	f, err := os.OpenFile(p.delPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(hex.EncodeToString(addr[:]) + "\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		p.deleted[addr] = true
+	}
+	return err
+}
+
+// packer appends blobs to the pack it is writing, and starts a
+// new one when the pack is full. The index of a pack is written
+// when it is closed, until then its entries are only known to
+// this process.
+type packer struct {
+	sync.Mutex
+	set     *packSet
+	packing *Packing
+	f       *os.File
+	cur     *packIndex
+	offset  int64
+	// the names of the packs written
+	wrote map[string]bool
+}
+
+func newPacker(set *packSet, packing *Packing) *packer {
+	return &packer{set: set, packing: packing, wrote: make(map[string]bool)}
+}
+
+// newPackName returns a random name for a new pack.
+func newPackName() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "pack-" + hex.EncodeToString(b), nil
+}
+
+func (p *packer) start() error {
+	if err := os.MkdirAll(p.set.dir, 0755); err != nil {
+		return err
+	}
+	name, err := newPackName()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(p.set.dir, name+packExt)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(packMagic); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	p.f = f
+	p.offset = int64(len(packMagic))
+	p.cur = &packIndex{
+		name:    name,
+		path:    path,
+		deleted: make(map[[sha1.Size]byte]bool),
+		byAddr:  make(map[[sha1.Size]byte]int),
+	}
+	p.set.Lock()
+	p.set.open[name] = p.cur
+	p.set.Unlock()
+	return nil
+}
+
+// add appends the encoded blob file data of the blob with the
+// given address to the pack, unless the pack already has it.
+func (p *packer) add(addr *util.Hash, kind byte, size int64, data []byte) (*packEntry, error) {
+	p.Lock()
+	defer p.Unlock()
+	e := packEntry{kind: kind, size: size, length: int64(len(data))}
+	copy(e.addr[:], addr.Bytes())
+	if p.cur != nil {
+		p.set.RLock()
+		existing, deleted := p.cur.find(e.addr), p.cur.deleted[e.addr]
+		p.set.RUnlock()
+		if existing != nil {
+			return existing, nil
+		}
+		if deleted {
+			// the list of deleted entries can't be undone, the
+			// blob goes to the next pack
+			if err := p.finish(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if p.cur == nil {
+		if err := p.start(); err != nil {
+			return nil, err
+		}
+	}
+	var hdr [packEntryHeaderSize]byte
+	copy(hdr[:], e.addr[:])
+	hdr[sha1.Size] = kind
+	binary.BigEndian.PutUint64(hdr[sha1.Size+1:], uint64(size))
+	binary.BigEndian.PutUint64(hdr[sha1.Size+9:], uint64(len(data)))
+	if _, err := p.f.Write(hdr[:]); err != nil {
+		return nil, err
+	}
+	if _, err := p.f.Write(data); err != nil {
+		return nil, err
+	}
+	e.offset = p.offset + packEntryHeaderSize
+	e.path = p.cur.path
+	p.offset = e.offset + e.length
+
+	p.set.Lock()
+	p.cur.byAddr[e.addr] = len(p.cur.entries)
+	p.cur.entries = append(p.cur.entries, e)
+	p.set.Unlock()
+
+	if p.offset >= p.packing.MaxPackSize {
+		if err := p.finish(); err != nil {
+			return nil, err
+		}
+	}
+	return &e, nil
+}
+
+// finish closes the current pack and writes its index.
+func (p *packer) finish() error {
+	if p.cur == nil {
+		return nil
+	}
+	cur := p.cur
+	p.cur = nil
+	err := p.f.Close()
+	if err == nil {
+		idx := &packIndex{name: cur.name, path: cur.path, entries: append([]packEntry(nil), cur.entries...)}
+		idx.sort()
+		err = writeIndex(idx)
+		// the entries deleted while it was written stay deleted
+		idx.deleted = cur.deleted
+		cur = idx
+	}
+	p.set.Lock()
+	delete(p.set.open, cur.name)
+	if err == nil {
+		p.set.packs[cur.name] = cur
+		p.wrote[cur.name] = true
+	}
+	p.set.Unlock()
+	return err
+}
+
+// close writes the index of the current pack, if any.
+func (p *packer) close() error {
+	if p == nil {
+		return nil
+	}
+	p.Lock()
+	defer p.Unlock()
+	return p.finish()
+}
+
+// pack encodes the blob and appends it to the current pack. It
+// returns the entry, the number of bytes written and whether the
+// content was compressed.
+func (b *blobFiles) pack(name string, h *util.Hash, size int64, src io.Reader) (*packEntry, int64, bool, error) {
+	ext, codec, src, err := b.prepare(name, size, src)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	buf := &bytes.Buffer{}
+	if err := b.encode(buf, ext, codec, h, size, src); err != nil {
+		return nil, 0, false, err
+	}
+	kind, _ := packKind(ext)
+	e, err := b.packer.add(b.enc.address(h), kind, size, buf.Bytes())
+	if err != nil {
+		return nil, 0, false, err
+	}
+	return e, int64(buf.Len()), codec != nil, nil
+}
+
+// lookupPacked returns the packed entry of the blob with the given
+// content hash, or nil if it isn't packed.
+func (b *blobFiles) lookupPacked(h *util.Hash) (*packEntry, error) {
+	return b.packs.lookup(b.enc.address(h))
+}
+
+// openEntry opens the packed entry, which reads its original
+// content.
+func (b *blobFiles) openEntry(e *packEntry) (io.ReadCloser, error) {
+	f, err := os.Open(e.path)
+	if err != nil {
+		return nil, err
+	}
+	sr := io.NewSectionReader(f, e.offset, e.length)
+	r, dec, err := b.decode(bufio.NewReader(sr), packKinds[e.kind])
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", e, err)
+	}
+	return &blobFileReadCloser{Reader: r, dec: dec, f: f}, nil
+}
+
+// statEntry returns the content hash and size of the packed entry,
+// the hash is nil unless the entry is encrypted.
+func (b *blobFiles) statEntry(e *packEntry) (*util.Hash, int64, error) {
+	if packKinds[e.kind] != encryptedExt {
+		return nil, e.size, nil
+	}
+	f, err := os.Open(e.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	hdr, err := b.enc.readHeader(io.NewSectionReader(f, e.offset, e.length))
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %v", e, err)
+	}
+	return hdr.hash, hdr.size, nil
+}
+
+// readRaw returns the encoded data of the packed entry.
+func readRaw(f *os.File, e *packEntry) ([]byte, error) {
+	data := make([]byte, e.length)
+	if _, err := f.ReadAt(data, e.offset); err != nil {
+		return nil, fmt.Errorf("%s: %v", e, err)
+	}
+	return data, nil
+}
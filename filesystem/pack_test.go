@@ -0,0 +1,113 @@
+package filesystem
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filemanager/util"
+)
+
+// checkGone checks that the blobs with the given contents are
+// neither found nor read.
+func checkGone(t *testing.T, fs *FileSystem, contents ...[]byte) {
+	t.Helper()
+	for _, c := range contents {
+		h := hashOf(c)
+		if ok, err := fs.Has(h); ok || err != nil {
+			t.Fatalf("deleted blob %s found: %v", h, err)
+		}
+		if _, err := readBlob(fs, h); err == nil {
+			t.Fatalf("deleted blob %s read", h)
+		}
+	}
+}
+
+func TestPackDeleteRepack(t *testing.T) {
+	root := t.TempDir()
+	a := newFS(t, root)
+	if err := a.SetPacking(NewPacking()); err != nil {
+		t.Fatal(err)
+	}
+	contents := [][]byte{[]byte("a"), []byte("bb"), testContent(3000, 1), testContent(100000, 2)}
+	hashes := storeAll(t, a, contents...)
+	if !strings.HasPrefix(a.BlobPath(hashes[0]), filepath.Join(root, packDir)) {
+		t.Fatalf("blob stored at %s", a.BlobPath(hashes[0]))
+	}
+	if strings.HasPrefix(a.BlobPath(hashes[3]), filepath.Join(root, packDir)) {
+		t.Fatal("large blob packed")
+	}
+	b := newFS(t, root)
+	checkBlobs(t, b, hashes, contents...)
+
+	// b has read the pack index, it sees the delete appended by a
+	if err := a.Delete(hashes[0]); err != nil {
+		t.Fatal(err)
+	}
+	checkGone(t, a, contents[0])
+	checkGone(t, b, contents[0])
+	if err := b.Delete(hashes[0]); err == nil {
+		t.Fatal("deleted blob deleted again")
+	}
+	// the next delete is appended to the list
+	if err := a.Delete(hashes[1]); err != nil {
+		t.Fatal(err)
+	}
+	checkGone(t, b, contents[1])
+	n := 0
+	if err := b.List(func(h *util.Hash, size int64) error {
+		n++
+		return nil
+	}); err != nil || n != 2 {
+		t.Fatalf("listed %d blobs: %v", n, err)
+	}
+
+	r, err := b.Repack(&RepackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Packs != 1 || r.Written != 1 || r.Entries != 1 || r.Dropped != 2 {
+		t.Fatalf("repack %+v", r)
+	}
+	checkBlobs(t, a, hashes[2:], contents[2:]...)
+	checkBlobs(t, newFS(t, root), hashes[2:], contents[2:]...)
+	checkGone(t, newFS(t, root), contents[:2]...)
+
+	// the deleted blobs are packed again
+	storeAll(t, a, contents[:2]...)
+	checkBlobs(t, b, hashes, contents...)
+}
+
+func TestPackDeleteOpen(t *testing.T) {
+	fs := newFS(t, t.TempDir())
+	if err := fs.SetPacking(NewPacking()); err != nil {
+		t.Fatal(err)
+	}
+	files := fs.files()
+	if _, _, _, err := files.pack("a", hashOf([]byte("a")), 1, strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+	addr := fs.enc.address(hashOf([]byte("a")))
+	if ok, err := fs.packs.remove(addr); !ok || err != nil {
+		t.Fatalf("blob of the open pack not removed: %v", err)
+	}
+	if e, err := fs.packs.lookup(addr); e != nil || err != nil {
+		t.Fatalf("removed blob found at %v: %v", e, err)
+	}
+
+	// packed again, it goes to a new pack
+	e, _, _, err := files.pack("a", hashOf([]byte("a")), 1, strings.NewReader("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := files.packer.close(); err != nil {
+		t.Fatal(err)
+	}
+	found, err := fs.packs.lookup(addr)
+	if err != nil || found == nil || found.path != e.path {
+		t.Fatalf("packed again at %v, found at %v: %v", e, found, err)
+	}
+	if len(fs.packs.complete()) != 2 {
+		t.Fatalf("%d packs", len(fs.packs.complete()))
+	}
+}
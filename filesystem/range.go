@@ -0,0 +1,148 @@
+package filesystem
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"filemanager/blob"
+)
+
+// encHeaderSize is the size of the header of an encrypted blob
+// file, the sealed chunks follow it.
+const encHeaderSize = prefixSize + wrappedKeySize + sealedMetaSize
+
+// OpenRange returns a reader of n bytes of the content from off,
+// up to the end if n is negative. Files, and blob files stored as
+// is, packed or not, are read from off; encrypted blob files from
+// the sealed chunk holding off and chunked blobs from the chunk
+// holding off. Compressed content is decompressed from its start.
+func (f *FileBlob) OpenRange(off, n int64) (io.ReadCloser, error) {
+	switch {
+	case f.blob != nil:
+		return blob.OpenBytesRange(f.blob, off, n)
+	case f.path == "":
+		return nil, fmt.Errorf("underlying blob ([]byte) is nil")
+	case f.entry != nil:
+		return f.files.openEntryRange(f.entry, off, n)
+	case f.files != nil:
+		return f.files.openRange(f.path, off, n)
+	}
+	return blob.OpenFileRange(f.path, off, n)
+}
+
+// openRange opens a range of the original content of the blob file
+// at the given path.
+func (b *blobFiles) openRange(path string, off, n int64) (io.ReadCloser, error) {
+	if off < 0 {
+		return nil, fmt.Errorf("negative offset %d", off)
+	}
+	switch blobExt(path) {
+	case "":
+		return blob.OpenFileRange(path, off, n)
+	case recipeExt:
+		rc, err := b.readRecipe(path)
+		if err != nil {
+			return nil, err
+		}
+		return b.openChunkRange(rc.Chunks, off, n)
+	case encryptedExt:
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return b.decryptRange(f, 0, fi.Size(), off, n)
+	}
+	rc, err := b.open(path)
+	if err != nil {
+		return nil, err
+	}
+	return blob.SkipRange(rc, off, n)
+}
+
+// openEntryRange opens a range of the original content of the
+// packed entry.
+func (b *blobFiles) openEntryRange(e *packEntry, off, n int64) (io.ReadCloser, error) {
+	if off < 0 {
+		return nil, fmt.Errorf("negative offset %d", off)
+	}
+	switch packKinds[e.kind] {
+	case "":
+		if off > e.length {
+			return nil, fmt.Errorf("%s: offset %d is past the end of the content", e, off)
+		}
+		f, err := os.Open(e.path)
+		if err != nil {
+			return nil, err
+		}
+		sr := io.NewSectionReader(f, e.offset+off, e.length-off)
+		return blob.LimitReadCloser(&blobFileReadCloser{Reader: sr, f: f}, n), nil
+	case encryptedExt:
+		f, err := os.Open(e.path)
+		if err != nil {
+			return nil, err
+		}
+		return b.decryptRange(f, e.offset, e.length, off, n)
+	}
+	rc, err := b.openEntry(e)
+	if err != nil {
+		return nil, err
+	}
+	return blob.SkipRange(rc, off, n)
+}
+
+// decryptRange opens a range of the content of the encrypted blob
+// file at base in f, which takes length bytes. f is closed with
+// the reader, or on error.
+func (b *blobFiles) decryptRange(f *os.File, base, length, off, n int64) (io.ReadCloser, error) {
+	hdr, err := b.enc.readHeader(io.NewSectionReader(f, base, length))
+	if err == nil && off > hdr.size {
+		err = fmt.Errorf("offset %d is past the end of the content", off)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %v", f.Name(), err)
+	}
+	if off == hdr.size {
+		f.Close()
+		return blob.NewBufferedReadCloser(nil), nil
+	}
+	if hdr.flags&flagCompressed != 0 {
+		r, dec, err := b.decode(bufio.NewReader(io.NewSectionReader(f, base, length)), encryptedExt)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s: %v", f.Name(), err)
+		}
+		return blob.SkipRange(&blobFileReadCloser{Reader: r, dec: dec, f: f}, off, n)
+	}
+	// the chunks but the last one have chunkSize bytes of content
+	cs := int64(hdr.chunkSize)
+	idx := off / cs
+	start := int64(encHeaderSize) + idx*(cs+int64(hdr.blobKey.Overhead()))
+	d := newDecryptReader(bufio.NewReader(io.NewSectionReader(f, base+start, length-start)), hdr)
+	d.idx = uint64(idx)
+	return blob.SkipRange(&blobFileReadCloser{Reader: d, f: f}, off-idx*cs, n)
+}
+
+// openChunkRange opens a range of the content of a chunked blob,
+// from the chunk holding off.
+func (b *blobFiles) openChunkRange(chunks []recipeChunk, off, n int64) (io.ReadCloser, error) {
+	start := int64(0)
+	for i, c := range chunks {
+		if off < start+c.Size {
+			r := &chunkReader{files: b, chunks: chunks[i:], skip: off - start}
+			return blob.LimitReadCloser(r, n), nil
+		}
+		start += c.Size
+	}
+	if off > start {
+		return nil, fmt.Errorf("offset %d is past the end of the content", off)
+	}
+	return blob.NewBufferedReadCloser(nil), nil
+}
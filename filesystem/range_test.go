@@ -0,0 +1,133 @@
+package filesystem
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"filemanager/blob"
+)
+
+// rangeOffsets returns the offsets around the boundaries of the
+// encryption chunks and of the chunks of the recipe, if any.
+func rangeOffsets(size int64, rc *recipe) []int64 {
+	offs := []int64{0, 1, size - 1, size}
+	for b := int64(DefaultChunkSize); b < size; b += DefaultChunkSize {
+		offs = append(offs, b-1, b, b+1)
+	}
+	if rc != nil {
+		b := int64(0)
+		for _, c := range rc.Chunks[:len(rc.Chunks)-1] {
+			b += c.Size
+			offs = append(offs, b-1, b, b+1)
+		}
+	}
+	return offs
+}
+
+func TestOpenRange(t *testing.T) {
+	// the content compresses, and its period doesn't divide the
+	// chunk sizes
+	size := int64(3*DefaultChunkSize + 123)
+	content := bytes.Repeat(testContent(1009, 1), int(size)/1009+1)[:size]
+	for _, c := range []struct {
+		name     string
+		compress bool
+		encrypt  Addressing
+		chunk    bool
+		pack     bool
+		ext      string
+	}{
+		{"plain", false, "", false, false, ""},
+		{"compressed", true, "", false, false, compressedExt},
+		{"encrypted", false, AddressPlain, false, false, encryptedExt},
+		{"encrypted hmac", false, AddressHMAC, false, false, encryptedExt},
+		{"encrypted compressed", true, AddressPlain, false, false, encryptedExt},
+		{"chunked", false, "", true, false, recipeExt},
+		{"chunked encrypted", true, AddressHMAC, true, false, recipeExt},
+		{"packed", false, "", false, true, packExt},
+		{"packed compressed", true, "", false, true, packExt},
+		{"packed encrypted", false, AddressHMAC, false, true, packExt},
+	} {
+		fs := newFS(t, t.TempDir())
+		if c.compress {
+			fs.SetCompression(NewCompression(GzipCodec{}))
+		}
+		if c.encrypt != "" {
+			if err := fs.SetEncryption(newMasterKey(t), c.encrypt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if c.chunk {
+			if err := fs.SetChunking(testChunking()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if c.pack {
+			if err := fs.SetPacking(&Packing{MaxBlobSize: 1 << 20, MaxPackSize: 1 << 22}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		h := storeAll(t, fs, content)[0]
+		path := fs.BlobPath(h)
+		if !strings.HasSuffix(path, c.ext) || (c.ext == "" && blobExt(path) != "") {
+			t.Fatalf("%s: blob stored at %s", c.name, path)
+		}
+		var rc *recipe
+		if c.chunk {
+			var err error
+			if rc, err = fs.files().readRecipe(path); err != nil {
+				t.Fatal(err)
+			}
+			if len(rc.Chunks) < 8 {
+				t.Fatalf("%s: %d chunks", c.name, len(rc.Chunks))
+			}
+		}
+		b, err := fs.Get(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, off := range rangeOffsets(size, rc) {
+			for _, n := range []int64{-1, 0, 1, 100, DefaultChunkSize, DefaultChunkSize + 1} {
+				r, err := blob.OpenRange(b, off, n)
+				if err != nil {
+					t.Fatalf("%s: range %d+%d: %v", c.name, off, n, err)
+				}
+				got, err := ioutil.ReadAll(r)
+				r.Close()
+				end := size
+				if n >= 0 && off+n < end {
+					end = off + n
+				}
+				if err != nil || !bytes.Equal(got, content[off:end]) {
+					t.Fatalf("%s: range %d+%d read %d bytes, %d expected: %v", c.name, off, n, len(got), end-off, err)
+				}
+			}
+		}
+		if r, err := blob.OpenRange(b, size+1, 1); err == nil {
+			r.Close()
+			t.Fatalf("%s: range past the end opened", c.name)
+		}
+
+		// read in pieces through a ReaderAt
+		sr := io.NewSectionReader(blob.NewReaderAt(b), 0, size)
+		got := make([]byte, 0, size)
+		piece := make([]byte, 1000)
+		for {
+			n, err := sr.Read(piece)
+			got = append(got, piece[:n]...)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: read at %d: %v", c.name, len(got), err)
+			}
+		}
+		if !bytes.Equal(got, content) {
+			t.Fatalf("%s: read %d bytes through a ReaderAt, content differs", c.name, len(got))
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package filesystem
+
+import (
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RepackOptions controls what Repack rewrites.
+type RepackOptions struct {
+	// Loose also moves the loose blobs which are small enough
+	// into the packs.
+	Loose bool
+	// Packing sets the max blob and pack sizes, it defaults to
+	// the packing of the store or else the default packing.
+	Packing *Packing
+	// OrphanAge is the age after which a pack without an index is
+	// considered left behind by an interrupted Store rather than
+	// being written, and its entries are repacked. It defaults to
+	// DefaultTempMaxAge.
+	OrphanAge time.Duration
+}
+
+// RepackReport is the result of Repack.
+type RepackReport struct {
+	Packs     int           `json:"packs"`
+	Orphans   int           `json:"orphans"`
+	Written   int           `json:"written"`
+	Entries   int64         `json:"entries"`
+	Dropped   int64         `json:"dropped"`
+	Loose     int64         `json:"loose"`
+	Reclaimed int64         `json:"reclaimed"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// Repack rewrites the packs of the store into new ones, which
+// drops the deleted entries and the duplicates, and merges small
+// packs. The old packs are removed once the new ones are complete,
+// so that the blobs can be read throughout.
+func (fs *FileSystem) Repack(opts *RepackOptions) (*RepackReport, error) {
+	o := *opts
+	if o.Packing == nil {
+		o.Packing = fs.packing
+	}
+	if o.Packing == nil {
+		o.Packing = NewPacking()
+	}
+	if err := o.Packing.Validate(); err != nil {
+		return nil, err
+	}
+	if o.OrphanAge <= 0 {
+		o.OrphanAge = DefaultTempMaxAge
+	}
+	t := time.Now()
+	r := &RepackReport{}
+	if _, err := fs.packs.reload(); err != nil {
+		return nil, err
+	}
+	old := fs.packs.complete()
+	orphans, err := fs.packs.orphans(o.OrphanAge)
+	if err != nil {
+		return nil, err
+	}
+	r.Packs = len(old)
+	r.Orphans = len(orphans)
+	old = append(old, orphans...)
+
+	files := fs.files()
+	var loose []string
+	if o.Loose {
+		if loose, err = fs.smallLoose(files, o.Packing.MaxBlobSize); err != nil {
+			return nil, err
+		}
+	}
+	rewrite := len(old) > 1 || len(orphans) > 0 || len(loose) > 0
+	for _, p := range old {
+		if len(p.deleted) > 0 {
+			rewrite = true
+		}
+	}
+	if !rewrite {
+		r.Duration = time.Now().Sub(t)
+		return r, nil
+	}
+
+	pk := newPacker(fs.packs, o.Packing)
+	seen := make(map[[sha1.Size]byte]bool)
+	var before int64
+	for _, p := range old {
+		n, err := fs.repackOne(pk, p, seen, r)
+		if err != nil {
+			pk.close()
+			return nil, err
+		}
+		before += n
+	}
+	for _, path := range loose {
+		h := fs.layout.parse(fs.root, path)
+		var addr [sha1.Size]byte
+		copy(addr[:], h.Bytes())
+		if seen[addr] {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			pk.close()
+			return nil, err
+		}
+		size, err := files.size(path, fi)
+		if err != nil {
+			pk.close()
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			pk.close()
+			return nil, err
+		}
+		kind, _ := packKind(blobExt(path))
+		if _, err := pk.add(h, kind, size, data); err != nil {
+			pk.close()
+			return nil, err
+		}
+		seen[addr] = true
+		r.Loose++
+	}
+	if err := pk.close(); err != nil {
+		return nil, err
+	}
+
+	// the new packs are complete, remove what they replace
+	for _, p := range old {
+		for _, path := range []string{p.path, p.idxPath(), p.delPath()} {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+	}
+	algDir := filepath.Join(fs.root, "sha1")
+	for _, path := range loose {
+		before += fileSize(path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		removeEmptyDirs(filepath.Dir(path), algDir)
+	}
+	fs.packs.Lock()
+	for _, p := range old {
+		delete(fs.packs.packs, p.name)
+	}
+	fs.packs.Unlock()
+
+	var after int64
+	for _, p := range fs.packs.complete() {
+		if pk.wrote[p.name] {
+			r.Written++
+			after += fileSize(p.path)
+		}
+	}
+	r.Reclaimed = before - after
+	r.Duration = time.Now().Sub(t)
+	fs.lg.Info().
+		Int("packs", r.Packs).
+		Int("written", r.Written).
+		Int64("entries", r.Entries).
+		Int64("dropped", r.Dropped).
+		Int64("loose", r.Loose).
+		Int64("duration", r.Duration.Nanoseconds()).
+		Msg("repack done")
+	return r, nil
+}
+
+// repackOne copies the entries of the pack which are neither
+// deleted nor already copied to the packer. It returns the size
+// of the pack.
+func (fs *FileSystem) repackOne(pk *packer, p *packIndex, seen map[[sha1.Size]byte]bool, r *RepackReport) (int64, error) {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	for i := range p.entries {
+		e := &p.entries[i]
+		if p.deleted[e.addr] || seen[e.addr] {
+			r.Dropped++
+			continue
+		}
+		data, err := readRaw(f, e)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := pk.add(e.hash(), e.kind, e.size, data); err != nil {
+			return 0, err
+		}
+		seen[e.addr] = true
+		r.Entries++
+	}
+	return fi.Size(), nil
+}
+
+// smallLoose returns the paths of the loose blobs in the store
+// layout whose files are at most max bytes. Chunked blobs stay
+// loose.
+func (fs *FileSystem) smallLoose(files *blobFiles, max int64) ([]string, error) {
+	paths := make([]string, 0)
+	algDir := filepath.Join(fs.root, "sha1")
+	err := filepath.Walk(algDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() || fi.Size() > max || blobExt(path) == recipeExt {
+			return nil
+		}
+		if strings.Contains(filepath.Base(path), tempMarker) || fs.layout.parse(fs.root, path) == nil {
+			return nil
+		}
+		paths = append(paths, path)
+		return nil
+	})
+	return paths, err
+}
+
+// orphans returns the packs without an index which are older than
+// the given age, indexed from their entries.
+func (s *packSet) orphans(age time.Duration) ([]*packIndex, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*"+packExt))
+	if err != nil {
+		return nil, err
+	}
+	orphans := make([]*packIndex, 0)
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), packExt)
+		s.RLock()
+		_, complete := s.packs[name]
+		_, open := s.open[name]
+		s.RUnlock()
+		if complete || open {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil || time.Now().Sub(fi.ModTime()) < age {
+			continue
+		}
+		p, err := scanPack(path)
+		if err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, p)
+	}
+	return orphans, nil
+}
+
+func fileSize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// removeEmptyDirs removes dir and its parents up to stop, as long
+// as they are empty.
+func removeEmptyDirs(dir, stop string) {
+	for dir != stop && strings.HasPrefix(dir, stop) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
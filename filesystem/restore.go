@@ -0,0 +1,333 @@
+package filesystem
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"filemanager/util"
+)
+
+// RestoreOptions controls what Restore writes.
+type RestoreOptions struct {
+	// Workers is the number of files written in parallel,
+	// defaults to the maxSaver of the file system.
+	Workers int
+	// Prefix restores only the subtree at this relative, slash
+	// separated path of the snapshot.
+	Prefix string
+	// Patterns restores only the files whose relative path or
+	// name matches one of them, see path.Match.
+	Patterns []string
+	// Overwrite replaces existing files whose content differs,
+	// which are reported as problems otherwise. Existing files
+	// with the right content are kept either way.
+	Overwrite bool
+}
+
+// RestoreProblem is a file or dir Restore failed to write.
+type RestoreProblem struct {
+	Path  string `json:"path"`
+	Hash  string `json:"hash,omitempty"`
+	Error string `json:"error"`
+}
+
+// RestoreReport is the result of Restore.
+type RestoreReport struct {
+	Dirs     int   `json:"dirs"`
+	Files    int   `json:"files"`
+	Size     int64 `json:"size"`
+	Existing int   `json:"existing"`
+	// AttrsSkipped counts the owners and xattrs which were not
+	// restored for lack of permission or support.
+	AttrsSkipped int               `json:"attrs-skipped"`
+	Problems     []*RestoreProblem `json:"problems"`
+	Duration     time.Duration     `json:"duration"`
+}
+
+// restorer writes the entries of a snapshot under a target dir.
+type restorer struct {
+	fs     *FileSystem
+	target string
+	opts   *RestoreOptions
+	report *RestoreReport
+	sync.Mutex
+}
+
+// Restore recreates the tree of the snapshot with the given hash
+// under the target dir, which is created if needed. The files are
+// read from this store in parallel and written to temp files which
+// are renamed once their content hash is verified, then the modes,
+// times, owners and xattrs of the files and dirs are restored where
+// permissions allow.
+func (fs *FileSystem) Restore(h *util.Hash, target string, opts *RestoreOptions) (*RestoreReport, error) {
+	o := *opts
+	if o.Workers <= 0 {
+		o.Workers = fs.maxSaver
+	}
+	o.Prefix = strings.Trim(path.Clean("/"+o.Prefix), "/")
+	for _, p := range o.Patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", p, err)
+		}
+	}
+	if fs.enc == nil && fs.Encrypted() {
+		return nil, fmt.Errorf("the store is encrypted, a master key is required")
+	}
+	snap, err := fs.ReadSnapshot(h)
+	if err != nil {
+		return nil, err
+	}
+	target, err = filepath.Abs(target)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return nil, err
+	}
+
+	t := time.Now()
+	r := &restorer{fs: fs, target: target, opts: &o, report: &RestoreReport{}}
+	dirs, files := r.selectEntries(snap.Entries)
+
+	// the dirs are writable until their files are restored
+	for _, e := range dirs {
+		if err := os.MkdirAll(r.path(e), 0755); err != nil {
+			r.problem(e, err)
+			continue
+		}
+		r.report.Dirs++
+	}
+
+	ch := make(chan *SnapshotEntry)
+	wg := &sync.WaitGroup{}
+	wg.Add(o.Workers)
+	for i := 0; i < o.Workers; i++ {
+		go func() {
+			defer wg.Done()
+			for e := range ch {
+				r.restoreFile(e)
+			}
+		}()
+	}
+	for _, e := range files {
+		ch <- e
+	}
+	close(ch)
+	wg.Wait()
+
+	// deepest first, so that setting a dir doesn't change the
+	// mtime of its parent
+	for i := len(dirs) - 1; i >= 0; i-- {
+		r.setAttrs(dirs[i])
+	}
+
+	r.report.Duration = time.Now().Sub(t)
+	fs.lg.Info().
+		Str("snapshot", h.String()).
+		Str("target", target).
+		Int("dirs", r.report.Dirs).
+		Int("files", r.report.Files).
+		Int("existing", r.report.Existing).
+		Int("problems", len(r.report.Problems)).
+		Int64("duration", r.report.Duration.Nanoseconds()).
+		Msg("restore done")
+	return r.report, nil
+}
+
+// selectEntries returns the dirs and files of the snapshot to
+// restore, the dirs sorted by path. With patterns, only the dirs
+// the matching files are in are restored.
+func (r *restorer) selectEntries(entries []*SnapshotEntry) ([]*SnapshotEntry, []*SnapshotEntry) {
+	dirs := make([]*SnapshotEntry, 0)
+	files := make([]*SnapshotEntry, 0)
+	byPath := make(map[string]*SnapshotEntry)
+	for _, e := range entries {
+		if !r.inPrefix(e.Path) {
+			continue
+		}
+		if !validEntryPath(e.Path) {
+			r.problem(e, fmt.Errorf("invalid path"))
+			continue
+		}
+		if e.Dir {
+			byPath[e.Path] = e
+			if len(r.opts.Patterns) == 0 {
+				dirs = append(dirs, e)
+			}
+			continue
+		}
+		if r.matches(e.Path) {
+			files = append(files, e)
+		}
+	}
+	if len(r.opts.Patterns) > 0 {
+		seen := make(map[string]bool)
+		for _, e := range files {
+			for dir := path.Dir(e.Path); dir != "." && !seen[dir]; dir = path.Dir(dir) {
+				seen[dir] = true
+				if d, ok := byPath[dir]; ok && r.inPrefix(dir) {
+					dirs = append(dirs, d)
+				}
+			}
+		}
+		sort.Slice(dirs, func(i, j int) bool {
+			return dirs[i].Path < dirs[j].Path
+		})
+	}
+	return dirs, files
+}
+
+func (r *restorer) inPrefix(p string) bool {
+	return r.opts.Prefix == "" || p == r.opts.Prefix || strings.HasPrefix(p, r.opts.Prefix+"/")
+}
+
+func (r *restorer) matches(p string) bool {
+	if len(r.opts.Patterns) == 0 {
+		return true
+	}
+	for _, pattern := range r.opts.Patterns {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(p)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validEntryPath tells if the path stays under the target, a
+// manifest is read from the store and isn't trusted.
+func validEntryPath(p string) bool {
+	return p != "" && p != "." && !path.IsAbs(p) && path.Clean(p) == p && p != ".." && !strings.HasPrefix(p, "../")
+}
+
+func (r *restorer) path(e *SnapshotEntry) string {
+	return filepath.Join(r.target, filepath.FromSlash(e.Path))
+}
+
+func (r *restorer) problem(e *SnapshotEntry, err error) {
+	r.Lock()
+	r.report.Problems = append(r.report.Problems, &RestoreProblem{Path: e.Path, Hash: e.Hash, Error: err.Error()})
+	r.Unlock()
+	r.fs.lg.Error().Err(err).Str("path", e.Path).Msg("restore error")
+}
+
+// restoreFile writes the content of the file entry, unless the
+// file already has it, and restores its attributes.
+func (r *restorer) restoreFile(e *SnapshotEntry) {
+	h, err := util.ParseHash(e.Hash)
+	if err != nil {
+		r.problem(e, err)
+		return
+	}
+	p := r.path(e)
+	existing := false
+	if fi, err := os.Stat(p); err == nil {
+		if fi.IsDir() {
+			r.problem(e, fmt.Errorf("a directory is in the way"))
+			return
+		}
+		if fi.Size() == e.Size {
+			if hh, err := hashFile(p); err == nil && bytes.Equal(hh, h.Bytes()) {
+				existing = true
+			}
+		}
+		if !existing && !r.opts.Overwrite {
+			r.problem(e, fmt.Errorf("file exists with other content"))
+			return
+		}
+	}
+	if !existing {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			r.problem(e, err)
+			return
+		}
+		if err := r.writeFile(p, h, e.Size); err != nil {
+			r.problem(e, err)
+			return
+		}
+	}
+	if !r.setAttrs(e) {
+		return
+	}
+	r.Lock()
+	if existing {
+		r.report.Existing++
+	} else {
+		r.report.Files++
+		r.report.Size += e.Size
+	}
+	r.Unlock()
+}
+
+// setAttrs restores the mode, times, owner and xattrs of the entry.
+func (r *restorer) setAttrs(e *SnapshotEntry) bool {
+	n, err := setAttrs(r.path(e), e)
+	if err != nil {
+		r.problem(e, err)
+		return false
+	}
+	if n > 0 {
+		r.Lock()
+		r.report.AttrsSkipped += n
+		r.Unlock()
+	}
+	return true
+}
+
+// writeFile writes the blob to a temp file next to p and renames
+// it to p if its content has the expected hash and size.
+func (r *restorer) writeFile(p string, h *util.Hash, size int64) error {
+	b, err := r.fs.Get(h)
+	if err != nil {
+		return err
+	}
+	rc, err := b.ReadCloser()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	dst, err := ioutil.TempFile(filepath.Dir(p), filepath.Base(p)+tempMarker)
+	if err != nil {
+		return err
+	}
+	sh := sha1.New()
+	n, err := io.Copy(io.MultiWriter(dst, sh), rc)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && (n != size || !bytes.Equal(sh.Sum(nil), h.Bytes())) {
+		err = fmt.Errorf("content hash mismatch, the blob is corrupt")
+	}
+	if err == nil {
+		err = os.Rename(dst.Name(), p)
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+	}
+	return err
+}
+
+func hashFile(p string) ([]byte, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sh := sha1.New()
+	if _, err := io.Copy(sh, f); err != nil {
+		return nil, err
+	}
+	return sh.Sum(nil), nil
+}
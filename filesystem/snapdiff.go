@@ -0,0 +1,223 @@
+package filesystem
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"filemanager/util"
+)
+
+// ChangeKind is the kind of a change between two snapshots.
+type ChangeKind string
+
+const (
+	ChangeAdded    ChangeKind = "added"
+	ChangeDeleted  ChangeKind = "deleted"
+	ChangeModified ChangeKind = "modified"
+	ChangeMoved    ChangeKind = "moved"
+)
+
+// Change is a file which differs between two snapshots. OldPath is
+// set for moved files, OldHash and OldSize for modified ones.
+type Change struct {
+	Kind    ChangeKind `json:"kind"`
+	Path    string     `json:"path"`
+	OldPath string     `json:"old-path,omitempty"`
+	Hash    string     `json:"hash,omitempty"`
+	OldHash string     `json:"old-hash,omitempty"`
+	Size    int64      `json:"size"`
+	OldSize int64      `json:"old-size,omitempty"`
+}
+
+// DirDelta sums up the changes under a top-level dir of the
+// snapshots, "." for the files at the root. Bytes is the change of
+// the size of the dir, moves between dirs count in both.
+type DirDelta struct {
+	Dir      string `json:"dir"`
+	Added    int    `json:"added"`
+	Deleted  int    `json:"deleted"`
+	Modified int    `json:"modified"`
+	Moved    int    `json:"moved"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// SnapshotDiff is the changeset between two snapshots.
+type SnapshotDiff struct {
+	From     string      `json:"from,omitempty"`
+	To       string      `json:"to,omitempty"`
+	Added    int         `json:"added"`
+	Deleted  int         `json:"deleted"`
+	Modified int         `json:"modified"`
+	Moved    int         `json:"moved"`
+	Bytes    int64       `json:"bytes"`
+	Changes  []*Change   `json:"changes"`
+	Dirs     []*DirDelta `json:"dirs"`
+}
+
+// DiffSnapshots reads the snapshots with the given hashes from this
+// store and returns the changes from the first to the second, they
+// must be snapshots of the same source.
+func (fs *FileSystem) DiffSnapshots(from, to *util.Hash) (*SnapshotDiff, error) {
+	a, err := fs.ReadSnapshot(from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := fs.ReadSnapshot(to)
+	if err != nil {
+		return nil, err
+	}
+	if a.Source != b.Source {
+		return nil, fmt.Errorf("snapshots are of different sources, %s and %s", a.Source, b.Source)
+	}
+	d := DiffSnapshots(a, b)
+	d.From = from.String()
+	d.To = to.String()
+	return d, nil
+}
+
+// DiffSnapshots returns the changes of the files from snapshot a to
+// snapshot b. Files are matched by path, a file whose content
+// changed is modified. A deleted file whose content is at a new
+// path is moved there, preferably to a path with the same name.
+// Empty files are never moved, they all have the same content.
+// Dirs only count by the files in them.
+func DiffSnapshots(a, b *Snapshot) *SnapshotDiff {
+	old := snapshotFiles(a)
+	cur := snapshotFiles(b)
+	d := &SnapshotDiff{Changes: make([]*Change, 0)}
+
+	deleted := make(map[string][]*SnapshotEntry)
+	for p, e := range old {
+		n, ok := cur[p]
+		if !ok {
+			deleted[e.Hash] = append(deleted[e.Hash], e)
+			continue
+		}
+		if n.Hash != e.Hash {
+			d.Changes = append(d.Changes, &Change{
+				Kind: ChangeModified, Path: p,
+				Hash: n.Hash, OldHash: e.Hash,
+				Size: n.Size, OldSize: e.Size,
+			})
+		}
+	}
+	for _, es := range deleted {
+		sort.Slice(es, func(i, j int) bool { return es[i].Path < es[j].Path })
+	}
+
+	added := make([]*SnapshotEntry, 0)
+	for p, e := range cur {
+		if _, ok := old[p]; !ok {
+			added = append(added, e)
+		}
+	}
+	sort.Slice(added, func(i, j int) bool { return added[i].Path < added[j].Path })
+	for _, e := range added {
+		if from := takeMoved(deleted, e); from != nil {
+			d.Changes = append(d.Changes, &Change{
+				Kind: ChangeMoved, Path: e.Path, OldPath: from.Path,
+				Hash: e.Hash, Size: e.Size,
+			})
+			continue
+		}
+		d.Changes = append(d.Changes, &Change{Kind: ChangeAdded, Path: e.Path, Hash: e.Hash, Size: e.Size})
+	}
+	for _, es := range deleted {
+		for _, e := range es {
+			d.Changes = append(d.Changes, &Change{Kind: ChangeDeleted, Path: e.Path, Hash: e.Hash, Size: e.Size})
+		}
+	}
+	sort.Slice(d.Changes, func(i, j int) bool {
+		return d.Changes[i].Path < d.Changes[j].Path
+	})
+	d.sum()
+	return d
+}
+
+// snapshotFiles returns the file entries of the snapshot by path.
+func snapshotFiles(s *Snapshot) map[string]*SnapshotEntry {
+	files := make(map[string]*SnapshotEntry, len(s.Entries))
+	for _, e := range s.Entries {
+		if !e.Dir {
+			files[e.Path] = e
+		}
+	}
+	return files
+}
+
+// takeMoved removes and returns the deleted file the added one was
+// moved from, if any.
+func takeMoved(deleted map[string][]*SnapshotEntry, e *SnapshotEntry) *SnapshotEntry {
+	es := deleted[e.Hash]
+	if len(es) == 0 || e.Size == 0 {
+		return nil
+	}
+	i := 0
+	for j, c := range es {
+		if path.Base(c.Path) == path.Base(e.Path) {
+			i = j
+			break
+		}
+	}
+	from := es[i]
+	deleted[e.Hash] = append(es[:i:i], es[i+1:]...)
+	return from
+}
+
+// sum counts the changes and the byte deltas per top-level dir.
+func (d *SnapshotDiff) sum() {
+	dirs := make(map[string]*DirDelta)
+	dir := func(p string) *DirDelta {
+		name := "."
+		if i := strings.IndexByte(p, '/'); i >= 0 {
+			name = p[:i]
+		}
+		dd, ok := dirs[name]
+		if !ok {
+			dd = &DirDelta{Dir: name}
+			dirs[name] = dd
+		}
+		return dd
+	}
+	for _, c := range d.Changes {
+		switch c.Kind {
+		case ChangeAdded:
+			d.Added++
+			dd := dir(c.Path)
+			dd.Added++
+			dd.Bytes += c.Size
+			d.Bytes += c.Size
+		case ChangeDeleted:
+			d.Deleted++
+			dd := dir(c.Path)
+			dd.Deleted++
+			dd.Bytes -= c.Size
+			d.Bytes -= c.Size
+		case ChangeModified:
+			d.Modified++
+			dd := dir(c.Path)
+			dd.Modified++
+			dd.Bytes += c.Size - c.OldSize
+			d.Bytes += c.Size - c.OldSize
+		case ChangeMoved:
+			d.Moved++
+			dd := dir(c.Path)
+			dd.Moved++
+			dd.Bytes += c.Size
+			od := dir(c.OldPath)
+			if od != dd {
+				od.Moved++
+			}
+			od.Bytes -= c.Size
+		}
+	}
+	d.Dirs = make([]*DirDelta, 0, len(dirs))
+	for _, dd := range dirs {
+		d.Dirs = append(d.Dirs, dd)
+	}
+	sort.Slice(d.Dirs, func(i, j int) bool {
+		return d.Dirs[i].Dir < d.Dirs[j].Dir
+	})
+}
@@ -0,0 +1,272 @@
+package filesystem
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+
+	"filemanager/blob"
+	"filemanager/util"
+)
+
+// snapshotKind tells snapshot manifests from the other blobs.
+const snapshotKind = "filemanager-snapshot"
+
+// the version of the snapshot manifest format
+const snapshotVersion = 1
+
+// snapshotsName is the log of the snapshots of a store, one
+// SnapshotRef per line.
+const snapshotsName = "snapshots.jsonl"
+
+// Snapshot is the manifest of the tree a load scanned, which is
+// stored as a blob itself, so that its hash addresses the tree
+// as it was at that time.
+type Snapshot struct {
+	Kind    string           `json:"kind"`
+	Version int              `json:"version"`
+	Source  string           `json:"source"`
+	Time    time.Time        `json:"time"`
+	Files   int64            `json:"files"`
+	Size    int64            `json:"size"`
+	Errors  int64            `json:"errors"`
+	Entries []*SnapshotEntry `json:"entries"`
+}
+
+// SnapshotEntry is a file or dir of a snapshot, the path is
+// relative to the source and slash separated.
+type SnapshotEntry struct {
+	Path    string      `json:"path"`
+	Dir     bool        `json:"dir,omitempty"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mtime"`
+	Size    int64       `json:"size,omitempty"`
+	Hash    string      `json:"hash,omitempty"`
+	Attrs   *FileAttrs  `json:"attrs,omitempty"`
+}
+
+// SnapshotRef is a snapshot recorded in the log of a store.
+type SnapshotRef struct {
+	Hash   string    `json:"hash"`
+	Source string    `json:"source"`
+	Time   time.Time `json:"time"`
+	Files  int64     `json:"files"`
+	Size   int64     `json:"size"`
+	Errors int64     `json:"errors"`
+}
+
+// snapshotRecorder collects the entries of a snapshot while the
+// tree is loaded.
+type snapshotRecorder struct {
+	sync.Mutex
+	root    string
+	entries []*SnapshotEntry
+}
+
+// add records the file or dir at the given path, the size is the
+// loaded one rather than the stat one for files.
+func (r *snapshotRecorder) add(path string, fi os.FileInfo, size int64, hash *util.Hash) {
+	if r == nil {
+		return
+	}
+	rel, err := filepath.Rel(r.root, path)
+	if err != nil {
+		return
+	}
+	e := &SnapshotEntry{
+		Path:    filepath.ToSlash(rel),
+		Dir:     fi.IsDir(),
+		Mode:    fi.Mode(),
+		ModTime: fi.ModTime(),
+		Attrs:   readAttrs(path, fi),
+	}
+	if hash != nil {
+		e.Size = size
+		e.Hash = hash.String()
+	}
+	r.Lock()
+	r.entries = append(r.entries, e)
+	r.Unlock()
+}
+
+// snapshot returns the manifest of the recorded entries, sorted
+// by path.
+func (r *snapshotRecorder) snapshot(errors int64) *Snapshot {
+	r.Lock()
+	defer r.Unlock()
+	s := &Snapshot{
+		Kind:    snapshotKind,
+		Version: snapshotVersion,
+		Source:  r.root,
+		Time:    time.Now().UTC(),
+		Errors:  errors,
+		Entries: r.entries,
+	}
+	sort.Slice(s.Entries, func(i, j int) bool {
+		return s.Entries[i].Path < s.Entries[j].Path
+	})
+	for _, e := range s.Entries {
+		if !e.Dir {
+			s.Files++
+			s.Size += e.Size
+		}
+	}
+	return s
+}
+
+// blob returns the manifest as an in-memory blob.
+func (s *Snapshot) blob() (*FileBlob, error) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(data)
+	u := util.PathToUrl(s.Source)
+	u.Fragment = "snapshot"
+	return &FileBlob{
+		url:  u,
+		name: "snapshot-" + s.Time.Format("20060102T150405Z") + ".json",
+		blob: data,
+		size: int64(len(data)),
+		hash: util.NewSha1Hash(sum[:]),
+	}, nil
+}
+
+// SnapshotLoad is a load which records a snapshot of the tree it
+// loads, the manifest is the last blob it sends.
+type SnapshotLoad struct {
+	blob.LoadStatus
+	snap *Snapshot
+	hash *util.Hash
+}
+
+// Snapshot returns the manifest and its hash once the load is
+// done, or nil if it was canceled.
+func (s *SnapshotLoad) Snapshot() (*Snapshot, *util.Hash) {
+	<-s.Done()
+	return s.snap, s.hash
+}
+
+// LoadSnapshot is like Load but also records the dirs and files
+// it loads, with their modes, mtimes, sizes, content hashes and
+// other attributes (see FileAttrs), in a snapshot manifest. Files which fail to load are missing from
+// the snapshot and counted in its errors.
+func (fs *FileSystem) LoadSnapshot() *SnapshotLoad {
+	sl := &SnapshotLoad{}
+	rec := &snapshotRecorder{root: fs.root}
+	id := uuid.Must(uuid.NewV4()).String()
+	sl.LoadStatus = fs.load(id, fs.skip, rec, func(sts *blob.ProcessStatus) {
+		snap := rec.snapshot(int64(sts.ErrorCount()))
+		b, err := snap.blob()
+		if err != nil {
+			sts.AddErrorCount(1)
+			fs.lg.Error().Err(err).Msg("encode snapshot error")
+			return
+		}
+		select {
+		case sts.Blob() <- b:
+		case <-sts.Canceled():
+			return
+		}
+		sts.AddCount(1)
+		sts.AddSize(b.size)
+		sl.snap = snap
+		sl.hash = b.hash
+		fs.lg.Info().
+			Str("content-hash", b.hash.String()).
+			Int64("files", sl.snap.Files).
+			Msg("snapshot recorded")
+	})
+	return sl
+}
+
+// AddSnapshot records the snapshot with the given hash in the log
+// of this store, the manifest must be stored already.
+func (fs *FileSystem) AddSnapshot(h *util.Hash, s *Snapshot) error {
+	if ok, err := fs.Has(h); err != nil || !ok {
+		if err == nil {
+			err = fmt.Errorf("snapshot %s is not stored", h.String())
+		}
+		return err
+	}
+	ref := &SnapshotRef{
+		Hash:   h.String(),
+		Source: s.Source,
+		Time:   s.Time,
+		Files:  s.Files,
+		Size:   s.Size,
+		Errors: s.Errors,
+	}
+	data, err := json.Marshal(ref)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(fs.root, snapshotsName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Snapshots returns the snapshots recorded in the log of this
+// store, the oldest first.
+func (fs *FileSystem) Snapshots() ([]*SnapshotRef, error) {
+	refs := make([]*SnapshotRef, 0)
+	f, err := os.Open(filepath.Join(fs.root, snapshotsName))
+	if os.IsNotExist(err) {
+		return refs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		ref := &SnapshotRef{}
+		if err := json.Unmarshal(sc.Bytes(), ref); err != nil {
+			// a line cut short by a crash
+			continue
+		}
+		refs = append(refs, ref)
+	}
+	return refs, sc.Err()
+}
+
+// ReadSnapshot reads the snapshot manifest with the given hash
+// from this store.
+func (fs *FileSystem) ReadSnapshot(h *util.Hash) (*Snapshot, error) {
+	b, err := fs.Get(h)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := b.ReadCloser()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{}
+	if err := json.Unmarshal(data, s); err != nil || s.Kind != snapshotKind {
+		return nil, fmt.Errorf("blob %s is not a snapshot", h.String())
+	}
+	if s.Version != snapshotVersion {
+		return nil, fmt.Errorf("snapshot %s has unsupported version %d", h.String(), s.Version)
+	}
+	return s, nil
+}
@@ -0,0 +1,167 @@
+package filesystem
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"filemanager/util"
+)
+
+// BlobPath returns the path of the blob with the given hash
+// in this store, which is the path in the current layout unless
+// the blob is still at its path in the previous one, or the path
+// of its pack if it is packed. The blobs of a store with HMAC
+// addressing are named by their address.
+func (fs *FileSystem) BlobPath(h *util.Hash) string {
+	files := fs.files()
+	if path, _, err := files.locate(h); err == nil && path != "" {
+		return path
+	}
+	if e, err := files.lookupPacked(h); err == nil && e != nil {
+		return e.path
+	}
+	return fs.layout.path(fs.root, fs.enc.address(h))
+}
+
+// Has returns true if the blob with the given hash exists
+// in this store.
+func (fs *FileSystem) Has(h *util.Hash) (bool, error) {
+	files := fs.files()
+	path, _, err := files.locate(h)
+	if path != "" || err != nil {
+		return path != "", err
+	}
+	e, err := files.lookupPacked(h)
+	return e != nil, err
+}
+
+// Get returns the stored blob with the given hash, its content
+// is read from the blob file when its ReadCloser is called.
+func (fs *FileSystem) Get(h *util.Hash) (*FileBlob, error) {
+	files := fs.files()
+	path, fi, err := files.locate(h)
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		e, err := files.lookupPacked(h)
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			return nil, fmt.Errorf("blob %s not found", h.String())
+		}
+		return &FileBlob{
+			path: e.path,
+			url:  util.PathToUrl(e.path),
+			name: h.Hex(),
+			size: e.size,
+			hash: h,
+
+			files: files,
+			entry: e,
+		}, nil
+	}
+	if fi.IsDir() {
+		return nil, fmt.Errorf("blob path %s is a directory", path)
+	}
+	size, err := files.size(path, fi)
+	if err != nil {
+		return nil, err
+	}
+	return &FileBlob{
+		path: path,
+		url:  util.PathToUrl(path),
+		name: h.Hex(),
+		size: size,
+		hash: h,
+
+		files: files,
+	}, nil
+}
+
+// List calls fn with the content hash and size of every blob in
+// this store, which is the original size of compressed,
+// encrypted and chunked blobs, the loose ones first and then the
+// packed ones. Files which don't belong to the store layout are
+// ignored. It stops at the first error returned by fn.
+func (fs *FileSystem) List(fn func(h *util.Hash, size int64) error) error {
+	files := fs.files()
+	if err := fs.listLoose(files, fn); err != nil {
+		return err
+	}
+	if _, err := fs.packs.reload(); err != nil {
+		return err
+	}
+	return fs.packs.each(func(e *packEntry) error {
+		h, size, err := files.statEntry(e)
+		if err != nil {
+			return err
+		}
+		if h == nil {
+			h = e.hash()
+		}
+		return fn(h, size)
+	})
+}
+
+func (fs *FileSystem) listLoose(files *blobFiles, fn func(h *util.Hash, size int64) error) error {
+	algDir := filepath.Join(fs.root, "sha1")
+	exists, err := util.IsPathExists(algDir)
+	if err != nil || !exists {
+		return err
+	}
+	return filepath.Walk(algDir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		h := fs.layout.parse(fs.root, path)
+		if h == nil {
+			return nil
+		}
+		// the name of an encrypted blob may be its address
+		ch, size, err := files.stat(path, fi)
+		if err != nil {
+			return err
+		}
+		if ch != nil {
+			h = ch
+		}
+		return fn(h, size)
+	})
+}
+
+// Delete removes the blob with the given hash from this store.
+// A packed blob is marked as deleted, and its space reclaimed by
+// Repack. The chunks of a chunked blob are kept, since other
+// blobs may share them.
+func (fs *FileSystem) Delete(h *util.Hash) error {
+	files := fs.files()
+	found := false
+	for {
+		path, _, err := files.locate(h)
+		if err != nil {
+			return err
+		}
+		if path == "" {
+			break
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		found = true
+	}
+	packed, err := fs.packs.remove(fs.enc.address(h))
+	if err != nil {
+		return err
+	}
+	if !found && !packed {
+		return fmt.Errorf("blob %s not found", h.String())
+	}
+	fs.lg.Info().Str("content-hash", h.String()).Msg("blob deleted")
+	return nil
+}
@@ -0,0 +1,160 @@
+package job
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// checkpointEntry is one line of a checkpoint journal, it
+// records a source blob which has been stored.
+type checkpointEntry struct {
+	Url  string `json:"url"`
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// Checkpoint is a persisted journal of the blobs a job has
+// stored, keyed by their source url. A job which is restarted
+// with the same id reads the journal back and skips them.
+type Checkpoint struct {
+	sync.Mutex
+	id   string
+	path string
+	f    *os.File
+	done map[string]*checkpointEntry
+}
+
+// OpenCheckpoint opens (or creates) the journal of the job with
+// the given id in dir.
+func OpenCheckpoint(dir, id string) (*Checkpoint, error) {
+	if id == "" || filepath.Base(id) != id {
+		return nil, fmt.Errorf("invalid checkpoint id %q", id)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, id+".journal")
+	cp := &Checkpoint{
+		id:   id,
+		path: path,
+		done: make(map[string]*checkpointEntry),
+	}
+	if err := cp.read(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	cp.f = f
+	return cp, nil
+}
+
+// read loads the existing journal, a partially written last
+// line (e.g. after a crash) is ignored.
+func (cp *Checkpoint) read() error {
+	f, err := os.Open(cp.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		e := &checkpointEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			continue
+		}
+		cp.done[e.Url] = e
+	}
+	return scanner.Err()
+}
+
+// ID returns the id of the job this checkpoint belongs to.
+func (cp *Checkpoint) ID() string {
+	return cp.id
+}
+
+// Path returns the path to the journal file.
+func (cp *Checkpoint) Path() string {
+	return cp.path
+}
+
+// IsDone returns true if the blob from the given source url
+// has been stored.
+func (cp *Checkpoint) IsDone(url string) bool {
+	cp.Lock()
+	defer cp.Unlock()
+	_, ok := cp.done[url]
+	return ok
+}
+
+// Count returns the number of stored blobs in the journal.
+func (cp *Checkpoint) Count() int {
+	cp.Lock()
+	defer cp.Unlock()
+	return len(cp.done)
+}
+
+// MarkDone appends the stored blob to the journal.
+func (cp *Checkpoint) MarkDone(url, hash string, size int64) error {
+	cp.Lock()
+	defer cp.Unlock()
+	if _, ok := cp.done[url]; ok {
+		return nil
+	}
+	if cp.f == nil {
+		return fmt.Errorf("checkpoint %s is closed", cp.id)
+	}
+	e := &checkpointEntry{Url: url, Hash: hash, Size: size}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := cp.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	cp.done[url] = e
+	return nil
+}
+
+// Sync commits the journal to stable storage.
+func (cp *Checkpoint) Sync() error {
+	cp.Lock()
+	defer cp.Unlock()
+	if cp.f == nil {
+		return nil
+	}
+	return cp.f.Sync()
+}
+
+// Close syncs and closes the journal file.
+func (cp *Checkpoint) Close() error {
+	cp.Lock()
+	defer cp.Unlock()
+	if cp.f == nil {
+		return nil
+	}
+	err := cp.f.Sync()
+	if cerr := cp.f.Close(); err == nil {
+		err = cerr
+	}
+	cp.f = nil
+	return err
+}
+
+// Remove closes and deletes the journal, it is meant to be
+// called once the job has completed without errors.
+func (cp *Checkpoint) Remove() error {
+	if err := cp.Close(); err != nil {
+		return err
+	}
+	return os.Remove(cp.path)
+}
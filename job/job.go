@@ -0,0 +1,109 @@
+package job
+
+import (
+	"sort"
+	"time"
+
+	"filemanager/blob"
+)
+
+// State is the state of a job.
+type State string
+
+// job states
+const (
+	StatePending  State = "pending"
+	StateRunning  State = "running"
+	StatePaused   State = "paused"
+	StateFinished State = "finished"
+	StateCanceled State = "canceled"
+)
+
+// Job is a load or store process tracked by a Manager.
+type Job struct {
+	sts        *blob.ProcessStatus
+	run        func()
+	state      State
+	submitTime time.Time
+	startTime  time.Time
+	finishTime time.Time
+}
+
+// ID returns the id of the job, which is the id of its process.
+func (j *Job) ID() string {
+	return j.sts.ID()
+}
+
+// Type returns the process type of the job.
+func (j *Job) Type() string {
+	return j.sts.Type()
+}
+
+// Status returns the process status of the job.
+func (j *Job) Status() *blob.ProcessStatus {
+	return j.sts
+}
+
+// currentState returns the state, taking into account that a
+// running process may have been paused.
+func (j *Job) currentState() State {
+	if j.state == StateRunning && j.sts.IsPaused() {
+		return StatePaused
+	}
+	return j.state
+}
+
+// Summary is the record of a job, it is what gets written
+// to the history file when a job finishes.
+type Summary struct {
+	ID         string     `json:"id"`
+	Type       string     `json:"type"`
+	Source     string     `json:"source,omitempty"`
+	State      State      `json:"state"`
+	SubmitTime time.Time  `json:"submit"`
+	StartTime  *time.Time `json:"start,omitempty"`
+	FinishTime *time.Time `json:"finish,omitempty"`
+	Duration   int64      `json:"duration"`
+	Count      int64      `json:"count"`
+	Size       int64      `json:"size"`
+	SkipCount  int64      `json:"skip-count"`
+	SkipSize   int64      `json:"skip-size"`
+	ErrorCount int64      `json:"error-count"`
+}
+
+// summary must be called with the manager lock held.
+func (j *Job) summary(source string) *Summary {
+	p := j.sts.Snapshot()
+	s := &Summary{
+		ID:         j.ID(),
+		Type:       j.Type(),
+		Source:     source,
+		State:      j.currentState(),
+		SubmitTime: j.submitTime,
+		Count:      p.Count,
+		Size:       p.Size,
+		SkipCount:  p.SkipCount,
+		SkipSize:   p.SkipSize,
+		ErrorCount: p.ErrorCount,
+	}
+	if !j.startTime.IsZero() {
+		t := j.startTime
+		s.StartTime = &t
+		end := time.Now().UTC()
+		if !j.finishTime.IsZero() {
+			end = j.finishTime
+		}
+		s.Duration = end.Sub(j.startTime).Nanoseconds()
+	}
+	if !j.finishTime.IsZero() {
+		t := j.finishTime
+		s.FinishTime = &t
+	}
+	return s
+}
+
+func sortSummaries(ss []*Summary) {
+	sort.Slice(ss, func(i, j int) bool {
+		return ss[i].SubmitTime.Before(ss[j].SubmitTime)
+	})
+}
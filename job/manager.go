@@ -0,0 +1,340 @@
+package job
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"filemanager/blob"
+
+	"github.com/rs/zerolog"
+)
+
+// DefaultMaxJobs is the default number of jobs of each type a
+// manager runs at the same time.
+const DefaultMaxJobs = 2
+
+// maxFinished is the number of finished jobs kept in memory.
+const maxFinished = 100
+
+// Manager runs load/store processes as jobs, at most maxJobs
+// of each type at the same time, the rest wait in a queue. Loads
+// and stores have separate slots, as a store consumes what a load
+// produces and would otherwise wait behind the loads it unblocks.
+type Manager struct {
+	sync.Mutex
+	source   string
+	maxJobs  int
+	running  map[string]int
+	jobs     map[string]*Job
+	pending  []*Job
+	finished []*Job
+	history  string
+	lg       *zerolog.Logger
+}
+
+// NewManager creates a job manager for the given source (e.g.
+// a FileSystem root), which is recorded in the job summaries.
+func NewManager(source string, maxJobs int, lg *zerolog.Logger) (*Manager, error) {
+	if maxJobs < 1 || maxJobs > 20 {
+		return nil, fmt.Errorf("maxJobs %d is out of allowed range [1, 20]", maxJobs)
+	}
+	return &Manager{
+		source:  source,
+		maxJobs: maxJobs,
+		running: make(map[string]int),
+		jobs:    make(map[string]*Job),
+		lg:      lg,
+	}, nil
+}
+
+// SetMaxJobs changes the number of jobs of each type that may
+// run at the same time. Running jobs are not affected when it shrinks.
+func (m *Manager) SetMaxJobs(n int) error {
+	if n < 1 || n > 20 {
+		return fmt.Errorf("maxJobs %d is out of allowed range [1, 20]", n)
+	}
+	m.Lock()
+	m.maxJobs = n
+	m.schedule()
+	m.Unlock()
+	return nil
+}
+
+// SetHistoryFile sets the file to which the summary of every
+// finished job is appended, as one json object per line. An
+// empty path disables the history.
+func (m *Manager) SetHistoryFile(path string) {
+	m.Lock()
+	m.history = path
+	m.Unlock()
+}
+
+// Run registers the process with the manager and calls run
+// in its own goroutine once there is a free slot. run MUST
+// block until the process is done and call sts.Finish().
+func (m *Manager) Run(sts *blob.ProcessStatus, run func()) *Job {
+	j := &Job{
+		sts:        sts,
+		run:        run,
+		state:      StatePending,
+		submitTime: time.Now().UTC(),
+	}
+	m.Lock()
+	m.jobs[j.ID()] = j
+	m.pending = append(m.pending, j)
+	m.lg.Debug().
+		Str("job-id", j.ID()).
+		Str("job-type", j.Type()).
+		Msg("job submitted")
+	m.schedule()
+	m.Unlock()
+	return j
+}
+
+// schedule starts the pending jobs whose type has a free slot,
+// in submission order, it must be called with the lock held.
+func (m *Manager) schedule() {
+	pending := m.pending[:0]
+	for _, j := range m.pending {
+		if m.running[j.Type()] >= m.maxJobs {
+			pending = append(pending, j)
+			continue
+		}
+		j.state = StateRunning
+		j.startTime = time.Now().UTC()
+		m.running[j.Type()]++
+		m.lg.Info().
+			Str("job-id", j.ID()).
+			Str("job-type", j.Type()).
+			Msg("job started")
+		go m.exec(j, true)
+	}
+	for i := len(pending); i < len(m.pending); i++ {
+		m.pending[i] = nil
+	}
+	m.pending = pending
+}
+
+// exec runs the job, slot tells if it holds a slot to free
+// once done.
+func (m *Manager) exec(j *Job, slot bool) {
+	j.run()
+	<-j.sts.Done()
+
+	m.Lock()
+	if slot {
+		m.running[j.Type()]--
+	}
+	m.finish(j)
+	m.schedule()
+	m.Unlock()
+}
+
+// finish moves the job to the finished list and records it in
+// the history file, it must be called with the lock held.
+func (m *Manager) finish(j *Job) {
+	j.finishTime = time.Now().UTC()
+	if j.sts.IsCanceled() {
+		j.state = StateCanceled
+	} else {
+		j.state = StateFinished
+	}
+	m.finished = append(m.finished, j)
+	if len(m.finished) > maxFinished {
+		old := m.finished[0]
+		m.finished = m.finished[1:]
+		// a newer job may have been registered under the same id
+		if m.jobs[old.ID()] == old {
+			delete(m.jobs, old.ID())
+		}
+	}
+	s := j.summary(m.source)
+	m.lg.Info().
+		Str("job-id", s.ID).
+		Str("job-type", s.Type).
+		Str("job-state", string(s.State)).
+		Int64("count", s.Count).
+		Int64("size", s.Size).
+		Int64("error-count", s.ErrorCount).
+		Msg("job finished")
+	if m.history != "" {
+		if err := appendHistory(m.history, s); err != nil {
+			m.lg.Error().
+				Err(err).
+				Str("job-id", s.ID).
+				Str("history", m.history).
+				Msg("write job history error")
+		}
+	}
+}
+
+// Get returns the job with the given id.
+func (m *Manager) Get(id string) (*Job, bool) {
+	m.Lock()
+	defer m.Unlock()
+	j, ok := m.jobs[id]
+	return j, ok
+}
+
+// Status returns the json encoded status of the job with
+// the given id.
+func (m *Manager) Status(id string) (string, error) {
+	j, ok := m.Get(id)
+	if !ok {
+		return "", fmt.Errorf("job %s not found", id)
+	}
+	return j.sts.JSONStr(), nil
+}
+
+// Summary returns the summary of the job with the given id.
+func (m *Manager) Summary(id string) (*Summary, error) {
+	m.Lock()
+	defer m.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return nil, fmt.Errorf("job %s not found", id)
+	}
+	return j.summary(m.source), nil
+}
+
+// Active returns the summaries of the pending and running jobs.
+func (m *Manager) Active() []*Summary {
+	m.Lock()
+	defer m.Unlock()
+	ss := make([]*Summary, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		if j.state == StateRunning {
+			ss = append(ss, j.summary(m.source))
+		}
+	}
+	for _, j := range m.pending {
+		ss = append(ss, j.summary(m.source))
+	}
+	sortSummaries(ss)
+	return ss
+}
+
+// Finished returns the summaries of the finished jobs still
+// kept in memory, oldest first.
+func (m *Manager) Finished() []*Summary {
+	m.Lock()
+	defer m.Unlock()
+	ss := make([]*Summary, len(m.finished))
+	for i, j := range m.finished {
+		ss[i] = j.summary(m.source)
+	}
+	return ss
+}
+
+// Cancel asks the job with the given id to stop. A pending job
+// is run right away, out of the slots, so that its process sees
+// the cancel and finishes, e.g. a store drains its input and its
+// sender doesn't block.
+func (m *Manager) Cancel(id string) error {
+	m.Lock()
+	defer m.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return fmt.Errorf("job %s not found", id)
+	}
+	switch j.state {
+	case StateFinished, StateCanceled:
+		return fmt.Errorf("job %s is already %s", id, j.state)
+	case StatePending:
+		for i, p := range m.pending {
+			if p == j {
+				m.pending = append(m.pending[:i], m.pending[i+1:]...)
+				break
+			}
+		}
+		j.state = StateCanceled
+		j.sts.Cancel()
+		go m.exec(j, false)
+	default:
+		j.sts.Cancel()
+	}
+	m.lg.Info().Str("job-id", id).Msg("job canceled")
+	return nil
+}
+
+// Pause asks the running job with the given id to stop picking
+// up new blobs, it keeps its slot and its state.
+func (m *Manager) Pause(id string) error {
+	m.Lock()
+	defer m.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return fmt.Errorf("job %s not found", id)
+	}
+	if j.state != StateRunning {
+		return fmt.Errorf("job %s is %s", id, j.state)
+	}
+	j.sts.Pause()
+	m.lg.Info().Str("job-id", id).Msg("job paused")
+	return nil
+}
+
+// Resume lets the paused job with the given id continue.
+func (m *Manager) Resume(id string) error {
+	m.Lock()
+	defer m.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return fmt.Errorf("job %s not found", id)
+	}
+	if j.currentState() != StatePaused {
+		return fmt.Errorf("job %s is %s", id, j.currentState())
+	}
+	j.sts.Resume()
+	m.lg.Info().Str("job-id", id).Msg("job resumed")
+	return nil
+}
+
+func appendHistory(path string, s *Summary) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// ReadHistory reads the job summaries from the given history
+// file, in the order they were written.
+func ReadHistory(path string) ([]*Summary, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ss := make([]*Summary, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		s := &Summary{}
+		if err := json.Unmarshal(scanner.Bytes(), s); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+		ss = append(ss, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
@@ -1,6 +1,7 @@
 package logging
 
 import (
+	"io"
 	"os"
 
 	"github.com/rs/zerolog"
@@ -25,3 +26,19 @@ func init() {
 func GetLogger() *zerolog.Logger {
 	return &logger
 }
+
+// SetLevel sets the global log level by its name, e.g. "debug",
+// "info", "warn" or "error".
+func SetLevel(level string) error {
+	l, err := zerolog.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	zerolog.SetGlobalLevel(l)
+	return nil
+}
+
+// SetOutput makes the logger write to the given writer.
+func SetOutput(w io.Writer) {
+	logger = logger.Output(w)
+}
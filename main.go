@@ -3,37 +3,80 @@ package main
 import (
 	"fmt"
 	"os"
-	"path/filepath"
+	"sort"
+)
 
-	fs "filemanager/filesystem"
-	"filemanager/logging"
+// exit codes
+const (
+	exitOK      = 0
+	exitErrors  = 1 // the command ran but some blobs failed
+	exitUsage   = 2
+	exitFailure = 3 // the command could not run
 )
 
+type command struct {
+	usage string
+	desc  string
+	run   func(args []string) int
+}
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"import":   {"import [flags] <src> <store>", "load files from src and store them in store", runImport},
+		"export":   {"export [flags] <src> <target>", "load files from src and write them to a tar file, device or - for stdout", runExport},
+		"scan":     {"scan [flags] <src>", "load files from src and print their hashes", runScan},
+		"meta":     {"meta [flags] <src>", "detect and print the metadata of the files of a directory src", runMeta},
+		"dedupe":   {"dedupe [flags] <src>", "find files with identical content in src", runDedupe},
+		"get":      {"get [flags] <hash>", "write the content of a stored blob", runGet},
+		"ls":       {"ls [flags]", "list the blobs in a store", runLs},
+		"verify":   {"verify [flags]", "rehash the blobs in a store and repair it", runVerify},
+		"stat":     {"stat [flags]", "print store statistics", runStat},
+		"migrate":  {"migrate [flags] <layout>", "move the blobs of a store to a new layout, e.g. 2x3 or flat", runMigrate},
+		"repack":   {"repack [flags]", "rewrite the packs of a store, dropping deleted blobs", runRepack},
+		"rm":       {"rm [flags] <hash>...", "delete blobs from a store", runRm},
+		"snapshot": {"snapshot [flags] ls | show <hash> | restore <hash> <dir> | diff <from> <to>", "list, show, restore or diff the snapshots of a store", runSnapshot},
+		"serve":    {"serve [flags]", "serve the blobs of a store over an http api", runServe},
+		"key":      {"key [flags] gen <file> | info | rotate <new-key-file>", "generate a master key, show or rotate the key of an encrypted store", runKey},
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: filemanager <command> [flags] [args]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", name, commands[name].desc)
+	}
+	fmt.Fprintf(os.Stderr, "\nrun 'filemanager <command> -h' for the flags of a command\n")
+}
+
 func main() {
-	lg := logging.GetLogger()
-	lg.Info().Msg("start testing ...")
-
-	inCh := make(chan *fs.FileBlob)
-
-	go func(ch chan *fs.FileBlob) {
-		filepath.Walk(os.Args[1], func(path string, info os.FileInfo, err error) error {
-			//fmt.Printf("file: %s, error: %v\n", path, err)
-			if err != nil {
-				fmt.Printf("prevent panic by handling failure accessing a path %q: %v\n", path, err)
-				return err
-			}
-			if !info.IsDir() {
-				fb := fs.NewFileBlob(path)
-				fb.Load()
-				ch <- fb
-			}
-			return nil
-		})
-		close(ch)
-	}(inCh)
-
-	lg.Info().Msg("reading output ...")
-	for bm := range fs.DetectMimeType("/tmp", 100, inCh, lg) {
-		fmt.Printf("%v\n", bm)
+	os.Exit(run(os.Args[1:]))
+}
+
+// run runs the command named by the first arg and returns its exit
+// code, once the log file it opened is closed.
+func run(args []string) int {
+	if len(args) < 1 {
+		usage()
+		return exitUsage
+	}
+	name := args[0]
+	if name == "help" || name == "-h" || name == "--help" {
+		usage()
+		return exitOK
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage()
+		return exitUsage
 	}
+	defer closeLogging()
+	return cmd.run(args[1:])
 }
@@ -0,0 +1,85 @@
+// Package memory implements a blob store and a blob source held in
+// memory, with the counters and semantics of the file system ones,
+// so that the code built on blob.Storage and blob.BlobSource can be
+// tested without directories. Faults injects failures and slow
+// reads into their processes.
+package memory
+
+import (
+	"crypto/sha1"
+	"io"
+	"net/url"
+	"time"
+
+	"filemanager/blob"
+	"filemanager/util"
+)
+
+// Blob is a content held in memory, which must not be modified
+// once the blob is created.
+type Blob struct {
+	url   *url.URL
+	name  string
+	data  []byte
+	hash  *util.Hash
+	delay time.Duration
+}
+
+// NewBlob creates the blob of the content with the given name, its
+// url is memory:///<name>.
+func NewBlob(name string, data []byte) *Blob {
+	sum := sha1.Sum(data)
+	return &Blob{
+		url:  &url.URL{Scheme: "memory", Path: "/" + name},
+		name: name,
+		data: data,
+		hash: util.NewSha1Hash(sum[:]),
+	}
+}
+
+func (b *Blob) Hash() *util.Hash {
+	return b.hash
+}
+
+func (b *Blob) Type() blob.Type {
+	return blob.TypeMemory
+}
+
+func (b *Blob) Url() *url.URL {
+	return b.url
+}
+
+func (b *Blob) Name() string {
+	return b.name
+}
+
+func (b *Blob) Size() (int64, error) {
+	return int64(len(b.data)), nil
+}
+
+// Bytes returns the content of the blob.
+func (b *Blob) Bytes() []byte {
+	return b.data
+}
+
+func (b *Blob) ReadCloser() (io.ReadCloser, error) {
+	return slow(blob.NewBufferedReadCloser(b.data), b.delay), nil
+}
+
+func (b *Blob) OpenRange(off, n int64) (io.ReadCloser, error) {
+	rc, err := blob.OpenBytesRange(b.data, off, n)
+	if err != nil {
+		return nil, err
+	}
+	return slow(rc, b.delay), nil
+}
+
+// withDelay returns a copy of the blob whose reads are delayed.
+func (b *Blob) withDelay(d time.Duration) *Blob {
+	if d <= 0 {
+		return b
+	}
+	c := *b
+	c.delay = d
+	return &c
+}
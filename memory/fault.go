@@ -0,0 +1,76 @@
+package memory
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// ErrInjected is the error of the blobs failed by Faults, unless
+// they set another one.
+var ErrInjected = errors.New("injected fault")
+
+// Faults describes the failures injected into the loads of a Source
+// or the stores of a Store. The zero value injects none.
+type Faults struct {
+	// FailAt fails the Nth blob (from 1) of every process, in the
+	// order the workers pick them up, 0 fails none. A failed blob
+	// counts as an error and is not sent on.
+	FailAt int
+	// FailEvery fails every Nth blob of every process, 0 fails
+	// none.
+	FailEvery int
+	// Err is the error the failed blobs are logged with,
+	// ErrInjected if nil.
+	Err error
+	// ReadDelay delays every read of the blob contents: the ones
+	// a Source loads, and the ones a Store is sent.
+	ReadDelay time.Duration
+}
+
+// counter numbers the blobs of a process to pick the failed ones.
+type counter struct {
+	n int64
+}
+
+// fail tells if the next blob fails, and with which error.
+func (f *Faults) fail(c *counter) (bool, error) {
+	n := int(atomic.AddInt64(&c.n, 1))
+	if f == nil {
+		return false, nil
+	}
+	if n != f.FailAt && (f.FailEvery <= 0 || n%f.FailEvery != 0) {
+		return false, nil
+	}
+	if f.Err != nil {
+		return true, f.Err
+	}
+	return true, ErrInjected
+}
+
+func (f *Faults) readDelay() time.Duration {
+	if f == nil {
+		return 0
+	}
+	return f.ReadDelay
+}
+
+// slowReadCloser sleeps before every read.
+type slowReadCloser struct {
+	io.ReadCloser
+	delay time.Duration
+}
+
+func (r *slowReadCloser) Read(p []byte) (int, error) {
+	time.Sleep(r.delay)
+	return r.ReadCloser.Read(p)
+}
+
+// slow returns rc with its reads delayed by d, if positive.
+func slow(rc io.ReadCloser, d time.Duration) io.ReadCloser {
+	if d <= 0 {
+		return rc
+	}
+	return &slowReadCloser{rc, d}
+}
@@ -0,0 +1,188 @@
+package memory
+
+import (
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"filemanager/blob"
+	"filemanager/job"
+
+	"github.com/rs/zerolog"
+	"github.com/satori/go.uuid"
+)
+
+// Source is a blob source of contents held in memory, it is safe
+// for concurrent use. A load sends the blobs added before it, in
+// parallel like the files of a file system.
+type Source struct {
+	sync.Mutex
+	blobs            []*Blob
+	maxLoader        int
+	skipDot          bool
+	skipPatterns     []string
+	faults           *Faults
+	progressInterval time.Duration
+	jobs             *job.Manager
+	lg               *zerolog.Logger
+}
+
+// NewSource creates an empty source whose blobs are loaded by
+// maxLoader workers.
+func NewSource(maxLoader int, lg *zerolog.Logger) (*Source, error) {
+	if maxLoader < 1 || maxLoader > 20 {
+		return nil, fmt.Errorf("maxLoader %d is out of allowed range [1, 20]", maxLoader)
+	}
+	l := lg.With().Str("source", "memory").Logger()
+	jobs, err := job.NewManager("memory", job.DefaultMaxJobs, &l)
+	if err != nil {
+		return nil, err
+	}
+	return &Source{
+		maxLoader:        maxLoader,
+		progressInterval: blob.DefaultProgressInterval,
+		jobs:             jobs,
+		lg:               &l,
+	}, nil
+}
+
+// Add adds a content with the given name, a path like the ones of
+// a file system source, and returns its blob.
+func (s *Source) Add(name string, data []byte) *Blob {
+	b := NewBlob(name, data)
+	s.Lock()
+	s.blobs = append(s.blobs, b)
+	s.Unlock()
+	return b
+}
+
+// SetSkip sets the skip rules of the loads, as the ones of a file
+// system: the names whose base starts with a dot are skipped if
+// dotFiles is true, and so are the ones which match any of the
+// given glob patterns, by base or whole name. None are skipped by
+// default.
+func (s *Source) SetSkip(dotFiles bool, patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid skip pattern %q: %v", p, err)
+		}
+	}
+	s.Lock()
+	s.skipDot = dotFiles
+	s.skipPatterns = patterns
+	s.Unlock()
+	return nil
+}
+
+// SetFaults sets the failures injected into the next loads, nil
+// injects none.
+func (s *Source) SetFaults(f *Faults) {
+	s.Lock()
+	s.faults = f
+	s.Unlock()
+}
+
+// SetProgressInterval sets the interval at which Load emits
+// progress snapshots, a non-positive interval disables them.
+func (s *Source) SetProgressInterval(d time.Duration) {
+	s.progressInterval = d
+}
+
+// Jobs returns the job manager the loads of this source run in.
+func (s *Source) Jobs() *job.Manager {
+	return s.jobs
+}
+
+// skip tells if the blob with the given name is skipped, it must
+// be called with the lock held.
+func (s *Source) skip(name string) bool {
+	base := path.Base(name)
+	if s.skipDot && base[0] == '.' {
+		return true
+	}
+	for _, p := range s.skipPatterns {
+		if ok, _ := path.Match(p, base); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Source) Load() blob.LoadStatus {
+	id := uuid.Must(uuid.NewV4()).String()
+	sts := blob.NewLoadStatus(id)
+	l := s.lg.With().Str("load-id", id).Logger()
+	if s.progressInterval > 0 {
+		sts.ReportProgress(s.progressInterval)
+	}
+	s.Lock()
+	blobs := make([]*Blob, 0, len(s.blobs))
+	size := int64(0)
+	for _, b := range s.blobs {
+		if s.skip(b.name) {
+			sts.AddSkipCount(1)
+			sts.AddSkipSize(int64(len(b.data)))
+			l.Info().Str("url", b.url.String()).Int64("size", int64(len(b.data))).Msg("skip file")
+			continue
+		}
+		blobs = append(blobs, b)
+		size += int64(len(b.data))
+	}
+	faults := s.faults
+	s.Unlock()
+	s.jobs.Run(sts, func() {
+		defer sts.Finish()
+		sts.AddEstimate(len(blobs), size)
+		sts.FinishEstimate()
+		ch := make(chan *Blob)
+		c := &counter{}
+		wg := &sync.WaitGroup{}
+		wg.Add(s.maxLoader)
+		for i := 0; i < s.maxLoader; i++ {
+			go load(i, ch, faults, c, wg, sts, &l)
+		}
+		for _, b := range blobs {
+			select {
+			case ch <- b:
+			case <-sts.Canceled():
+			}
+		}
+		close(ch)
+		wg.Wait()
+	})
+	return sts
+}
+
+func load(id int, ch chan *Blob, faults *Faults, c *counter, wg *sync.WaitGroup, sts *blob.ProcessStatus, lg *zerolog.Logger) {
+	defer wg.Done()
+	worker := fmt.Sprintf("loader-%d", id)
+	defer sts.RemoveWorker(worker)
+	for b := range ch {
+		if !sts.WaitIfPaused() {
+			continue
+		}
+		sts.SetWorkerState(worker, b.url.String())
+		bl := lg.With().Str("url", b.url.String()).Logger()
+		if failed, err := faults.fail(c); failed {
+			sts.AddErrorCount(1)
+			bl.Error().Err(err).Msg("load")
+			continue
+		}
+		size := int64(len(b.data))
+		sts.AddCount(1)
+		sts.AddSize(size)
+		bl.Info().
+			Str("content-hash", b.hash.String()).
+			Int64("size", size).
+			Msg("loaded")
+		select {
+		case sts.Blob() <- b.withDelay(faults.readDelay()):
+		case <-sts.Canceled():
+		}
+	}
+	sts.SetWorkerState(worker, "")
+}
@@ -0,0 +1,198 @@
+package memory
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"filemanager/blob"
+	fs "filemanager/filesystem"
+)
+
+func newSource(t *testing.T, maxLoader int) *Source {
+	src, err := NewSource(maxLoader, &discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.SetProgressInterval(0)
+	return src
+}
+
+// loadAll runs a load and returns its status once done, with the
+// loaded blobs.
+func loadAll(src blob.BlobSource) (*blob.ProcessStatus, []blob.Blob) {
+	sts := src.Load()
+	blobs := make([]blob.Blob, 0)
+	for b := range sts.Blob() {
+		blobs = append(blobs, b)
+	}
+	<-sts.Done()
+	return sts.(*blob.ProcessStatus), blobs
+}
+
+func names(blobs []blob.Blob) []string {
+	n := make([]string, 0, len(blobs))
+	for _, b := range blobs {
+		n = append(n, filepath.Base(b.Name()))
+	}
+	sort.Strings(n)
+	return n
+}
+
+func TestSourceCountsLikeFileSystem(t *testing.T) {
+	files := map[string]string{
+		"a.txt":      "aaa",
+		"b.txt":      "aaa",
+		".hidden":    "h",
+		"x.bak":      "backup",
+		"sub/c.txt":  "cc",
+		"sub/.d":     "dd",
+		"sub/e.bak":  "eeee",
+		"sub/empty":  "",
+		"sub/f.data": "ffff",
+	}
+	root := t.TempDir()
+	src := newSource(t, 3)
+	for name, c := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+		src.Add(name, []byte(c))
+	}
+	fsys, err := fs.New(root, 3, 3, &discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys.SetProgressInterval(0)
+
+	for _, skip := range []struct {
+		dotFiles bool
+		patterns []string
+	}{
+		{false, nil},
+		{true, nil},
+		{true, []string{"*.bak"}},
+		{false, []string{"sub/*.bak", "empty"}},
+	} {
+		if err := fsys.SetSkip(skip.dotFiles, skip.patterns); err != nil {
+			t.Fatal(err)
+		}
+		if err := src.SetSkip(skip.dotFiles, skip.patterns); err != nil {
+			t.Fatal(err)
+		}
+		fsts, fblobs := loadAll(fsys)
+		msts, mblobs := loadAll(src)
+		if msts.Count() != fsts.Count() || msts.Size() != fsts.Size() ||
+			msts.SkipCount() != fsts.SkipCount() || msts.SkipSize() != fsts.SkipSize() ||
+			msts.ErrorCount() != fsts.ErrorCount() {
+			t.Fatalf("skip %+v: loaded %d/%d, skipped %d/%d, %d errors; the file system %d/%d, %d/%d, %d",
+				skip, msts.Count(), msts.Size(), msts.SkipCount(), msts.SkipSize(), msts.ErrorCount(),
+				fsts.Count(), fsts.Size(), fsts.SkipCount(), fsts.SkipSize(), fsts.ErrorCount())
+		}
+		if fmt.Sprint(names(mblobs)) != fmt.Sprint(names(fblobs)) {
+			t.Fatalf("skip %+v: loaded %v, the file system %v", skip, names(mblobs), names(fblobs))
+		}
+	}
+	if err := src.SetSkip(false, []string{"["}); err == nil {
+		t.Fatal("invalid pattern accepted")
+	}
+}
+
+func TestSourceFaults(t *testing.T) {
+	src := newSource(t, 2)
+	for i := 0; i < 6; i++ {
+		src.Add(fmt.Sprintf("f%d", i), []byte{byte(i)})
+	}
+	src.SetFaults(&Faults{FailAt: 2, FailEvery: 5})
+	for run := 0; run < 2; run++ {
+		sts, blobs := loadAll(src)
+		if sts.Count() != 4 || sts.ErrorCount() != 2 || len(blobs) != 4 {
+			t.Fatalf("run %d: loaded %d, %d errors, %d sent", run, sts.Count(), sts.ErrorCount(), len(blobs))
+		}
+	}
+
+	// a load keeps the faults it started with
+	src.SetFaults(nil)
+	sts, _ := loadAll(src)
+	if sts.Count() != 6 || sts.ErrorCount() != 0 {
+		t.Fatalf("without faults: loaded %d, %d errors", sts.Count(), sts.ErrorCount())
+	}
+}
+
+func TestSourceReadDelay(t *testing.T) {
+	src := newSource(t, 1)
+	added := src.Add("a", []byte("content"))
+	src.SetFaults(&Faults{ReadDelay: 20 * time.Millisecond})
+	_, blobs := loadAll(src)
+	if len(blobs) != 1 {
+		t.Fatalf("loaded %d", len(blobs))
+	}
+	for _, open := range []func(b blob.Blob) (io.ReadCloser, error){
+		func(b blob.Blob) (io.ReadCloser, error) { return b.ReadCloser() },
+		func(b blob.Blob) (io.ReadCloser, error) { return blob.OpenRange(b, 2, 3) },
+	} {
+		t0 := time.Now()
+		rc, err := open(blobs[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		if d := time.Since(t0); d < 20*time.Millisecond || len(data) == 0 {
+			t.Fatalf("read %q in %v", data, d)
+		}
+	}
+
+	// the added blob itself isn't slowed down
+	t0 := time.Now()
+	rc, _ := added.ReadCloser()
+	ioutil.ReadAll(rc)
+	if d := time.Since(t0); d >= 20*time.Millisecond {
+		t.Fatalf("read in %v", d)
+	}
+}
+
+func TestSourceToStore(t *testing.T) {
+	src := newSource(t, 4)
+	for i := 0; i < 50; i++ {
+		src.Add(fmt.Sprintf("f%d", i), []byte(fmt.Sprintf("content %d", i%20)))
+	}
+	st := newStore(t, 4)
+	st.SetFaults(&Faults{FailEvery: 10})
+	lsts := src.Load()
+	ssts := st.Store(lsts.Blob())
+	for range ssts.Blob() {
+	}
+	<-ssts.Done()
+	<-lsts.Done()
+	if lsts.Count() != 50 || ssts.ErrorCount() != 5 || ssts.Count()+ssts.SkipCount() != 45 || st.Len() != ssts.Count() {
+		t.Fatalf("loaded %d, stored %d, skipped %d, %d errors", lsts.Count(), ssts.Count(), ssts.SkipCount(), ssts.ErrorCount())
+	}
+}
+
+func TestSourceCancel(t *testing.T) {
+	src := newSource(t, 2)
+	for i := 0; i < 100; i++ {
+		src.Add(fmt.Sprintf("f%d", i), []byte{byte(i)})
+	}
+	sts := src.Load()
+	<-sts.Blob()
+	sts.Cancel()
+	select {
+	case <-sts.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("canceled load not done")
+	}
+	if sts.Count() == 100 {
+		t.Fatal("canceled load loaded every blob")
+	}
+}
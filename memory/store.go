@@ -0,0 +1,242 @@
+package memory
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"filemanager/blob"
+	"filemanager/job"
+	"filemanager/util"
+
+	"github.com/rs/zerolog"
+	"github.com/satori/go.uuid"
+)
+
+// Store is a blob store held in memory, it is safe for concurrent
+// use. Like a file system store, a blob which is already stored
+// with the same size is skipped, and the stored blobs are sent on
+// the Blob channel of the status. A blob whose content doesn't
+// match its size and hash is an error.
+type Store struct {
+	sync.RWMutex
+	name             string
+	blobs            map[string]*Blob
+	maxSaver         int
+	faults           *Faults
+	progressInterval time.Duration
+	jobs             *job.Manager
+	lg               *zerolog.Logger
+}
+
+// New creates an empty store whose blobs are saved by maxSaver
+// workers, the name is the host of the urls of its blobs.
+func New(name string, maxSaver int, lg *zerolog.Logger) (*Store, error) {
+	if maxSaver < 1 || maxSaver > 20 {
+		return nil, fmt.Errorf("maxSaver %d is out of allowed range [1, 20]", maxSaver)
+	}
+	l := lg.With().Str("store", "memory://"+name).Logger()
+	jobs, err := job.NewManager("memory://"+name, job.DefaultMaxJobs, &l)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{
+		name:             name,
+		blobs:            make(map[string]*Blob),
+		maxSaver:         maxSaver,
+		progressInterval: blob.DefaultProgressInterval,
+		jobs:             jobs,
+		lg:               &l,
+	}, nil
+}
+
+// SetFaults sets the failures injected into the next stores, nil
+// injects none.
+func (s *Store) SetFaults(f *Faults) {
+	s.Lock()
+	s.faults = f
+	s.Unlock()
+}
+
+// SetProgressInterval sets the interval at which Store emits
+// progress snapshots, a non-positive interval disables them.
+func (s *Store) SetProgressInterval(d time.Duration) {
+	s.progressInterval = d
+}
+
+// Jobs returns the job manager the stores run in.
+func (s *Store) Jobs() *job.Manager {
+	return s.jobs
+}
+
+// Len returns the number of stored blobs.
+func (s *Store) Len() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.blobs)
+}
+
+// Has returns true if the blob with the given hash is stored.
+func (s *Store) Has(h *util.Hash) (bool, error) {
+	s.RLock()
+	defer s.RUnlock()
+	_, ok := s.blobs[h.String()]
+	return ok, nil
+}
+
+// Get returns the stored blob with the given hash.
+func (s *Store) Get(h *util.Hash) (*Blob, error) {
+	s.RLock()
+	defer s.RUnlock()
+	b, ok := s.blobs[h.String()]
+	if !ok {
+		return nil, fmt.Errorf("blob %s not found", h.String())
+	}
+	return b, nil
+}
+
+// List calls fn with the hash and size of every stored blob, in
+// hash order. It stops at the first error returned by fn.
+func (s *Store) List(fn func(h *util.Hash, size int64) error) error {
+	s.RLock()
+	blobs := make([]*Blob, 0, len(s.blobs))
+	for _, b := range s.blobs {
+		blobs = append(blobs, b)
+	}
+	s.RUnlock()
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].hash.String() < blobs[j].hash.String()
+	})
+	for _, b := range blobs {
+		if err := fn(b.hash, int64(len(b.data))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes the blob with the given hash from the store.
+func (s *Store) Delete(h *util.Hash) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.blobs[h.String()]; !ok {
+		return fmt.Errorf("blob %s not found", h.String())
+	}
+	delete(s.blobs, h.String())
+	s.lg.Info().Str("content-hash", h.String()).Msg("blob deleted")
+	return nil
+}
+
+func (s *Store) Store(blobCh chan blob.Blob) blob.StoreStatus {
+	id := uuid.Must(uuid.NewV4()).String()
+	sts := blob.NewStoreStatus(id)
+	l := s.lg.With().Str("process-id", id).Logger()
+	if s.progressInterval > 0 {
+		sts.ReportProgress(s.progressInterval)
+	}
+	s.RLock()
+	faults := s.faults
+	s.RUnlock()
+	s.jobs.Run(sts, func() {
+		defer sts.Finish()
+		c := &counter{}
+		wg := &sync.WaitGroup{}
+		wg.Add(s.maxSaver)
+		for i := 0; i < s.maxSaver; i++ {
+			go s.save(i, blobCh, faults, c, wg, sts, &l)
+		}
+		wg.Wait()
+	})
+	return sts
+}
+
+func (s *Store) save(id int, inCh chan blob.Blob, faults *Faults, c *counter, wg *sync.WaitGroup, sts *blob.ProcessStatus, lg *zerolog.Logger) {
+	defer wg.Done()
+	worker := fmt.Sprintf("memory-%d", id)
+	defer sts.RemoveWorker(worker)
+	for b := range inCh {
+		if !sts.WaitIfPaused() {
+			// keep draining so that the sender doesn't block
+			continue
+		}
+		h := b.Hash()
+		bl := lg.With().Str("source", b.Url().String()).Str("content-hash", h.String()).Logger()
+		sts.SetWorkerState(worker, b.Url().String())
+		if failed, err := faults.fail(c); failed {
+			sts.AddErrorCount(1)
+			bl.Error().Err(err).Msg("save blob error")
+			continue
+		}
+		size, err := b.Size()
+		if err != nil {
+			sts.AddErrorCount(1)
+			bl.Error().Err(err).Msg("get blob size error")
+			continue
+		}
+		s.RLock()
+		existing, ok := s.blobs[h.String()]
+		s.RUnlock()
+		if ok && int64(len(existing.data)) == size {
+			sts.AddSkipCount(1)
+			sts.AddSkipSize(size)
+			bl.Info().Msg("skip existing")
+			continue
+		}
+		t := time.Now()
+		rc, err := b.ReadCloser()
+		if err != nil {
+			sts.AddErrorCount(1)
+			bl.Error().Err(err).Msg("blob reader error")
+			continue
+		}
+		data, err := ioutil.ReadAll(slow(rc, faults.readDelay()))
+		rc.Close()
+		if err == nil {
+			err = checkContent(h, size, data)
+		}
+		if err != nil {
+			sts.AddErrorCount(1)
+			bl.Error().Err(err).Msg("save blob error")
+			continue
+		}
+		stored := &Blob{
+			url:  &url.URL{Scheme: "memory", Host: s.name, Path: "/" + h.Hex()},
+			name: b.Name(),
+			data: data,
+			hash: h,
+		}
+		s.Lock()
+		s.blobs[h.String()] = stored
+		s.Unlock()
+		d := time.Now().Sub(t)
+		sts.AddCount(1)
+		sts.AddSize(size)
+		bl.Info().
+			Int64("size", size).
+			Int64("duration", d.Nanoseconds()).
+			Msg("done saving")
+		select {
+		case sts.Blob() <- stored:
+		case <-sts.Canceled():
+		}
+	}
+	sts.SetWorkerState(worker, "")
+}
+
+// checkContent checks the content read from a blob against its size
+// and hash.
+func checkContent(h *util.Hash, size int64, data []byte) error {
+	if int64(len(data)) != size {
+		return fmt.Errorf("blob has %d bytes, %d expected", len(data), size)
+	}
+	sum := sha1.Sum(data)
+	if !bytes.Equal(sum[:], h.Bytes()) {
+		return fmt.Errorf("content hash mismatch, the blob is corrupt")
+	}
+	return nil
+}
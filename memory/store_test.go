@@ -0,0 +1,255 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filemanager/blob"
+	fs "filemanager/filesystem"
+	"filemanager/util"
+
+	"github.com/rs/zerolog"
+)
+
+var discard = zerolog.New(ioutil.Discard)
+
+func newStore(t *testing.T, maxSaver int) *Store {
+	st, err := New("test", maxSaver, &discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.SetProgressInterval(0)
+	return st
+}
+
+// send stores the blobs and returns the status once done, with the
+// stored blobs sent on its channel.
+func send(st blob.Storage, blobs ...blob.Blob) (blob.StoreStatus, []blob.Blob) {
+	ch := make(chan blob.Blob, len(blobs))
+	for _, b := range blobs {
+		ch <- b
+	}
+	close(ch)
+	sts := st.Store(ch)
+	stored := make([]blob.Blob, 0, len(blobs))
+	for b := range sts.Blob() {
+		stored = append(stored, b)
+	}
+	<-sts.Done()
+	return sts, stored
+}
+
+type counts struct {
+	count, skipCount, errorCount int
+	size, skipSize               int64
+}
+
+func countsOf(sts blob.StoreStatus) counts {
+	return counts{sts.Count(), sts.SkipCount(), sts.ErrorCount(), sts.Size(), sts.SkipSize()}
+}
+
+// fileBlobs writes the contents to files and returns their blobs.
+func fileBlobs(t *testing.T, contents ...string) []blob.Blob {
+	dir := t.TempDir()
+	blobs := make([]blob.Blob, 0, len(contents))
+	for i, c := range contents {
+		path := filepath.Join(dir, fmt.Sprintf("f%d", i))
+		if err := ioutil.WriteFile(path, []byte(c), 0644); err != nil {
+			t.Fatal(err)
+		}
+		b := fs.NewFileBlob(path)
+		if err := b.Load(); err != nil {
+			t.Fatal(err)
+		}
+		blobs = append(blobs, b)
+	}
+	return blobs
+}
+
+func TestStoreCountsLikeFileSystem(t *testing.T) {
+	contents := []string{"a", "bb", "a", "", "ccc", "bb"}
+	fsys, err := fs.New(t.TempDir(), 1, 1, &discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys.SetProgressInterval(0)
+	st := newStore(t, 1)
+
+	// duplicates in a store are skipped, as are all the blobs when
+	// they are stored again
+	for pass := 1; pass <= 2; pass++ {
+		fsts, _ := send(fsys, fileBlobs(t, contents...)...)
+		msts, stored := send(st, fileBlobs(t, contents...)...)
+		if got, want := countsOf(msts), countsOf(fsts); got != want {
+			t.Fatalf("pass %d: counts %+v, the file system counts %+v", pass, got, want)
+		}
+		if len(stored) != msts.Count() {
+			t.Fatalf("pass %d: %d blobs sent, %d stored", pass, len(stored), msts.Count())
+		}
+	}
+	if st.Len() != 4 {
+		t.Fatalf("%d blobs stored, 4 expected", st.Len())
+	}
+}
+
+func TestStoreGetListDelete(t *testing.T) {
+	st := newStore(t, 2)
+	a, b := NewBlob("a.txt", []byte("aaa")), NewBlob("b.txt", []byte("b"))
+	_, stored := send(st, a, b)
+	if len(stored) != 2 || stored[0].Type() != blob.TypeMemory {
+		t.Fatalf("stored %v", stored)
+	}
+
+	if ok, err := st.Has(a.Hash()); !ok || err != nil {
+		t.Fatalf("has: %v, %v", ok, err)
+	}
+	got, err := st.Get(a.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Bytes()) != "aaa" || got.Name() != "a.txt" || got.Url().String() != "memory://test/"+a.Hash().Hex() {
+		t.Fatalf("got %s %q at %s", got.Name(), got.Bytes(), got.Url())
+	}
+
+	sizes := make(map[string]int64)
+	prev := ""
+	err = st.List(func(h *util.Hash, size int64) error {
+		if h.String() < prev {
+			return fmt.Errorf("%s listed after %s", h.String(), prev)
+		}
+		prev = h.String()
+		sizes[h.String()] = size
+		return nil
+	})
+	if err != nil || len(sizes) != 2 || sizes[a.Hash().String()] != 3 || sizes[b.Hash().String()] != 1 {
+		t.Fatalf("listed %v, %v", sizes, err)
+	}
+
+	if err := st.Delete(a.Hash()); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := st.Has(a.Hash()); ok {
+		t.Fatal("deleted blob still stored")
+	}
+	if _, err := st.Get(a.Hash()); err == nil {
+		t.Fatal("get of a deleted blob succeeded")
+	}
+	if err := st.Delete(a.Hash()); err == nil {
+		t.Fatal("delete of a missing blob succeeded")
+	}
+}
+
+// corruptBlob is a blob whose hash or size isn't the one of its
+// content.
+type corruptBlob struct {
+	*Blob
+	hash *util.Hash
+	size int64
+}
+
+func (b *corruptBlob) Hash() *util.Hash {
+	if b.hash != nil {
+		return b.hash
+	}
+	return b.Blob.Hash()
+}
+
+func (b *corruptBlob) Size() (int64, error) {
+	if b.size >= 0 {
+		return b.size, nil
+	}
+	return b.Blob.Size()
+}
+
+func TestStoreRejectsCorruptContent(t *testing.T) {
+	st := newStore(t, 2)
+	badHash := &corruptBlob{NewBlob("a", []byte("content")), NewBlob("", []byte("other")).Hash(), -1}
+	badSize := &corruptBlob{NewBlob("b", []byte("content")), nil, 3}
+	sts, stored := send(st, badHash, badSize)
+	if sts.Count() != 0 || sts.ErrorCount() != 2 || len(stored) != 0 || st.Len() != 0 {
+		t.Fatalf("stored %d, %d errors, %d in the store", sts.Count(), sts.ErrorCount(), st.Len())
+	}
+}
+
+func TestStoreFaults(t *testing.T) {
+	blobs := make([]blob.Blob, 0, 10)
+	for i := 0; i < 10; i++ {
+		blobs = append(blobs, NewBlob(fmt.Sprintf("f%d", i), []byte{byte(i)}))
+	}
+	errDisk := errors.New("disk full")
+	for _, c := range []struct {
+		faults Faults
+		errors int
+	}{
+		{Faults{}, 0},
+		{Faults{FailAt: 3}, 1},
+		{Faults{FailAt: 11}, 0},
+		{Faults{FailEvery: 3}, 3},
+		{Faults{FailAt: 1, FailEvery: 4, Err: errDisk}, 3},
+		{Faults{FailAt: 4, FailEvery: 4}, 2},
+	} {
+		st := newStore(t, 3)
+		f := c.faults
+		st.SetFaults(&f)
+		sts, stored := send(st, blobs...)
+		if sts.ErrorCount() != c.errors || sts.Count() != 10-c.errors || len(stored) != sts.Count() || st.Len() != sts.Count() {
+			t.Fatalf("%+v: %d stored, %d errors, %d expected", c.faults, sts.Count(), sts.ErrorCount(), c.errors)
+		}
+		// every process counts from 1
+		sts, _ = send(st, blobs...)
+		if sts.Count()+sts.SkipCount()+sts.ErrorCount() != 10 || sts.ErrorCount() != c.errors {
+			t.Fatalf("%+v, again: %d stored, %d skipped, %d errors", c.faults, sts.Count(), sts.SkipCount(), sts.ErrorCount())
+		}
+	}
+}
+
+func TestStoreReadDelay(t *testing.T) {
+	st := newStore(t, 1)
+	st.SetFaults(&Faults{ReadDelay: 20 * time.Millisecond})
+	t0 := time.Now()
+	sts, _ := send(st, NewBlob("a", []byte("a")), NewBlob("b", []byte("b")))
+	// at least a read of each blob, by a single saver
+	if d := time.Since(t0); sts.Count() != 2 || d < 40*time.Millisecond {
+		t.Fatalf("stored %d in %v", sts.Count(), d)
+	}
+
+	// the stored blobs are read at full speed
+	b, err := st.Get(NewBlob("", []byte("a")).Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 = time.Now()
+	rc, _ := b.ReadCloser()
+	ioutil.ReadAll(rc)
+	if d := time.Since(t0); d >= 20*time.Millisecond {
+		t.Fatalf("read in %v", d)
+	}
+}
+
+func TestStoreCancel(t *testing.T) {
+	st := newStore(t, 2)
+	st.SetFaults(&Faults{ReadDelay: 10 * time.Millisecond})
+	ch := make(chan blob.Blob)
+	sts := st.Store(ch)
+	go func() {
+		for i := 0; i < 100; i++ {
+			ch <- NewBlob(fmt.Sprintf("f%d", i), []byte{byte(i)})
+		}
+		close(ch)
+	}()
+	<-sts.Blob()
+	sts.Cancel()
+	// the sender is drained, not blocked
+	select {
+	case <-sts.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("canceled store not done")
+	}
+	if sts.Count() == 100 {
+		t.Fatal("canceled store stored every blob")
+	}
+}
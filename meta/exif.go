@@ -0,0 +1,175 @@
+package meta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrNotJPEG is returned by ReadExif for content which isn't a
+// jpeg image.
+var ErrNotJPEG = errors.New("not a jpeg image")
+
+// the jpeg markers
+const (
+	markerSOI  = 0xd8
+	markerEOI  = 0xd9
+	markerSOS  = 0xda
+	markerAPP1 = 0xe1
+)
+
+// the tiff tags read, and the metadata keys they are recorded as
+const (
+	tagMake             = 0x010f
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagDateTimeOriginal = 0x9003
+	tagPixelXDimension  = 0xa002
+	tagPixelYDimension  = 0xa003
+)
+
+var exifKeys = map[uint16]string{
+	tagMake:             "exif-make",
+	tagModel:            "exif-model",
+	tagOrientation:      "exif-orientation",
+	tagDateTime:         "exif-datetime",
+	tagDateTimeOriginal: "exif-datetime-original",
+	tagPixelXDimension:  "exif-width",
+	tagPixelYDimension:  "exif-height",
+}
+
+// the tiff field types read
+const (
+	typeASCII = 2
+	typeShort = 3
+	typeLong  = 4
+)
+
+// ReadExif reads the camera make and model, orientation, dates and
+// pixel dimensions of the Exif segment of a jpeg image of the given
+// size. Only the segment headers before it and the segment itself
+// are read, so r is typically a blob.NewReaderAt. An image without
+// Exif has no metadata.
+func ReadExif(r io.ReaderAt, size int64) (Metadata, error) {
+	var soi [2]byte
+	if _, err := r.ReadAt(soi[:], 0); err != nil || soi[0] != 0xff || soi[1] != markerSOI {
+		return nil, ErrNotJPEG
+	}
+	m := make(Metadata)
+	pos := int64(2)
+	for pos+4 <= size {
+		var hdr [4]byte
+		if _, err := r.ReadAt(hdr[:], pos); err != nil {
+			return nil, err
+		}
+		if hdr[0] != 0xff {
+			return nil, fmt.Errorf("invalid jpeg marker at %d", pos)
+		}
+		marker := hdr[1]
+		if marker == 0xff {
+			// fill byte
+			pos++
+			continue
+		}
+		if marker == markerSOS || marker == markerEOI {
+			break
+		}
+		n := int64(binary.BigEndian.Uint16(hdr[2:]))
+		if n < 2 || pos+2+n > size {
+			return nil, fmt.Errorf("invalid jpeg segment length at %d", pos)
+		}
+		if marker == markerAPP1 {
+			seg := make([]byte, n-2)
+			if _, err := r.ReadAt(seg, pos+4); err != nil {
+				return nil, err
+			}
+			if bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+				if err := readTIFF(seg[6:], m); err != nil {
+					return nil, fmt.Errorf("exif: %v", err)
+				}
+				break
+			}
+		}
+		pos += 2 + n
+	}
+	return m, nil
+}
+
+// readTIFF reads the tags of IFD0 and of the Exif IFD of the tiff
+// structure of the Exif segment.
+func readTIFF(data []byte, m Metadata) error {
+	if len(data) < 8 {
+		return errors.New("truncated tiff header")
+	}
+	var bo binary.ByteOrder
+	switch string(data[0:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return errors.New("invalid tiff byte order")
+	}
+	if bo.Uint16(data[2:]) != 42 {
+		return errors.New("invalid tiff magic")
+	}
+	exifIFD, err := readIFD(data, bo, bo.Uint32(data[4:]), m)
+	if err != nil || exifIFD == 0 {
+		return err
+	}
+	_, err = readIFD(data, bo, exifIFD, m)
+	return err
+}
+
+// readIFD records the known tags of the IFD at off, it returns the
+// offset of the Exif IFD if the IFD points to it.
+func readIFD(data []byte, bo binary.ByteOrder, off uint32, m Metadata) (uint32, error) {
+	if int64(off)+2 > int64(len(data)) {
+		return 0, fmt.Errorf("ifd offset %d out of range", off)
+	}
+	cnt := int(bo.Uint16(data[off:]))
+	entries := data[off+2:]
+	if len(entries) < cnt*12 {
+		return 0, fmt.Errorf("truncated ifd at %d", off)
+	}
+	exifIFD := uint32(0)
+	for i := 0; i < cnt; i++ {
+		e := entries[i*12 : i*12+12]
+		tag, typ, count := bo.Uint16(e), bo.Uint16(e[2:]), bo.Uint32(e[4:])
+		if tag == tagExifIFD && typ == typeLong {
+			exifIFD = bo.Uint32(e[8:])
+			continue
+		}
+		key, ok := exifKeys[tag]
+		if !ok || count == 0 {
+			continue
+		}
+		switch typ {
+		case typeShort:
+			m[key] = IntValue(bo.Uint16(e[8:]))
+		case typeLong:
+			m[key] = IntValue(bo.Uint32(e[8:]))
+		case typeASCII:
+			// up to 4 chars are inline, longer values at an offset
+			var v []byte
+			if count <= 4 {
+				v = e[8 : 8+count]
+			} else {
+				o := bo.Uint32(e[8:])
+				if int64(o)+int64(count) > int64(len(data)) {
+					return 0, fmt.Errorf("tag %#04x value out of range", tag)
+				}
+				v = data[o : o+count]
+			}
+			if s := strings.TrimSpace(strings.TrimRight(string(v), "\x00")); s != "" {
+				m[key] = StringValue(s)
+			}
+		}
+	}
+	return exifIFD, nil
+}
@@ -0,0 +1,174 @@
+package meta
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+)
+
+// jsonBlobMeta is the json form of a BlobMeta, as printed by the
+// meta command.
+type jsonBlobMeta struct {
+	ID   string                     `json:"id"`
+	Meta map[string]json.RawMessage `json:"meta"`
+}
+
+func (m *BlobMeta) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ID   string   `json:"id"`
+		Meta Metadata `json:"meta"`
+	}{m.id, m.meta})
+}
+
+// UnmarshalJSON decodes the metadata values as StringValue or
+// IntValue, other json types are errors.
+func (m *BlobMeta) UnmarshalJSON(data []byte) error {
+	var jm jsonBlobMeta
+	if err := json.Unmarshal(data, &jm); err != nil {
+		return err
+	}
+	meta := make(Metadata, len(jm.Meta))
+	for k, raw := range jm.Meta {
+		var v interface{}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return err
+		}
+		switch v := v.(type) {
+		case string:
+			meta[k] = StringValue(v)
+		case float64:
+			if v != math.Trunc(v) {
+				return fmt.Errorf("meta %q: %v is not an integer", k, v)
+			}
+			meta[k] = IntValue(v)
+		default:
+			return fmt.Errorf("meta %q: unsupported value %s", k, raw)
+		}
+	}
+	m.id = jm.ID
+	m.meta = meta
+	return nil
+}
+
+// Index maps blob ids (content hashes) to their metadata. It is
+// kept in memory, and appended to a json lines file if opened
+// from one, so that it is read back on the next runs.
+type Index struct {
+	sync.Mutex
+	path  string
+	metas map[string]*BlobMeta
+}
+
+// NewIndex creates an empty index kept in memory only.
+func NewIndex() *Index {
+	return &Index{metas: make(map[string]*BlobMeta)}
+}
+
+// OpenIndex reads the index from the json lines file at the given
+// path, which is created by the first Put if it doesn't exist. A
+// later line of a blob adds to, and overrides, the earlier ones.
+func OpenIndex(path string) (*Index, error) {
+	x := NewIndex()
+	x.path = path
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return x, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		m := &BlobMeta{}
+		if err := json.Unmarshal(scanner.Bytes(), m); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, line, err)
+		}
+		x.merge(m)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// Path returns the file of the index, or "" for an index kept in
+// memory only.
+func (x *Index) Path() string {
+	return x.path
+}
+
+// Len returns the number of blobs in the index.
+func (x *Index) Len() int {
+	x.Lock()
+	defer x.Unlock()
+	return len(x.metas)
+}
+
+// Get returns a copy of the metadata of the blob with the given
+// id.
+func (x *Index) Get(id string) (*BlobMeta, bool) {
+	x.Lock()
+	defer x.Unlock()
+	m, ok := x.metas[id]
+	if !ok {
+		return nil, false
+	}
+	return m.copy(), true
+}
+
+// Put adds the metadata to the one already indexed for the blob,
+// the values of m override the existing ones, and appends the
+// result to the index file.
+func (x *Index) Put(m *BlobMeta) error {
+	x.Lock()
+	defer x.Unlock()
+	merged := x.merge(m)
+	if x.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(x.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// merge adds m to the index and returns the merged metadata, it
+// must be called with the lock held.
+func (x *Index) merge(m *BlobMeta) *BlobMeta {
+	cur, ok := x.metas[m.id]
+	if !ok {
+		cur = NewBlobMeta(m.id)
+		x.metas[m.id] = cur
+	}
+	for k, v := range m.meta {
+		cur.meta[k] = v
+	}
+	return cur
+}
+
+func (m *BlobMeta) copy() *BlobMeta {
+	c := NewBlobMeta(m.id)
+	for k, v := range m.meta {
+		c.meta[k] = v
+	}
+	return c
+}
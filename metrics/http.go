@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/rs/zerolog"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Handler returns an http.Handler serving the metrics of the
+// given registry in the prometheus text format.
+func Handler(r *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		if req.Method == http.MethodHead {
+			return
+		}
+		r.WriteText(w)
+	})
+}
+
+// Serve starts an http server listening on the given address
+// (e.g. "127.0.0.1:9100") which serves the default registry
+// at /metrics. The returned server can be shut down with its
+// Close or Shutdown method.
+func Serve(addr string, lg *zerolog.Logger) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler(Default))
+	srv := &http.Server{Handler: mux}
+	l := lg.With().Str("metrics-addr", ln.Addr().String()).Logger()
+	go func() {
+		l.Info().Msg("serving metrics")
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			l.Error().Err(err).Msg("metrics server error")
+		}
+	}()
+	return srv, nil
+}
@@ -0,0 +1,221 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricType is the prometheus type of a metric family
+type metricType string
+
+const (
+	typeCounter   metricType = "counter"
+	typeGauge     metricType = "gauge"
+	typeHistogram metricType = "histogram"
+)
+
+// DefBuckets are the default histogram buckets for latencies,
+// in seconds.
+var DefBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// SizeBuckets are the default histogram buckets for blob sizes,
+// in bytes.
+var SizeBuckets = []float64{
+	1 << 10, 16 << 10, 64 << 10, 256 << 10,
+	1 << 20, 4 << 20, 16 << 20, 64 << 20, 256 << 20, 1 << 30,
+}
+
+// family is a named metric with a fixed set of label names and
+// one series per distinct set of label values.
+type family struct {
+	sync.Mutex
+	name    string
+	help    string
+	typ     metricType
+	labels  []string
+	buckets []float64
+	series  map[string]*series
+}
+
+// series holds the value(s) of one metric series.
+type series struct {
+	sync.Mutex
+	labelValues []string
+	value       float64
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+func newFamily(name, help string, typ metricType, buckets []float64, labels []string) *family {
+	return &family{
+		name:    name,
+		help:    help,
+		typ:     typ,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+}
+
+func (f *family) with(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	f.Lock()
+	defer f.Unlock()
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), values...)}
+		if f.typ == typeHistogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (f *family) sortedSeries() []*series {
+	f.Lock()
+	defer f.Unlock()
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ss := make([]*series, len(keys))
+	for i, k := range keys {
+		ss[i] = f.series[k]
+	}
+	return ss
+}
+
+func (s *series) add(v float64) {
+	s.Lock()
+	s.value += v
+	s.Unlock()
+}
+
+func (s *series) set(v float64) {
+	s.Lock()
+	s.value = v
+	s.Unlock()
+}
+
+func (s *series) observe(buckets []float64, v float64) {
+	s.Lock()
+	for i, b := range buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+	s.Unlock()
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	s *series
+}
+
+// Inc increases the counter by 1.
+func (c Counter) Inc() {
+	c.s.add(1)
+}
+
+// Add increases the counter by the given non-negative value.
+func (c Counter) Add(v float64) {
+	if v < 0 {
+		panic("counter cannot decrease")
+	}
+	c.s.add(v)
+}
+
+// CounterVec is a counter partitioned by label values.
+type CounterVec struct {
+	f *family
+}
+
+// With returns the counter for the given label values.
+func (v *CounterVec) With(values ...string) Counter {
+	return Counter{v.f.with(values)}
+}
+
+// Gauge is a value which can go up and down.
+type Gauge struct {
+	s *series
+}
+
+// Inc increases the gauge by 1.
+func (g Gauge) Inc() {
+	g.s.add(1)
+}
+
+// Dec decreases the gauge by 1.
+func (g Gauge) Dec() {
+	g.s.add(-1)
+}
+
+// Add adds the given value to the gauge.
+func (g Gauge) Add(v float64) {
+	g.s.add(v)
+}
+
+// Set sets the gauge to the given value.
+func (g Gauge) Set(v float64) {
+	g.s.set(v)
+}
+
+// GaugeVec is a gauge partitioned by label values.
+type GaugeVec struct {
+	f *family
+}
+
+// With returns the gauge for the given label values.
+func (v *GaugeVec) With(values ...string) Gauge {
+	return Gauge{v.f.with(values)}
+}
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct {
+	s       *series
+	buckets []float64
+}
+
+// Observe adds a single observation to the histogram.
+func (h Histogram) Observe(v float64) {
+	h.s.observe(h.buckets, v)
+}
+
+// ObserveDuration adds the given duration, in seconds.
+func (h Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+// HistogramVec is a histogram partitioned by label values.
+type HistogramVec struct {
+	f *family
+}
+
+// With returns the histogram for the given label values.
+func (v *HistogramVec) With(values ...string) Histogram {
+	return Histogram{v.f.with(values), v.f.buckets}
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return fmt.Sprintf("%g", v)
+}
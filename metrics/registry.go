@@ -0,0 +1,134 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Registry keeps metric families and writes them in the
+// prometheus text exposition format.
+type Registry struct {
+	sync.Mutex
+	families map[string]*family
+}
+
+// Default is the registry the metrics of this module
+// are registered to.
+var Default = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{
+		families: make(map[string]*family),
+	}
+}
+
+// register adds the family to the registry, or returns the
+// existing one if a family with the same name and type has
+// already been registered.
+func (r *Registry) register(f *family) *family {
+	r.Lock()
+	defer r.Unlock()
+	if old, ok := r.families[f.name]; ok {
+		if old.typ != f.typ || len(old.labels) != len(f.labels) {
+			panic(fmt.Sprintf("metric %s registered twice with different types or labels", f.name))
+		}
+		return old
+	}
+	r.families[f.name] = f
+	return f
+}
+
+// NewCounterVec registers a counter with the given label names.
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{r.register(newFamily(name, help, typeCounter, nil, labels))}
+}
+
+// NewGaugeVec registers a gauge with the given label names.
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{r.register(newFamily(name, help, typeGauge, nil, labels))}
+}
+
+// NewHistogramVec registers a histogram with the given upper
+// bucket bounds and label names.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return &HistogramVec{r.register(newFamily(name, help, typeHistogram, b, labels))}
+}
+
+// WriteText writes all metrics in the prometheus text format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	r.Unlock()
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		r.Lock()
+		f := r.families[name]
+		r.Unlock()
+		writeFamily(bw, f)
+	}
+	return bw.Flush()
+}
+
+func writeFamily(w *bufio.Writer, f *family) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+	for _, s := range f.sortedSeries() {
+		s.Lock()
+		switch f.typ {
+		case typeHistogram:
+			for i, b := range f.buckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n",
+					f.name, labelStr(f.labels, s.labelValues, "le", formatFloat(b)), s.counts[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n",
+				f.name, labelStr(f.labels, s.labelValues, "le", "+Inf"), s.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n",
+				f.name, labelStr(f.labels, s.labelValues, "", ""), formatFloat(s.sum))
+			fmt.Fprintf(w, "%s_count%s %d\n",
+				f.name, labelStr(f.labels, s.labelValues, "", ""), s.count)
+		default:
+			fmt.Fprintf(w, "%s%s %s\n",
+				f.name, labelStr(f.labels, s.labelValues, "", ""), formatFloat(s.value))
+		}
+		s.Unlock()
+	}
+}
+
+// labelStr formats the label pairs, with an optional extra
+// pair appended, as {k1="v1",k2="v2"}.
+func labelStr(names, values []string, extraName, extraValue string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, n := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", n, escapeLabel(values[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extraName, escapeLabel(extraValue)))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,111 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// client sends signed requests for the objects of a bucket.
+type client struct {
+	endpoint  *url.URL
+	bucket    string
+	pathStyle bool
+	signer    *signer
+	http      *http.Client
+}
+
+// apiError is the error document of a failed request.
+type apiError struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *apiError) Error() string {
+	if e.Code == "" {
+		return http.StatusText(e.Status)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// isNotFound tells if the error is a 404 response.
+func isNotFound(err error) bool {
+	e, ok := err.(*apiError)
+	return ok && e.Status == http.StatusNotFound
+}
+
+// objectURL returns the url of the object with the given key, or
+// of the bucket for an empty key.
+func (c *client) objectURL(key string, query url.Values) *url.URL {
+	u := *c.endpoint
+	p := "/" + key
+	if c.pathStyle {
+		p = "/" + c.bucket + p
+	} else {
+		u.Host = c.bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + p
+	u.RawPath = ""
+	u.RawQuery = strings.Replace(query.Encode(), "+", "%20", -1)
+	return &u
+}
+
+// do sends the request and returns the response if its status is
+// a 2xx, its body is to be closed. Other responses are returned as
+// an *apiError.
+func (c *client) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.objectURL(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, vs := range header {
+		req.Header[name] = vs
+	}
+	req.ContentLength = int64(len(body))
+	if len(body) == 0 {
+		req.Body = nil
+	}
+	c.signer.sign(req, payloadHash(body), time.Now())
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	e := &apiError{Status: resp.StatusCode}
+	if data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024)); err == nil && len(data) > 0 {
+		xml.Unmarshal(data, e)
+	}
+	return nil, e
+}
+
+// call sends the request and decodes the xml response into v, if
+// not nil.
+func (c *client) call(method, key string, query url.Values, body []byte, v interface{}) (http.Header, error) {
+	name := key
+	if name == "" {
+		name = c.bucket
+	}
+	resp, err := c.do(method, key, query, nil, body)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %v", method, name, err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := xml.NewDecoder(resp.Body).Decode(v); err != nil {
+			return nil, fmt.Errorf("%s %s: %v", method, name, err)
+		}
+	} else {
+		io.Copy(ioutil.Discard, resp.Body)
+	}
+	return resp.Header, nil
+}
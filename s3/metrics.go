@@ -0,0 +1,18 @@
+package s3
+
+import (
+	"filemanager/metrics"
+)
+
+var (
+	uploadCount = metrics.Default.NewCounterVec(
+		"filemanager_s3_uploads_total",
+		"Number of blobs uploaded to S3 or failed.", "state")
+	uploadBytes = metrics.Default.NewCounterVec(
+		"filemanager_s3_upload_bytes_total",
+		"Total size of uploaded blobs, in bytes.").With()
+	uploadLatency = metrics.Default.NewHistogramVec(
+		"filemanager_s3_upload_seconds",
+		"Time spent uploading a single blob.",
+		metrics.DefBuckets).With()
+)
@@ -0,0 +1,325 @@
+// Package s3test implements an in-process fake of the S3 api, the
+// subset the s3 store uses, for tests which must not reach a real
+// service.
+package s3test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"filemanager/s3"
+)
+
+// the credentials the fake server accepts
+const (
+	AccessKey = "AKIAFAKEACCESSKEY"
+	SecretKey = "fake/secret/key"
+	Region    = "us-east-1"
+)
+
+// Server is a fake S3 service with path-style buckets, which checks
+// the SigV4 signature of every request. Objects and the parts of
+// multipart uploads are kept in memory.
+type Server struct {
+	*httptest.Server
+	// PageSize is the max number of keys of a list page.
+	PageSize int
+
+	mu      sync.Mutex
+	buckets map[string]map[string][]byte
+	uploads map[string]map[int][]byte
+	parts   map[string]int
+	nextID  int
+}
+
+// NewServer starts a fake server with the given empty buckets,
+// Close stops it.
+func NewServer(buckets ...string) *Server {
+	s := &Server{
+		PageSize: 1000,
+		buckets:  make(map[string]map[string][]byte),
+		uploads:  make(map[string]map[int][]byte),
+		parts:    make(map[string]int),
+	}
+	for _, b := range buckets {
+		s.buckets[b] = make(map[string][]byte)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Options returns the store options for a bucket of the server.
+func (s *Server) Options(bucket string) *s3.Options {
+	o := s3.NewOptions(s.URL, bucket)
+	o.Region = Region
+	o.AccessKey = AccessKey
+	o.SecretKey = SecretKey
+	o.PathStyle = true
+	return o
+}
+
+// Object returns the content of the object with the given key.
+func (s *Server) Object(bucket, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.buckets[bucket][key]
+	return data, ok
+}
+
+// PutObject stores an object as a client would.
+func (s *Server) PutObject(bucket, key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[bucket][key] = data
+}
+
+// Keys returns the sorted keys of the bucket.
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sortedKeys(s.buckets[bucket], "")
+}
+
+// Parts returns the number of parts the object with the given key
+// was completed from, 0 if it was put in a single request.
+func (s *Server) Parts(bucket, key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.parts[bucket+"/"+key]
+}
+
+// Uploads returns the number of multipart uploads neither completed
+// nor aborted.
+func (s *Server) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+type apiError struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+	status  int
+}
+
+func fail(status int, code, format string, args ...interface{}) *apiError {
+	return &apiError{Code: code, Message: fmt.Sprintf(format, args...), status: status}
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	var e *apiError
+	if err := s3.Verify(r, body, AccessKey, SecretKey); err != nil {
+		e = fail(http.StatusForbidden, "SignatureDoesNotMatch", "%v", err)
+	} else {
+		e = s.handle(w, r, body)
+	}
+	if e != nil {
+		w.Header().Set("Content-Type", "application/xml")
+		w.WriteHeader(e.status)
+		if r.Method != http.MethodHead {
+			data, _ := xml.Marshal(e)
+			w.Write(data)
+		}
+	}
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request, body []byte) *apiError {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	objects, ok := s.buckets[parts[0]]
+	if !ok {
+		return fail(http.StatusNotFound, "NoSuchBucket", "bucket %q not found", parts[0])
+	}
+	q := r.URL.Query()
+	if len(parts) == 1 || parts[1] == "" {
+		if r.Method != http.MethodGet || q.Get("list-type") != "2" {
+			return fail(http.StatusNotImplemented, "NotImplemented", "%s of a bucket", r.Method)
+		}
+		return s.list(w, objects, q.Get("prefix"), q.Get("continuation-token"))
+	}
+	key := parts[1]
+	switch {
+	case r.Method == http.MethodPost && q["uploads"] != nil:
+		s.nextID++
+		id := strconv.Itoa(s.nextID)
+		s.uploads[id] = make(map[int][]byte)
+		return writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Key      string   `xml:"Key"`
+			UploadID string   `xml:"UploadId"`
+		}{Key: key, UploadID: id})
+	case q.Get("uploadId") != "":
+		return s.multipart(w, r, objects, parts[0], key, q.Get("uploadId"), body)
+	case r.Method == http.MethodPut:
+		objects[key] = body
+		delete(s.parts, parts[0]+"/"+key)
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := objects[key]
+		if !ok {
+			return fail(http.StatusNotFound, "NoSuchKey", "key %q not found", key)
+		}
+		w.Header().Set("ETag", etag(data))
+		status := http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" && r.Method == http.MethodGet {
+			first, last, ok := parseRange(rng, len(data))
+			if !ok {
+				return fail(http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "range %q of %d bytes", rng, len(data))
+			}
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, len(data)))
+			data = data[first : last+1]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(objects, key)
+		delete(s.parts, parts[0]+"/"+key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		return fail(http.StatusNotImplemented, "NotImplemented", "%s of an object", r.Method)
+	}
+	return nil
+}
+
+func (s *Server) multipart(w http.ResponseWriter, r *http.Request, objects map[string][]byte, bucket, key, id string, body []byte) *apiError {
+	parts, ok := s.uploads[id]
+	if !ok {
+		return fail(http.StatusNotFound, "NoSuchUpload", "upload %q not found", id)
+	}
+	switch r.Method {
+	case http.MethodPut:
+		n, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+		if err != nil || n < 1 || n > 10000 {
+			return fail(http.StatusBadRequest, "InvalidArgument", "invalid part number")
+		}
+		parts[n] = body
+		w.Header().Set("ETag", etag(body))
+	case http.MethodDelete:
+		delete(s.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPost:
+		var complete struct {
+			Parts []struct {
+				PartNumber int    `xml:"PartNumber"`
+				ETag       string `xml:"ETag"`
+			} `xml:"Part"`
+		}
+		if err := xml.Unmarshal(body, &complete); err != nil || len(complete.Parts) == 0 {
+			return fail(http.StatusBadRequest, "MalformedXML", "invalid part list")
+		}
+		var buf bytes.Buffer
+		for i, p := range complete.Parts {
+			data, ok := parts[p.PartNumber]
+			if !ok || etag(data) != p.ETag || (i > 0 && p.PartNumber <= complete.Parts[i-1].PartNumber) {
+				return fail(http.StatusBadRequest, "InvalidPart", "part %d", p.PartNumber)
+			}
+			if i < len(complete.Parts)-1 && len(data) < s3.MinPartSize {
+				return fail(http.StatusBadRequest, "EntityTooSmall", "part %d has %d bytes", p.PartNumber, len(data))
+			}
+			buf.Write(data)
+		}
+		objects[key] = buf.Bytes()
+		s.parts[bucket+"/"+key] = len(complete.Parts)
+		delete(s.uploads, id)
+		return writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Key     string   `xml:"Key"`
+			ETag    string   `xml:"ETag"`
+		}{Key: key, ETag: etag(buf.Bytes())})
+	default:
+		return fail(http.StatusNotImplemented, "NotImplemented", "%s of an upload", r.Method)
+	}
+	return nil
+}
+
+// list writes a ListObjectsV2 page, the continuation token is the
+// last key of the previous page.
+func (s *Server) list(w http.ResponseWriter, objects map[string][]byte, prefix, token string) *apiError {
+	type content struct {
+		Key  string `xml:"Key"`
+		Size int    `xml:"Size"`
+	}
+	res := struct {
+		XMLName               xml.Name  `xml:"ListBucketResult"`
+		Prefix                string    `xml:"Prefix"`
+		KeyCount              int       `xml:"KeyCount"`
+		IsTruncated           bool      `xml:"IsTruncated"`
+		NextContinuationToken string    `xml:"NextContinuationToken,omitempty"`
+		Contents              []content `xml:"Contents"`
+	}{Prefix: prefix}
+	for _, k := range sortedKeys(objects, prefix) {
+		if k <= token {
+			continue
+		}
+		if len(res.Contents) == s.PageSize {
+			res.IsTruncated = true
+			res.NextContinuationToken = res.Contents[len(res.Contents)-1].Key
+			break
+		}
+		res.Contents = append(res.Contents, content{Key: k, Size: len(objects[k])})
+	}
+	res.KeyCount = len(res.Contents)
+	return writeXML(w, res)
+}
+
+// parseRange parses a "bytes=<first>-<last>" range, the only form
+// the store sends.
+func parseRange(s string, size int) (int, int, bool) {
+	var first, last int
+	if _, err := fmt.Sscanf(s, "bytes=%d-%d", &first, &last); err != nil {
+		return 0, 0, false
+	}
+	if first < 0 || first > last || first >= size {
+		return 0, 0, false
+	}
+	if last >= size {
+		last = size - 1
+	}
+	return first, last, true
+}
+
+func sortedKeys(objects map[string][]byte, prefix string) []string {
+	keys := make([]string, 0, len(objects))
+	for k := range objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) *apiError {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		return fail(http.StatusInternalServerError, "InternalError", "%v", err)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write(append([]byte(xml.Header), data...))
+	return nil
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
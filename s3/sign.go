@@ -0,0 +1,185 @@
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+const (
+	signAlgorithm = "AWS4-HMAC-SHA256"
+	amzDateFormat = "20060102T150405Z"
+	service       = "s3"
+	// emptyHash is the sha256 of an empty payload
+	emptyHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// signer signs the requests with the credentials of an access key.
+type signer struct {
+	accessKey string
+	secretKey string
+	region    string
+}
+
+// payloadHash returns the hex sha256 of the payload, sent in the
+// x-amz-content-sha256 header.
+func payloadHash(data []byte) string {
+	if len(data) == 0 {
+		return emptyHash
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// sign adds the date, payload hash and authorization headers to
+// the request, whose payload has the given hash.
+func (s *signer) sign(req *http.Request, payload string, t time.Time) {
+	t = t.UTC()
+	req.Header.Set("X-Amz-Date", t.Format(amzDateFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	headers := signedHeaders(req)
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", t.Format("20060102"), s.region, service)
+	sig := signature(s.secretKey, s.region, t, scope, canonicalRequest(req, headers, payload))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		signAlgorithm, s.accessKey, scope, strings.Join(headers, ";"), sig))
+}
+
+// Verify checks the signature of a request received by a server
+// knowing the secret key of the access key it was signed with, and
+// that its payload hash matches the body, e.g. for a fake server.
+func Verify(req *http.Request, body []byte, accessKey, secretKey string) error {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, signAlgorithm+" ") {
+		return fmt.Errorf("missing %s authorization", signAlgorithm)
+	}
+	fields := make(map[string]string)
+	for _, f := range strings.Split(strings.TrimPrefix(auth, signAlgorithm+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(f), "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	cred := strings.SplitN(fields["Credential"], "/", 2)
+	if len(cred) != 2 || cred[0] != accessKey {
+		return fmt.Errorf("unknown access key")
+	}
+	scope := cred[1]
+	parts := strings.Split(scope, "/")
+	if len(parts) != 4 || parts[2] != service || parts[3] != "aws4_request" {
+		return fmt.Errorf("invalid credential scope %q", scope)
+	}
+	t, err := time.Parse(amzDateFormat, req.Header.Get("X-Amz-Date"))
+	if err != nil || t.Format("20060102") != parts[0] {
+		return fmt.Errorf("invalid request date")
+	}
+	payload := req.Header.Get("X-Amz-Content-Sha256")
+	if payload != payloadHash(body) {
+		return fmt.Errorf("payload hash mismatch")
+	}
+	headers := strings.Split(fields["SignedHeaders"], ";")
+	sig := signature(secretKey, parts[1], t, scope, canonicalRequest(req, headers, payload))
+	if !hmac.Equal([]byte(sig), []byte(fields["Signature"])) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+// signedHeaders returns the sorted lower-cased names of the signed
+// headers: host and the x-amz-* ones.
+func signedHeaders(req *http.Request) []string {
+	headers := []string{"host"}
+	for name := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "content-md5" || name == "content-type" {
+			headers = append(headers, name)
+		}
+	}
+	sort.Strings(headers)
+	return headers
+}
+
+func canonicalRequest(req *http.Request, headers []string, payload string) string {
+	var b strings.Builder
+	b.WriteString(req.Method + "\n")
+	b.WriteString(uriEncode(req.URL.EscapedPath(), false) + "\n")
+	b.WriteString(canonicalQuery(req.URL.Query()) + "\n")
+	for _, name := range headers {
+		v := req.Header.Get(name)
+		if name == "host" {
+			v = req.Host
+			if v == "" {
+				v = req.URL.Host
+			}
+		}
+		b.WriteString(name + ":" + strings.TrimSpace(v) + "\n")
+	}
+	b.WriteString("\n" + strings.Join(headers, ";") + "\n")
+	b.WriteString(payload)
+	return b.String()
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode encodes s as SigV4 expects: the unreserved chars are
+// kept, and the slashes of a path. An escaped path is decoded
+// first so that it is encoded the same on both sides.
+func uriEncode(s string, query bool) string {
+	if !query {
+		if u, err := url.PathUnescape(s); err == nil {
+			s = u
+		}
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !query:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func signature(secretKey, region string, t time.Time, scope, canonical string) string {
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{signAlgorithm, t.Format(amzDateFormat), scope, hex.EncodeToString(sum[:])}, "\n")
+	key := hmacSHA256([]byte("AWS4"+secretKey), t.Format("20060102"))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
@@ -0,0 +1,506 @@
+// Package s3 implements a content-addressed blob store on
+// S3-compatible object storage, e.g. MinIO.
+package s3
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"filemanager/blob"
+	fs "filemanager/filesystem"
+	"filemanager/job"
+	"filemanager/util"
+
+	"github.com/rs/zerolog"
+	"github.com/satori/go.uuid"
+)
+
+// the allowed part sizes of multipart uploads, S3 rejects smaller
+// parts but the last one
+const (
+	MinPartSize     = 5 * 1024 * 1024
+	DefaultPartSize = 16 * 1024 * 1024
+	maxParts        = 10000
+)
+
+// Options describes the bucket of a store and how to reach it.
+type Options struct {
+	// Endpoint is the base url of the service, e.g.
+	// http://localhost:9000 for a MinIO server.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// Prefix is prepended to the keys of the blobs, e.g. "store/".
+	Prefix string
+	// PathStyle addresses the bucket in the url path instead of the
+	// host name, as MinIO expects by default.
+	PathStyle bool
+	// PartSize is the size of the parts of multipart uploads, the
+	// blobs up to this size are uploaded in a single request.
+	PartSize int64
+	// Layout is the fan-out of the keys, the one of the file
+	// system stores.
+	Layout fs.Layout
+}
+
+// NewOptions returns the default options for the bucket.
+func NewOptions(endpoint, bucket string) *Options {
+	return &Options{
+		Endpoint: endpoint,
+		Region:   "us-east-1",
+		Bucket:   bucket,
+		PartSize: DefaultPartSize,
+		Layout:   fs.DefaultLayout,
+	}
+}
+
+// Validate checks that the options can address a bucket.
+func (o *Options) Validate() error {
+	u, err := url.Parse(o.Endpoint)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("endpoint %q is not an http(s) url", o.Endpoint)
+	}
+	if o.Bucket == "" || o.Region == "" {
+		return fmt.Errorf("bucket and region must not be empty")
+	}
+	if o.PartSize < MinPartSize {
+		return fmt.Errorf("part size %d is less than %d", o.PartSize, MinPartSize)
+	}
+	return o.Layout.Validate()
+}
+
+// Store is a blob store in a bucket. The blobs are stored whole,
+// keyed by their hash like the blob files of a file system store.
+type Store struct {
+	opts     Options
+	client   *client
+	url      *url.URL
+	maxSaver int
+	jobs     *job.Manager
+	lg       *zerolog.Logger
+}
+
+// New creates the store in the bucket of the options, whose blobs
+// are uploaded by maxSaver workers.
+func New(opts *Options, maxSaver int, lg *zerolog.Logger) (*Store, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if maxSaver < 1 || maxSaver > 20 {
+		return nil, fmt.Errorf("maxSaver %d is out of allowed range [1, 20]", maxSaver)
+	}
+	endpoint, _ := url.Parse(opts.Endpoint)
+	name := "s3://" + opts.Bucket + "/" + opts.Prefix
+	l := lg.With().Str("store", name).Logger()
+	jobs, err := job.NewManager(name, job.DefaultMaxJobs, &l)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{
+		opts: *opts,
+		client: &client{
+			endpoint:  endpoint,
+			bucket:    opts.Bucket,
+			pathStyle: opts.PathStyle,
+			signer:    &signer{accessKey: opts.AccessKey, secretKey: opts.SecretKey, region: opts.Region},
+			http:      http.DefaultClient,
+		},
+		url:      &url.URL{Scheme: "s3", Host: opts.Bucket, Path: "/" + opts.Prefix},
+		maxSaver: maxSaver,
+		jobs:     jobs,
+		lg:       &l,
+	}, nil
+}
+
+// SetClient sets the client the requests are sent with, e.g. the
+// one of a test server.
+func (s *Store) SetClient(c *http.Client) {
+	s.client.http = c
+}
+
+// Jobs returns the job manager the stores run in.
+func (s *Store) Jobs() *job.Manager {
+	return s.jobs
+}
+
+// key returns the key of the blob with the given hash.
+func (s *Store) key(h *util.Hash) string {
+	return s.opts.Prefix + s.opts.Layout.Name(h)
+}
+
+// parseKey returns the hash of the blob with the given key, or nil
+// if the key doesn't follow the layout.
+func (s *Store) parseKey(key string) *util.Hash {
+	h, err := util.ParseHash("sha1:" + path.Base(key))
+	if err != nil || s.key(h) != key {
+		return nil
+	}
+	return h
+}
+
+func (s *Store) objectURL(key string) *url.URL {
+	u := *s.url
+	u.Path = "/" + key
+	return &u
+}
+
+// Has tells if the blob with the given hash is stored.
+func (s *Store) Has(h *util.Hash) (bool, error) {
+	_, err := s.head(s.key(h))
+	if isNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// head returns the size of the object with the given key.
+func (s *Store) head(key string) (int64, error) {
+	resp, err := s.client.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.ContentLength, nil
+}
+
+// Get returns the stored blob with the given hash, its content is
+// downloaded when its ReadCloser is called.
+func (s *Store) Get(h *util.Hash) (*Object, error) {
+	key := s.key(h)
+	size, err := s.head(key)
+	if isNotFound(err) {
+		return nil, fmt.Errorf("blob %s not found", h.String())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("HEAD %s: %v", key, err)
+	}
+	return &Object{store: s, key: key, url: s.objectURL(key), size: size, hash: h}, nil
+}
+
+// listResult is a page of a ListObjectsV2 response.
+type listResult struct {
+	Contents []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List calls fn with the hash and size of every stored blob, in key
+// order. Keys which don't follow the layout are ignored.
+func (s *Store) List(fn func(h *util.Hash, size int64) error) error {
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {s.opts.Prefix + "sha1/"}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		var res listResult
+		if _, err := s.client.call(http.MethodGet, "", q, nil, &res); err != nil {
+			return err
+		}
+		for _, c := range res.Contents {
+			h := s.parseKey(c.Key)
+			if h == nil {
+				continue
+			}
+			if err := fn(h, c.Size); err != nil {
+				return err
+			}
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+// Delete deletes the blob with the given hash.
+func (s *Store) Delete(h *util.Hash) error {
+	key := s.key(h)
+	if ok, err := s.Has(h); err != nil || !ok {
+		if err == nil {
+			err = fmt.Errorf("blob %s not found", h.String())
+		}
+		return err
+	}
+	if _, err := s.client.call(http.MethodDelete, key, nil, nil, nil); err != nil {
+		return err
+	}
+	s.lg.Info().Str("content-hash", h.String()).Msg("blob deleted")
+	return nil
+}
+
+func (s *Store) Store(blobCh chan blob.Blob) blob.StoreStatus {
+	id := uuid.Must(uuid.NewV4()).String()
+	sts := blob.NewStoreStatus(id)
+	l := s.lg.With().Str("process-id", id).Logger()
+	s.jobs.Run(sts, func() {
+		defer sts.Finish()
+		wg := &sync.WaitGroup{}
+		wg.Add(s.maxSaver)
+		for i := 0; i < s.maxSaver; i++ {
+			go s.save(i, blobCh, wg, sts, &l)
+		}
+		wg.Wait()
+	})
+	return sts
+}
+
+func (s *Store) save(id int, inCh chan blob.Blob, wg *sync.WaitGroup, sts *blob.ProcessStatus, lg *zerolog.Logger) {
+	defer wg.Done()
+	worker := fmt.Sprintf("s3-%d", id)
+	defer sts.RemoveWorker(worker)
+	for b := range inCh {
+		if !sts.WaitIfPaused() {
+			// keep draining so that the sender doesn't block
+			continue
+		}
+		h := b.Hash()
+		key := s.key(h)
+		bl := lg.With().Str("source", b.Url().String()).Str("key", key).Logger()
+		sts.SetWorkerState(worker, b.Url().String())
+		size, err := b.Size()
+		if err != nil {
+			sts.AddErrorCount(1)
+			bl.Error().Err(err).Msg("get blob size error")
+			continue
+		}
+		existing, err := s.head(key)
+		if err != nil && !isNotFound(err) {
+			sts.AddErrorCount(1)
+			bl.Error().Err(err).Msg("check target blob error")
+			continue
+		}
+		if err == nil && existing == size {
+			sts.AddSkipCount(1)
+			sts.AddSkipSize(size)
+			bl.Info().Msg("skip existing")
+			continue
+		}
+		t := time.Now()
+		parts, err := s.upload(key, b, size)
+		if err != nil {
+			sts.AddErrorCount(1)
+			uploadCount.With("error").Inc()
+			bl.Error().Err(err).Msg("upload error")
+			continue
+		}
+		d := time.Now().Sub(t)
+		sts.AddCount(1)
+		sts.AddSize(size)
+		uploadCount.With("uploaded").Inc()
+		uploadBytes.Add(float64(size))
+		uploadLatency.ObserveDuration(d)
+		bl.Info().
+			Int64("size", size).
+			Int("parts", parts).
+			Int64("duration", d.Nanoseconds()).
+			Msg("uploaded")
+		select {
+		case sts.Blob() <- &Object{store: s, key: key, url: s.objectURL(key), name: b.Name(), size: size, hash: h}:
+		case <-sts.Canceled():
+		}
+	}
+	sts.SetWorkerState(worker, "")
+}
+
+// upload writes the content of the blob to the key, in parts if it
+// is larger than the part size. The content is checked against the
+// hash and size of the blob before the upload completes, it returns
+// the number of parts, 0 for a single request.
+func (s *Store) upload(key string, b blob.Blob, size int64) (int, error) {
+	rc, err := b.ReadCloser()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	sh := sha1.New()
+	r := io.TeeReader(rc, sh)
+	if size <= s.opts.PartSize {
+		data, err := ioutil.ReadAll(io.LimitReader(r, size+1))
+		if err != nil {
+			return 0, err
+		}
+		if err := checkContent(b.Hash(), size, int64(len(data)), sh); err != nil {
+			return 0, err
+		}
+		_, err = s.client.call(http.MethodPut, key, nil, data, nil)
+		return 0, err
+	}
+	return s.uploadParts(key, b.Hash(), size, r, sh)
+}
+
+// the xml documents of multipart uploads
+type initiateResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []*completePart `xml:"Part"`
+}
+
+// uploadParts uploads the content read from r in parts, the upload
+// is aborted on error so that the bucket doesn't keep its parts.
+func (s *Store) uploadParts(key string, h *util.Hash, size int64, r io.Reader, sh hash.Hash) (int, error) {
+	partSize := s.opts.PartSize
+	if n := (size + partSize - 1) / partSize; n > maxParts {
+		partSize = (size + maxParts - 1) / maxParts
+	}
+	var init initiateResult
+	if _, err := s.client.call(http.MethodPost, key, url.Values{"uploads": {""}}, nil, &init); err != nil {
+		return 0, err
+	}
+	uploadID := init.UploadID
+	complete := &completeUpload{}
+	err := func() error {
+		buf := make([]byte, partSize)
+		read := int64(0)
+		for n := 1; read < size; n++ {
+			m, err := io.ReadFull(r, buf)
+			if err == io.EOF {
+				break
+			}
+			if err != nil && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			read += int64(m)
+			q := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}}
+			header, err := s.client.call(http.MethodPut, key, q, buf[:m], nil)
+			if err != nil {
+				return err
+			}
+			complete.Parts = append(complete.Parts, &completePart{PartNumber: n, ETag: header.Get("ETag")})
+		}
+		// the rest of the content, if any, counts in the check
+		rest, err := io.Copy(ioutil.Discard, io.LimitReader(r, 1))
+		if err != nil {
+			return err
+		}
+		if err := checkContent(h, size, read+rest, sh); err != nil {
+			return err
+		}
+		data, err := xml.Marshal(complete)
+		if err != nil {
+			return err
+		}
+		_, err = s.client.call(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, data, nil)
+		return err
+	}()
+	if err != nil {
+		if _, aerr := s.client.call(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil); aerr != nil {
+			s.lg.Warn().Err(aerr).Str("key", key).Msg("abort upload error")
+		}
+		return 0, err
+	}
+	return len(complete.Parts), nil
+}
+
+// checkContent checks the size and the sha1 of the read content.
+func checkContent(h *util.Hash, size, read int64, sh hash.Hash) error {
+	if read != size {
+		return fmt.Errorf("blob has %d bytes, %d expected", read, size)
+	}
+	if !bytes.Equal(sh.Sum(nil), h.Bytes()) {
+		return fmt.Errorf("content hash mismatch, the blob is corrupt")
+	}
+	return nil
+}
+
+// Object is a blob stored in a bucket.
+type Object struct {
+	store *Store
+	key   string
+	url   *url.URL
+	name  string
+	size  int64
+	hash  *util.Hash
+}
+
+func (o *Object) Hash() *util.Hash {
+	return o.hash
+}
+
+func (o *Object) Type() blob.Type {
+	return blob.TypeObject
+}
+
+// Url returns s3://<bucket>/<key>.
+func (o *Object) Url() *url.URL {
+	return o.url
+}
+
+// Name returns the name of the stored blob, or its hex hash.
+func (o *Object) Name() string {
+	if o.name == "" {
+		return o.hash.Hex()
+	}
+	return o.name
+}
+
+func (o *Object) Size() (int64, error) {
+	return o.size, nil
+}
+
+// Key returns the key of the object in the bucket.
+func (o *Object) Key() string {
+	return o.key
+}
+
+// ReadCloser downloads the content of the object.
+func (o *Object) ReadCloser() (io.ReadCloser, error) {
+	resp, err := o.store.client.do(http.MethodGet, o.key, nil, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: %v", o.key, err)
+	}
+	return resp.Body, nil
+}
+
+// OpenRange downloads a range of the content of the object with a
+// ranged GET.
+func (o *Object) OpenRange(off, n int64) (io.ReadCloser, error) {
+	if off < 0 || off > o.size {
+		return nil, fmt.Errorf("offset %d is out of the %d bytes of %s", off, o.size, o.key)
+	}
+	if off == o.size || n == 0 {
+		// S3 rejects empty ranges
+		return blob.NewBufferedReadCloser(nil), nil
+	}
+	last := o.size - 1
+	if n > 0 && off+n-1 < last {
+		last = off + n - 1
+	}
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", off, last)}}
+	resp, err := o.store.client.do(http.MethodGet, o.key, nil, header, nil)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: %v", o.key, err)
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		// the whole content, the range was ignored
+		return blob.SkipRange(resp.Body, off, last-off+1)
+	}
+	return resp.Body, nil
+}
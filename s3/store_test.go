@@ -0,0 +1,240 @@
+package s3_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"filemanager/blob"
+	fs "filemanager/filesystem"
+	"filemanager/memory"
+	"filemanager/s3"
+	"filemanager/s3/s3test"
+	"filemanager/util"
+
+	"github.com/rs/zerolog"
+)
+
+const bucket = "blobs"
+
+func newStore(t *testing.T, srv *s3test.Server, opts *s3.Options) *s3.Store {
+	lg := zerolog.New(ioutil.Discard)
+	if opts == nil {
+		opts = srv.Options(bucket)
+	}
+	st, err := s3.New(opts, 2, &lg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+// store stores the blobs and returns the status once done.
+func store(st *s3.Store, blobs ...blob.Blob) blob.StoreStatus {
+	ch := make(chan blob.Blob, len(blobs))
+	for _, b := range blobs {
+		ch <- b
+	}
+	close(ch)
+	sts := st.Store(ch)
+	for range sts.Blob() {
+	}
+	<-sts.Done()
+	return sts
+}
+
+func content(n int, seed byte) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i*7) + seed
+	}
+	return data
+}
+
+func hashOf(data []byte) *util.Hash {
+	sum := sha1.Sum(data)
+	return util.NewSha1Hash(sum[:])
+}
+
+// badBlob is a blob whose hash isn't the one of its content.
+type badBlob struct {
+	*memory.Blob
+}
+
+func (b badBlob) Hash() *util.Hash {
+	return hashOf([]byte("something else"))
+}
+
+func TestStoreGetHasDelete(t *testing.T) {
+	srv := s3test.NewServer(bucket)
+	defer srv.Close()
+	st := newStore(t, srv, nil)
+
+	a := memory.NewBlob("a.txt", []byte("hello"))
+	b := memory.NewBlob("b.bin", content(1000, 1))
+	sts := store(st, a, b)
+	if sts.Count() != 2 || sts.Size() != 1005 || sts.ErrorCount() != 0 {
+		t.Fatalf("stored %d blobs of %d bytes, %d errors", sts.Count(), sts.Size(), sts.ErrorCount())
+	}
+	key := fs.DefaultLayout.Name(a.Hash())
+	if data, ok := srv.Object(bucket, key); !ok || string(data) != "hello" {
+		t.Fatalf("object %s: %q, %v, keys %v", key, data, ok, srv.Keys(bucket))
+	}
+
+	// stored again, both are skipped
+	sts = store(st, a, b)
+	if sts.Count() != 0 || sts.SkipCount() != 2 || sts.SkipSize() != 1005 {
+		t.Fatalf("stored %d, skipped %d blobs of %d bytes", sts.Count(), sts.SkipCount(), sts.SkipSize())
+	}
+
+	ok, err := st.Has(b.Hash())
+	if err != nil || !ok {
+		t.Fatalf("has: %v, %v", ok, err)
+	}
+	o, err := st.Get(b.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := o.Size(); size != 1000 {
+		t.Fatalf("size %d", size)
+	}
+	rc, err := o.ReadCloser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || !bytes.Equal(data, b.Bytes()) {
+		t.Fatalf("content differs: %v", err)
+	}
+	rc, err = o.OpenRange(990, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || !bytes.Equal(data, b.Bytes()[990:]) {
+		t.Fatalf("range differs: %v", err)
+	}
+
+	if err := st.Delete(a.Hash()); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := st.Has(a.Hash()); err != nil || ok {
+		t.Fatalf("has after delete: %v, %v", ok, err)
+	}
+	if _, err := st.Get(a.Hash()); err == nil {
+		t.Fatal("get of a deleted blob succeeded")
+	}
+	if err := st.Delete(a.Hash()); err == nil {
+		t.Fatal("delete of a missing blob succeeded")
+	}
+}
+
+func TestMultipartUpload(t *testing.T) {
+	srv := s3test.NewServer(bucket)
+	defer srv.Close()
+	opts := srv.Options(bucket)
+	opts.PartSize = s3.MinPartSize
+	st := newStore(t, srv, opts)
+	b := memory.NewBlob("large", content(2*s3.MinPartSize+1234, 3))
+	sts := store(st, b)
+	if sts.Count() != 1 || sts.ErrorCount() != 0 {
+		t.Fatalf("stored %d, %d errors", sts.Count(), sts.ErrorCount())
+	}
+	o, err := st.Get(b.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := srv.Parts(bucket, o.Key()); n != 3 {
+		t.Fatalf("uploaded in %d parts, 3 expected", n)
+	}
+	data, _ := srv.Object(bucket, o.Key())
+	if !bytes.Equal(data, b.Bytes()) {
+		t.Fatal("content differs")
+	}
+	if n := srv.Uploads(); n != 0 {
+		t.Fatalf("%d uploads left", n)
+	}
+}
+
+func TestHashMismatchAborts(t *testing.T) {
+	srv := s3test.NewServer(bucket)
+	defer srv.Close()
+	opts := srv.Options(bucket)
+	opts.PartSize = s3.MinPartSize
+	st := newStore(t, srv, opts)
+
+	small := badBlob{memory.NewBlob("small", []byte("content"))}
+	large := badBlob{memory.NewBlob("large", content(s3.MinPartSize+10, 5))}
+	sts := store(st, small, large)
+	if sts.Count() != 0 || sts.ErrorCount() != 2 {
+		t.Fatalf("stored %d, %d errors", sts.Count(), sts.ErrorCount())
+	}
+	if keys := srv.Keys(bucket); len(keys) != 0 {
+		t.Fatalf("keys %v stored", keys)
+	}
+	if n := srv.Uploads(); n != 0 {
+		t.Fatalf("%d uploads not aborted", n)
+	}
+}
+
+func TestListPages(t *testing.T) {
+	srv := s3test.NewServer(bucket)
+	defer srv.Close()
+	srv.PageSize = 2
+	st := newStore(t, srv, nil)
+
+	blobs := make([]blob.Blob, 0, 5)
+	want := make(map[string]int64)
+	for i := 0; i < 5; i++ {
+		b := memory.NewBlob(fmt.Sprintf("f%d", i), content(10+i, byte(i)))
+		blobs = append(blobs, b)
+		want[b.Hash().String()] = int64(10 + i)
+	}
+	if sts := store(st, blobs...); sts.Count() != 5 {
+		t.Fatalf("stored %d", sts.Count())
+	}
+	// keys out of the layout are ignored
+	srv.PutObject(bucket, "sha1/readme.txt", []byte("x"))
+
+	got := make(map[string]int64)
+	prev := ""
+	err := st.List(func(h *util.Hash, size int64) error {
+		if h.String() <= prev {
+			return fmt.Errorf("%s listed after %s", h.String(), prev)
+		}
+		prev = h.String()
+		got[h.String()] = size
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("listed %d blobs over pages of 2, %d expected", len(got), len(want))
+	}
+	for h, size := range want {
+		if got[h] != size {
+			t.Fatalf("blob %s listed with size %d, %d expected", h, got[h], size)
+		}
+	}
+}
+
+func TestSignature(t *testing.T) {
+	srv := s3test.NewServer(bucket)
+	defer srv.Close()
+	opts := srv.Options(bucket)
+	opts.SecretKey = "wrong"
+	st := newStore(t, srv, opts)
+
+	if _, err := st.Has(hashOf([]byte("x"))); err == nil {
+		t.Fatal("request with a bad signature succeeded")
+	}
+	sts := store(st, memory.NewBlob("a", []byte("a")))
+	if sts.Count() != 0 || sts.ErrorCount() != 1 {
+		t.Fatalf("stored %d, %d errors", sts.Count(), sts.ErrorCount())
+	}
+}
@@ -1,8 +1,10 @@
 package util
 
 import (
+	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
+	"strings"
 )
 
 // Hash represents the hash of some algorithm
@@ -60,3 +62,21 @@ func NewSha1HashFromHex(s string) (*Hash, error) {
 		str:  fmt.Sprintf("%s:%s", "sha1", s),
 	}, nil
 }
+
+// ParseHash parses a hash string in format [algorithm]:[hex],
+// a bare hex string is taken as a "sha1" hash.
+func ParseHash(s string) (*Hash, error) {
+	alg := "sha1"
+	hexStr := s
+	if idx := strings.Index(s, ":"); idx != -1 {
+		alg = s[0:idx]
+		hexStr = s[idx+1:]
+	}
+	if alg != "sha1" {
+		return nil, fmt.Errorf("unsupported hash algorithm %q", alg)
+	}
+	if len(hexStr) != sha1.Size*2 {
+		return nil, fmt.Errorf("invalid sha1 hash %q", hexStr)
+	}
+	return NewSha1HashFromHex(strings.ToLower(hexStr))
+}
@@ -0,0 +1,18 @@
+package web
+
+import (
+	"filemanager/metrics"
+)
+
+var (
+	requestCount = metrics.Default.NewCounterVec(
+		"filemanager_http_requests_total",
+		"Number of http requests, by result (loaded, not-modified, retried, error).", "result")
+	requestLatency = metrics.Default.NewHistogramVec(
+		"filemanager_http_request_seconds",
+		"Time spent downloading and hashing a single url.",
+		metrics.DefBuckets).With()
+	downloadBytes = metrics.Default.NewCounterVec(
+		"filemanager_http_download_bytes_total",
+		"Total size of downloaded bodies, in bytes.").With()
+)
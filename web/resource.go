@@ -0,0 +1,108 @@
+// Package web implements a blob source downloading a list of
+// http(s) urls.
+package web
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"filemanager/blob"
+	"filemanager/util"
+)
+
+// Resource is the body of a url downloaded into memory.
+type Resource struct {
+	url          *url.URL
+	name         string
+	blob         []byte
+	size         int64
+	hash         *util.Hash
+	contentType  string
+	etag         string
+	lastModified string
+}
+
+func (r *Resource) Hash() *util.Hash {
+	return r.hash
+}
+
+func (r *Resource) Type() blob.Type {
+	return blob.TypeHTTP
+}
+
+func (r *Resource) Url() *url.URL {
+	return r.url
+}
+
+// Name returns the file name from the Content-Disposition of the
+// response, or the last part of the url path.
+func (r *Resource) Name() string {
+	return r.name
+}
+
+func (r *Resource) Size() (int64, error) {
+	return r.size, nil
+}
+
+// ContentType returns the Content-Type of the response.
+func (r *Resource) ContentType() string {
+	return r.contentType
+}
+
+// ETag returns the ETag of the response, or "".
+func (r *Resource) ETag() string {
+	return r.etag
+}
+
+// ModTime returns the Last-Modified time of the response, or the
+// zero time.
+func (r *Resource) ModTime() time.Time {
+	t, err := http.ParseTime(r.lastModified)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// Free clears the downloaded content.
+func (r *Resource) Free() {
+	r.blob = nil
+}
+
+func (r *Resource) ReadCloser() (io.ReadCloser, error) {
+	if r.blob == nil {
+		return nil, fmt.Errorf("underlying blob ([]byte) is nil")
+	}
+	return blob.NewBufferedReadCloser(r.blob), nil
+}
+
+func (r *Resource) OpenRange(off, n int64) (io.ReadCloser, error) {
+	if r.blob == nil {
+		return nil, fmt.Errorf("underlying blob ([]byte) is nil")
+	}
+	return blob.OpenBytesRange(r.blob, off, n)
+}
+
+// resourceName returns the file name given by the Content-Disposition
+// header, or the last part of the url path, or the host for the
+// root path.
+func resourceName(u *url.URL, disposition string) string {
+	if _, params, err := mime.ParseMediaType(disposition); err == nil {
+		// the name is untrusted, only its base is kept
+		name := path.Base(strings.Replace(params["filename"], "\\", "/", -1))
+		if name != "." && name != "/" && name != ".." {
+			return name
+		}
+	}
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		return u.Hostname()
+	}
+	return name
+}
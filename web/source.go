@@ -0,0 +1,406 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"filemanager/blob"
+	"filemanager/job"
+	"filemanager/util"
+
+	"github.com/rs/zerolog"
+	"github.com/satori/go.uuid"
+)
+
+// default retry settings
+const (
+	DefaultRetries = 3
+	DefaultBackoff = 500 * time.Millisecond
+	// maxBackoff caps the wait between attempts, Retry-After included
+	maxBackoff = time.Minute
+	// DefaultMaxSize is the default max size of a downloaded body,
+	// which is held in memory
+	DefaultMaxSize = 1 << 30
+)
+
+// URLSource downloads a list of http(s) urls, maxLoader of them in
+// parallel. Failed requests, 429 and 5xx responses are retried with
+// an exponential backoff, other responses than 200 are errors. With
+// a state file, the ETag and Last-Modified of the responses whose
+// blobs a store confirmed, see Stored, are recorded and sent back in
+// the requests of the next loads, the urls which were not modified
+// since are counted as skipped. The
+// bodies are held in memory, the ones larger than the max size are
+// errors.
+type URLSource struct {
+	urls             []*url.URL
+	maxLoader        int
+	maxSize          int64
+	client           *http.Client
+	retries          int
+	backoff          time.Duration
+	statePath        string
+	stateMu          sync.Mutex
+	st               *state
+	progressInterval time.Duration
+	jobs             *job.Manager
+	lg               *zerolog.Logger
+}
+
+// NewURLSource creates the source of the given http(s) urls.
+func NewURLSource(urls []string, maxLoader int, lg *zerolog.Logger) (*URLSource, error) {
+	if maxLoader < 1 || maxLoader > 20 {
+		return nil, fmt.Errorf("maxLoader %d is out of allowed range [1, 20]", maxLoader)
+	}
+	us := make([]*url.URL, 0, len(urls))
+	for _, s := range urls {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("%q is not an http(s) url", s)
+		}
+		us = append(us, u)
+	}
+	l := lg.With().Str("source", "urls").Logger()
+	jobs, err := job.NewManager("urls", job.DefaultMaxJobs, &l)
+	if err != nil {
+		return nil, err
+	}
+	return &URLSource{
+		urls:             us,
+		maxLoader:        maxLoader,
+		maxSize:          DefaultMaxSize,
+		client:           http.DefaultClient,
+		retries:          DefaultRetries,
+		backoff:          DefaultBackoff,
+		progressInterval: blob.DefaultProgressInterval,
+		jobs:             jobs,
+		lg:               &l,
+	}, nil
+}
+
+// ReadURLList reads the urls of a list file, one per line. Blank
+// lines and lines starting with # are ignored.
+func ReadURLList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	urls := make([]string, 0)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	return urls, sc.Err()
+}
+
+// SetClient sets the client the requests are sent with, e.g. the
+// one of an httptest.Server.
+func (s *URLSource) SetClient(c *http.Client) {
+	s.client = c
+}
+
+// SetRetry sets the number of retries of a failed request and the
+// wait before the first one, which doubles at each retry.
+func (s *URLSource) SetRetry(retries int, backoff time.Duration) error {
+	if retries < 0 || backoff < 0 {
+		return fmt.Errorf("retries and backoff must not be negative")
+	}
+	s.retries = retries
+	s.backoff = backoff
+	return nil
+}
+
+// SetMaxSize sets the max size of a downloaded body, in bytes,
+// DefaultMaxSize by default.
+func (s *URLSource) SetMaxSize(n int64) error {
+	if n <= 0 {
+		return fmt.Errorf("max size must be positive")
+	}
+	s.maxSize = n
+	return nil
+}
+
+// SetStateFile sets the file the validators of the responses are
+// recorded in for the next loads, "" disables conditional requests.
+func (s *URLSource) SetStateFile(path string) {
+	s.statePath = path
+}
+
+// SetProgressInterval sets the interval at which Load emits
+// progress snapshots, a non-positive interval disables them.
+func (s *URLSource) SetProgressInterval(d time.Duration) {
+	s.progressInterval = d
+}
+
+// Jobs returns the job manager the loads of this source run in.
+func (s *URLSource) Jobs() *job.Manager {
+	return s.jobs
+}
+
+func (s *URLSource) Load() blob.LoadStatus {
+	id := uuid.Must(uuid.NewV4()).String()
+	sts := blob.NewLoadStatus(id)
+	l := s.lg.With().Str("load-id", id).Logger()
+	if s.progressInterval > 0 {
+		sts.ReportProgress(s.progressInterval)
+	}
+	s.jobs.Run(sts, func() {
+		defer sts.Finish()
+		st, err := s.state()
+		if err != nil {
+			sts.AddErrorCount(len(s.urls))
+			l.Error().Err(err).Msg("read state error")
+			return
+		}
+		s.load(st, sts, &l)
+	})
+	return sts
+}
+
+// state returns the state of the loads, read from the state file
+// by the first one.
+func (s *URLSource) state() (*state, error) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	if s.st == nil {
+		st, err := readState(s.statePath)
+		if err != nil {
+			return nil, err
+		}
+		s.st = st
+	}
+	return s.st, nil
+}
+
+// Stored relays the blobs a store sends once stored, e.g. from the
+// Blob channel of its status, recording on the way the validators
+// of the urls whose downloads they are. The state file is saved
+// once in is closed. A url whose blob the store didn't confirm, as
+// it failed, was canceled or skipped, is downloaded again by the
+// next load.
+func (s *URLSource) Stored(in chan blob.Blob) chan blob.Blob {
+	out := make(chan blob.Blob)
+	go func() {
+		defer close(out)
+		for b := range in {
+			if st, _ := s.state(); st != nil && b.Hash() != nil {
+				st.confirm(b.Hash().String())
+			}
+			out <- b
+		}
+		st, err := s.state()
+		if err == nil {
+			err = st.save()
+		}
+		if err != nil {
+			s.lg.Error().Err(err).Msg("save state error")
+		}
+	}()
+	return out
+}
+
+func (s *URLSource) load(st *state, sts *blob.ProcessStatus, lg *zerolog.Logger) {
+	sts.AddEstimate(len(s.urls), 0)
+	sts.FinishEstimate()
+
+	// the requests in flight are aborted on cancel
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-sts.Canceled():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ch := make(chan *url.URL)
+	wg := &sync.WaitGroup{}
+	wg.Add(s.maxLoader)
+	for i := 0; i < s.maxLoader; i++ {
+		go s.loadURLs(ctx, i, ch, st, wg, sts, lg)
+	}
+	for _, u := range s.urls {
+		select {
+		case ch <- u:
+		case <-sts.Canceled():
+		}
+	}
+	close(ch)
+	wg.Wait()
+}
+
+func (s *URLSource) loadURLs(ctx context.Context, id int, ch chan *url.URL, st *state, wg *sync.WaitGroup, sts *blob.ProcessStatus, lg *zerolog.Logger) {
+	defer wg.Done()
+	worker := fmt.Sprintf("http-%d", id)
+	defer sts.RemoveWorker(worker)
+	for u := range ch {
+		if !sts.WaitIfPaused() {
+			continue
+		}
+		sts.SetWorkerState(worker, u.String())
+		ul := lg.With().Str("url", u.String()).Logger()
+		t := time.Now()
+		prev := st.get(u.String())
+		r, err := s.fetch(ctx, u, prev, &ul)
+		if err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			sts.AddErrorCount(1)
+			requestCount.With("error").Inc()
+			ul.Error().Err(err).Msg("download error")
+			continue
+		}
+		if r == nil {
+			sts.AddSkipCount(1)
+			sts.AddSkipSize(prev.Size)
+			requestCount.With("not-modified").Inc()
+			ul.Info().Msg("not modified")
+			continue
+		}
+		d := time.Now().Sub(t)
+		sts.AddCount(1)
+		sts.AddSize(r.size)
+		requestCount.With("loaded").Inc()
+		requestLatency.ObserveDuration(d)
+		downloadBytes.Add(float64(r.size))
+		ul.Info().
+			Str("content-hash", r.hash.String()).
+			Int64("size", r.size).
+			Int64("duration", d.Nanoseconds()).
+			Msg("loaded")
+		// recorded once the store confirms the blob, which a
+		// canceled load doesn't send
+		st.hold(u.String(), &validator{ETag: r.etag, LastModified: r.lastModified, Hash: r.hash.String(), Size: r.size})
+		select {
+		case sts.Blob() <- r:
+		case <-sts.Canceled():
+		}
+	}
+	sts.SetWorkerState(worker, "")
+}
+
+// fetch downloads the url, retrying the failures which may be
+// transient. It returns a nil resource if the url was not modified
+// since the previous load.
+func (s *URLSource) fetch(ctx context.Context, u *url.URL, prev *validator, lg *zerolog.Logger) (*Resource, error) {
+	wait := s.backoff
+	for attempt := 0; ; attempt++ {
+		r, retryAfter, err := s.get(ctx, u, prev)
+		if err == nil || retryAfter < 0 || attempt >= s.retries {
+			return r, err
+		}
+		if retryAfter < wait {
+			retryAfter = wait
+		}
+		if retryAfter > maxBackoff {
+			retryAfter = maxBackoff
+		}
+		requestCount.With("retried").Inc()
+		lg.Warn().Err(err).Int("attempt", attempt+1).Dur("wait", retryAfter).Msg("retry")
+		select {
+		case <-time.After(retryAfter):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		wait *= 2
+	}
+}
+
+// get sends a single request. On error, it returns the wait the
+// server asked for before a retry, 0 if none, or -1 if the error
+// isn't worth a retry.
+func (s *URLSource) get(ctx context.Context, u *url.URL, prev *validator) (*Resource, time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, -1, err
+	}
+	if prev != nil {
+		if prev.ETag != "" {
+			req.Header.Set("If-None-Match", prev.ETag)
+		}
+		if prev.LastModified != "" {
+			req.Header.Set("If-Modified-Since", prev.LastModified)
+		}
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified && prev != nil:
+		return nil, 0, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return nil, retryAfter(resp.Header.Get("Retry-After")), fmt.Errorf("GET %s: %s", u, resp.Status)
+	case resp.StatusCode != http.StatusOK:
+		return nil, -1, fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+
+	if resp.ContentLength > s.maxSize {
+		return nil, -1, fmt.Errorf("GET %s: %d bytes exceed the max size of %d bytes", u, resp.ContentLength, s.maxSize)
+	}
+
+	// the body is hashed as it is read
+	var buf bytes.Buffer
+	if resp.ContentLength > 0 {
+		buf.Grow(int(resp.ContentLength))
+	}
+	sh := sha1.New()
+	n, err := io.Copy(io.MultiWriter(&buf, sh), io.LimitReader(resp.Body, s.maxSize+1))
+	if err != nil {
+		return nil, 0, err
+	}
+	if n > s.maxSize {
+		return nil, -1, fmt.Errorf("GET %s: the body exceeds the max size of %d bytes", u, s.maxSize)
+	}
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		return nil, 0, fmt.Errorf("GET %s: got %d bytes of %d", u, n, resp.ContentLength)
+	}
+	return &Resource{
+		url:          u,
+		name:         resourceName(u, resp.Header.Get("Content-Disposition")),
+		blob:         buf.Bytes(),
+		size:         n,
+		hash:         util.NewSha1Hash(sh.Sum(nil)),
+		contentType:  resp.Header.Get("Content-Type"),
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}, 0, nil
+}
+
+// retryAfter parses a Retry-After header, in seconds or as a date.
+func retryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,294 @@
+package web
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"filemanager/blob"
+
+	"github.com/rs/zerolog"
+)
+
+func newSource(t *testing.T, urls ...string) *URLSource {
+	lg := zerolog.New(ioutil.Discard)
+	s, err := NewURLSource(urls, 2, &lg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetRetry(3, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	s.SetProgressInterval(0)
+	return s
+}
+
+// load runs a load and returns its status and resources by url.
+func load(s *URLSource) (blob.LoadStatus, map[string]*Resource) {
+	sts := s.Load()
+	res := make(map[string]*Resource)
+	for b := range sts.Blob() {
+		res[b.Url().String()] = b.(*Resource)
+	}
+	<-sts.Done()
+	return sts, res
+}
+
+// loadStored runs a load whose blobs with the given urls are
+// confirmed stored, as a store would, and returns its status.
+func loadStored(s *URLSource, stored ...string) blob.LoadStatus {
+	sts := s.Load()
+	ch := make(chan blob.Blob)
+	out := s.Stored(ch)
+	go func() {
+		for b := range sts.Blob() {
+			for _, u := range stored {
+				if b.Url().String() == u {
+					ch <- b
+				}
+			}
+		}
+		close(ch)
+	}()
+	for range out {
+	}
+	<-sts.Done()
+	return sts
+}
+
+func TestRetry(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&calls, 1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.Write([]byte("content"))
+		}
+	}))
+	defer srv.Close()
+	s := newSource(t, srv.URL+"/f")
+	s.SetClient(srv.Client())
+
+	t0 := time.Now()
+	sts, res := load(s)
+	if sts.Count() != 1 || sts.ErrorCount() != 0 || calls != 3 {
+		t.Fatalf("loaded %d with %d errors in %d requests", sts.Count(), sts.ErrorCount(), calls)
+	}
+	if d := time.Since(t0); d < time.Second {
+		t.Fatalf("retried after %v, before the Retry-After of 1s", d)
+	}
+	r := res[srv.URL+"/f"]
+	sum := sha1.Sum([]byte("content"))
+	if r == nil || r.Hash().Hex() != hex.EncodeToString(sum[:]) {
+		t.Fatalf("resource %v", r)
+	}
+}
+
+func TestRetryLimit(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	s := newSource(t, srv.URL+"/broken")
+	s.SetClient(srv.Client())
+	if sts, _ := load(s); sts.ErrorCount() != 1 || calls != 4 {
+		t.Fatalf("%d errors in %d requests, 1 in 4 expected", sts.ErrorCount(), calls)
+	}
+
+	// other errors than 429 and 5xx are not retried
+	calls = 0
+	s = newSource(t, srv.URL+"/missing")
+	s.SetClient(srv.Client())
+	if sts, _ := load(s); sts.ErrorCount() != 1 || calls != 1 {
+		t.Fatalf("%d errors in %d requests, 1 in 1 expected", sts.ErrorCount(), calls)
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	var calls, notModified int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("version 1"))
+	}))
+	defer srv.Close()
+	statePath := filepath.Join(t.TempDir(), "urls.state")
+
+	s := newSource(t, srv.URL+"/a", srv.URL+"/b")
+	s.SetClient(srv.Client())
+	s.SetStateFile(statePath)
+	if sts := loadStored(s, srv.URL+"/a", srv.URL+"/b"); sts.Count() != 2 || notModified != 0 {
+		t.Fatalf("first load: %d loaded, %d not modified", sts.Count(), notModified)
+	}
+
+	// a new source reads the validators back from the state file
+	s = newSource(t, srv.URL+"/a", srv.URL+"/b")
+	s.SetClient(srv.Client())
+	s.SetStateFile(statePath)
+	sts, _ := load(s)
+	ss := sts.(*blob.ProcessStatus)
+	if sts.Count() != 0 || ss.SkipCount() != 2 || ss.SkipSize() != 2*int64(len("version 1")) || notModified != 2 {
+		t.Fatalf("second load: %d loaded, %d skipped of %d bytes, %d not modified", sts.Count(), ss.SkipCount(), ss.SkipSize(), notModified)
+	}
+
+	// without state the urls are loaded again
+	s = newSource(t, srv.URL+"/a")
+	s.SetClient(srv.Client())
+	if sts, _ := load(s); sts.Count() != 1 {
+		t.Fatalf("stateless load: %d loaded", sts.Count())
+	}
+}
+
+func TestStateConfirmed(t *testing.T) {
+	var notModified, hold int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&hold) == 1 {
+			// until the load is canceled
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("ETag", `"`+r.URL.Path+`"`)
+		if r.Header.Get("If-None-Match") == `"`+r.URL.Path+`"` {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+	statePath := filepath.Join(t.TempDir(), "urls.state")
+	open := func() *URLSource {
+		s := newSource(t, srv.URL+"/a", srv.URL+"/b")
+		s.SetClient(srv.Client())
+		s.SetStateFile(statePath)
+		return s
+	}
+
+	// the blobs which aren't confirmed stored are loaded again
+	if sts, _ := load(open()); sts.Count() != 2 {
+		t.Fatalf("unconfirmed load: %d loaded", sts.Count())
+	}
+	if sts := loadStored(open(), srv.URL+"/a"); sts.Count() != 2 || notModified != 0 {
+		t.Fatalf("first load: %d loaded, %d not modified", sts.Count(), notModified)
+	}
+	if sts := loadStored(open()); sts.Count() != 1 || notModified != 1 {
+		t.Fatalf("second load: %d loaded, %d not modified", sts.Count(), notModified)
+	}
+
+	// the blobs of a canceled load aren't sent, nor recorded
+	atomic.StoreInt32(&hold, 1)
+	s := open()
+	sts := s.Load()
+	sts.Cancel()
+	for range s.Stored(sts.Blob()) {
+	}
+	<-sts.Done()
+	atomic.StoreInt32(&hold, 0)
+	if sts := loadStored(open()); sts.Count() != 1 || notModified != 2 {
+		t.Fatalf("load after cancel: %d loaded, %d not modified", sts.Count(), notModified)
+	}
+}
+
+func TestResourceName(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/download" {
+			w.Header().Set("Content-Disposition", `attachment; filename="../../report.pdf"`)
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer srv.Close()
+	u := srv.URL
+	s := newSource(t, u+"/download", u+"/dir/plain.txt", u+"/")
+	s.SetClient(srv.Client())
+	sts, res := load(s)
+	if sts.Count() != 3 {
+		t.Fatalf("loaded %d", sts.Count())
+	}
+	host := strings.Split(strings.TrimPrefix(u, "http://"), ":")[0]
+	for url, name := range map[string]string{
+		u + "/download":      "report.pdf",
+		u + "/dir/plain.txt": "plain.txt",
+		u + "/":              host,
+	} {
+		if r := res[url]; r == nil || r.Name() != name {
+			t.Fatalf("%s named %v, %q expected", url, r, name)
+		}
+	}
+}
+
+func TestShortBody(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte("only 16 bytes..."))
+	}))
+	defer srv.Close()
+	s := newSource(t, srv.URL+"/short")
+	s.SetClient(srv.Client())
+	s.SetRetry(1, time.Millisecond)
+	sts, res := load(s)
+	if sts.Count() != 0 || sts.ErrorCount() != 1 || len(res) != 0 {
+		t.Fatalf("loaded %d with %d errors", sts.Count(), sts.ErrorCount())
+	}
+	// a truncated body may be transient
+	if calls != 2 {
+		t.Fatalf("%d requests, 2 expected", calls)
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.URL.Path == "/chunked" {
+			// no Content-Length, the size is only known once read
+			for i := 0; i < 10; i++ {
+				w.Write([]byte("0123456789"))
+				w.(http.Flusher).Flush()
+			}
+			return
+		}
+		w.Write([]byte(strings.Repeat("x", 100)))
+	}))
+	defer srv.Close()
+	s := newSource(t, srv.URL+"/large", srv.URL+"/chunked")
+	s.SetClient(srv.Client())
+	if err := s.SetMaxSize(50); err != nil {
+		t.Fatal(err)
+	}
+	sts, _ := load(s)
+	if sts.Count() != 0 || sts.ErrorCount() != 2 {
+		t.Fatalf("loaded %d with %d errors", sts.Count(), sts.ErrorCount())
+	}
+	// too large bodies are not retried
+	if calls != 2 {
+		t.Fatalf("%d requests, 2 expected", calls)
+	}
+	if err := s.SetMaxSize(0); err == nil {
+		t.Fatal("max size 0 accepted")
+	}
+}
@@ -0,0 +1,114 @@
+package web
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// validator is what a previous run recorded about a url, sent back
+// in conditional requests.
+type validator struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last-modified,omitempty"`
+	Hash         string `json:"hash"`
+	Size         int64  `json:"size"`
+}
+
+// pendingValidator is the validator of a url whose blob has been
+// sent but not yet confirmed stored.
+type pendingValidator struct {
+	url string
+	v   *validator
+}
+
+// state maps the urls to their validators, persisted as json. The
+// pending validators are keyed by the content hash of their blob.
+type state struct {
+	sync.Mutex
+	path    string
+	urls    map[string]*validator
+	pending map[string][]pendingValidator
+	dirty   bool
+}
+
+// readState reads the state file at path, a missing file is an
+// empty state. An empty path keeps no state.
+func readState(path string) (*state, error) {
+	s := &state{path: path, urls: make(map[string]*validator), pending: make(map[string][]pendingValidator)}
+	if path == "" {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.urls); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *state) get(u string) *validator {
+	s.Lock()
+	defer s.Unlock()
+	return s.urls[u]
+}
+
+// hold keeps the validator of the url until its blob is confirmed
+// stored.
+func (s *state) hold(u string, v *validator) {
+	if s.path == "" || (v.ETag == "" && v.LastModified == "") {
+		return
+	}
+	s.Lock()
+	s.pending[v.Hash] = append(s.pending[v.Hash], pendingValidator{u, v})
+	s.Unlock()
+}
+
+// confirm records the pending validators of the urls whose blob
+// has the given content hash.
+func (s *state) confirm(hash string) {
+	s.Lock()
+	defer s.Unlock()
+	for _, p := range s.pending[hash] {
+		s.urls[p.url] = p.v
+		s.dirty = true
+	}
+	delete(s.pending, hash)
+}
+
+// save writes the state to a temp file renamed to its path.
+func (s *state) save() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.path == "" || !s.dirty {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.urls, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	s.dirty = false
+	return nil
+}